@@ -0,0 +1,510 @@
+package main
+
+import (
+	"crypto/x509"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed api/openapi.json
+var openapiSpec []byte
+
+const apiV1Prefix = "api/v1/"
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type apiErrorResponse struct {
+	Error apiError `json:"error"`
+}
+
+type apiUsersResponse struct {
+	Users []OpenvpnClient `json:"users"`
+}
+
+type apiCreateUserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// ExpiresAt or ValidDays set the certificate lifetime instead of --client-cert.expiration-days
+	ExpiresAt string `json:"expires_at,omitempty"`
+	ValidDays int    `json:"valid_days,omitempty"`
+	// CSR is a PEM encoded PKCS#10 request to issue the certificate for, the username defaults to its common name
+	CSR string `json:"csr,omitempty"`
+}
+
+type apiRotateUserRequest struct {
+	Password  string `json:"password"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	ValidDays int    `json:"valid_days,omitempty"`
+}
+
+type apiPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+type apiGroupsResponse struct {
+	Groups []userGroup `json:"groups"`
+}
+
+type apiDisconnectRequest struct {
+	Server string `json:"server"`
+}
+
+type apiDisconnectResponse struct {
+	Disconnected bool             `json:"disconnected"`
+	Results      []mgmtKillResult `json:"results"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if v == nil {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("writeJSON: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, apiErrorResponse{Error: apiError{Code: code, Message: strings.TrimSpace(message)}})
+}
+
+func decodeJSONBody(r *http.Request, v interface{}) error {
+	if r.Body == nil {
+		return fmt.Errorf("request body is empty")
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid JSON body: %w", err)
+	}
+	return nil
+}
+
+// getUser returns the current state of a single user from the index
+func (oAdmin *OvpnAdmin) getUser(username string) (OpenvpnClient, bool) {
+	for _, u := range oAdmin.usersList() {
+		if u.Identity == username {
+			return u, true
+		}
+	}
+	return OpenvpnClient{}, false
+}
+
+// apiV1Handler routes every request below /api/v1/
+func (oAdmin *OvpnAdmin) apiV1Handler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, *listenBaseUrl), "/")
+	path = strings.Trim(strings.TrimPrefix(path, apiV1Prefix), "/")
+	parts := strings.Split(path, "/")
+
+	switch parts[0] {
+	case "openapi.json":
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(openapiSpec)
+		return
+	case "users":
+		oAdmin.apiUsersHandler(w, r, parts[1:])
+		return
+	case "audit":
+		oAdmin.apiAuditHandler(w, r, parts[1:])
+		return
+	case "sessions":
+		oAdmin.apiSessionsHandler(w, r, parts[1:])
+		return
+	case "ca":
+		oAdmin.apiCAHandler(w, r, parts[1:])
+		return
+	case "renewal":
+		oAdmin.apiRenewalHandler(w, r, parts[1:])
+		return
+	case "groups":
+		oAdmin.apiGroupsHandler(w, r, parts[1:])
+		return
+	}
+
+	writeAPIError(w, http.StatusNotFound, "not_found", fmt.Sprintf("Unknown API endpoint %q", r.URL.Path))
+}
+
+func (oAdmin *OvpnAdmin) apiUsersHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 || parts[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			oAdmin.apiListUsers(w, r)
+		case http.MethodPost:
+			oAdmin.apiCreateUser(w, r)
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		}
+		return
+	}
+
+	username := parts[0]
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			oAdmin.apiGetUser(w, username)
+		case http.MethodDelete:
+			oAdmin.apiDeleteUser(w, r, username)
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		}
+		return
+	}
+
+	if len(parts) == 3 && parts[1] == "renewal" && parts[2] == "confirm" {
+		if r.Method != http.MethodPost {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+			return
+		}
+		oAdmin.apiConfirmRenewal(w, r, username)
+		return
+	}
+
+	if len(parts) > 2 {
+		writeAPIError(w, http.StatusNotFound, "not_found", fmt.Sprintf("Unknown API endpoint %q", r.URL.Path))
+		return
+	}
+
+	action := parts[1]
+	switch action {
+	case "ccd":
+		switch r.Method {
+		case http.MethodGet:
+			oAdmin.apiGetCcd(w, username)
+		case http.MethodPut, http.MethodPost:
+			oAdmin.apiApplyCcd(w, r, username)
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		}
+		return
+	case "config":
+		oAdmin.apiExportConfig(w, r, username)
+		return
+	case "certificate":
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+			return
+		}
+		oAdmin.apiGetCertificates(w, username)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	switch action {
+	case "revoke":
+		oAdmin.apiRevokeUser(w, r, username)
+	case "unrevoke":
+		oAdmin.apiUnrevokeUser(w, r, username)
+	case "rotate":
+		oAdmin.apiRotateUser(w, r, username)
+	case "password":
+		oAdmin.apiChangePassword(w, r, username)
+	case "disconnect":
+		oAdmin.apiDisconnectUser(w, r, username)
+	case "renewal":
+		oAdmin.apiUserRenewal(w, r, username)
+	default:
+		writeAPIError(w, http.StatusNotFound, "not_found", fmt.Sprintf("Unknown action %q", action))
+	}
+}
+
+// apiAuthorize writes an error and returns false if the caller may not perform the operation on this server
+func (oAdmin *OvpnAdmin) apiAuthorize(w http.ResponseWriter, r *http.Request, permission string) bool {
+	switch status, msg := oAdmin.checkAccess(r, permission); status {
+	case 0:
+		return true
+	case http.StatusLocked:
+		writeAPIError(w, status, "read_only", msg)
+	default:
+		writeAPIError(w, status, "forbidden", msg)
+	}
+	return false
+}
+
+// apiRequireUser writes an error and returns false if the user does not exist
+func (oAdmin *OvpnAdmin) apiRequireUser(w http.ResponseWriter, username string) bool {
+	if !oAdmin.userExists(username) {
+		writeAPIError(w, http.StatusNotFound, "user_not_found", fmt.Sprintf("User %q not found", username))
+		return false
+	}
+	return true
+}
+
+func (oAdmin *OvpnAdmin) apiListUsers(w http.ResponseWriter, r *http.Request) {
+	oAdmin.refreshClients()
+
+	users := oAdmin.getClients()
+	status := r.URL.Query().Get("status")
+	search := strings.ToLower(r.URL.Query().Get("search"))
+	if status != "" || search != "" {
+		var filtered []OpenvpnClient
+		for _, u := range users {
+			if status != "" && !strings.EqualFold(u.AccountStatus, status) {
+				continue
+			}
+			if search != "" && !strings.Contains(strings.ToLower(u.Identity), search) {
+				continue
+			}
+			filtered = append(filtered, u)
+		}
+		users = filtered
+	}
+
+	if users == nil {
+		users = []OpenvpnClient{}
+	}
+	writeJSON(w, http.StatusOK, apiUsersResponse{Users: users})
+}
+
+func (oAdmin *OvpnAdmin) apiGetUser(w http.ResponseWriter, username string) {
+	user, found := oAdmin.getUser(username)
+	if !found {
+		writeAPIError(w, http.StatusNotFound, "user_not_found", fmt.Sprintf("User %q not found", username))
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (oAdmin *OvpnAdmin) apiCreateUser(w http.ResponseWriter, r *http.Request) {
+	if !oAdmin.apiAuthorize(w, r, permCreate) {
+		return
+	}
+
+	var req apiCreateUserRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	var csr *x509.CertificateRequest
+	if req.CSR != "" {
+		var err error
+		if csr, err = parseClientCSR([]byte(req.CSR), req.Username); err != nil {
+			writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+			return
+		}
+		req.Username = csr.Subject.CommonName
+	}
+
+	if oAdmin.userExists(req.Username) {
+		writeAPIError(w, http.StatusConflict, "user_exists", fmt.Sprintf("User %q already exists", req.Username))
+		return
+	}
+
+	notAfter, err := parseCertExpiry(req.ExpiresAt, req.ValidDays, time.Now())
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+		return
+	}
+
+	userCreated, userCreateStatus := oAdmin.userCreate(req.Username, req.Password, notAfter, csr)
+	oAdmin.audit(r, auditEntry{Action: auditActionCreate, Target: req.Username, Result: auditResult(userCreated), Message: userCreateStatus})
+	if !userCreated {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", userCreateStatus)
+		return
+	}
+
+	oAdmin.refreshClients()
+	user, _ := oAdmin.getUser(req.Username)
+	writeJSON(w, http.StatusCreated, user)
+}
+
+func (oAdmin *OvpnAdmin) apiDeleteUser(w http.ResponseWriter, r *http.Request, username string) {
+	if !oAdmin.apiAuthorize(w, r, permDelete) || !oAdmin.apiRequireUser(w, username) {
+		return
+	}
+
+	err, msg := oAdmin.userDelete(username)
+	oAdmin.audit(r, auditEntry{Action: auditActionDelete, Target: username, Result: auditResult(err == nil), Message: msg})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "delete_failed", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func (oAdmin *OvpnAdmin) apiRevokeUser(w http.ResponseWriter, r *http.Request, username string) {
+	if !oAdmin.apiAuthorize(w, r, permRevoke) || !oAdmin.apiRequireUser(w, username) {
+		return
+	}
+
+	err, msg := oAdmin.userRevoke(username)
+	oAdmin.audit(r, auditEntry{Action: auditActionRevoke, Target: username, Result: auditResult(err == nil), Message: msg})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "revoke_failed", err.Error())
+		return
+	}
+	oAdmin.apiGetUser(w, username)
+}
+
+func (oAdmin *OvpnAdmin) apiUnrevokeUser(w http.ResponseWriter, r *http.Request, username string) {
+	if !oAdmin.apiAuthorize(w, r, permUnrevoke) || !oAdmin.apiRequireUser(w, username) {
+		return
+	}
+
+	err, msg := oAdmin.userUnrevoke(username)
+	oAdmin.audit(r, auditEntry{Action: auditActionUnrevoke, Target: username, Result: auditResult(err == nil), Message: msg})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "unrevoke_failed", err.Error())
+		return
+	}
+	oAdmin.apiGetUser(w, username)
+}
+
+func (oAdmin *OvpnAdmin) apiRotateUser(w http.ResponseWriter, r *http.Request, username string) {
+	if !oAdmin.apiAuthorize(w, r, permRotate) || !oAdmin.apiRequireUser(w, username) {
+		return
+	}
+
+	var req apiRotateUserRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSONBody(r, &req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+	}
+	notAfter, err := parseCertExpiry(req.ExpiresAt, req.ValidDays, time.Now())
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+		return
+	}
+
+	err, msg := oAdmin.userRotate(username, req.Password, notAfter)
+	oAdmin.audit(r, auditEntry{Action: auditActionRotate, Target: username, Result: auditResult(err == nil), Message: msg})
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, "rotate_failed", msg)
+		return
+	}
+	oAdmin.apiGetUser(w, username)
+}
+
+func (oAdmin *OvpnAdmin) apiChangePassword(w http.ResponseWriter, r *http.Request, username string) {
+	if !oAdmin.apiAuthorize(w, r, permPassword) {
+		return
+	}
+	if !*authByPassword {
+		writeAPIError(w, http.StatusNotImplemented, "not_enabled", "Password authentication not enabled")
+		return
+	}
+	if !oAdmin.apiRequireUser(w, username) {
+		return
+	}
+
+	var req apiPasswordRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	if err := validatePassword(req.Password); err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+		return
+	}
+
+	err, msg := oAdmin.userChangePassword(username, req.Password)
+	oAdmin.audit(r, auditEntry{Action: auditActionPassword, Target: username, Result: auditResult(err == nil), Message: msg})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "password_change_failed", msg)
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func (oAdmin *OvpnAdmin) apiGetCcd(w http.ResponseWriter, username string) {
+	if !*ccdEnabled {
+		writeAPIError(w, http.StatusNotImplemented, "not_enabled", "client-config-dir is not enabled")
+		return
+	}
+	if !oAdmin.apiRequireUser(w, username) {
+		return
+	}
+
+	ccd := oAdmin.getCcd(username)
+	ccd.User = username
+	writeJSON(w, http.StatusOK, ccd)
+}
+
+func (oAdmin *OvpnAdmin) apiApplyCcd(w http.ResponseWriter, r *http.Request, username string) {
+	if !oAdmin.apiAuthorize(w, r, permCcd) {
+		return
+	}
+	if !*ccdEnabled {
+		writeAPIError(w, http.StatusNotImplemented, "not_enabled", "client-config-dir is not enabled")
+		return
+	}
+	if !oAdmin.apiRequireUser(w, username) {
+		return
+	}
+
+	// directives the request leaves out are kept, only the address and the routes are reset
+	ccd := oAdmin.parseCcd(username)
+	ccd.ClientAddress, ccd.CustomRoutes = "", nil
+	if err := decodeJSONBody(r, &ccd); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	ccd.User = username
+	if ccd.ClientAddress == "" {
+		ccd.ClientAddress = "dynamic"
+	}
+	if ccd.CustomRoutes == nil {
+		ccd.CustomRoutes = []ccdRoute{}
+	}
+
+	ccdBefore := oAdmin.readCcd(username)
+	ccdApplied, applyStatus := oAdmin.modifyCcd(ccd)
+	oAdmin.auditCcd(r, username, ccdBefore, ccdApplied, applyStatus)
+	if !ccdApplied {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", applyStatus)
+		return
+	}
+	oAdmin.apiGetCcd(w, username)
+}
+
+func (oAdmin *OvpnAdmin) apiDisconnectUser(w http.ResponseWriter, r *http.Request, username string) {
+	if !oAdmin.apiAuthorize(w, r, permDisconnect) || !oAdmin.apiRequireUser(w, username) {
+		return
+	}
+
+	var req apiDisconnectRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSONBody(r, &req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+	}
+
+	results, err := oAdmin.userDisconnect(username, req.Server)
+	if err != nil {
+		oAdmin.audit(r, auditEntry{Action: auditActionDisconnect, Target: username, Result: auditResultFailure, Message: err.Error()})
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+		return
+	}
+	disconnected, summary := summarizeKillResults(results)
+	oAdmin.audit(r, auditEntry{Action: auditActionDisconnect, Target: username, Result: auditResult(disconnected), Message: summary})
+
+	if results == nil {
+		results = []mgmtKillResult{}
+	}
+	writeJSON(w, http.StatusOK, apiDisconnectResponse{Disconnected: disconnected, Results: results})
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testIndexTxt = "V\t340101000000Z\t\t01\tunknown\t/CN=server\n" +
+	"V\t340101000000Z\t\t02\tunknown\t/CN=alice\n" +
+	"R\t340101000000Z\t250101000000Z\t03\tunknown\t/CN=bob\n"
+
+// setTestIndexTxt points --easyrsa.index-path to a temporary index.txt for the duration of the test
+func setTestIndexTxt(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "index.txt")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldPath := *indexTxtPath
+	*indexTxtPath = path
+	t.Cleanup(func() { *indexTxtPath = oldPath })
+}
+
+func decodeAPIError(t *testing.T, w *httptest.ResponseRecorder) apiError {
+	t.Helper()
+	var resp apiErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Error response is not valid JSON: %v (%s)", err, w.Body.String())
+	}
+	return resp.Error
+}
+
+func TestAPIListUsers(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	oAdmin := newTestOvpnAdmin()
+
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/users", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected Content-Type application/json, got %s", ct)
+	}
+
+	var resp apiUsersResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Response is not valid JSON: %v", err)
+	}
+	if len(resp.Users) != 2 {
+		t.Fatalf("Expected 2 users (server certificate excluded), got %d", len(resp.Users))
+	}
+	if resp.Users[0].Identity != "alice" || resp.Users[0].AccountStatus != "Active" {
+		t.Errorf("Unexpected first user: %+v", resp.Users[0])
+	}
+	if resp.Users[1].Identity != "bob" || resp.Users[1].AccountStatus != "Revoked" {
+		t.Errorf("Unexpected second user: %+v", resp.Users[1])
+	}
+}
+
+func TestAPIListUsers_StatusFilter(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	oAdmin := newTestOvpnAdmin()
+
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/users?status=revoked", nil))
+
+	var resp apiUsersResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Response is not valid JSON: %v", err)
+	}
+	if len(resp.Users) != 1 || resp.Users[0].Identity != "bob" {
+		t.Errorf("Expected only bob, got %+v", resp.Users)
+	}
+}
+
+func TestAPIGetUser(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	oAdmin := newTestOvpnAdmin()
+
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/users/alice", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var user OpenvpnClient
+	if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil {
+		t.Fatalf("Response is not valid JSON: %v", err)
+	}
+	if user.Identity != "alice" {
+		t.Errorf("Expected alice, got %s", user.Identity)
+	}
+}
+
+func TestAPIGetUser_NotFound(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	oAdmin := newTestOvpnAdmin()
+
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/users/nobody", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected status 404, got %d", w.Code)
+	}
+	if apiErr := decodeAPIError(t, w); apiErr.Code != "user_not_found" {
+		t.Errorf("Expected error code user_not_found, got %s", apiErr.Code)
+	}
+}
+
+func TestAPICreateUser_SlaveLocked(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.role = "slave"
+
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodPost, "/api/v1/users", strings.NewReader(`{"username":"carol"}`)))
+
+	if w.Code != http.StatusLocked {
+		t.Fatalf("Expected status 423, got %d", w.Code)
+	}
+	if apiErr := decodeAPIError(t, w); apiErr.Code != "read_only" {
+		t.Errorf("Expected error code read_only, got %s", apiErr.Code)
+	}
+}
+
+func TestAPICreateUser_Conflict(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	oAdmin := newTestOvpnAdmin()
+
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodPost, "/api/v1/users", strings.NewReader(`{"username":"alice"}`)))
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected status 409, got %d", w.Code)
+	}
+}
+
+func TestAPICreateUser_BadJSON(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	oAdmin := newTestOvpnAdmin()
+
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodPost, "/api/v1/users", strings.NewReader(`{"user":`)))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got %d", w.Code)
+	}
+	if apiErr := decodeAPIError(t, w); apiErr.Code != "bad_request" {
+		t.Errorf("Expected error code bad_request, got %s", apiErr.Code)
+	}
+}
+
+func TestParseCertExpiry(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expiresAt string
+		validDays int
+		want      time.Time
+		wantErr   bool
+	}{
+		{"", 0, time.Time{}, false},
+		{"", 30, now.AddDate(0, 0, 30), false},
+		{"2025-12-31", 0, time.Date(2025, 12, 31, 23, 59, 59, 0, time.UTC), false},
+		{"2025-07-01T08:00:00+02:00", 0, time.Date(2025, 7, 1, 6, 0, 0, 0, time.UTC), false},
+		{"2025-06-01", 0, time.Date(2025, 6, 1, 23, 59, 59, 0, time.UTC), false},
+		{"2025-05-31", 0, time.Time{}, true},
+		{"31.12.2025", 0, time.Time{}, true},
+		{"2025-12-31", 30, time.Time{}, true},
+		{"", -1, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCertExpiry(tt.expiresAt, tt.validDays, now)
+		if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+			t.Errorf("parseCertExpiry(%q, %d) = %v, %v, want %v", tt.expiresAt, tt.validDays, got, err, tt.want)
+		}
+	}
+}
+
+func TestAPIUserLifetime(t *testing.T) {
+	p := newTestPKI(t)
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.storage = &filesystemStorage{pki: p, ccdDir: t.TempDir()}
+	notAfterOf := func(username string) time.Time {
+		t.Helper()
+		certPEM, _, err := oAdmin.storage.ClientCert(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := decodeCert([]byte(certPEM))
+		return cert.NotAfter
+	}
+	post := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := post("/api/v1/users", `{"username":"contractor","valid_days":7}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if days := time.Until(notAfterOf("contractor")).Hours() / 24; days < 6.9 || days > 7 {
+		t.Errorf("Expected a certificate valid for 7 days, got %.2f", days)
+	}
+
+	expiresAt := time.Now().UTC().AddDate(0, 2, 0).Format("2006-01-02")
+	if w := post("/api/v1/users/contractor/rotate", `{"expires_at":"`+expiresAt+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := notAfterOf("contractor").Format("2006-01-02 15:04:05"); got != expiresAt+" 23:59:59" {
+		t.Errorf("Expected the lifetime to be extended to the end of %s, got %s", expiresAt, got)
+	}
+
+	w := post("/api/v1/users", `{"username":"temp","expires_at":"2020-01-01"}`)
+	if w.Code != http.StatusUnprocessableEntity || decodeAPIError(t, w).Code != "validation_failed" {
+		t.Errorf("Expected 422 for a date in the past, got %d", w.Code)
+	}
+	if oAdmin.userExists("temp") {
+		t.Error("Expected no certificate for a rejected lifetime")
+	}
+}
+
+func TestAPIUserAction_MethodNotAllowed(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	oAdmin := newTestOvpnAdmin()
+
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/users/alice/revoke", nil))
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status 405, got %d", w.Code)
+	}
+}
+
+func TestAPIOpenAPISpec(t *testing.T) {
+	oAdmin := newTestOvpnAdmin()
+
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var spec map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("OpenAPI document is not valid JSON: %v", err)
+	}
+	paths, _ := spec["paths"].(map[string]interface{})
+	for _, p := range []string{"/users", "/users/{username}", "/users/{username}/revoke", "/users/{username}/ccd"} {
+		if _, ok := paths[p]; !ok {
+			t.Errorf("OpenAPI document should describe %s", p)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	auditActionCreate     = "create"
+	auditActionRevoke     = "revoke"
+	auditActionUnrevoke   = "unrevoke"
+	auditActionRotate     = "rotate"
+	auditActionDelete     = "delete"
+	auditActionPassword   = "password"
+	auditActionCcd        = "ccd"
+	auditActionDisconnect = "disconnect"
+	auditActionCA         = "ca"
+	auditActionRenew      = "renew"
+	auditActionGroup      = "group"
+
+	// auditActorSystem is the actor of actions ovpn-admin makes on its own
+	auditActorSystem = "system"
+
+	auditResultSuccess = "success"
+	auditResultFailure = "failure"
+
+	auditDefaultLimit = 100
+)
+
+var auditActions = []string{
+	auditActionCreate,
+	auditActionRevoke,
+	auditActionUnrevoke,
+	auditActionRotate,
+	auditActionDelete,
+	auditActionPassword,
+	auditActionCcd,
+	auditActionDisconnect,
+	auditActionCA,
+	auditActionRenew,
+	auditActionGroup,
+}
+
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	SourceIP  string    `json:"source_ip"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Result    string    `json:"result"`
+	Message   string    `json:"message,omitempty"`
+	CcdBefore *string   `json:"ccd_before,omitempty"`
+	CcdAfter  *string   `json:"ccd_after,omitempty"`
+}
+
+type auditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Result string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// auditLog is an append-only JSON Lines file, one entry per line
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newAuditLog(path string) *auditLog {
+	return &auditLog{path: path}
+}
+
+func (a *auditLog) append(entry auditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (f auditFilter) match(entry auditEntry) bool {
+	switch {
+	case f.Actor != "" && entry.Actor != f.Actor:
+		return false
+	case f.Action != "" && entry.Action != f.Action:
+		return false
+	case f.Target != "" && entry.Target != f.Target:
+		return false
+	case f.Result != "" && entry.Result != f.Result:
+		return false
+	case !f.Since.IsZero() && entry.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && entry.Time.After(f.Until):
+		return false
+	}
+	return true
+}
+
+// each calls fn for every entry matching the filter in the order they were written
+func (a *auditLog) each(filter auditFilter, fn func(auditEntry) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	file, err := os.Open(a.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Warnf("audit: skipping malformed entry: %v", err)
+			continue
+		}
+		if !filter.match(entry) {
+			continue
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// query returns matching entries, newest first
+func (a *auditLog) query(filter auditFilter) ([]auditEntry, error) {
+	var entries []auditEntry
+	err := a.each(filter, func(entry auditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+	}
+	return entries, nil
+}
+
+// export writes matching entries as JSON Lines in the order they were written
+func (a *auditLog) export(w io.Writer, filter auditFilter) error {
+	encoder := json.NewEncoder(w)
+	return a.each(filter, func(entry auditEntry) error {
+		return encoder.Encode(entry)
+	})
+}
+
+func auditResult(ok bool) string {
+	if ok {
+		return auditResultSuccess
+	}
+	return auditResultFailure
+}
+
+// sourceIP strips the port from the remote address of the request
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// audit records an administrative action made by the request, nothing is recorded if the audit log is disabled
+func (oAdmin *OvpnAdmin) audit(r *http.Request, entry auditEntry) {
+	if oAdmin.auditLog == nil {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	entry.Actor = oAdmin.requestActor(r)
+	entry.SourceIP = sourceIP(r)
+	if err := oAdmin.auditLog.append(entry); err != nil {
+		log.Errorf("audit: can't write entry %+v: %v", entry, err)
+	}
+}
+
+// auditSystem records an action ovpn-admin made on its own, like a scheduled certificate renewal
+func (oAdmin *OvpnAdmin) auditSystem(entry auditEntry) {
+	if oAdmin.auditLog == nil {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	entry.Actor = auditActorSystem
+	if err := oAdmin.auditLog.append(entry); err != nil {
+		log.Errorf("audit: can't write entry %+v: %v", entry, err)
+	}
+}
+
+// auditCcd records a CCD change with the content before and after it
+func (oAdmin *OvpnAdmin) auditCcd(r *http.Request, username, before string, ok bool, message string) {
+	after := oAdmin.readCcd(username)
+	oAdmin.audit(r, auditEntry{
+		Action:    auditActionCcd,
+		Target:    username,
+		Result:    auditResult(ok),
+		Message:   message,
+		CcdBefore: &before,
+		CcdAfter:  &after,
+	})
+}
+
+func parseAuditFilter(r *http.Request) (auditFilter, error) {
+	q := r.URL.Query()
+	filter := auditFilter{
+		Actor:  q.Get("actor"),
+		Action: q.Get("action"),
+		Target: q.Get("target"),
+		Result: q.Get("result"),
+		Limit:  auditDefaultLimit,
+	}
+
+	for name, dest := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := q.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+			}
+			*dest = t
+		}
+	}
+
+	if value := q.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return filter, errors.New("limit must be a non-negative number")
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+type apiAuditResponse struct {
+	Entries []auditEntry `json:"entries"`
+}
+
+// apiAuditHandler serves /api/v1/audit and /api/v1/audit/export
+func (oAdmin *OvpnAdmin) apiAuditHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	if !oAdmin.apiAuthorize(w, r, permAudit) {
+		return
+	}
+	if oAdmin.auditLog == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_enabled", "Audit log is not enabled")
+		return
+	}
+
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	switch {
+	case len(parts) == 0 || parts[0] == "":
+		entries, err := oAdmin.auditLog.query(filter)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "audit_read_failed", err.Error())
+			return
+		}
+		if entries == nil {
+			entries = []auditEntry{}
+		}
+		writeJSON(w, http.StatusOK, apiAuditResponse{Entries: entries})
+	case len(parts) == 1 && parts[0] == "export":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%s.jsonl"`, time.Now().UTC().Format("20060102-150405")))
+		if err := oAdmin.auditLog.export(w, filter); err != nil {
+			log.Errorf("audit: export failed: %v", err)
+		}
+	default:
+		writeAPIError(w, http.StatusNotFound, "not_found", fmt.Sprintf("Unknown API endpoint %q", r.URL.Path))
+	}
+}
+
+func (oAdmin *OvpnAdmin) auditPageHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+
+	data := oAdmin.pageData(r, "audit")
+	data["AuditEnabled"] = oAdmin.auditLog != nil
+	data["AuditActions"] = auditActions
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := oAdmin.htmlTemplates.ExecuteTemplate(w, "base", data); err != nil {
+		log.Errorf("Error rendering audit template: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// auditRowsHandler renders the filtered audit entries (HTMX partial)
+func (oAdmin *OvpnAdmin) auditRowsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+
+	var entries []auditEntry
+	if oAdmin.auditLog != nil {
+		filter, err := parseAuditFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		entries, err = oAdmin.auditLog.query(filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := oAdmin.htmlTemplates.ExecuteTemplate(w, "audit_rows", map[string]interface{}{
+		"Entries": entries,
+	})
+	if err != nil {
+		log.Errorf("Error rendering audit_rows template: %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAuditAdmin(t *testing.T) *OvpnAdmin {
+	t.Helper()
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.auditLog = newAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	return oAdmin
+}
+
+func TestAuditLog_AppendAndQuery(t *testing.T) {
+	log := newAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	entries := []auditEntry{
+		{Time: start, Actor: "admin", Action: auditActionCreate, Target: "alice", Result: auditResultSuccess},
+		{Time: start.Add(time.Hour), Actor: "operator", Action: auditActionRevoke, Target: "alice", Result: auditResultSuccess},
+		{Time: start.Add(2 * time.Hour), Actor: "admin", Action: auditActionDelete, Target: "bob", Result: auditResultFailure},
+	}
+	for _, e := range entries {
+		if err := log.append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := log.query(auditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 || all[0].Action != auditActionDelete {
+		t.Fatalf("Expected 3 entries newest first, got %+v", all)
+	}
+
+	byTarget, _ := log.query(auditFilter{Target: "alice"})
+	if len(byTarget) != 2 {
+		t.Errorf("Expected 2 entries for alice, got %d", len(byTarget))
+	}
+
+	byTime, _ := log.query(auditFilter{Since: start.Add(30 * time.Minute), Until: start.Add(90 * time.Minute)})
+	if len(byTime) != 1 || byTime[0].Actor != "operator" {
+		t.Errorf("Expected only the revoke entry, got %+v", byTime)
+	}
+
+	limited, _ := log.query(auditFilter{Limit: 1})
+	if len(limited) != 1 || limited[0].Target != "bob" {
+		t.Errorf("Expected only the newest entry, got %+v", limited)
+	}
+}
+
+func TestAuditLog_MissingFile(t *testing.T) {
+	log := newAuditLog(filepath.Join(t.TempDir(), "missing.log"))
+	entries, err := log.query(auditFilter{})
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Expected no entries and no error, got %v, %v", entries, err)
+	}
+}
+
+func TestAudit_RecordsActorAndCcd(t *testing.T) {
+	oldCcdDir := *ccdDir
+	*ccdDir = t.TempDir()
+	t.Cleanup(func() { *ccdDir = oldCcdDir })
+	oAdmin := newTestAuditAdmin(t)
+	if err := os.WriteFile(filepath.Join(*ccdDir, "alice"), []byte("ifconfig-push 10.8.0.10 255.255.255.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/users/alice/ccd", nil)
+	req.RemoteAddr = "192.0.2.10:51234"
+	before := oAdmin.readCcd("alice")
+	if err := os.WriteFile(filepath.Join(*ccdDir, "alice"), []byte("ifconfig-push 10.8.0.20 255.255.255.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oAdmin.auditCcd(req, "alice", before, true, "ccd updated successfully")
+
+	entries, err := oAdmin.auditLog.query(auditFilter{})
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %v, %v", entries, err)
+	}
+	e := entries[0]
+	if e.Actor != "anonymous" || e.SourceIP != "192.0.2.10" || e.Action != auditActionCcd || e.Target != "alice" || e.Result != auditResultSuccess {
+		t.Errorf("Unexpected entry: %+v", e)
+	}
+	if e.CcdBefore == nil || !strings.Contains(*e.CcdBefore, "10.8.0.10") || e.CcdAfter == nil || !strings.Contains(*e.CcdAfter, "10.8.0.20") {
+		t.Errorf("Expected CCD before and after, got %+v", e)
+	}
+}
+
+func TestAudit_Disabled(t *testing.T) {
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.audit(httptest.NewRequest(http.MethodPost, "/", nil), auditEntry{Action: auditActionRevoke})
+
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/audit", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status 501, got %d", w.Code)
+	}
+}
+
+func TestAPIAudit_QueryAndExport(t *testing.T) {
+	oAdmin := newTestAuditAdmin(t)
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	oAdmin.audit(req, auditEntry{Action: auditActionRevoke, Target: "alice", Result: auditResultSuccess})
+	oAdmin.audit(req, auditEntry{Action: auditActionDelete, Target: "bob", Result: auditResultFailure, Message: "boom"})
+
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/audit?action=delete", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var resp apiAuditResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Entries) != 1 || resp.Entries[0].Target != "bob" || resp.Entries[0].Message != "boom" {
+		t.Errorf("Unexpected entries: %+v", resp.Entries)
+	}
+
+	w = httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/audit/export", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Expected JSON Lines content type, got %s", ct)
+	}
+	lines := 0
+	scanner := bufio.NewScanner(bytes.NewReader(w.Body.Bytes()))
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Errorf("Line %d is not valid JSON: %v", lines+1, err)
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Errorf("Expected 2 exported lines, got %d", lines)
+	}
+
+	w = httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/audit?since=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid since, got %d", w.Code)
+	}
+}
+
+func TestAPIAudit_RequiresAdmin(t *testing.T) {
+	oAdmin := newTestAuditAdmin(t)
+	oAdmin.auth = newTestUIAuth(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/audit", nil)
+	req.SetBasicAuth(uiRoleOperator, "secret")
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d", w.Code)
+	}
+}
+
+func TestAuditPage(t *testing.T) {
+	oAdmin := newTestAuditAdmin(t)
+	before := "ifconfig-push 10.8.0.10 255.255.255.0"
+	after := "ifconfig-push 10.8.0.20 255.255.255.0"
+	oAdmin.audit(httptest.NewRequest(http.MethodPost, "/", nil), auditEntry{Action: auditActionCcd, Target: "alice", Result: auditResultSuccess, CcdBefore: &before, CcdAfter: &after})
+
+	w := httptest.NewRecorder()
+	oAdmin.auditPageHandler(w, httptest.NewRequest(http.MethodGet, "/audit", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Audit Log") {
+		t.Fatalf("Expected audit page, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	oAdmin.auditRowsHandler(w, httptest.NewRequest(http.MethodGet, "/audit/rows?target=alice", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, "10.8.0.10") || !strings.Contains(body, "10.8.0.20") {
+		t.Errorf("Expected CCD before and after in rows, got %s", body)
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	uiRoleViewer   = "viewer"
+	uiRoleOperator = "operator"
+	uiRoleAdmin    = "admin"
+
+	permView       = "view"
+	permConfig     = "config"
+	permRevoke     = "revoke"
+	permDisconnect = "disconnect"
+	permUnrevoke   = "unrevoke"
+	permCreate     = "create"
+	permDelete     = "delete"
+	permRotate     = "rotate"
+	permCcd        = "ccd"
+	permPassword   = "password"
+	permAudit      = "audit"
+	permCA         = "ca"
+
+	sessionCookieName = "ovpn_admin_session"
+)
+
+type ctxKey int
+
+const ctxKeyUISession ctxKey = iota
+
+var uiRoleLevels = map[string]int{
+	uiRoleViewer:   1,
+	uiRoleOperator: 2,
+	uiRoleAdmin:    3,
+}
+
+// minimal role required for every permission
+var uiPermissionRoles = map[string]string{
+	permView:       uiRoleViewer,
+	permConfig:     uiRoleOperator,
+	permRevoke:     uiRoleOperator,
+	permDisconnect: uiRoleOperator,
+	permUnrevoke:   uiRoleAdmin,
+	permCreate:     uiRoleAdmin,
+	permDelete:     uiRoleAdmin,
+	permRotate:     uiRoleAdmin,
+	permCcd:        uiRoleAdmin,
+	permPassword:   uiRoleAdmin,
+	permAudit:      uiRoleAdmin,
+	permCA:         uiRoleAdmin,
+}
+
+// permissions which change the PKI or ccd and therefore are not available on a slave server
+var pkiPermissions = map[string]bool{
+	permRevoke:   true,
+	permUnrevoke: true,
+	permCreate:   true,
+	permDelete:   true,
+	permRotate:   true,
+	permCcd:      true,
+	permPassword: true,
+	permCA:       true,
+}
+
+// used to spend the same time on unknown users as on known ones
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("ovpn-admin"), bcrypt.DefaultCost)
+
+type uiUser struct {
+	Username     string
+	Role         string
+	PasswordHash []byte
+}
+
+type uiSession struct {
+	Username string
+	Role     string
+	Expires  time.Time
+}
+
+type uiAuth struct {
+	mu         sync.RWMutex
+	users      map[string]uiUser
+	sessions   map[string]uiSession
+	sessionTTL time.Duration
+}
+
+func roleHasPermission(role, permission string) bool {
+	required, ok := uiPermissionRoles[permission]
+	if !ok {
+		return false
+	}
+	return uiRoleLevels[role] >= uiRoleLevels[required]
+}
+
+func newUIAuth(sessionTTL time.Duration) *uiAuth {
+	return &uiAuth{
+		users:      make(map[string]uiUser),
+		sessions:   make(map[string]uiSession),
+		sessionTTL: sessionTTL,
+	}
+}
+
+// loadUsers reads users in the "username:role:bcrypt-hash" format, one user per line
+func (a *uiAuth) loadUsers(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	users := make(map[string]uiUser)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			return fmt.Errorf("%s:%d: expected username:role:hash", path, lineNumber)
+		}
+		if _, ok := uiRoleLevels[parts[1]]; !ok {
+			return fmt.Errorf("%s:%d: unknown role %q", path, lineNumber, parts[1])
+		}
+		users[parts[0]] = uiUser{Username: parts[0], Role: parts[1], PasswordHash: []byte(parts[2])}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.users = users
+	a.mu.Unlock()
+	return nil
+}
+
+// bootstrapAdmin creates the users file with a single admin user if it doesn't exist yet
+func (a *uiAuth) bootstrapAdmin(path, username, password string) error {
+	if fExist(path) && strings.TrimSpace(fRead(path)) != "" {
+		return nil
+	}
+	if password == "" {
+		return errors.New("users file is empty and no initial admin password is set")
+	}
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	content := "# username:role:bcrypt-hash, roles: viewer, operator, admin\n"
+	content += fmt.Sprintf("%s:%s:%s\n", username, uiRoleAdmin, hash)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		return err
+	}
+	log.Infof("ui auth: created users file %s with admin user %s", path, username)
+	return nil
+}
+
+func (a *uiAuth) hasUsers() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.users) > 0
+}
+
+func (a *uiAuth) checkPassword(username, password string) (uiUser, bool) {
+	a.mu.RLock()
+	user, found := a.users[username]
+	a.mu.RUnlock()
+
+	if !found {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return uiUser{}, false
+	}
+	if bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password)) != nil {
+		return uiUser{}, false
+	}
+	return user, true
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func (a *uiAuth) createSession(username, role string) (string, uiSession, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", uiSession{}, err
+	}
+	session := uiSession{Username: username, Role: role, Expires: time.Now().Add(a.sessionTTL)}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for t, s := range a.sessions {
+		if now.After(s.Expires) {
+			delete(a.sessions, t)
+		}
+	}
+	a.sessions[token] = session
+
+	return token, session, nil
+}
+
+func (a *uiAuth) deleteSession(token string) {
+	a.mu.Lock()
+	delete(a.sessions, token)
+	a.mu.Unlock()
+}
+
+func (a *uiAuth) getSession(token string) (uiSession, bool) {
+	a.mu.RLock()
+	session, found := a.sessions[token]
+	a.mu.RUnlock()
+	if !found || time.Now().After(session.Expires) {
+		return uiSession{}, false
+	}
+	return session, true
+}
+
+// authenticate looks up the session cookie first and falls back to HTTP Basic auth for API clients
+func (a *uiAuth) authenticate(r *http.Request) (uiSession, bool) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if session, ok := a.getSession(cookie.Value); ok {
+			return session, true
+		}
+	}
+
+	if username, password, ok := r.BasicAuth(); ok {
+		if user, valid := a.checkPassword(username, password); valid {
+			return uiSession{Username: user.Username, Role: user.Role}, true
+		}
+		log.Warnf("ui auth: failed basic auth for %q from %s", username, r.RemoteAddr)
+	}
+
+	return uiSession{}, false
+}
+
+func isAPIRequest(r *http.Request) bool {
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, *listenBaseUrl), "/")
+	return strings.HasPrefix(path, "api/")
+}
+
+func loginURL(r *http.Request) string {
+	return *listenBaseUrl + "login?next=" + url.QueryEscape(r.URL.RequestURI())
+}
+
+func (oAdmin *OvpnAdmin) unauthorized(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case isAPIRequest(r):
+		w.Header().Set("WWW-Authenticate", `Basic realm="ovpn-admin"`)
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized", "Authentication required")
+	case r.Header.Get("HX-Request") == "true":
+		w.Header().Set("HX-Redirect", loginURL(r))
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+	default:
+		http.Redirect(w, r, loginURL(r), http.StatusSeeOther)
+	}
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request, msg string) {
+	if isAPIRequest(r) {
+		writeAPIError(w, http.StatusForbidden, "forbidden", msg)
+		return
+	}
+	http.Error(w, msg, http.StatusForbidden)
+}
+
+// requestSession returns the authenticated UI user of the request
+func (oAdmin *OvpnAdmin) requestSession(r *http.Request) (uiSession, bool) {
+	if oAdmin.auth == nil {
+		return uiSession{Role: uiRoleAdmin}, true
+	}
+	if session, ok := r.Context().Value(ctxKeyUISession).(uiSession); ok {
+		return session, true
+	}
+	return oAdmin.auth.authenticate(r)
+}
+
+// requestRole returns the role of the UI user, every request is treated as admin if UI auth is disabled
+func (oAdmin *OvpnAdmin) requestRole(r *http.Request) string {
+	session, ok := oAdmin.requestSession(r)
+	if !ok {
+		return ""
+	}
+	return session.Role
+}
+
+// requestActor returns a human-readable name of whoever made the request
+func (oAdmin *OvpnAdmin) requestActor(r *http.Request) string {
+	if session, ok := oAdmin.requestSession(r); ok && session.Username != "" {
+		return session.Username
+	}
+	return "anonymous"
+}
+
+// checkAccess returns a non-zero HTTP status and a reason if the request may not use the permission
+func (oAdmin *OvpnAdmin) checkAccess(r *http.Request, permission string) (int, string) {
+	if oAdmin.role == "slave" && pkiPermissions[permission] {
+		return http.StatusLocked, "Operation not allowed in slave mode"
+	}
+	if !roleHasPermission(oAdmin.requestRole(r), permission) {
+		return http.StatusForbidden, fmt.Sprintf("Permission %q denied", permission)
+	}
+	return 0, ""
+}
+
+// requirePermission wraps a route handler and rejects requests of users without the permission
+func (oAdmin *OvpnAdmin) requirePermission(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if oAdmin.auth == nil {
+			next(w, r)
+			return
+		}
+
+		session, ok := oAdmin.auth.authenticate(r)
+		if !ok {
+			oAdmin.unauthorized(w, r)
+			return
+		}
+		if !roleHasPermission(session.Role, permission) {
+			log.Warnf("ui auth: %s (%s) denied %q for %s", session.Username, session.Role, permission, r.RequestURI)
+			forbidden(w, r, fmt.Sprintf("Permission %q denied", permission))
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), ctxKeyUISession, session)))
+	}
+}
+
+// userActionPermission returns the permission needed for an action below /users/{username}/
+func userActionPermission(action, method string) string {
+	switch action {
+	case "":
+		if method == http.MethodDelete {
+			return permDelete
+		}
+		return permView
+	case "revoke":
+		return permRevoke
+	case "unrevoke":
+		return permUnrevoke
+	case "rotate":
+		return permRotate
+	case "password":
+		return permPassword
+	case "config", "export":
+		return permConfig
+	case "disconnect":
+		return permDisconnect
+	case "renewal":
+		return permRotate
+	case "ccd":
+		if method == http.MethodPost || method == http.MethodPut {
+			return permCcd
+		}
+		return permView
+	}
+	return permView
+}
+
+// setSessionCookie sets the session cookie, an empty token removes it
+func (oAdmin *OvpnAdmin) setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     *listenBaseUrl,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if token == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// safeRedirectTarget only allows local redirects after login
+func safeRedirectTarget(next string) string {
+	if next == "" || !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return *listenBaseUrl
+	}
+	return next
+}
+
+func (oAdmin *OvpnAdmin) loginHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if oAdmin.auth == nil {
+		http.Redirect(w, r, *listenBaseUrl, http.StatusSeeOther)
+		return
+	}
+
+	_ = r.ParseForm()
+	next := safeRedirectTarget(r.FormValue("next"))
+	errorMessage := ""
+
+	if r.Method == http.MethodPost {
+		username := r.FormValue("username")
+		user, ok := oAdmin.auth.checkPassword(username, r.FormValue("password"))
+		if ok {
+			token, session, err := oAdmin.auth.createSession(user.Username, user.Role)
+			if err != nil {
+				log.Errorf("ui auth: can't create session: %v", err)
+				http.Error(w, "Can't create session", http.StatusInternalServerError)
+				return
+			}
+			oAdmin.setSessionCookie(w, r, token, session.Expires)
+			log.Infof("ui auth: %s (%s) logged in from %s", user.Username, user.Role, r.RemoteAddr)
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		log.Warnf("ui auth: failed login for %q from %s", username, r.RemoteAddr)
+		errorMessage = "Invalid username or password"
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if errorMessage != "" {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	err := oAdmin.htmlTemplates.ExecuteTemplate(w, "login", map[string]interface{}{
+		"Next":          next,
+		"Error":         errorMessage,
+		"PasswordLogin": oAdmin.auth.hasUsers(),
+		"SSO":           oAdmin.oidc != nil,
+	})
+	if err != nil {
+		log.Errorf("Error rendering login template: %v", err)
+	}
+}
+
+func (oAdmin *OvpnAdmin) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if oAdmin.auth != nil {
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			oAdmin.auth.deleteSession(cookie.Value)
+		}
+		oAdmin.setSessionCookie(w, r, "", time.Time{})
+	}
+	http.Redirect(w, r, *listenBaseUrl+"login", http.StatusSeeOther)
+}
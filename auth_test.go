@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestUIAuth returns auth with a viewer, an operator and an admin user, all with the password "secret"
+func newTestUIAuth(t *testing.T) *uiAuth {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := "# test users\n"
+	for _, role := range []string{uiRoleViewer, uiRoleOperator, uiRoleAdmin} {
+		content += fmt.Sprintf("%s:%s:%s\n", role, role, hash)
+	}
+	path := filepath.Join(t.TempDir(), "ui-users.txt")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	auth := newUIAuth(time.Hour)
+	if err := auth.loadUsers(path); err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+func TestRoleHasPermission(t *testing.T) {
+	tests := []struct {
+		role       string
+		permission string
+		expected   bool
+	}{
+		{uiRoleViewer, permView, true},
+		{uiRoleViewer, permConfig, false},
+		{uiRoleOperator, permRevoke, true},
+		{uiRoleOperator, permDisconnect, true},
+		{uiRoleOperator, permCreate, false},
+		{uiRoleAdmin, permDelete, true},
+		{"", permView, false},
+		{uiRoleAdmin, "unknown", false},
+	}
+
+	for _, tt := range tests {
+		if got := roleHasPermission(tt.role, tt.permission); got != tt.expected {
+			t.Errorf("roleHasPermission(%q, %q) = %v, expected %v", tt.role, tt.permission, got, tt.expected)
+		}
+	}
+}
+
+func TestLoadUsers_InvalidRole(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ui-users.txt")
+	if err := os.WriteFile(path, []byte("bob:superuser:hash\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := newUIAuth(time.Hour).loadUsers(path); err == nil {
+		t.Error("Expected error for unknown role")
+	}
+}
+
+func TestBootstrapAdmin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ui-users.txt")
+	auth := newUIAuth(time.Hour)
+
+	if err := auth.bootstrapAdmin(path, "admin", ""); err == nil {
+		t.Fatal("Expected error without initial admin password")
+	}
+	if err := auth.bootstrapAdmin(path, "admin", "supersecret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.loadUsers(path); err != nil {
+		t.Fatal(err)
+	}
+	if user, ok := auth.checkPassword("admin", "supersecret"); !ok || user.Role != uiRoleAdmin {
+		t.Errorf("Expected bootstrapped admin to log in, got %+v", user)
+	}
+	if _, ok := auth.checkPassword("admin", "wrong"); ok {
+		t.Error("Expected wrong password to be rejected")
+	}
+}
+
+func TestRequirePermission_Unauthenticated(t *testing.T) {
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.auth = newTestUIAuth(t)
+	handler := oAdmin.requirePermission(permView, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/users", nil))
+	if w.Code != http.StatusSeeOther || !strings.Contains(w.Header().Get("Location"), "login?next=") {
+		t.Errorf("Expected redirect to login, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/users", nil)
+	req.Header.Set("HX-Request", "true")
+	handler(w, req)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("HX-Redirect") == "" {
+		t.Errorf("Expected 401 with HX-Redirect, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/users", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for API request, got %d", w.Code)
+	}
+}
+
+func TestRequirePermission_Roles(t *testing.T) {
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.auth = newTestUIAuth(t)
+	handler := oAdmin.requirePermission(permRevoke, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		username string
+		expected int
+	}{
+		{uiRoleViewer, http.StatusForbidden},
+		{uiRoleOperator, http.StatusOK},
+		{uiRoleAdmin, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/users/alice/revoke", nil)
+		req.SetBasicAuth(tt.username, "secret")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != tt.expected {
+			t.Errorf("%s: expected status %d, got %d", tt.username, tt.expected, w.Code)
+		}
+	}
+}
+
+func TestLoginHandler(t *testing.T) {
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.auth = newTestUIAuth(t)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("username=operator&password=wrong"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	oAdmin.loginHandler(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401 for wrong password, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("username=operator&password=secret&next=/users"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	oAdmin.loginHandler(w, req)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/users" {
+		t.Fatalf("Expected redirect to /users, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookieName || !cookies[0].HttpOnly {
+		t.Fatalf("Expected HttpOnly session cookie, got %+v", cookies)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+	if role := oAdmin.requestRole(req); role != uiRoleOperator {
+		t.Errorf("Expected session role operator, got %q", role)
+	}
+}
+
+func TestAPIDeleteUser_Forbidden(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.auth = newTestUIAuth(t)
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/v1/users/bob", nil)
+	req.SetBasicAuth(uiRoleOperator, "secret")
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected status 403, got %d", w.Code)
+	}
+	if apiErr := decodeAPIError(t, w); apiErr.Code != "forbidden" {
+		t.Errorf("Expected error code forbidden, got %s", apiErr.Code)
+	}
+}
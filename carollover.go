@@ -0,0 +1,736 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	caCertFile          = "ca.crt"
+	caKeyFile           = "private/ca.key"
+	caNextCertFile      = "ca-next.crt"
+	caNextKeyFile       = "private/ca-next.key"
+	caRolloverStateFile = "ca-rollover.json"
+
+	serverCommonName = "server"
+
+	caRolloverStepStart    = "start"
+	caRolloverStepReissue  = "reissue"
+	caRolloverStepServer   = "server"
+	caRolloverStepRetire   = "retire"
+	caRolloverDefaultBatch = 10
+)
+
+// caRollover is implemented by storage backends which can replace their CA.
+//
+// A rollover goes through these steps:
+//  1. start: a new CA is created and ca.crt holds both CAs, so the server and new client configs trust both
+//  2. reissue: client certificates are rotated under the new CA, on demand or in batches
+//  3. server: the server certificate is rotated under the new CA once the clients trust it
+//  4. retire: the new CA replaces the old one in ca.crt and the old CA is kept aside
+type caRollover interface {
+	CARolloverStatus() (caRolloverStatus, error)
+	StartCARollover() error
+	ReissueServerCert() error
+	// RetireCA finishes the rollover, force skips the check for certificates which are not reissued yet
+	RetireCA(force bool) error
+}
+
+type caInfo struct {
+	Serial       string    `json:"serial"`
+	KeyAlgorithm string    `json:"key_algorithm"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+}
+
+type caRolloverStatus struct {
+	InProgress     bool       `json:"in_progress"`
+	Current        caInfo     `json:"current"`
+	Next           *caInfo    `json:"next,omitempty"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	ServerReissued bool       `json:"server_reissued"`
+	// Reissued and Pending list the users with a valid certificate of the new and the old CA
+	Reissued []string `json:"reissued"`
+	Pending  []string `json:"pending"`
+}
+
+// ReadyToRetire reports whether every certificate is issued by the new CA
+func (s caRolloverStatus) ReadyToRetire() bool {
+	return s.InProgress && s.ServerReissued && len(s.Pending) == 0
+}
+
+type caRolloverState struct {
+	StartedAt time.Time `json:"started_at"`
+}
+
+func newCAInfo(cert *x509.Certificate) caInfo {
+	return caInfo{
+		Serial:       indexTxtSerial(cert.SerialNumber),
+		KeyAlgorithm: publicKeyDescription(cert.PublicKey),
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+	}
+}
+
+func (p *filesystemPKI) rolloverInProgress() bool {
+	_, err := os.Stat(p.path(caNextCertFile))
+	return err == nil
+}
+
+// issuedBy reports whether the issued certificate of the common name is signed by the CA
+func (p *filesystemPKI) issuedBy(commonName string, ca *x509.Certificate) bool {
+	certPEM, err := os.ReadFile(p.path("issued", commonName+".crt"))
+	if err != nil {
+		return false
+	}
+	cert, err := decodeCert(certPEM)
+	if err != nil {
+		return false
+	}
+	return cert.CheckSignatureFrom(ca) == nil
+}
+
+func (p *filesystemPKI) caRolloverStatus() (caRolloverStatus, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.readRolloverStatus()
+}
+
+func (p *filesystemPKI) readRolloverStatus() (status caRolloverStatus, err error) {
+	status.Reissued, status.Pending = []string{}, []string{}
+
+	current, _, err := p.loadCAFiles(caCertFile, caKeyFile)
+	if err != nil {
+		return
+	}
+	status.Current = newCAInfo(current)
+	if !p.rolloverInProgress() {
+		return
+	}
+
+	next, _, err := p.loadCAFiles(caNextCertFile, caNextKeyFile)
+	if err != nil {
+		return
+	}
+	status.InProgress = true
+	nextInfo := newCAInfo(next)
+	status.Next = &nextInfo
+
+	var state caRolloverState
+	if content, err := os.ReadFile(p.path(caRolloverStateFile)); err == nil {
+		if err := json.Unmarshal(content, &state); err != nil {
+			log.Warnf("pki: can't parse %s: %v", caRolloverStateFile, err)
+		}
+	}
+	if !state.StartedAt.IsZero() {
+		status.StartedAt = &state.StartedAt
+	}
+
+	lines, err := p.readIndex()
+	if err != nil {
+		return
+	}
+	for _, line := range lines {
+		if line.Flag != "V" || strings.HasPrefix(line.Identity, "REVOKED") {
+			continue
+		}
+		reissued := p.issuedBy(line.Identity, next)
+		switch {
+		case line.Identity == serverCommonName:
+			status.ServerReissued = reissued
+		case reissued:
+			status.Reissued = append(status.Reissued, line.Identity)
+		default:
+			status.Pending = append(status.Pending, line.Identity)
+		}
+	}
+	return
+}
+
+// caRolloverStart creates the new CA and publishes both CAs in ca.crt
+func (p *filesystemPKI) caRolloverStart() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.rolloverInProgress() {
+		return errors.New("a CA rollover is already in progress")
+	}
+	current, _, err := p.loadCAFiles(caCertFile, caKeyFile)
+	if err != nil {
+		return err
+	}
+
+	keyPEM, err := genPrivKey(*pkiKeyAlgo)
+	if err != nil {
+		return err
+	}
+	key, err := decodePrivKey(keyPEM.Bytes())
+	if err != nil {
+		return err
+	}
+	certPEM, err := genCA(key)
+	if err != nil {
+		return err
+	}
+	sealedKey, err := p.keys.seal(keyPEM.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if err = fWriteAtomic(p.path(caNextKeyFile), sealedKey, 0600); err != nil {
+		return err
+	}
+	if err = fWriteAtomic(p.path(caNextCertFile), certPEM.Bytes(), 0644); err != nil {
+		_ = os.Remove(p.path(caNextKeyFile))
+		return err
+	}
+	state, _ := json.Marshal(caRolloverState{StartedAt: time.Now().UTC()})
+	if err = fWriteAtomic(p.path(caRolloverStateFile), state, 0644); err != nil {
+		return err
+	}
+
+	// the current CA stays first, easyrsa and loadCA only read the first certificate of ca.crt
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: current.Raw})
+	bundle = append(bundle, certPEM.Bytes()...)
+	if err = fWriteAtomic(p.path(caCertFile), bundle, 0644); err != nil {
+		return err
+	}
+
+	lines, err := p.readIndex()
+	if err != nil {
+		return err
+	}
+	return p.genCRL(lines)
+}
+
+// caRolloverReissueServer rotates the server certificate under the new CA
+func (p *filesystemPKI) caRolloverReissueServer() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.rolloverInProgress() {
+		return errors.New("no CA rollover is in progress")
+	}
+	lines, err := p.readIndex()
+	if err != nil {
+		return err
+	}
+	if indexTxtFind(lines, serverCommonName) < 0 {
+		return fmt.Errorf("server certificate (%s) not found in index.txt", serverCommonName)
+	}
+	return p.rotate(serverCommonName, genServerCert)
+}
+
+// caRolloverRetire makes the new CA the only one, the old certificate and key are kept as ca-<serial>
+func (p *filesystemPKI) caRolloverRetire(force bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status, err := p.readRolloverStatus()
+	if err != nil {
+		return err
+	}
+	if !status.InProgress {
+		return errors.New("no CA rollover is in progress")
+	}
+	if !force && len(status.Pending) > 0 {
+		return fmt.Errorf("%d client certificate(s) are still issued by the old CA", len(status.Pending))
+	}
+	if !force && !status.ServerReissued {
+		return errors.New("the server certificate is still issued by the old CA")
+	}
+
+	current, _, err := p.loadCAFiles(caCertFile, caKeyFile)
+	if err != nil {
+		return err
+	}
+	retired := "ca-" + status.Current.Serial
+	if err = fWriteAtomic(p.path(retired+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: current.Raw}), 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(p.path(caKeyFile), p.path("private", retired+".key")); err != nil {
+		return err
+	}
+	if err = os.Rename(p.path(caNextKeyFile), p.path(caKeyFile)); err != nil {
+		return err
+	}
+	if err = os.Rename(p.path(caNextCertFile), p.path(caCertFile)); err != nil {
+		return err
+	}
+	if err = os.Remove(p.path(caRolloverStateFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(status.Pending) > 0 {
+		log.Warnf("pki: CA retired with certificates of the old CA left: %s", strings.Join(status.Pending, ", "))
+	}
+
+	lines, err := p.readIndex()
+	if err != nil {
+		return err
+	}
+	return p.genCRL(lines)
+}
+
+func (s *filesystemStorage) CARolloverStatus() (caRolloverStatus, error) {
+	return s.pki.caRolloverStatus()
+}
+
+func (s *filesystemStorage) StartCARollover() error {
+	return s.pki.caRolloverStart()
+}
+
+func (s *filesystemStorage) ReissueServerCert() error {
+	return s.pki.caRolloverReissueServer()
+}
+
+func (s *filesystemStorage) RetireCA(force bool) error {
+	return s.pki.caRolloverRetire(force)
+}
+
+// CARolloverStatus reads the progress from the secrets, the new CA is kept in the openvpn-pki-ca-next secret
+func (openVPNPKI *OpenVPNPKI) CARolloverStatus() (status caRolloverStatus, err error) {
+	status.Reissued, status.Pending = []string{}, []string{}
+	if openVPNPKI.CACert == nil {
+		return status, errors.New("CA is not loaded")
+	}
+	status.Current = newCAInfo(openVPNPKI.CACert)
+	if openVPNPKI.NextCACert == nil {
+		return
+	}
+
+	next, err := openVPNPKI.secretGetByName(secretCANext)
+	if err != nil {
+		return
+	}
+	status.InProgress = true
+	nextInfo := newCAInfo(openVPNPKI.NextCACert)
+	status.Next = &nextInfo
+	if startedAt, err := time.Parse(time.RFC3339, next.Annotations["startedAt"]); err == nil {
+		status.StartedAt = &startedAt
+	}
+
+	secrets, err := openVPNPKI.secretsGetByLabels(labelKeyIndexTxt + "=")
+	if err != nil {
+		return
+	}
+	for _, secret := range secrets.Items {
+		if secret.Annotations["revokedAt"] != "" || secret.Labels["revokedForever"] == "true" {
+			continue
+		}
+		cert, err := decodeCert(secret.Data[certFileName])
+		if err != nil || cert.NotAfter.Before(time.Now()) {
+			continue
+		}
+		reissued := cert.CheckSignatureFrom(openVPNPKI.NextCACert) == nil
+		switch name := secret.Labels[labelKeyName]; {
+		case name == serverCommonName:
+			status.ServerReissued = reissued
+		case reissued:
+			status.Reissued = append(status.Reissued, name)
+		default:
+			status.Pending = append(status.Pending, name)
+		}
+	}
+	sort.Strings(status.Reissued)
+	sort.Strings(status.Pending)
+	return status, nil
+}
+
+// StartCARollover creates the new CA in the openvpn-pki-ca-next secret and publishes both CAs in ca.crt
+func (openVPNPKI *OpenVPNPKI) StartCARollover() error {
+	if openVPNPKI.NextCACert != nil {
+		return errors.New("a CA rollover is already in progress")
+	}
+
+	keyPEM, err := genPrivKey(*pkiKeyAlgo)
+	if err != nil {
+		return err
+	}
+	key, err := decodePrivKey(keyPEM.Bytes())
+	if err != nil {
+		return err
+	}
+	certPEM, err := genCA(key)
+	if err != nil {
+		return err
+	}
+	cert, err := decodeCert(certPEM.Bytes())
+	if err != nil {
+		return err
+	}
+	sealedKey, err := openVPNPKI.Keyring.seal(keyPEM.Bytes())
+	if err != nil {
+		return err
+	}
+
+	secretMetaData := metav1.ObjectMeta{
+		Name:        secretCANext,
+		Annotations: map[string]string{"startedAt": time.Now().UTC().Format(time.RFC3339)},
+	}
+	secretData := map[string][]byte{
+		certFileName:    certPEM.Bytes(),
+		privKeyFileName: sealedKey,
+	}
+	if err = openVPNPKI.secretCreate(secretMetaData, secretData, v1.SecretTypeTLS); err != nil {
+		return err
+	}
+	openVPNPKI.NextCAPrivKey, openVPNPKI.NextCACert = key, cert
+
+	if err = openVPNPKI.updateCAOnDisk(); err != nil {
+		return err
+	}
+	return openVPNPKI.GenCRL()
+}
+
+// ReissueServerCert replaces the certificate and key of the server secret with ones of the new CA
+func (openVPNPKI *OpenVPNPKI) ReissueServerCert() error {
+	if openVPNPKI.NextCACert == nil {
+		return errors.New("no CA rollover is in progress")
+	}
+	secret, err := openVPNPKI.secretGetByName(secretServer)
+	if err != nil {
+		return fmt.Errorf("server certificate (%s) not found: %w", secretServer, err)
+	}
+
+	keyPEM, err := genPrivKey(*pkiKeyAlgo)
+	if err != nil {
+		return err
+	}
+	key, err := decodePrivKey(keyPEM.Bytes())
+	if err != nil {
+		return err
+	}
+	certPEM, err := genServerCert(key.Public(), openVPNPKI.NextCAPrivKey, openVPNPKI.NextCACert, serverCommonName)
+	if err != nil {
+		return err
+	}
+	cert, err := decodeCert(certPEM.Bytes())
+	if err != nil {
+		return err
+	}
+
+	secret.Data[certFileName] = certPEM.Bytes()
+	secret.Data[privKeyFileName] = keyPEM.Bytes()
+	if err = openVPNPKI.secretUpdate(secret.ObjectMeta, secret.Data, secret.Type); err != nil {
+		return err
+	}
+	openVPNPKI.ServerPrivKeyPEM, openVPNPKI.ServerPrivKey = keyPEM, key
+	openVPNPKI.ServerCertPEM, openVPNPKI.ServerCert = certPEM, cert
+
+	if err = openVPNPKI.indexTxtUpdate(); err != nil {
+		return err
+	}
+	if err = openVPNPKI.updateIndexTxtOnDisk(); err != nil {
+		return err
+	}
+	return openVPNPKI.updateFilesFromSecrets()
+}
+
+// RetireCA moves the new CA into the openvpn-pki-ca secret, the old one is kept in openvpn-pki-ca-<serial>
+func (openVPNPKI *OpenVPNPKI) RetireCA(force bool) error {
+	status, err := openVPNPKI.CARolloverStatus()
+	if err != nil {
+		return err
+	}
+	if !status.InProgress {
+		return errors.New("no CA rollover is in progress")
+	}
+	if !force && len(status.Pending) > 0 {
+		return fmt.Errorf("%d client certificate(s) are still issued by the old CA", len(status.Pending))
+	}
+	if !force && !status.ServerReissued {
+		return errors.New("the server certificate is still issued by the old CA")
+	}
+
+	ca, err := openVPNPKI.secretGetByName(secretCA)
+	if err != nil {
+		return err
+	}
+	next, err := openVPNPKI.secretGetByName(secretCANext)
+	if err != nil {
+		return err
+	}
+
+	retiredMetaData := metav1.ObjectMeta{
+		Name:   fmt.Sprintf(secretCARetired, strings.ToLower(status.Current.Serial)),
+		Labels: map[string]string{labelKeyType: labelValueRetiredCA},
+	}
+	if err = openVPNPKI.secretCreate(retiredMetaData, ca.Data, ca.Type); err != nil {
+		return err
+	}
+	ca.Data = next.Data
+	if err = openVPNPKI.secretUpdate(ca.ObjectMeta, ca.Data, ca.Type); err != nil {
+		return err
+	}
+	if err = openVPNPKI.KubeClient.CoreV1().Secrets(namespace).Delete(context.TODO(), secretCANext, metav1.DeleteOptions{}); err != nil {
+		return err
+	}
+	if len(status.Pending) > 0 {
+		log.Warnf("CA retired with certificates of the old CA left: %s", strings.Join(status.Pending, ", "))
+	}
+
+	current, err := openVPNPKI.secretGetClientCert(secretCA)
+	if err != nil {
+		return err
+	}
+	openVPNPKI.CAPrivKeyPEM, openVPNPKI.CAPrivKey = current.PrivKeyPEM, current.PrivKey
+	openVPNPKI.CACertPEM, openVPNPKI.CACert = current.CertPEM, current.Cert
+	openVPNPKI.NextCAPrivKey, openVPNPKI.NextCACert = nil, nil
+
+	if err = openVPNPKI.updateCAOnDisk(); err != nil {
+		return err
+	}
+	return openVPNPKI.GenCRL()
+}
+
+// caRollover returns the storage backend if it supports CA rollover
+func (oAdmin *OvpnAdmin) caRollover() (caRollover, error) {
+	rollover, ok := oAdmin.storage.(caRollover)
+	if !ok {
+		return nil, fmt.Errorf("CA rollover is not supported by the %s storage backend", oAdmin.storage.Name())
+	}
+	return rollover, nil
+}
+
+// caReissue rotates up to limit client certificates which are still issued by the old CA
+func (oAdmin *OvpnAdmin) caReissue(limit int) ([]string, error) {
+	rollover, err := oAdmin.caRollover()
+	if err != nil {
+		return nil, err
+	}
+	status, err := rollover.CARolloverStatus()
+	if err != nil {
+		return nil, err
+	}
+	if !status.InProgress {
+		return nil, errors.New("no CA rollover is in progress")
+	}
+
+	reissued := []string{}
+	for _, username := range status.Pending {
+		if limit > 0 && len(reissued) >= limit {
+			break
+		}
+		if err = oAdmin.storage.Rotate(username, oAdmin.certExpiry(username)); err != nil {
+			err = fmt.Errorf("can't reissue the certificate of %s: %w", username, err)
+			break
+		}
+		reissued = append(reissued, username)
+	}
+	if len(reissued) > 0 {
+		crlFix()
+		oAdmin.refreshClients()
+	}
+	return reissued, err
+}
+
+// certExpiry returns when the current certificate of the user expires, so a reissued certificate keeps the lifetime
+// chosen for the user. It is zero, the default lifetime, if the certificate can't be read or has expired.
+func (oAdmin *OvpnAdmin) certExpiry(username string) time.Time {
+	certPEM, _, err := oAdmin.storage.ClientCert(username)
+	if err != nil {
+		return time.Time{}
+	}
+	cert, err := decodeCert([]byte(certPEM))
+	if err != nil || cert.NotAfter.Before(time.Now()) {
+		return time.Time{}
+	}
+	return cert.NotAfter
+}
+
+// caRolloverStep runs a rollover step and returns a message for the audit log and the UI
+func (oAdmin *OvpnAdmin) caRolloverStep(step string, limit int, force bool) (string, []string, error) {
+	rollover, err := oAdmin.caRollover()
+	if err != nil {
+		return err.Error(), nil, err
+	}
+
+	var reissued []string
+	switch step {
+	case caRolloverStepStart:
+		err = rollover.StartCARollover()
+	case caRolloverStepReissue:
+		reissued, err = oAdmin.caReissue(limit)
+	case caRolloverStepServer:
+		err = rollover.ReissueServerCert()
+	case caRolloverStepRetire:
+		err = rollover.RetireCA(force)
+	default:
+		err = fmt.Errorf("unknown CA rollover step %q", step)
+	}
+	if step != caRolloverStepReissue && err == nil {
+		crlFix()
+		oAdmin.refreshClients()
+	}
+
+	msg := map[string]string{
+		caRolloverStepStart:   "New CA created, ca.crt now holds the old and the new CA",
+		caRolloverStepServer:  "Server certificate reissued under the new CA, restart OpenVPN to use it",
+		caRolloverStepRetire:  "Old CA retired",
+		caRolloverStepReissue: fmt.Sprintf("Reissued %d certificate(s) under the new CA", len(reissued)),
+	}[step]
+	if len(reissued) > 0 {
+		msg += ": " + strings.Join(reissued, ", ")
+	}
+	if err != nil {
+		log.Errorf("CA rollover %s: %v", step, err)
+		msg = err.Error()
+	}
+	return msg, reissued, err
+}
+
+func (oAdmin *OvpnAdmin) caPageHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+
+	data := oAdmin.pageData(r, "ca")
+	oAdmin.addCARolloverData(data)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := oAdmin.htmlTemplates.ExecuteTemplate(w, "base", data); err != nil {
+		log.Errorf("Error rendering CA template: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (oAdmin *OvpnAdmin) addCARolloverData(data map[string]interface{}) {
+	data["Supported"] = false
+	rollover, err := oAdmin.caRollover()
+	if err == nil {
+		data["Supported"] = true
+		data["Rollover"], err = rollover.CARolloverStatus()
+	}
+	if err != nil {
+		data["Error"] = err.Error()
+	}
+	data["DefaultBatch"] = caRolloverDefaultBatch
+}
+
+// caStatusHandler renders the rollover status (HTMX partial) and runs the step posted to /ca/rollover/{step}
+func (oAdmin *OvpnAdmin) caStatusHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, *listenBaseUrl), "/")
+	step := strings.TrimPrefix(path, "ca/rollover/")
+	if r.Method == http.MethodPost {
+		if status, msg := oAdmin.checkAccess(r, permCA); status != 0 {
+			http.Error(w, msg, status)
+			return
+		}
+		_ = r.ParseForm()
+		limit, _ := strconv.Atoi(r.FormValue("limit"))
+		msg, _, err := oAdmin.caRolloverStep(step, limit, r.FormValue("force") == "true")
+		oAdmin.audit(r, auditEntry{Action: auditActionCA, Target: step, Result: auditResult(err == nil), Message: msg})
+		if err != nil {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		trigger, _ := json.Marshal(map[string]interface{}{"showToast": map[string]string{"message": msg, "type": "success"}})
+		w.Header().Set("HX-Trigger", string(trigger))
+	}
+
+	data := oAdmin.pageData(r, "ca")
+	oAdmin.addCARolloverData(data)
+	var buf bytes.Buffer
+	if err := oAdmin.htmlTemplates.ExecuteTemplate(&buf, "ca_status", data); err != nil {
+		log.Errorf("Error rendering ca_status template: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
+
+type apiCARolloverRequest struct {
+	// Limit is the number of certificates a reissue step rotates, 0 for all
+	Limit int  `json:"limit"`
+	Force bool `json:"force"`
+}
+
+type apiCARolloverResponse struct {
+	Message  string           `json:"message"`
+	Reissued []string         `json:"reissued,omitempty"`
+	Status   caRolloverStatus `json:"status"`
+}
+
+// apiCAHandler serves /api/v1/ca and /api/v1/ca/rollover/{step}
+func (oAdmin *OvpnAdmin) apiCAHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	rollover, err := oAdmin.caRollover()
+	if err != nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_supported", err.Error())
+		return
+	}
+
+	if len(parts) == 0 || parts[0] == "" {
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+			return
+		}
+		if !oAdmin.apiAuthorize(w, r, permCA) {
+			return
+		}
+		status, err := rollover.CARolloverStatus()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "ca_read_failed", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+		return
+	}
+
+	if len(parts) != 2 || parts[0] != "rollover" {
+		writeAPIError(w, http.StatusNotFound, "not_found", fmt.Sprintf("Unknown API endpoint %q", r.URL.Path))
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	if !oAdmin.apiAuthorize(w, r, permCA) {
+		return
+	}
+
+	var req apiCARolloverRequest
+	if r.ContentLength > 0 {
+		if err := decodeJSONBody(r, &req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+	}
+
+	step := parts[1]
+	switch step {
+	case caRolloverStepStart, caRolloverStepReissue, caRolloverStepServer, caRolloverStepRetire:
+	default:
+		writeAPIError(w, http.StatusNotFound, "not_found", fmt.Sprintf("Unknown CA rollover step %q", step))
+		return
+	}
+
+	msg, reissued, err := oAdmin.caRolloverStep(step, req.Limit, req.Force)
+	oAdmin.audit(r, auditEntry{Action: auditActionCA, Target: step, Result: auditResult(err == nil), Message: msg})
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, "ca_rollover_failed", msg)
+		return
+	}
+	status, err := rollover.CARolloverStatus()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "ca_read_failed", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, apiCARolloverResponse{Message: msg, Reissued: reissued, Status: status})
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRolloverPKI creates a pki with a server certificate and the users
+func newTestRolloverPKI(t *testing.T, users ...string) *filesystemPKI {
+	t.Helper()
+	p := newTestPKI(t)
+	line, err := p.issue(serverCommonName, genServerCert, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.writeIndex([]indexTxtLine{line}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range users {
+		if err := p.easyrsaBuildClient(name, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+func readTestPEMs(t *testing.T, path, blockType string) [][]byte {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocks [][]byte
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return blocks
+		}
+		if block.Type == blockType {
+			blocks = append(blocks, block.Bytes)
+		}
+	}
+}
+
+func TestFilesystemPKI_CARollover(t *testing.T) {
+	p := newTestRolloverPKI(t, "alice", "bob")
+	oldCA, _, _ := p.loadCA()
+
+	// the new CA migrates the pki to ECDSA
+	setTestKeyAlgo(t, keyAlgoECDSAP256)
+	if err := p.caRolloverStart(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.caRolloverStart(); err == nil {
+		t.Error("Expected an error starting a second rollover")
+	}
+
+	status, err := p.caRolloverStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.InProgress || status.Next == nil || status.Next.KeyAlgorithm != "ECDSA P-256" || status.Current.KeyAlgorithm != "RSA 2048" {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+	if strings.Join(status.Pending, ",") != "alice,bob" || len(status.Reissued) != 0 || status.ServerReissued {
+		t.Errorf("Expected every certificate to be pending, got %+v", status)
+	}
+	if bundle := readTestPEMs(t, p.path(caCertFile), "CERTIFICATE"); len(bundle) != 2 || !oldCA.Equal(mustParseCert(t, bundle[0])) {
+		t.Errorf("Expected ca.crt to hold the old CA followed by the new one, got %d certificates", len(bundle))
+	}
+	newCA, _, _ := p.loadCA()
+	if newCA.Equal(oldCA) {
+		t.Fatal("Expected new certificates to be signed by the new CA")
+	}
+	crls := readTestPEMs(t, p.path("crl.pem"), "X509 CRL")
+	if len(crls) != 2 {
+		t.Fatalf("Expected a CRL of each CA, got %d", len(crls))
+	}
+	for i, ca := range []*x509.Certificate{oldCA, newCA} {
+		crl, err := x509.ParseRevocationList(crls[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := crl.CheckSignatureFrom(ca); err != nil {
+			t.Errorf("CRL %d is not signed by its CA: %v", i, err)
+		}
+	}
+
+	// new users are issued by the new CA right away
+	if err := p.easyrsaBuildClient("carol", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.easyrsaRotate("alice", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	status, _ = p.caRolloverStatus()
+	if strings.Join(status.Reissued, ",") != "alice,carol" || strings.Join(status.Pending, ",") != "bob" {
+		t.Errorf("Expected alice and carol to be reissued, got %+v", status)
+	}
+
+	if err := p.caRolloverReissueServer(); err != nil {
+		t.Fatal(err)
+	}
+	server, err := decodeCert([]byte(fRead(p.path("issued", serverCommonName+".crt"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(server.ExtKeyUsage) != 1 || server.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth || server.CheckSignatureFrom(newCA) != nil {
+		t.Errorf("Expected a server certificate of the new CA, got %+v", server.ExtKeyUsage)
+	}
+
+	if err := p.caRolloverRetire(false); err == nil {
+		t.Error("Expected an error retiring the old CA while bob is pending")
+	}
+	if err := p.easyrsaRotate("bob", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ = p.caRolloverStatus(); !status.ReadyToRetire() {
+		t.Errorf("Expected the rollover to be ready to retire, got %+v", status)
+	}
+	if err := p.caRolloverRetire(false); err != nil {
+		t.Fatal(err)
+	}
+
+	status, _ = p.caRolloverStatus()
+	if status.InProgress || status.Current.Serial != indexTxtSerial(newCA.SerialNumber) {
+		t.Errorf("Expected the new CA to be the only one, got %+v", status)
+	}
+	if bundle := readTestPEMs(t, p.path(caCertFile), "CERTIFICATE"); len(bundle) != 1 {
+		t.Errorf("Expected ca.crt to hold only the new CA, got %d certificates", len(bundle))
+	}
+	retired := "ca-" + indexTxtSerial(oldCA.SerialNumber)
+	for _, name := range []string{retired + ".crt", "private/" + retired + ".key"} {
+		if _, err := os.Stat(p.path(name)); err != nil {
+			t.Errorf("Expected the old CA to be kept as %s: %v", name, err)
+		}
+	}
+	for _, name := range []string{caNextCertFile, caNextKeyFile, caRolloverStateFile} {
+		if _, err := os.Stat(p.path(name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed", name)
+		}
+	}
+	if crls := readTestPEMs(t, p.path("crl.pem"), "X509 CRL"); len(crls) != 1 {
+		t.Errorf("Expected a single CRL after the rollover, got %d", len(crls))
+	}
+	readTestCRL(t, p)
+}
+
+func TestFilesystemPKI_CARolloverForceRetire(t *testing.T) {
+	p := newTestRolloverPKI(t, "alice")
+	if err := p.caRolloverRetire(true); err == nil {
+		t.Error("Expected an error retiring without a rollover")
+	}
+	if err := p.caRolloverStart(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.caRolloverRetire(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.easyrsaBuildClient("bob", time.Time{}); err != nil {
+		t.Errorf("Expected the new CA to issue certificates: %v", err)
+	}
+}
+
+func mustParseCert(t *testing.T, der []byte) *x509.Certificate {
+	t.Helper()
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestAPICARollover(t *testing.T) {
+	p := newTestRolloverPKI(t, "alice", "bob")
+	oldDir := *easyrsaDirPath
+	*easyrsaDirPath = filepath.Dir(p.dir)
+	t.Cleanup(func() { *easyrsaDirPath = oldDir })
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.storage = &filesystemStorage{pki: p, ccdDir: t.TempDir()}
+
+	post := func(step, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodPost, "/api/v1/ca/rollover/"+step, strings.NewReader(body)))
+		return w
+	}
+
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/ca", nil))
+	var status caRolloverStatus
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &status) != nil || status.InProgress {
+		t.Fatalf("Expected the status of an idle CA, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// alice has a shorter lifetime, which the reissued certificate keeps
+	notAfter := time.Now().Add(5 * 24 * time.Hour).Truncate(time.Second)
+	if err := p.easyrsaRotate("alice", notAfter); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := post(caRolloverStepStart, ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	w = post(caRolloverStepReissue, `{"limit": 1}`)
+	var resp apiCARolloverResponse
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &resp) != nil {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if strings.Join(resp.Reissued, ",") != "alice" || strings.Join(resp.Status.Pending, ",") != "bob" {
+		t.Errorf("Expected a batch of one certificate, got %+v", resp)
+	}
+	if got := oAdmin.certExpiry("alice"); !got.Equal(notAfter) {
+		t.Errorf("Expected the reissued certificate to expire at %v, got %v", notAfter, got)
+	}
+	if w := post(caRolloverStepRetire, ""); w.Code != http.StatusConflict || decodeAPIError(t, w).Code != "ca_rollover_failed" {
+		t.Errorf("Expected 409 retiring with pending certificates, got %d", w.Code)
+	}
+	if w := post("unknown", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown step, got %d", w.Code)
+	}
+}
+
+func TestKubernetesStorage_CARollover(t *testing.T) {
+	k := newTestKubernetesStorage(t, testKeyring(t, "1"))
+	for _, name := range []string{"alice", "bob"} {
+		if err := k.BuildClient(name, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldCA := k.CACert
+	caPath := filepath.Join(*easyrsaDirPath, "pki", caCertFile)
+	crlPath := filepath.Join(*easyrsaDirPath, "pki", "crl.pem")
+
+	if err := k.StartCARollover(); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.StartCARollover(); err == nil {
+		t.Error("Expected an error starting a second rollover")
+	}
+	status, err := k.CARolloverStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.InProgress || status.StartedAt == nil || strings.Join(status.Pending, ",") != "alice,bob" || status.ServerReissued {
+		t.Fatalf("Expected every certificate to be pending, got %+v", status)
+	}
+	if bundle := readTestPEMs(t, caPath, "CERTIFICATE"); len(bundle) != 2 || !oldCA.Equal(mustParseCert(t, bundle[0])) {
+		t.Errorf("Expected ca.crt to hold the old CA followed by the new one, got %d certificates", len(bundle))
+	}
+	if crls := readTestPEMs(t, crlPath, "X509 CRL"); len(crls) != 2 {
+		t.Errorf("Expected a CRL of each CA, got %d", len(crls))
+	}
+
+	// a restarted ovpn-admin continues the rollover
+	restarted := &OpenVPNPKI{KubeClient: k.KubeClient, Keyring: k.Keyring}
+	if err := restarted.initPKI(); err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.NextCACert.Equal(k.NextCACert) {
+		t.Fatal("Expected the new CA to be loaded from its secret")
+	}
+	k = restarted
+	newCA := k.NextCACert
+
+	if err := k.Rotate("alice", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.BuildClient("carol", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.ReissueServerCert(); err != nil {
+		t.Fatal(err)
+	}
+	status, _ = k.CARolloverStatus()
+	if strings.Join(status.Reissued, ",") != "alice,carol" || strings.Join(status.Pending, ",") != "bob" || !status.ServerReissued {
+		t.Errorf("Expected alice, carol and the server to be reissued, got %+v", status)
+	}
+	server, err := decodeCert([]byte(fRead(filepath.Join(*easyrsaDirPath, "pki", "issued", serverCommonName+".crt"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.CheckSignatureFrom(newCA) != nil {
+		t.Error("Expected server.crt to be issued by the new CA")
+	}
+
+	if err := k.RetireCA(false); err == nil {
+		t.Error("Expected an error retiring the old CA while bob is pending")
+	}
+	if err := k.Rotate("bob", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.RetireCA(false); err != nil {
+		t.Fatal(err)
+	}
+
+	status, _ = k.CARolloverStatus()
+	if status.InProgress || !k.CACert.Equal(newCA) {
+		t.Errorf("Expected the new CA to be the only one, got %+v", status)
+	}
+	if exists, _ := k.secretCheckExists(secretCANext); exists {
+		t.Errorf("Expected %s to be removed", secretCANext)
+	}
+	retired := fmt.Sprintf(secretCARetired, strings.ToLower(indexTxtSerial(oldCA.SerialNumber)))
+	if exists, _ := k.secretCheckExists(retired); !exists {
+		t.Errorf("Expected the old CA to be kept in %s", retired)
+	}
+	if bundle := readTestPEMs(t, caPath, "CERTIFICATE"); len(bundle) != 1 || !newCA.Equal(mustParseCert(t, bundle[0])) {
+		t.Errorf("Expected ca.crt to hold only the new CA, got %d certificates", len(bundle))
+	}
+	if crls := readTestPEMs(t, crlPath, "X509 CRL"); len(crls) != 1 {
+		t.Errorf("Expected a single CRL after the rollover, got %d", len(crls))
+	}
+}
+
+func TestCAStatusHandler(t *testing.T) {
+	p := newTestRolloverPKI(t, "alice")
+	oldDir := *easyrsaDirPath
+	*easyrsaDirPath = filepath.Dir(p.dir)
+	t.Cleanup(func() { *easyrsaDirPath = oldDir })
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.storage = &filesystemStorage{pki: p, ccdDir: t.TempDir()}
+
+	w := httptest.NewRecorder()
+	oAdmin.caPageHandler(w, httptest.NewRequest(http.MethodGet, "/ca", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Start CA rollover") {
+		t.Fatalf("Expected the CA page, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	oAdmin.caStatusHandler(w, httptest.NewRequest(http.MethodPost, "/ca/rollover/start", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Header().Get("HX-Trigger"), "New CA created") {
+		t.Errorf("Expected a toast, got %q", w.Header().Get("HX-Trigger"))
+	}
+	body := w.Body.String()
+	for _, want := range []string{"New CA", "0 of 1 client certificate(s) reissued", "alice", "/ca/rollover/server"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in the status partial", want)
+		}
+	}
+
+	oAdmin.role = "slave"
+	w = httptest.NewRecorder()
+	oAdmin.caStatusHandler(w, httptest.NewRequest(http.MethodPost, "/ca/rollover/retire", nil))
+	if w.Code != http.StatusLocked {
+		t.Errorf("Expected 423 on a slave, got %d", w.Code)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const (
+	ccdDirectiveIPv6Push  = "ifconfig-ipv6-push"
+	ccdDirectiveIroute    = "iroute"
+	ccdDirectivePush      = "push"
+	ccdDirectivePushReset = "push-reset"
+	ccdDirectiveDisable   = "disable"
+	ccdDirectiveConfig    = "config"
+	ccdRedirectGateway    = "redirect-gateway def1"
+)
+
+// parseCcdContent sets the CCD fields from the lines of the user. Lines without a field are kept in ExtraLines as they
+// are, the lines after the groups marker only set GroupAddress.
+func parseCcdContent(ccd *Ccd, content string) {
+	groupLines := false
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if strings.HasPrefix(line, ccdGroupsMarker) {
+			groupLines = true
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if groupLines {
+			if fields[0] == prefixStaticRoute && len(fields) > 1 {
+				ccd.GroupAddress = fields[1]
+			}
+			continue
+		}
+		if !parseCcdDirective(ccd, line) {
+			ccd.ExtraLines = append(ccd.ExtraLines, line)
+		}
+	}
+}
+
+// parseCcdDirective sets the field of a directive the CCD template renders and reports whether it did. Directives
+// the template would render differently, e.g. with a comment, are left to ExtraLines.
+func parseCcdDirective(ccd *Ccd, line string) bool {
+	if strings.Fields(line)[0] == ccdDirectivePush {
+		return parsePushDirective(ccd, line)
+	}
+
+	args, comment, commented := strings.Cut(line, "#")
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return false
+	}
+	if fields[0] == ccdDirectiveIroute && len(fields) == 3 {
+		ccd.IRoutes = append(ccd.IRoutes, ccdRoute{Address: fields[1], Mask: fields[2], Description: strings.TrimSpace(comment)})
+		return true
+	}
+	if commented {
+		return false
+	}
+
+	switch {
+	case fields[0] == prefixStaticRoute && len(fields) <= 3 && len(fields) > 1 && ccd.ClientAddress == "dynamic":
+		ccd.ClientAddress = fields[1]
+	case fields[0] == ccdDirectiveIPv6Push && len(fields) <= 3 && len(fields) > 1 && ccd.ClientAddressIPv6 == "":
+		ccd.ClientAddressIPv6 = strings.Join(fields[1:], " ")
+	case fields[0] == ccdDirectivePushReset && len(fields) == 1:
+		ccd.PushReset = true
+	case fields[0] == ccdDirectiveDisable && len(fields) == 1:
+		ccd.Disable = true
+	case fields[0] == ccdDirectiveConfig && len(fields) == 2:
+		ccd.ConfigIncludes = append(ccd.ConfigIncludes, fields[1])
+	default:
+		return false
+	}
+	return true
+}
+
+// parsePushDirective sets the field of a push "<option>" line: routes, DNS servers and domains and redirect-gateway def1
+func parsePushDirective(ccd *Ccd, line string) bool {
+	option, comment, ok := parsePushLine(line)
+	if !ok {
+		return false
+	}
+	fields := strings.Fields(option)
+	switch {
+	case len(fields) == 3 && fields[0] == "route":
+		ccd.CustomRoutes = append(ccd.CustomRoutes, ccdRoute{Address: fields[1], Mask: fields[2], Description: comment})
+		return true
+	case comment != "":
+		return false
+	case len(fields) == 3 && fields[0] == "dhcp-option" && fields[1] == "DNS":
+		ccd.DNSServers = append(ccd.DNSServers, fields[2])
+	case len(fields) == 3 && fields[0] == "dhcp-option" && fields[1] == "DOMAIN":
+		ccd.DNSDomains = append(ccd.DNSDomains, fields[2])
+	case strings.Join(fields, " ") == ccdRedirectGateway:
+		ccd.RedirectGateway = true
+	default:
+		return false
+	}
+	return true
+}
+
+// parsePushLine returns the quoted option and the comment after it of a push line
+func parsePushLine(line string) (option, comment string, ok bool) {
+	rest, found := strings.CutPrefix(strings.TrimSpace(line), ccdDirectivePush)
+	if !found {
+		return "", "", false
+	}
+	rest, found = strings.CutPrefix(strings.TrimSpace(rest), `"`)
+	if !found {
+		return "", "", false
+	}
+	option, rest, found = strings.Cut(rest, `"`)
+	if !found {
+		return "", "", false
+	}
+	rest = strings.TrimSpace(rest)
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", "", false
+	}
+	return option, strings.TrimSpace(strings.TrimPrefix(rest, "#")), true
+}
+
+// normalizeCcd trims the lists of the CCD and drops their empty entries
+func normalizeCcd(ccd *Ccd) {
+	ccd.ClientAddressIPv6 = strings.Join(strings.Fields(ccd.ClientAddressIPv6), " ")
+	ccd.DNSServers = trimList(ccd.DNSServers)
+	ccd.DNSDomains = trimList(ccd.DNSDomains)
+	ccd.ConfigIncludes = trimList(ccd.ConfigIncludes)
+	var extra []string
+	for _, line := range ccd.ExtraLines {
+		if line = strings.TrimRight(line, " \t\r"); strings.TrimSpace(line) != "" {
+			extra = append(extra, line)
+		}
+	}
+	ccd.ExtraLines = extra
+}
+
+func trimList(values []string) []string {
+	var trimmed []string
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			trimmed = append(trimmed, value)
+		}
+	}
+	return trimmed
+}
+
+// validateCcdDirectives checks the CCD directives besides the static address and the routes
+func validateCcdDirectives(ccd Ccd) error {
+	if ccd.ClientAddressIPv6 != "" {
+		fields := strings.Fields(ccd.ClientAddressIPv6)
+		if prefix, err := netip.ParsePrefix(fields[0]); err != nil || !prefix.Addr().Is6() || len(fields) > 2 {
+			return fmt.Errorf("ClientAddressIPv6 \"%s\" must be ADDRESS/PREFIX [REMOTE] with IPv6 addresses", ccd.ClientAddressIPv6)
+		}
+		if len(fields) == 2 {
+			if remote, err := netip.ParseAddr(fields[1]); err != nil || !remote.Is6() {
+				return fmt.Errorf("ClientAddressIPv6 \"%s\" must be ADDRESS/PREFIX [REMOTE] with IPv6 addresses", ccd.ClientAddressIPv6)
+			}
+		}
+	}
+
+	for _, route := range ccd.IRoutes {
+		if addr, err := netip.ParseAddr(route.Address); err != nil || !addr.Is4() {
+			return fmt.Errorf("IRoute.Address \"%s\" must be a valid IPv4 address", route.Address)
+		}
+		if mask, err := netip.ParseAddr(route.Mask); err != nil || !mask.Is4() {
+			return fmt.Errorf("IRoute.Mask \"%s\" must be a valid IPv4 address", route.Mask)
+		}
+		if strings.ContainsAny(route.Description, "\r\n") {
+			return fmt.Errorf("IRoute.Description %q must be a single line", route.Description)
+		}
+	}
+
+	for _, server := range ccd.DNSServers {
+		if _, err := netip.ParseAddr(server); err != nil {
+			return fmt.Errorf("DNS server \"%s\" must be a valid IP address", server)
+		}
+	}
+	for _, domain := range ccd.DNSDomains {
+		if strings.ContainsAny(domain, " \t\r\n\"'") {
+			return fmt.Errorf("DNS domain %q can't contain whitespace or quotes", domain)
+		}
+	}
+	for _, path := range ccd.ConfigIncludes {
+		if strings.ContainsAny(path, " \t\r\n\"'#;") {
+			return fmt.Errorf("Config include %q can't contain whitespace, quotes or comments", path)
+		}
+	}
+	for _, line := range ccd.ExtraLines {
+		if strings.ContainsAny(line, "\r\n") {
+			return fmt.Errorf("Extra line %q must be a single line", line)
+		}
+		if strings.HasPrefix(line, ccdGroupsMarker) {
+			return fmt.Errorf("Extra line %q can't start with the %q marker", line, ccdGroupsMarker)
+		}
+	}
+	return nil
+}
+
+// parseRouteLines reads routes given one per line as ADDRESS MASK [description]
+func parseRouteLines(text string) ([]ccdRoute, error) {
+	routes := []ccdRoute{}
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("Route %q must be ADDRESS MASK [description]", strings.TrimSpace(line))
+		}
+		routes = append(routes, ccdRoute{Address: fields[0], Mask: fields[1], Description: strings.Join(fields[2:], " ")})
+	}
+	return routes, nil
+}
+
+// splitFormList splits a form value separated by commas, spaces or newlines
+func splitFormList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' || r == ' ' })
+}
+
+// parseCcdForm reads the directives of the CCD modal form besides the static address and the routes
+func parseCcdForm(r *http.Request, ccd *Ccd) error {
+	iroutes, err := parseRouteLines(r.FormValue("iroutes"))
+	if err != nil {
+		return err
+	}
+	ccd.IRoutes = iroutes
+	ccd.ClientAddressIPv6 = r.FormValue("clientAddressIPv6")
+	ccd.DNSServers = splitFormList(r.FormValue("dnsServers"))
+	ccd.DNSDomains = splitFormList(r.FormValue("dnsDomains"))
+	ccd.RedirectGateway = r.FormValue("redirectGateway") != ""
+	ccd.PushReset = r.FormValue("pushReset") != ""
+	ccd.Disable = r.FormValue("disable") != ""
+	ccd.ConfigIncludes = strings.Split(r.FormValue("configIncludes"), "\n")
+	ccd.ExtraLines = strings.Split(r.FormValue("extraLines"), "\n")
+	return nil
+}
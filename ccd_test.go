@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testHandWrittenCcd = `disable
+ifconfig-push 172.16.100.10 255.255.255.0
+ifconfig-ipv6-push fd00:8::10/64 fd00:8::1
+push "route 192.168.1.0 255.255.255.0" # home lan
+iroute 10.20.0.0 255.255.0.0 # branch
+push "dhcp-option DNS 10.0.0.53"
+push "dhcp-option DOMAIN corp.example.com"
+push "redirect-gateway def1"
+push "redirect-gateway def1 bypass-dhcp"
+push-reset
+config /etc/openvpn/common
+# managed by hand
+push "route-gateway 172.16.100.254"
+disable # not rendered with the comment
+# groups: sre
+ifconfig-push 172.16.100.65 255.255.255.0
+push "dhcp-option DNS 10.9.9.9"
+`
+
+func TestParseCcdContent(t *testing.T) {
+	ccd := Ccd{ClientAddress: "dynamic"}
+	parseCcdContent(&ccd, testHandWrittenCcd)
+
+	want := Ccd{
+		ClientAddress:     "172.16.100.10",
+		CustomRoutes:      []ccdRoute{{Address: "192.168.1.0", Mask: "255.255.255.0", Description: "home lan"}},
+		GroupAddress:      "172.16.100.65",
+		ClientAddressIPv6: "fd00:8::10/64 fd00:8::1",
+		IRoutes:           []ccdRoute{{Address: "10.20.0.0", Mask: "255.255.0.0", Description: "branch"}},
+		DNSServers:        []string{"10.0.0.53"},
+		DNSDomains:        []string{"corp.example.com"},
+		RedirectGateway:   true,
+		PushReset:         true,
+		Disable:           true,
+		ConfigIncludes:    []string{"/etc/openvpn/common"},
+		ExtraLines: []string{
+			`push "redirect-gateway def1 bypass-dhcp"`,
+			"# managed by hand",
+			`push "route-gateway 172.16.100.254"`,
+			"disable # not rendered with the comment",
+		},
+	}
+	if !reflect.DeepEqual(ccd, want) {
+		t.Errorf("Expected\n%+v\ngot\n%+v", want, ccd)
+	}
+}
+
+func TestModifyCcdKeepsDirectives(t *testing.T) {
+	oAdmin := newTestGroupsAdmin(t)
+	if err := oAdmin.storage.WriteCcd("alice", []byte(strings.Split(testHandWrittenCcd, ccdGroupsMarker)[0])); err != nil {
+		t.Fatal(err)
+	}
+	oAdmin.loadAddresses(oAdmin.addressIndex())
+
+	before := oAdmin.parseCcd("alice")
+	if ok, msg := oAdmin.modifyCcd(before); !ok {
+		t.Fatal(msg)
+	}
+	if after := oAdmin.parseCcd("alice"); !reflect.DeepEqual(before, after) {
+		t.Errorf("Expected the CCD to survive a save, got\n%+v\nwant\n%+v\n%s", after, before, oAdmin.readCcd("alice"))
+	}
+
+	// group changes render the CCD again from what was parsed
+	testSaveGroup(t, oAdmin, userGroup{Name: "sre", Members: []string{"alice"}, PushOptions: []string{"dhcp-option DNS 10.9.9.9"}})
+	ccd := oAdmin.readCcd("alice")
+	for _, line := range []string{"iroute 10.20.0.0 255.255.0.0 # branch", "# managed by hand", `push "route-gateway 172.16.100.254"`, "push-reset", "# groups: sre"} {
+		if !strings.Contains(ccd, line) {
+			t.Errorf("Expected %q in the CCD, got\n%s", line, ccd)
+		}
+	}
+	if strings.Index(ccd, "push-reset") > strings.Index(ccd, "push \"route ") {
+		t.Errorf("Expected push-reset before the pushed options, got\n%s", ccd)
+	}
+}
+
+func TestValidateCcdDirectives(t *testing.T) {
+	tests := []struct {
+		name string
+		ccd  Ccd
+		err  string
+	}{
+		{"ipv4 as ipv6", Ccd{ClientAddressIPv6: "172.16.100.10/24"}, "IPv6"},
+		{"ipv6 without prefix", Ccd{ClientAddressIPv6: "fd00::10"}, "ADDRESS/PREFIX"},
+		{"bad ipv6 remote", Ccd{ClientAddressIPv6: "fd00::10/64 10.0.0.1"}, "IPv6"},
+		{"bad iroute", Ccd{IRoutes: []ccdRoute{{Address: "10.20.0", Mask: "255.255.0.0"}}}, "IRoute.Address"},
+		{"bad iroute mask", Ccd{IRoutes: []ccdRoute{{Address: "10.20.0.0", Mask: "16"}}}, "IRoute.Mask"},
+		{"bad dns server", Ccd{DNSServers: []string{"dns.example.com"}}, "DNS server"},
+		{"quoted domain", Ccd{DNSDomains: []string{`corp"`}}, "DNS domain"},
+		{"config with a space", Ccd{ConfigIncludes: []string{"/etc/openvpn/my file"}}, "Config include"},
+		{"groups marker", Ccd{ExtraLines: []string{"# groups: sre"}}, "marker"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateCcdDirectives(tt.ccd); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	valid := Ccd{ClientAddressIPv6: "fd00:8::10/64", IRoutes: []ccdRoute{{Address: "10.20.0.0", Mask: "255.255.0.0"}}, DNSServers: []string{"10.0.0.53", "fd00::53"}, DNSDomains: []string{"corp.example.com"}}
+	if err := validateCcdDirectives(valid); err != nil {
+		t.Errorf("Expected a valid CCD, got %v", err)
+	}
+}
+
+func TestValidateCcd_RouteDescription(t *testing.T) {
+	oAdmin := newTestGroupsAdmin(t)
+	route := ccdRoute{Address: "192.168.1.0", Mask: "255.255.255.0", Description: "lab\r\npush \"redirect-gateway def1\""}
+	if ok, msg := oAdmin.validateCcd(Ccd{User: "alice", ClientAddress: "dynamic", CustomRoutes: []ccdRoute{route}}); ok || !strings.Contains(msg, "single line") {
+		t.Errorf("Expected a multi-line route description to be rejected, got %q", msg)
+	}
+}
+
+func TestApplyCcdForm(t *testing.T) {
+	oAdmin := newTestGroupsAdmin(t)
+	form := url.Values{
+		"clientAddress":     {"dynamic"},
+		"routes[0].address": {"192.168.1.0"},
+		"routes[0].mask":    {"255.255.255.0"},
+		"iroutes":           {"10.20.0.0 255.255.0.0 branch office\n"},
+		"dnsServers":        {"10.0.0.53, 10.0.0.54"},
+		"dnsDomains":        {"corp.example.com"},
+		"redirectGateway":   {"1"},
+		"extraLines":        {"# managed by hand\r\n\r\n"},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/users/alice/ccd", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	oAdmin.userApplyCcdHandler(w, r)
+
+	got := oAdmin.parseCcd("alice")
+	if len(got.IRoutes) != 1 || got.IRoutes[0].Description != "branch office" || len(got.DNSServers) != 2 || !got.RedirectGateway || got.PushReset || len(got.ExtraLines) != 1 {
+		t.Errorf("Expected the directives of the form, got %+v (%s)", got, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	oAdmin.userShowCcdHandler(w, httptest.NewRequest(http.MethodGet, "/modal/ccd/alice", nil))
+	if !strings.Contains(w.Body.String(), "10.0.0.53, 10.0.0.54") || !strings.Contains(w.Body.String(), "10.20.0.0 255.255.0.0 branch office") {
+		t.Errorf("Expected the directives in the CCD modal, got\n%s", w.Body.String())
+	}
+}
+
+func TestAPICcdKeepsDirectives(t *testing.T) {
+	oAdmin := newTestGroupsAdmin(t)
+	if err := oAdmin.storage.WriteCcd("alice", []byte("push \"dhcp-option DNS 10.0.0.53\"\n# managed by hand\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodPut, "/api/v1/users/alice/ccd", strings.NewReader(`{"ClientAddress": "172.16.100.20", "Disable": true}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	got := oAdmin.parseCcd("alice")
+	if got.ClientAddress != "172.16.100.20" || !got.Disable || len(got.DNSServers) != 1 || len(got.ExtraLines) != 1 {
+		t.Errorf("Expected the directives left out of the request to be kept, got %+v", got)
+	}
+}
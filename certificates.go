@@ -2,6 +2,10 @@ package main
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -14,9 +18,24 @@ import (
 	"time"
 )
 
+const (
+	keyAlgoRSA2048   = "rsa2048"
+	keyAlgoRSA3072   = "rsa3072"
+	keyAlgoRSA4096   = "rsa4096"
+	keyAlgoECDSAP256 = "ecdsa-p256"
+	keyAlgoECDSAP384 = "ecdsa-p384"
+	keyAlgoEd25519   = "ed25519"
+)
+
+var keyAlgorithms = []string{keyAlgoRSA2048, keyAlgoRSA3072, keyAlgoRSA4096, keyAlgoECDSAP256, keyAlgoECDSAP384, keyAlgoEd25519}
+
 // decode certificate from PEM to x509
 func decodeCert(certPEMBytes []byte) (cert *x509.Certificate, err error) {
 	certPem, _ := pem.Decode(certPEMBytes)
+	if certPem == nil {
+		err = errors.New("error decode certificate PEM")
+		return
+	}
 	certPemBytes := certPem.Bytes
 
 	cert, err = x509.ParseCertificate(certPemBytes)
@@ -27,29 +46,59 @@ func decodeCert(certPEMBytes []byte) (cert *x509.Certificate, err error) {
 	return
 }
 
-// decode private key from PEM to RSA format
-func decodePrivKey(privKey []byte) (key *rsa.PrivateKey, err error) {
+// decode private key from PKCS#1, SEC 1 or PKCS#8 PEM, RSA, ECDSA and Ed25519 keys are supported
+func decodePrivKey(privKey []byte) (key crypto.Signer, err error) {
 	privKeyPem, _ := pem.Decode(privKey)
-	key, err = x509.ParsePKCS1PrivateKey(privKeyPem.Bytes)
-	if err == nil {
+	if privKeyPem == nil {
+		err = errors.New("error decode private key PEM")
 		return
 	}
 
+	switch privKeyPem.Type {
+	case "RSA PRIVATE KEY":
+		// keys written by older versions are PKCS#8 with a PKCS#1 header
+		if key, err = x509.ParsePKCS1PrivateKey(privKeyPem.Bytes); err == nil {
+			return
+		}
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(privKeyPem.Bytes)
+	}
+
 	tmp, err := x509.ParsePKCS8PrivateKey(privKeyPem.Bytes)
 	if err != nil {
 		err = errors.New("error parse private key")
 		return
 	}
-	key, _ = tmp.(*rsa.PrivateKey)
+	key, ok := tmp.(crypto.Signer)
+	if !ok {
+		err = fmt.Errorf("unsupported private key type %T", tmp)
+	}
 
 	return
 }
 
-// return PEM encoded private key
-func genPrivKey() (privKeyPEM *bytes.Buffer, err error) {
-	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
-
-	//privKeyPKCS1 := x509.MarshalPKCS1PrivateKey(privKey)
+// return PEM encoded private key of the algorithm
+func genPrivKey(algo string) (privKeyPEM *bytes.Buffer, err error) {
+	var privKey crypto.Signer
+	switch algo {
+	case keyAlgoRSA2048:
+		privKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case keyAlgoRSA3072:
+		privKey, err = rsa.GenerateKey(rand.Reader, 3072)
+	case keyAlgoRSA4096:
+		privKey, err = rsa.GenerateKey(rand.Reader, 4096)
+	case keyAlgoECDSAP256:
+		privKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case keyAlgoECDSAP384:
+		privKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case keyAlgoEd25519:
+		_, privKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("unknown key algorithm %q", algo)
+	}
+	if err != nil {
+		return
+	}
 
 	privKeyPKCS8, err := x509.MarshalPKCS8PrivateKey(privKey)
 	if err != nil {
@@ -58,15 +107,60 @@ func genPrivKey() (privKeyPEM *bytes.Buffer, err error) {
 
 	privKeyPEM = new(bytes.Buffer)
 	err = pem.Encode(privKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
+		Type:  "PRIVATE KEY",
 		Bytes: privKeyPKCS8,
 	})
 
 	return
 }
 
+// signatureAlgorithm returns the algorithm the key signs with using --pki.signature-hash,
+// Ed25519 has a fixed hash and an unknown hash leaves the choice to crypto/x509
+func signatureAlgorithm(signer crypto.Signer) x509.SignatureAlgorithm {
+	byHash := map[string][2]x509.SignatureAlgorithm{
+		"sha256": {x509.SHA256WithRSA, x509.ECDSAWithSHA256},
+		"sha384": {x509.SHA384WithRSA, x509.ECDSAWithSHA384},
+		"sha512": {x509.SHA512WithRSA, x509.ECDSAWithSHA512},
+	}
+	algorithms, ok := byHash[*pkiSignatureHash]
+	if !ok {
+		return x509.UnknownSignatureAlgorithm
+	}
+
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return algorithms[0]
+	case *ecdsa.PublicKey:
+		return algorithms[1]
+	case ed25519.PublicKey:
+		return x509.PureEd25519
+	}
+	return x509.UnknownSignatureAlgorithm
+}
+
+// keyUsage returns the key usage of a TLS certificate for the key, key encipherment is RSA only
+func keyUsage(pub crypto.PublicKey) x509.KeyUsage {
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		return x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	}
+	return x509.KeyUsageDigitalSignature
+}
+
+// publicKeyDescription returns the algorithm and size of a public key, e.g. "RSA 2048" or "ECDSA P-256"
+func publicKeyDescription(pub interface{}) string {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return fmt.Sprintf("%T", pub)
+}
+
 // return PEM encoded certificate
-func genCA(privKey *rsa.PrivateKey) (issuerPEM *bytes.Buffer, err error) {
+func genCA(privKey crypto.Signer) (issuerPEM *bytes.Buffer, err error) {
 	serialNumberRange := new(big.Int).Lsh(big.NewInt(1), 128)
 
 	issuerSerial, err := rand.Int(rand.Reader, serialNumberRange)
@@ -79,11 +173,12 @@ func genCA(privKey *rsa.PrivateKey) (issuerPEM *bytes.Buffer, err error) {
 			CommonName: "ca",
 		},
 
-		KeyUsage:  x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
-		NotBefore: time.Now(),
-		NotAfter:  time.Now().AddDate(10, 0, 0),
+		KeyUsage:           x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		SignatureAlgorithm: signatureAlgorithm(privKey),
+		NotBefore:          time.Now(),
+		NotAfter:           time.Now().AddDate(10, 0, 0),
 	}
-	issuerBytes, err := x509.CreateCertificate(rand.Reader, &issuerTemplate, &issuerTemplate, &privKey.PublicKey, privKey)
+	issuerBytes, err := x509.CreateCertificate(rand.Reader, &issuerTemplate, &issuerTemplate, privKey.Public(), privKey)
 	if err != nil {
 		return
 	}
@@ -97,8 +192,8 @@ func genCA(privKey *rsa.PrivateKey) (issuerPEM *bytes.Buffer, err error) {
 	return
 }
 
-// return PEM encoded certificate
-func genServerCert(privKey, caPrivKey *rsa.PrivateKey, ca *x509.Certificate, cn string) (issuerPEM *bytes.Buffer, err error) {
+// return PEM encoded certificate for the public key
+func genServerCert(pub crypto.PublicKey, caPrivKey crypto.Signer, ca *x509.Certificate, cn string) (issuerPEM *bytes.Buffer, err error) {
 	serialNumberRange := new(big.Int).Lsh(big.NewInt(1), 128)
 	serial, err := rand.Int(rand.Reader, serialNumberRange)
 
@@ -109,13 +204,14 @@ func genServerCert(privKey, caPrivKey *rsa.PrivateKey, ca *x509.Certificate, cn
 		Subject: pkix.Name{
 			CommonName: cn,
 		},
-		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		NotBefore:   time.Now(),
-		NotAfter:    ca.NotAfter,
+		KeyUsage:           keyUsage(pub),
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		SignatureAlgorithm: signatureAlgorithm(caPrivKey),
+		NotBefore:          time.Now(),
+		NotAfter:           ca.NotAfter,
 	}
 
-	issuerBytes, err := x509.CreateCertificate(rand.Reader, &template, ca, &privKey.PublicKey, caPrivKey)
+	issuerBytes, err := x509.CreateCertificate(rand.Reader, &template, ca, pub, caPrivKey)
 	if err != nil {
 		return
 	}
@@ -129,18 +225,35 @@ func genServerCert(privKey, caPrivKey *rsa.PrivateKey, ca *x509.Certificate, cn
 	return
 }
 
-// return PEM encoded certificate
-func genClientCert(privKey, caPrivKey *rsa.PrivateKey, ca *x509.Certificate, cn string) (issuerPEM *bytes.Buffer, err error) {
-	serialNumberRange := new(big.Int).Lsh(big.NewInt(1), 128)
-	serial, err := rand.Int(rand.Reader, serialNumberRange)
+// return PEM encoded certificate for the public key valid for --client-cert.expiration-days
+func genClientCert(pub crypto.PublicKey, caPrivKey crypto.Signer, ca *x509.Certificate, cn string) (issuerPEM *bytes.Buffer, err error) {
+	return genClientCertUntil(pub, caPrivKey, ca, cn, time.Time{})
+}
 
-	certLifetimeDays, err := strconv.Atoi(*clientCertExpirationDays)
-	if err != nil {
-		return nil, fmt.Errorf("can't get client certificate expiration value: %w", err)
+// clientCertGenerator returns a certGenerator of client certificates expiring at notAfter
+func clientCertGenerator(notAfter time.Time) certGenerator {
+	return func(pub crypto.PublicKey, caPrivKey crypto.Signer, ca *x509.Certificate, cn string) (*bytes.Buffer, error) {
+		return genClientCertUntil(pub, caPrivKey, ca, cn, notAfter)
 	}
+}
+
+// return PEM encoded certificate for the public key expiring at notAfter, zero for --client-cert.expiration-days.
+// Certificates never outlive the CA.
+func genClientCertUntil(pub crypto.PublicKey, caPrivKey crypto.Signer, ca *x509.Certificate, cn string, notAfter time.Time) (issuerPEM *bytes.Buffer, err error) {
+	serialNumberRange := new(big.Int).Lsh(big.NewInt(1), 128)
+	serial, err := rand.Int(rand.Reader, serialNumberRange)
 
 	notBefore := time.Now()
-	notAfter := notBefore.Add(time.Duration(certLifetimeDays) * 24 * time.Hour)
+	if notAfter.IsZero() {
+		certLifetimeDays, err := strconv.Atoi(*clientCertExpirationDays)
+		if err != nil {
+			return nil, fmt.Errorf("can't get client certificate expiration value: %w", err)
+		}
+		notAfter = notBefore.Add(time.Duration(certLifetimeDays) * 24 * time.Hour)
+	}
+	if !notAfter.After(notBefore) {
+		return nil, fmt.Errorf("certificate expiration %s is in the past", notAfter.Format(time.RFC3339))
+	}
 	if notAfter.After(ca.NotAfter) {
 		notAfter = ca.NotAfter
 	}
@@ -152,13 +265,17 @@ func genClientCert(privKey, caPrivKey *rsa.PrivateKey, ca *x509.Certificate, cn
 		Subject: pkix.Name{
 			CommonName: cn,
 		},
-		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
-		NotBefore:   notBefore,
-		NotAfter:    notAfter,
+		KeyUsage:           keyUsage(pub),
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		SignatureAlgorithm: signatureAlgorithm(caPrivKey),
+		NotBefore:          notBefore,
+		NotAfter:           notAfter,
+	}
+	if *ocspURL != "" {
+		template.OCSPServer = []string{*ocspURL}
 	}
 
-	issuerBytes, err := x509.CreateCertificate(rand.Reader, &template, ca, &privKey.PublicKey, caPrivKey)
+	issuerBytes, err := x509.CreateCertificate(rand.Reader, &template, ca, pub, caPrivKey)
 	if err != nil {
 		return
 	}
@@ -172,20 +289,44 @@ func genClientCert(privKey, caPrivKey *rsa.PrivateKey, ca *x509.Certificate, cn
 	return
 }
 
-// return PEM encoded CRL
-func genCRL(certs []*RevokedCert, ca *x509.Certificate, caKey *rsa.PrivateKey) (crlPEM *bytes.Buffer, err error) {
+// return PEM encoded certificate request
+func genCSR(privKey crypto.Signer, cn string) (csrPEM *bytes.Buffer, err error) {
+	template := x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName: cn,
+		},
+		SignatureAlgorithm: signatureAlgorithm(privKey),
+	}
+
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &template, privKey)
+	if err != nil {
+		return
+	}
+
+	csrPEM = new(bytes.Buffer)
+	err = pem.Encode(csrPEM, &pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: csrBytes,
+	})
+
+	return
+}
+
+// return PEM encoded CRL valid for the validity from now
+func genCRL(certs []*RevokedCert, ca *x509.Certificate, caKey crypto.Signer, number *big.Int, validity time.Duration) (crlPEM *bytes.Buffer, err error) {
 	var revokedCertificates []pkix.RevokedCertificate
 
 	for _, cert := range certs {
 		revokedCertificates = append(revokedCertificates, pkix.RevokedCertificate{SerialNumber: cert.Cert.SerialNumber, RevocationTime: cert.RevokedTime})
 	}
 
+	now := time.Now()
 	revocationList := &x509.RevocationList{
-		//SignatureAlgorithm: x509.SHA256WithRSA,
+		SignatureAlgorithm:  signatureAlgorithm(caKey),
 		RevokedCertificates: revokedCertificates,
-		Number:              big.NewInt(1),
-		ThisUpdate:          time.Now(),
-		NextUpdate:          time.Now().Add(180 * time.Hour * 24),
+		Number:              number,
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(validity),
 		//ExtraExtensions: []pkix.Extension{},
 	}
 
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newTestKey(t *testing.T, algo string) crypto.Signer {
+	t.Helper()
+	keyPEM, err := genPrivKey(algo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := decodePrivKey(keyPEM.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTestCA(t *testing.T, algo string) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	key := newTestKey(t, algo)
+	certPEM, err := genCA(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := decodeCert(certPEM.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func setTestSignatureHash(t *testing.T, hash string) {
+	oldHash := *pkiSignatureHash
+	*pkiSignatureHash = hash
+	t.Cleanup(func() { *pkiSignatureHash = oldHash })
+}
+
+// testKeyAlgo returns the --pki.key-algo value the key was generated with
+func testKeyAlgo(key crypto.Signer) string {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return fmt.Sprintf("rsa%d", k.N.BitLen())
+	case *ecdsa.PrivateKey:
+		return map[elliptic.Curve]string{elliptic.P256(): keyAlgoECDSAP256, elliptic.P384(): keyAlgoECDSAP384}[k.Curve]
+	case ed25519.PrivateKey:
+		return keyAlgoEd25519
+	}
+	return fmt.Sprintf("%T", key)
+}
+
+func TestGenPrivKey(t *testing.T) {
+	for _, algo := range []string{keyAlgoRSA2048, keyAlgoRSA3072, keyAlgoECDSAP256, keyAlgoECDSAP384, keyAlgoEd25519} {
+		t.Run(algo, func(t *testing.T) {
+			keyPEM, err := genPrivKey(algo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block, _ := pem.Decode(keyPEM.Bytes()); block == nil || block.Type != "PRIVATE KEY" {
+				t.Errorf("Expected a PKCS#8 PRIVATE KEY block")
+			}
+			key, err := decodePrivKey(keyPEM.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := testKeyAlgo(key); got != algo {
+				t.Errorf("Expected a %s key, got %s", algo, got)
+			}
+		})
+	}
+
+	if _, err := genPrivKey("dsa"); err == nil {
+		t.Error("Expected an error for an unknown algorithm")
+	}
+}
+
+func TestDecodePrivKey_LegacyFormats(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+	pkcs8DER, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+
+	tests := []struct {
+		name  string
+		block *pem.Block
+	}{
+		{"PKCS1", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}},
+		// older versions wrote PKCS#8 with this header
+		{"PKCS8 with RSA header", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: pkcs8DER}},
+		{"SEC1", &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodePrivKey(pem.EncodeToMemory(tt.block)); err != nil {
+				t.Errorf("Expected the key to decode: %v", err)
+			}
+		})
+	}
+
+	if _, err := decodePrivKey([]byte("not a key")); err == nil {
+		t.Error("Expected an error for a non PEM key")
+	}
+}
+
+// a CA of one algorithm has to sign client keys of every other one during a migration
+func TestGenClientCert_MixedAlgorithms(t *testing.T) {
+	oldDays := *clientCertExpirationDays
+	*clientCertExpirationDays = "30"
+	t.Cleanup(func() { *clientCertExpirationDays = oldDays })
+	setTestSignatureHash(t, "sha256")
+
+	for _, caAlgo := range []string{keyAlgoRSA2048, keyAlgoECDSAP256, keyAlgoEd25519} {
+		ca, caKey := newTestCA(t, caAlgo)
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+
+		for _, algo := range []string{keyAlgoRSA2048, keyAlgoECDSAP384, keyAlgoEd25519} {
+			t.Run(caAlgo+"/"+algo, func(t *testing.T) {
+				key := newTestKey(t, algo)
+				certPEM, err := genClientCert(key.Public(), caKey, ca, "alice")
+				if err != nil {
+					t.Fatal(err)
+				}
+				cert, err := decodeCert(certPEM.Bytes())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+					t.Errorf("Client certificate doesn't verify against the CA: %v", err)
+				}
+				_, isRSA := key.(*rsa.PrivateKey)
+				if encipherment := cert.KeyUsage&x509.KeyUsageKeyEncipherment != 0; encipherment != isRSA {
+					t.Errorf("Expected key encipherment only for RSA keys, got key usage %v", cert.KeyUsage)
+				}
+			})
+		}
+	}
+}
+
+func TestSignatureAlgorithm(t *testing.T) {
+	rsaKey := newTestKey(t, keyAlgoRSA2048)
+	ecKey := newTestKey(t, keyAlgoECDSAP384)
+	edKey := newTestKey(t, keyAlgoEd25519)
+
+	tests := []struct {
+		hash string
+		key  crypto.Signer
+		want x509.SignatureAlgorithm
+	}{
+		{"sha256", rsaKey, x509.SHA256WithRSA},
+		{"sha512", rsaKey, x509.SHA512WithRSA},
+		{"sha384", ecKey, x509.ECDSAWithSHA384},
+		{"sha512", edKey, x509.PureEd25519},
+		{"", rsaKey, x509.UnknownSignatureAlgorithm},
+	}
+	for _, tt := range tests {
+		setTestSignatureHash(t, tt.hash)
+		if got := signatureAlgorithm(tt.key); got != tt.want {
+			t.Errorf("signatureAlgorithm(%T) with %q = %v, want %v", tt.key, tt.hash, got, tt.want)
+		}
+	}
+
+	setTestSignatureHash(t, "sha384")
+	ca, _ := newTestCA(t, keyAlgoRSA2048)
+	if ca.SignatureAlgorithm != x509.SHA384WithRSA {
+		t.Errorf("Expected the CA to be signed with SHA384WithRSA, got %v", ca.SignatureAlgorithm)
+	}
+}
+
+func TestGenCRL_ECDSA(t *testing.T) {
+	setTestSignatureHash(t, "sha384")
+	ca, caKey := newTestCA(t, keyAlgoECDSAP384)
+
+	revoked := []*RevokedCert{{RevokedTime: time.Now(), Cert: &x509.Certificate{SerialNumber: big.NewInt(42)}}}
+	crlPEM, err := genCRL(revoked, ca, caKey, big.NewInt(7), 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(crlPEM.Bytes())
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crl.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("CRL is not signed by the CA: %v", err)
+	}
+	if crl.SignatureAlgorithm != x509.ECDSAWithSHA384 {
+		t.Errorf("Expected an ECDSAWithSHA384 signature, got %v", crl.SignatureAlgorithm)
+	}
+	if crl.Number.Int64() != 7 || crl.NextUpdate.Sub(crl.ThisUpdate) != 48*time.Hour {
+		t.Errorf("Expected CRL number 7 valid for 48h, got %v until %v", crl.Number, crl.NextUpdate)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Int64() != 42 {
+		t.Errorf("Unexpected revoked certificates %+v", crl.RevokedCertificateEntries)
+	}
+}
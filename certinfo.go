@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var keyUsageNames = []struct {
+	usage x509.KeyUsage
+	name  string
+}{
+	{x509.KeyUsageDigitalSignature, "Digital Signature"},
+	{x509.KeyUsageContentCommitment, "Content Commitment"},
+	{x509.KeyUsageKeyEncipherment, "Key Encipherment"},
+	{x509.KeyUsageDataEncipherment, "Data Encipherment"},
+	{x509.KeyUsageKeyAgreement, "Key Agreement"},
+	{x509.KeyUsageCertSign, "Certificate Sign"},
+	{x509.KeyUsageCRLSign, "CRL Sign"},
+	{x509.KeyUsageEncipherOnly, "Encipher Only"},
+	{x509.KeyUsageDecipherOnly, "Decipher Only"},
+}
+
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "Any",
+	x509.ExtKeyUsageServerAuth:      "TLS Web Server Authentication",
+	x509.ExtKeyUsageClientAuth:      "TLS Web Client Authentication",
+	x509.ExtKeyUsageCodeSigning:     "Code Signing",
+	x509.ExtKeyUsageEmailProtection: "E-mail Protection",
+	x509.ExtKeyUsageTimeStamping:    "Time Stamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSP Signing",
+}
+
+// certificateDetails is what the certificate page and GET /api/v1/users/{username}/certificate show of a certificate
+type certificateDetails struct {
+	Serial             string     `json:"serial"`
+	Subject            string     `json:"subject"`
+	Issuer             string     `json:"issuer"`
+	NotBefore          time.Time  `json:"not_before"`
+	NotAfter           time.Time  `json:"not_after"`
+	KeyAlgorithm       string     `json:"key_algorithm"`
+	SignatureAlgorithm string     `json:"signature_algorithm"`
+	SANs               []string   `json:"sans"`
+	KeyUsage           []string   `json:"key_usage"`
+	ExtKeyUsage        []string   `json:"ext_key_usage"`
+	FingerprintSHA256  string     `json:"fingerprint_sha256"`
+	Status             string     `json:"status"`
+	RevokedAt          *time.Time `json:"revoked_at,omitempty"`
+	RevocationReason   string     `json:"revocation_reason,omitempty"`
+}
+
+type userCertificates struct {
+	Username string `json:"username"`
+	// Certificate is the current certificate, History the ones it replaced, newest first
+	Certificate *certificateDetails  `json:"certificate"`
+	History     []certificateDetails `json:"history"`
+}
+
+// fingerprintSHA256 formats the fingerprint of the certificate like openssl x509 -fingerprint does
+func fingerprintSHA256(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+func newCertificateDetails(c issuedCertificate, now time.Time) certificateDetails {
+	cert := c.Cert
+	details := certificateDetails{
+		Serial:             indexTxtSerial(cert.SerialNumber),
+		Subject:            cert.Subject.String(),
+		Issuer:             cert.Issuer.String(),
+		NotBefore:          cert.NotBefore.UTC(),
+		NotAfter:           cert.NotAfter.UTC(),
+		KeyAlgorithm:       publicKeyDescription(cert.PublicKey),
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		SANs:               []string{},
+		KeyUsage:           []string{},
+		ExtKeyUsage:        []string{},
+		FingerprintSHA256:  fingerprintSHA256(cert),
+		Status:             "Active",
+	}
+
+	for _, name := range cert.DNSNames {
+		details.SANs = append(details.SANs, "DNS:"+name)
+	}
+	for _, ip := range cert.IPAddresses {
+		details.SANs = append(details.SANs, "IP:"+ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		details.SANs = append(details.SANs, "email:"+email)
+	}
+	for _, uri := range cert.URIs {
+		details.SANs = append(details.SANs, "URI:"+uri.String())
+	}
+	for _, ku := range keyUsageNames {
+		if cert.KeyUsage&ku.usage != 0 {
+			details.KeyUsage = append(details.KeyUsage, ku.name)
+		}
+	}
+	for _, eku := range cert.ExtKeyUsage {
+		name, ok := extKeyUsageNames[eku]
+		if !ok {
+			name = fmt.Sprintf("unknown (%d)", eku)
+		}
+		details.ExtKeyUsage = append(details.ExtKeyUsage, name)
+	}
+
+	switch {
+	case !c.RevokedAt.IsZero():
+		revokedAt := c.RevokedAt.UTC()
+		details.Status, details.RevokedAt = "Revoked", &revokedAt
+		// ovpn-admin and the CRL don't record a reason
+		details.RevocationReason = c.RevocationReason
+		if details.RevocationReason == "" {
+			details.RevocationReason = "unspecified"
+		}
+	case cert.NotAfter.Before(now):
+		details.Status = "Expired"
+	}
+	return details
+}
+
+// userCertificates returns the current and the past certificates of the user
+func (oAdmin *OvpnAdmin) userCertificates(username string) (userCertificates, error) {
+	result := userCertificates{Username: username, History: []certificateDetails{}}
+	certs, err := oAdmin.storage.Certificates(username)
+	if err != nil {
+		return result, err
+	}
+	now := time.Now()
+	for _, c := range certs {
+		details := newCertificateDetails(c, now)
+		if c.Current {
+			result.Certificate = &details
+		} else {
+			result.History = append(result.History, details)
+		}
+	}
+	return result, nil
+}
+
+func (oAdmin *OvpnAdmin) modalCertHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	username := oAdmin.extractUsername(r)
+	if !oAdmin.userExists(username) {
+		http.Error(w, fmt.Sprintf("User %q not found", username), http.StatusNotFound)
+		return
+	}
+	certs, err := oAdmin.userCertificates(username)
+	data := map[string]interface{}{
+		"Username":     username,
+		"Certificates": certs,
+	}
+	if err != nil {
+		log.Errorf("can't read the certificates of %s: %v", username, err)
+		data["Error"] = err.Error()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := oAdmin.htmlTemplates.ExecuteTemplate(w, "modal_cert", data); err != nil {
+		log.Errorf("Error rendering modal_cert template: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// apiGetCertificates handles GET /api/v1/users/{username}/certificate
+func (oAdmin *OvpnAdmin) apiGetCertificates(w http.ResponseWriter, username string) {
+	if !oAdmin.apiRequireUser(w, username) {
+		return
+	}
+	certs, err := oAdmin.userCertificates(username)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, certs)
+}
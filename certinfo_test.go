@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetiredCommonName(t *testing.T) {
+	tests := []struct {
+		identity string
+		want     string
+	}{
+		{"REVOKED-alice-0123456789abcdef0123456789abcdef", "alice"},
+		{"REVOKED-alice-b-0123456789abcdef0123456789abcdef", "alice-b"},
+		{"REVOKED-alice", ""},
+		{"alice", ""},
+	}
+	for _, tt := range tests {
+		if got := retiredCommonName(tt.identity); got != tt.want {
+			t.Errorf("retiredCommonName(%q) = %q, want %q", tt.identity, got, tt.want)
+		}
+	}
+}
+
+func TestIndexTxtRevocation(t *testing.T) {
+	revokedAt, reason, err := indexTxtRevocation("250102030405Z,keyCompromise")
+	if err != nil || reason != "keyCompromise" || !revokedAt.Equal(time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("Unexpected revocation %v %q %v", revokedAt, reason, err)
+	}
+}
+
+func TestAPIUserCertificates(t *testing.T) {
+	setTestSignatureHash(t, "sha256")
+	p := newTestPKI(t)
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.storage = &filesystemStorage{pki: p, ccdDir: t.TempDir()}
+	if err := oAdmin.storage.BuildClient("alice", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	first := testClientCert(t, oAdmin, "alice")
+	if err := oAdmin.storage.Rotate("alice", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	current := testClientCert(t, oAdmin, "alice")
+
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/users/alice/certificate", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var got userCertificates
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	c := got.Certificate
+	if c == nil || c.Serial != indexTxtSerial(current.SerialNumber) || c.Status != "Active" || c.RevokedAt != nil {
+		t.Fatalf("Expected the current certificate, got %+v", c)
+	}
+	sum := sha256.Sum256(current.Raw)
+	if strings.ReplaceAll(c.FingerprintSHA256, ":", "") != strings.ToUpper(hex.EncodeToString(sum[:])) {
+		t.Errorf("Unexpected fingerprint %s", c.FingerprintSHA256)
+	}
+	if c.Subject != "CN=alice" || c.KeyAlgorithm != "RSA 2048" || c.SignatureAlgorithm != "SHA256-RSA" {
+		t.Errorf("Unexpected subject or algorithms %+v", c)
+	}
+	if len(c.SANs) != 1 || c.SANs[0] != "DNS:alice" {
+		t.Errorf("Expected the DNS name in the SANs, got %v", c.SANs)
+	}
+	if len(c.ExtKeyUsage) != 1 || c.ExtKeyUsage[0] != "TLS Web Client Authentication" {
+		t.Errorf("Expected client authentication, got %v", c.ExtKeyUsage)
+	}
+
+	if len(got.History) != 1 || got.History[0].Serial != indexTxtSerial(first.SerialNumber) {
+		t.Fatalf("Expected the rotated certificate in the history, got %+v", got.History)
+	}
+	if h := got.History[0]; h.Status != "Revoked" || h.RevokedAt == nil || h.RevocationReason != "unspecified" {
+		t.Errorf("Expected the rotated certificate to be revoked, got %+v", h)
+	}
+
+	w = httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/users/nobody/certificate", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown user, got %d", w.Code)
+	}
+}
+
+func TestModalCertHandler(t *testing.T) {
+	p := newTestPKI(t)
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.storage = &filesystemStorage{pki: p, ccdDir: t.TempDir()}
+	if err := oAdmin.storage.BuildClient("alice", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	oAdmin.modalCertHandler(w, httptest.NewRequest(http.MethodGet, "/modal/cert/alice", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	serial := indexTxtSerial(testClientCert(t, oAdmin, "alice").SerialNumber)
+	for _, want := range []string{"Certificate of alice", serial, "SHA-256 fingerprint", "No rotated or deleted certificates"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in the modal", want)
+		}
+	}
+}
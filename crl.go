@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// crlNumberFile holds the next CRL number in hex, the file openssl ca -gencrl uses in an easyrsa pki
+	crlNumberFile    = "crlnumber"
+	crlCheckInterval = time.Hour
+)
+
+// parseCRLs decodes every CRL of a crl.pem, there is one per CA during a CA rollover
+func parseCRLs(crlPEM []byte) ([]*x509.RevocationList, error) {
+	var crls []*x509.RevocationList
+	for {
+		var block *pem.Block
+		block, crlPEM = pem.Decode(crlPEM)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		return nil, errors.New("no CRL found")
+	}
+	return crls, nil
+}
+
+// nextCRLNumber returns the number of the next CRL, it is above the stored counter and every CRL in crlPEM,
+// so the number keeps increasing when easyrsa or an older version wrote the last CRL
+func nextCRLNumber(stored string, crlPEM []byte) *big.Int {
+	next := big.NewInt(1)
+	if n, ok := new(big.Int).SetString(strings.TrimSpace(stored), 16); ok && n.Cmp(next) > 0 {
+		next = n
+	}
+	// a missing or broken crl.pem is replaced anyway
+	crls, _ := parseCRLs(crlPEM)
+	for _, crl := range crls {
+		if crl.Number != nil && crl.Number.Cmp(next) >= 0 {
+			next = new(big.Int).Add(crl.Number, big.NewInt(1))
+		}
+	}
+	return next
+}
+
+// formatCRLNumber formats the counter like openssl does, in uppercase hex with an even number of digits
+func formatCRLNumber(n *big.Int) string {
+	s := strings.ToUpper(n.Text(16))
+	if len(s)%2 != 0 {
+		s = "0" + s
+	}
+	return s + "\n"
+}
+
+// crlRefresh re-signs the CRL when it expires within --crl.refresh-margin and updates the CRL metrics.
+// Slaves get the CRL from the master, so they only report it.
+func (oAdmin *OvpnAdmin) crlRefresh(now time.Time) error {
+	crls, err := oAdmin.currentCRLs()
+	if err != nil {
+		log.Warnf("crl: can't read the current CRL: %v", err)
+	}
+	if oAdmin.role != "slave" && (err != nil || crls[0].NextUpdate.Sub(now) < *crlRefreshMargin) {
+		if err := oAdmin.storage.GenCRL(); err != nil {
+			return fmt.Errorf("can't re-sign the CRL: %w", err)
+		}
+		if crls, err = oAdmin.currentCRLs(); err != nil {
+			return err
+		}
+		log.Infof("crl: re-signed CRL %s, valid until %s", crls[0].Number, crls[0].NextUpdate.Format(time.RFC3339))
+	}
+	if err != nil {
+		return err
+	}
+	setCRLMetrics(crls)
+	return nil
+}
+
+// currentCRLs returns the CRLs of crl.pem, the one expiring first comes first
+func (oAdmin *OvpnAdmin) currentCRLs() ([]*x509.RevocationList, error) {
+	crlPEM, err := oAdmin.storage.CRL()
+	if err != nil {
+		return nil, err
+	}
+	crls, err := parseCRLs(crlPEM)
+	if err != nil {
+		return nil, err
+	}
+	for i := range crls {
+		if crls[i].NextUpdate.Before(crls[0].NextUpdate) {
+			crls[0], crls[i] = crls[i], crls[0]
+		}
+	}
+	return crls, nil
+}
+
+func setCRLMetrics(crls []*x509.RevocationList) {
+	ovpnCRLNextUpdate.Set(float64(crls[0].NextUpdate.Unix()))
+	if crls[0].Number != nil {
+		number, _ := new(big.Float).SetInt(crls[0].Number).Float64()
+		ovpnCRLNumber.Set(number)
+	}
+}
+
+func (oAdmin *OvpnAdmin) crlRefreshLoop() {
+	for {
+		if err := oAdmin.crlRefresh(time.Now()); err != nil {
+			log.Errorf("crl: %v", err)
+		}
+		time.Sleep(crlCheckInterval)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func setTestCRLValidity(t *testing.T, validity, margin time.Duration) {
+	oldValidity, oldMargin := *crlValidity, *crlRefreshMargin
+	*crlValidity, *crlRefreshMargin = validity, margin
+	t.Cleanup(func() { *crlValidity, *crlRefreshMargin = oldValidity, oldMargin })
+}
+
+func TestNextCRLNumber(t *testing.T) {
+	setTestSignatureHash(t, "sha256")
+	ca, caKey := newTestCA(t, keyAlgoRSA2048)
+	crl, err := genCRL(nil, ca, caKey, big.NewInt(12), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		stored string
+		crl    []byte
+		want   int64
+	}{
+		{"first CRL", "", nil, 1},
+		{"openssl counter", "0A\n", nil, 10},
+		{"CRL written without a counter", "", crl.Bytes(), 13},
+		{"counter ahead of the CRL", "FF\n", crl.Bytes(), 255},
+		{"broken counter", "garbage", crl.Bytes(), 13},
+	}
+	for _, tt := range tests {
+		if got := nextCRLNumber(tt.stored, tt.crl); got.Int64() != tt.want {
+			t.Errorf("%s: expected %d, got %s", tt.name, tt.want, got)
+		}
+	}
+
+	if got := formatCRLNumber(big.NewInt(255)); got != "FF\n" {
+		t.Errorf("Expected FF, got %q", got)
+	}
+	if got := formatCRLNumber(big.NewInt(256)); got != "0100\n" {
+		t.Errorf("Expected 0100, got %q", got)
+	}
+}
+
+func TestFilesystemPKI_CRLNumber(t *testing.T) {
+	setTestCRLValidity(t, 48*time.Hour, 24*time.Hour)
+	p := newTestPKI(t)
+	if err := p.easyrsaBuildClient("alice", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.easyrsaGenCRL(); err != nil {
+		t.Fatal(err)
+	}
+	first := readTestCRL(t, p).Number
+	if err := p.easyrsaRevoke("alice"); err != nil {
+		t.Fatal(err)
+	}
+	crl := readTestCRL(t, p)
+	if crl.Number.Cmp(first) <= 0 {
+		t.Errorf("Expected the CRL number to increase, got %s after %s", crl.Number, first)
+	}
+	if got := crl.NextUpdate.Sub(crl.ThisUpdate); got != 48*time.Hour {
+		t.Errorf("Expected the CRL to be valid for 48h, got %v", got)
+	}
+	if stored, _ := os.ReadFile(p.path(crlNumberFile)); string(stored) != formatCRLNumber(new(big.Int).Add(crl.Number, big.NewInt(1))) {
+		t.Errorf("Expected crlnumber to hold the next number, got %q", stored)
+	}
+}
+
+func TestCRLRefresh(t *testing.T) {
+	setTestCRLValidity(t, 48*time.Hour, 24*time.Hour)
+	p := newTestPKI(t)
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.storage = &filesystemStorage{pki: p, ccdDir: t.TempDir()}
+
+	// a missing CRL is created right away
+	if err := oAdmin.crlRefresh(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	crl := readTestCRL(t, p)
+	if testutil.ToFloat64(ovpnCRLNextUpdate) != float64(crl.NextUpdate.Unix()) || testutil.ToFloat64(ovpnCRLNumber) != float64(crl.Number.Int64()) {
+		t.Errorf("Expected the metrics of CRL %s", crl.Number)
+	}
+
+	if err := oAdmin.crlRefresh(time.Now().Add(12 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if readTestCRL(t, p).Number.Cmp(crl.Number) != 0 {
+		t.Error("Expected the CRL to be kept outside the refresh margin")
+	}
+
+	if err := oAdmin.crlRefresh(time.Now().Add(36 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	refreshed := readTestCRL(t, p)
+	if refreshed.Number.Cmp(crl.Number) <= 0 {
+		t.Errorf("Expected a new CRL within the refresh margin, got %s", refreshed.Number)
+	}
+	if testutil.ToFloat64(ovpnCRLNumber) != float64(refreshed.Number.Int64()) {
+		t.Errorf("Expected the CRL number metric to follow, got %v", testutil.ToFloat64(ovpnCRLNumber))
+	}
+
+	// slaves get the CRL from the master
+	oAdmin.role = "slave"
+	if err := oAdmin.crlRefresh(time.Now().Add(47 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if readTestCRL(t, p).Number.Cmp(refreshed.Number) != 0 {
+		t.Error("Expected a slave not to re-sign the CRL")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// a CSR is about 1KB, even with a 4096 bit RSA key and a long subject
+const csrMaxSize = 64 * 1024
+
+// decodeCSR parses a PEM or DER encoded PKCS#10 certificate request
+func decodeCSR(data []byte) (*x509.CertificateRequest, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST" {
+			return nil, fmt.Errorf("expected a certificate request, got a PEM %s", block.Type)
+		}
+		data = block.Bytes
+	}
+	csr, err := x509.ParseCertificateRequest(data)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse the certificate request: %w", err)
+	}
+	return csr, nil
+}
+
+// encodeCSR returns the PEM encoded certificate request, the way easyrsa keeps it in reqs/
+func encodeCSR(csr *x509.CertificateRequest) *bytes.Buffer {
+	reqPEM := new(bytes.Buffer)
+	_ = pem.Encode(reqPEM, &pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})
+	return reqPEM
+}
+
+// parseClientCSR decodes the CSR of a user and checks its signature, common name and key.
+// An empty username takes the common name of the CSR.
+func parseClientCSR(data []byte, username string) (*x509.CertificateRequest, error) {
+	csr, err := decodeCSR(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("bad signature of the certificate request: %w", err)
+	}
+
+	commonName := csr.Subject.CommonName
+	if err := validateUsername(commonName); err != nil {
+		return nil, fmt.Errorf("common name %q of the certificate request: %w", commonName, err)
+	}
+	if username != "" && username != commonName {
+		return nil, fmt.Errorf("common name %q of the certificate request doesn't match user %q", commonName, username)
+	}
+
+	switch pub := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA keys need at least 2048 bits, got %d", pub.N.BitLen())
+		}
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() && pub.Curve != elliptic.P384() && pub.Curve != elliptic.P521() {
+			return nil, fmt.Errorf("unsupported ECDSA curve %s", pub.Curve.Params().Name)
+		}
+	case ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", csr.PublicKey)
+	}
+	return csr, nil
+}
+
+// formCSR returns the CSR uploaded as the csr file of the form, nil if there is none
+func formCSR(r *http.Request, username string) (*x509.CertificateRequest, error) {
+	file, _, err := r.FormFile("csr")
+	if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, csrMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > csrMaxSize {
+		return nil, errors.New("certificate request too large")
+	}
+	return parseClientCSR(data, username)
+}
+
+// externalKeyDirective returns the config line referencing the private key of a user who signed a CSR
+func externalKeyDirective(username string) string {
+	return strings.ReplaceAll(*clientCertExternalKey, "{username}", username)
+}
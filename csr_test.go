@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCSR returns the CSR of a new ECDSA key, the key stays with the test like it stays with the user
+func testCSR(t *testing.T, commonName string) *x509.CertificateRequest {
+	t.Helper()
+	csr, err := decodeCSR(testCSRPEM(t, commonName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func testCSRPEM(t *testing.T, commonName string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: commonName}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, _ := x509.ParseCertificateRequest(der)
+	return encodeCSR(csr).Bytes()
+}
+
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
+
+func TestParseClientCSR(t *testing.T) {
+	alice := testCSRPEM(t, "alice")
+	// flip a bit of the signature, which is at the end of the DER encoded request
+	csr, _ := decodeCSR(alice)
+	raw := bytes.Clone(csr.Raw)
+	raw[len(raw)-3] ^= 0x01
+	tampered := encodeCSR(&x509.CertificateRequest{Raw: raw}).Bytes()
+
+	tests := []struct {
+		name     string
+		data     []byte
+		username string
+		wantErr  string
+	}{
+		{"matching username", alice, "alice", ""},
+		{"username from the CSR", alice, "", ""},
+		{"DER", csr.Raw, "alice", ""},
+		{"other username", alice, "bob", "doesn't match"},
+		{"bad common name", testCSRPEM(t, "alice smith"), "", "common name"},
+		{"bad signature", tampered, "", "signature"},
+		{"not a CSR", []byte("-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"), "", "expected a certificate request"},
+		{"garbage", []byte("garbage"), "", "can't parse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csr, err := parseClientCSR(tt.data, tt.username)
+			if tt.wantErr == "" {
+				if err != nil || csr.Subject.CommonName != "alice" {
+					t.Errorf("Expected the CSR of alice, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestAPICreateUser_CSR(t *testing.T) {
+	oldExternalKey := *clientCertExternalKey
+	*clientCertExternalKey = "key {username}.key"
+	t.Cleanup(func() { *clientCertExternalKey = oldExternalKey })
+
+	p := newTestPKI(t)
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.storage = &filesystemStorage{pki: p, ccdDir: t.TempDir()}
+	csrPEM := testCSRPEM(t, "token-user")
+
+	body, _ := json.Marshal(apiCreateUserRequest{CSR: string(csrPEM)})
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodPost, "/api/v1/users", bytes.NewReader(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if !oAdmin.userExists("token-user") {
+		t.Fatal("Expected the user to be named after the common name of the CSR")
+	}
+
+	config := oAdmin.renderClientConfig("token-user")
+	if strings.Contains(config, "<key>") || !strings.Contains(config, "\nkey token-user.key\n") {
+		t.Errorf("Expected the config to reference the external key, got\n%s", config)
+	}
+	if !strings.Contains(config, "<cert>") {
+		t.Error("Expected the certificate in the config")
+	}
+
+	body, _ = json.Marshal(apiCreateUserRequest{Username: "other", CSR: string(testCSRPEM(t, "mallory"))})
+	w = httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodPost, "/api/v1/users", bytes.NewReader(body)))
+	if w.Code != http.StatusUnprocessableEntity || oAdmin.userExists("mallory") || oAdmin.userExists("other") {
+		t.Errorf("Expected 422 for a CSR of another user, got %d", w.Code)
+	}
+}
+
+func TestUserCreateHandler_CSRUpload(t *testing.T) {
+	p := newTestPKI(t)
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.storage = &filesystemStorage{pki: p, ccdDir: t.TempDir()}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	_ = form.WriteField("username", "laptop")
+	part, _ := form.CreateFormFile("csr", "laptop.csr")
+	_, _ = part.Write(testCSRPEM(t, "laptop"))
+	_ = form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/users", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	oAdmin.userCreateHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, key, err := oAdmin.storage.ClientCert("laptop"); err != nil || key != "" {
+		t.Errorf("Expected a certificate without a private key, got %q, %v", key, err)
+	}
+	if time.Until(testClientCert(t, oAdmin, "laptop").NotAfter) < 29*24*time.Hour {
+		t.Error("Expected the default lifetime")
+	}
+}
@@ -32,8 +32,8 @@ else
     fi
 fi
 
-# Generate CRL
-easyrsa gen-crl
+# Generate CRL, ovpn-admin re-signs it afterwards and may have encrypted ca.key, which easyrsa can't read
+[ -f "$EASY_RSA_LOC/pki/crl.pem" ] || easyrsa gen-crl
 
 # Setup NAT for VPN traffic
 iptables -t nat -D POSTROUTING -s ${OVPN_SRV_NET}/${OVPN_SRV_MASK} ! -d ${OVPN_SRV_NET}/${OVPN_SRV_MASK} -j MASQUERADE 2>/dev/null || true
@@ -48,6 +48,22 @@ fi
 # Copy OpenVPN config
 cp -f /etc/openvpn/setup/openvpn.conf /etc/openvpn/openvpn.conf
 
+# Control channel protection, openvpn.conf uses tls-auth
+case "${OVPN_TLS_MODE:-tls-auth}" in
+    tls-crypt)
+        sed -i -e "s|^tls-auth .*|tls-crypt $EASY_RSA_LOC/pki/ta.key|" -e '/^key-direction/d' /etc/openvpn/openvpn.conf
+        ;;
+    tls-crypt-v2)
+        [ -e "$EASY_RSA_LOC/pki/tls-crypt-v2-server.key" ] || openvpn --genkey tls-crypt-v2-server "$EASY_RSA_LOC/pki/tls-crypt-v2-server.key"
+        mkdir -p /etc/openvpn/scripts/
+        cp -f /etc/openvpn/setup/tls-crypt-v2-verify.sh /etc/openvpn/scripts/tls-crypt-v2-verify.sh
+        chmod +x /etc/openvpn/scripts/tls-crypt-v2-verify.sh
+        sed -i -e "s|^tls-auth .*|tls-crypt-v2 $EASY_RSA_LOC/pki/tls-crypt-v2-server.key|" -e '/^key-direction/d' /etc/openvpn/openvpn.conf
+        echo "tls-crypt-v2-verify \"/etc/openvpn/scripts/tls-crypt-v2-verify.sh $EASY_RSA_LOC/pki/index.txt\"" >> /etc/openvpn/openvpn.conf
+        echo "script-security 2" >> /etc/openvpn/openvpn.conf
+        ;;
+esac
+
 # Setup password authentication if enabled
 if [ "${OVPN_PASSWD_AUTH}" = "true" ]; then
     echo "==> Enabling password authentication"
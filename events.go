@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	uiEventConnection = "connection"
+	uiEventStats      = "stats"
+	uiEventUserRow    = "user-row"
+	uiEventUsers      = "users"
+
+	uiEventBuffer    = 64
+	uiEventKeepalive = 30 * time.Second
+)
+
+// uiEvent is a change pushed to the open dashboards, rendered for every subscriber on its own
+// because the actions in a user row depend on the role of the viewer
+type uiEvent struct {
+	Name       string
+	User       OpenvpnClient
+	Stats      DashboardStats
+	Connection mgmtEvent
+}
+
+type uiConnectionEvent struct {
+	Type           string `json:"type"`
+	User           string `json:"user"`
+	Server         string `json:"server"`
+	RealAddress    string `json:"real_address,omitempty"`
+	VirtualAddress string `json:"virtual_address,omitempty"`
+}
+
+// eventBroker fans events out to the /events streams, a nil broker drops everything
+type eventBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan uiEvent]struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subscribers: make(map[chan uiEvent]struct{})}
+}
+
+func (b *eventBroker) subscribe() chan uiEvent {
+	ch := make(chan uiEvent, uiEventBuffer)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan uiEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publish never blocks, a subscriber that can't keep up is dropped and catches up when its browser reconnects
+func (b *eventBroker) publish(event uiEvent) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Debugf("events: dropping slow subscriber")
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// refreshClients rebuilds the user list and pushes the changed rows and stats to the open dashboards
+func (oAdmin *OvpnAdmin) refreshClients() {
+	oAdmin.clientsMu.Lock()
+	defer oAdmin.clientsMu.Unlock()
+
+	previous := oAdmin.clients
+	oAdmin.clients = oAdmin.usersList()
+	oAdmin.publishClientChanges(previous, oAdmin.clients)
+}
+
+// getClients returns a copy of the user list built by the last refreshClients
+func (oAdmin *OvpnAdmin) getClients() []OpenvpnClient {
+	oAdmin.clientsMu.Lock()
+	defer oAdmin.clientsMu.Unlock()
+	return slices.Clone(oAdmin.clients)
+}
+
+func (oAdmin *OvpnAdmin) publishClientChanges(previous, current []OpenvpnClient) {
+	if oAdmin.events == nil {
+		return
+	}
+
+	before := make(map[string]OpenvpnClient, len(previous))
+	for _, client := range previous {
+		before[client.Identity] = client
+	}
+
+	var changed []OpenvpnClient
+	sameUsers := len(previous) == len(current)
+	for _, client := range current {
+		old, ok := before[client.Identity]
+		if !ok {
+			sameUsers = false
+			break
+		}
+		if !reflect.DeepEqual(old, client) {
+			changed = append(changed, client)
+		}
+	}
+
+	// users were added or removed, the rows have to be renumbered
+	if !sameUsers {
+		oAdmin.events.publish(uiEvent{Name: uiEventUsers})
+	} else {
+		for _, client := range changed {
+			oAdmin.events.publish(uiEvent{Name: uiEventUserRow, User: client})
+		}
+	}
+
+	if stats := dashboardStats(current); stats != oAdmin.lastStats {
+		oAdmin.lastStats = stats
+		oAdmin.events.publish(uiEvent{Name: uiEventStats, Stats: stats})
+	}
+}
+
+// renderEvent returns the data of the event as the subscriber with the role should see it
+func (oAdmin *OvpnAdmin) renderEvent(event uiEvent, role string) (string, error) {
+	var buf bytes.Buffer
+	var err error
+	switch event.Name {
+	case uiEventStats:
+		err = oAdmin.htmlTemplates.ExecuteTemplate(&buf, "stats_cards", map[string]interface{}{
+			"Stats": event.Stats,
+		})
+	case uiEventUserRow:
+		err = oAdmin.htmlTemplates.ExecuteTemplate(&buf, "user_rows", map[string]interface{}{
+			"Users":      []OpenvpnClient{event.User},
+			"ServerRole": oAdmin.role,
+			"UserRole":   role,
+			"Modules":    oAdmin.modules,
+		})
+	case uiEventConnection:
+		var data []byte
+		data, err = json.Marshal(uiConnectionEvent{
+			Type:           event.Connection.Type,
+			User:           event.Connection.Client.CommonName,
+			Server:         event.Connection.Server,
+			RealAddress:    event.Connection.Client.RealAddress,
+			VirtualAddress: event.Connection.Client.VirtualAddress,
+		})
+		buf.Write(data)
+	}
+	return buf.String(), err
+}
+
+// writeSSE writes one event in the text/event-stream format, every line of the data gets its own data field
+func writeSSE(w http.ResponseWriter, name, data string) {
+	fmt.Fprintf(w, "event: %s\n", name)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// eventsHandler streams connection, stats and user row changes as Server-Sent Events
+func (oAdmin *OvpnAdmin) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok || oAdmin.events == nil {
+		http.Error(w, "streaming is not supported", http.StatusNotImplemented)
+		return
+	}
+
+	role := oAdmin.requestRole(r)
+	events := oAdmin.events.subscribe()
+	defer oAdmin.events.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(uiEventKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := oAdmin.renderEvent(event, role)
+			if err != nil {
+				log.Errorf("events: can't render %s event: %v", event.Name, err)
+				continue
+			}
+			writeSSE(w, event.Name, data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseStream reads the events of an /events response
+type sseStream struct {
+	t       *testing.T
+	body    io.Closer
+	scanner *bufio.Scanner
+}
+
+func openTestEvents(t *testing.T, oAdmin *OvpnAdmin) *sseStream {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(oAdmin.eventsHandler))
+	t.Cleanup(server.Close)
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %s", ct)
+	}
+
+	stream := &sseStream{t: t, body: resp.Body, scanner: bufio.NewScanner(resp.Body)}
+	// the retry preamble is written once the stream is subscribed
+	if name, _ := stream.next(); name != "" {
+		t.Fatalf("Expected the retry preamble first, got event %s", name)
+	}
+	return stream
+}
+
+// next returns the name and data of the next event
+func (s *sseStream) next() (string, string) {
+	s.t.Helper()
+	var name string
+	var data []string
+	// closing the body ends the scan below
+	timer := time.AfterFunc(5*time.Second, func() { s.body.Close() })
+	defer timer.Stop()
+
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		switch {
+		case line == "":
+			return name, strings.Join(data, "\n")
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	s.t.Fatal("Event stream closed before the next event")
+	return "", ""
+}
+
+func TestEventBroker_DropsSlowSubscriber(t *testing.T) {
+	b := newEventBroker()
+	ch := b.subscribe()
+	for i := 0; i <= uiEventBuffer; i++ {
+		b.publish(uiEvent{Name: uiEventUsers})
+	}
+
+	received := 0
+	for range ch {
+		received++
+	}
+	if received != uiEventBuffer {
+		t.Errorf("Expected %d buffered events before the channel was closed, got %d", uiEventBuffer, received)
+	}
+
+	var nilBroker *eventBroker
+	nilBroker.publish(uiEvent{Name: uiEventUsers})
+}
+
+func TestPublishClientChanges(t *testing.T) {
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.events = newEventBroker()
+	ch := oAdmin.events.subscribe()
+
+	previous := []OpenvpnClient{
+		{Identity: "alice", AccountStatus: "Active", ConnectionStatus: ""},
+		{Identity: "bob", AccountStatus: "Active"},
+	}
+	current := []OpenvpnClient{
+		{Identity: "alice", AccountStatus: "Active", ConnectionStatus: "Connected", Connections: 1, ConnectedTo: []string{"main"}},
+		{Identity: "bob", AccountStatus: "Active"},
+	}
+	oAdmin.publishClientChanges(previous, current)
+
+	row := <-ch
+	if row.Name != uiEventUserRow || row.User.Identity != "alice" {
+		t.Errorf("Expected a row event for alice, got %+v", row)
+	}
+	stats := <-ch
+	if stats.Name != uiEventStats || stats.Stats.ActiveConnections != 1 || stats.Stats.TotalUsers != 2 {
+		t.Errorf("Expected a stats event, got %+v", stats)
+	}
+
+	// unchanged stats are not sent again, a new user reloads the whole table
+	withCarol := append(current, OpenvpnClient{Identity: "carol", AccountStatus: "Revoked"})
+	oAdmin.publishClientChanges(current, withCarol)
+	if e := <-ch; e.Name != uiEventUsers {
+		t.Errorf("Expected a users event, got %+v", e)
+	}
+	if e := <-ch; e.Name != uiEventStats || e.Stats.RevokedUsers != 1 {
+		t.Errorf("Expected a stats event, got %+v", e)
+	}
+
+	oAdmin.publishClientChanges(withCarol, withCarol)
+	select {
+	case e := <-ch:
+		t.Errorf("Expected no event without changes, got %+v", e)
+	default:
+	}
+}
+
+func TestGetClients_ReturnsCopy(t *testing.T) {
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.clients = []OpenvpnClient{{Identity: "alice", AccountStatus: "Active"}}
+
+	users := oAdmin.getClients()
+	users[0].AccountStatus = "Revoked"
+	if oAdmin.clients[0].AccountStatus != "Active" {
+		t.Errorf("Expected getClients to return a copy, the list was changed to %+v", oAdmin.clients)
+	}
+}
+
+func TestEventsHandler_RendersForViewerRole(t *testing.T) {
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.events = newEventBroker()
+	stream := openTestEvents(t, oAdmin)
+
+	oAdmin.events.publish(uiEvent{Name: uiEventUserRow, User: OpenvpnClient{Identity: "alice", AccountStatus: "Active", ConnectionStatus: "Connected", Connections: 1, ConnectedTo: []string{"main"}}})
+	name, data := stream.next()
+	if name != uiEventUserRow || !strings.Contains(data, `id="user-row-alice"`) || !strings.Contains(data, "/users/alice/disconnect") {
+		t.Errorf("Unexpected row event %s: %s", name, data)
+	}
+
+	oAdmin.events.publish(uiEvent{Name: uiEventStats, Stats: DashboardStats{TotalUsers: 7}})
+	name, data = stream.next()
+	if name != uiEventStats || !strings.Contains(data, `<span class="stat-value">7</span>`) {
+		t.Errorf("Unexpected stats event %s: %s", name, data)
+	}
+}
+
+func TestEventsHandler_ConnectionFromMgmt(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	server := newFakeMgmtServer(t)
+
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.events = newEventBroker()
+	startTestMgmt(t, oAdmin, map[string]string{"main": server.addr()}, "main")
+	eventually(t, "read the status", func() bool { return server.countCommands("status 2") == 1 })
+	stream := openTestEvents(t, oAdmin)
+
+	server.push(">CLIENT:ESTABLISHED,1",
+		">CLIENT:ENV,common_name=alice",
+		">CLIENT:ENV,trusted_ip=198.51.100.7",
+		">CLIENT:ENV,trusted_port=41000",
+		">CLIENT:ENV,END")
+
+	seen := map[string]string{}
+	for len(seen) < 3 {
+		name, data := stream.next()
+		seen[name] = data
+	}
+	if !strings.Contains(seen[uiEventConnection], `"type":"connect"`) || !strings.Contains(seen[uiEventConnection], `"user":"alice"`) {
+		t.Errorf("Unexpected connection event: %s", seen[uiEventConnection])
+	}
+	if !strings.Contains(seen[uiEventUserRow], "Online") {
+		t.Errorf("Expected alice's row to be online, got %s", seen[uiEventUserRow])
+	}
+	if !strings.Contains(seen[uiEventStats], `<span class="stat-value">1</span>`) {
+		t.Errorf("Expected one active connection, got %s", seen[uiEventStats])
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	exportFormatOvpn = "ovpn"
+	exportFormatP12  = "p12"
+	exportFormatZip  = "zip"
+)
+
+var errNoPrivateKey = errors.New("no private key is stored, the certificate was signed from a CSR")
+
+// clientExport is a downloadable file with the credentials of a user
+type clientExport struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+type apiExportRequest struct {
+	Format   string `json:"format"`
+	Password string `json:"password"`
+}
+
+// validateExport checks the format and the password a PKCS#12 bundle is encrypted with
+func validateExport(format, password string) error {
+	switch format {
+	case exportFormatOvpn, exportFormatZip:
+		return nil
+	case exportFormatP12:
+		return validatePassword(password)
+	}
+	return fmt.Errorf("unknown export format %q, expected %s, %s or %s", format, exportFormatOvpn, exportFormatP12, exportFormatZip)
+}
+
+// exportClientConfig returns the credentials of the user as an inline .ovpn config, a PKCS#12 bundle or
+// a zip with the config and the certificates and keys it references
+func (oAdmin *OvpnAdmin) exportClientConfig(username, format, password string) (clientExport, error) {
+	if err := validateExport(format, password); err != nil {
+		return clientExport{}, err
+	}
+	conf, err := oAdmin.clientConfig(username)
+	if err != nil {
+		return clientExport{}, fmt.Errorf("can't read certificate of %s: %w", username, err)
+	}
+
+	switch format {
+	case exportFormatP12:
+		return exportPKCS12(oAdmin.storage, username, conf, password)
+	case exportFormatZip:
+		return oAdmin.exportZip(username, conf)
+	}
+	return clientExport{
+		Filename:    username + ".ovpn",
+		ContentType: "application/x-openvpn-profile",
+		Data:        []byte(oAdmin.executeClientConfig(username, conf)),
+	}, nil
+}
+
+func exportPKCS12(storage Storage, username string, conf openvpnClientConfig, password string) (clientExport, error) {
+	if conf.Key == "" {
+		return clientExport{}, errNoPrivateKey
+	}
+	cert, err := decodeCert([]byte(conf.Cert))
+	if err != nil {
+		return clientExport{}, err
+	}
+	key, err := decodePrivKey([]byte(conf.Key))
+	if err != nil {
+		return clientExport{}, err
+	}
+	// every trusted CA, so the bundle still verifies during a CA rollover
+	caCerts, _, err := storage.CertificateAuthorities()
+	if err != nil {
+		return clientExport{}, err
+	}
+	data, err := encodePKCS12(key, cert, caCerts, username, password)
+	if err != nil {
+		return clientExport{}, err
+	}
+	return clientExport{Filename: username + ".p12", ContentType: "application/x-pkcs12", Data: data}, nil
+}
+
+func (oAdmin *OvpnAdmin) exportZip(username string, conf openvpnClientConfig) (clientExport, error) {
+	split := conf
+	split.SplitFiles = true
+	files := []struct{ name, content string }{
+		{username + ".ovpn", oAdmin.executeClientConfig(username, split)},
+		{"ca.crt", conf.CA},
+		{"client.crt", conf.Cert},
+		{"client.key", conf.Key},
+		{tlsKeyFile(conf.TLSMode), conf.TLS},
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	now := time.Now()
+	for _, f := range files {
+		if f.content == "" {
+			continue
+		}
+		header := &zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: now}
+		// the private keys shouldn't be readable by others after unzip
+		header.SetMode(0600)
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return clientExport{}, err
+		}
+		if _, err := fw.Write([]byte(f.content)); err != nil {
+			return clientExport{}, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return clientExport{}, err
+	}
+	return clientExport{Filename: username + ".zip", ContentType: "application/zip", Data: buf.Bytes()}, nil
+}
+
+// writeExport sends the export as a file download
+func (oAdmin *OvpnAdmin) writeExport(w http.ResponseWriter, export clientExport) {
+	w.Header().Set("Content-Type", export.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", export.Filename))
+	_, _ = w.Write(export.Data)
+}
+
+func (oAdmin *OvpnAdmin) userExportHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if status, msg := oAdmin.checkAccess(r, permConfig); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_ = r.ParseForm()
+	username := oAdmin.extractUsername(r)
+	if !oAdmin.userExists(username) {
+		http.Error(w, fmt.Sprintf("User %q not found", username), http.StatusNotFound)
+		return
+	}
+	format, password := r.FormValue("format"), r.FormValue("password")
+	if err := validateExport(format, password); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	export, err := oAdmin.exportClientConfig(username, format, password)
+	switch {
+	case errors.Is(err, errNoPrivateKey):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		log.Errorf("can't export the config of %s: %v", username, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		oAdmin.writeExport(w, export)
+	}
+}
+
+func (oAdmin *OvpnAdmin) modalExportHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	username := oAdmin.extractUsername(r)
+	_, key, _ := oAdmin.storage.ClientCert(username)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := oAdmin.htmlTemplates.ExecuteTemplate(w, "modal_export", map[string]interface{}{
+		"Username":          username,
+		"HasKey":            key != "",
+		"PasswordMinLength": passwordMinLength,
+	})
+	if err != nil {
+		log.Errorf("Error rendering modal_export template: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// apiExportConfig handles GET /api/v1/users/{username}/config?format=ovpn|zip and POST with an apiExportRequest,
+// which a PKCS#12 bundle needs for its password
+func (oAdmin *OvpnAdmin) apiExportConfig(w http.ResponseWriter, r *http.Request, username string) {
+	if !oAdmin.apiAuthorize(w, r, permConfig) || !oAdmin.apiRequireUser(w, username) {
+		return
+	}
+	req := apiExportRequest{Format: r.URL.Query().Get("format")}
+	switch r.Method {
+	case http.MethodGet:
+		if req.Format == exportFormatP12 {
+			writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "a PKCS#12 bundle needs a password, use POST")
+			return
+		}
+	case http.MethodPost:
+		if err := decodeJSONBody(r, &req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	if req.Format == "" {
+		req.Format = exportFormatOvpn
+	}
+	if err := validateExport(req.Format, req.Password); err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+		return
+	}
+
+	export, err := oAdmin.exportClientConfig(username, req.Format, req.Password)
+	switch {
+	case errors.Is(err, errNoPrivateKey):
+		writeAPIError(w, http.StatusConflict, "no_private_key", err.Error())
+	case err != nil:
+		writeAPIError(w, http.StatusInternalServerError, "export_failed", err.Error())
+	default:
+		oAdmin.writeExport(w, export)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+func newTestExportAdmin(t *testing.T) *OvpnAdmin {
+	t.Helper()
+	p := newTestPKI(t)
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.storage = &filesystemStorage{pki: p, ccdDir: t.TempDir()}
+	if err := oAdmin.storage.BuildClient("alice", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	return oAdmin
+}
+
+func TestEncodePKCS12(t *testing.T) {
+	oAdmin := newTestExportAdmin(t)
+	export, err := oAdmin.exportClientConfig("alice", exportFormatP12, "pässword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if export.Filename != "alice.p12" {
+		t.Errorf("Unexpected file name %s", export.Filename)
+	}
+
+	blocks, err := pkcs12.ToPEM(export.Data, "pässword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var certs, keys int
+	for _, b := range blocks {
+		switch b.Type {
+		case "CERTIFICATE":
+			certs++
+		case "PRIVATE KEY", "RSA PRIVATE KEY":
+			keys++
+			if b.Headers["friendlyName"] != "alice" {
+				t.Errorf("Expected the key to be named after the user, got %v", b.Headers)
+			}
+		}
+	}
+	if certs != 2 || keys != 1 {
+		t.Errorf("Expected the client and the CA certificate and the key, got %d certificates and %d keys", certs, keys)
+	}
+
+	if _, err := pkcs12.ToPEM(export.Data, "wrong"); err == nil {
+		t.Error("Expected the wrong password to be rejected")
+	}
+}
+
+func TestExportClientConfig_Zip(t *testing.T) {
+	oAdmin := newTestExportAdmin(t)
+	export, err := oAdmin.exportClientConfig("alice", exportFormatZip, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(export.Data), int64(len(export.Data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		data, _ := io.ReadAll(rc)
+		_ = rc.Close()
+		files[f.Name] = string(data)
+		if f.Mode().Perm() != 0600 {
+			t.Errorf("Expected %s to be readable by the owner only, got %v", f.Name, f.Mode())
+		}
+	}
+
+	certPEM, keyPEM, _ := oAdmin.storage.ClientCert("alice")
+	if files["client.crt"] != certPEM || files["client.key"] != keyPEM {
+		t.Error("Expected the certificate and the key of alice in the zip")
+	}
+	config := files["alice.ovpn"]
+	for _, want := range []string{"\nca ca.crt\n", "\ncert client.crt\n", "\nkey client.key\n", "\ntls-auth ta.key 1"} {
+		if !strings.Contains(config, want) {
+			t.Errorf("Expected %q in the config", want)
+		}
+	}
+	if strings.Contains(config, "<cert>") || strings.Contains(config, "<key>") {
+		t.Errorf("Expected no inline credentials in the config\n%s", config)
+	}
+	if inline := oAdmin.renderClientConfig("alice"); !strings.Contains(inline, "<key>") {
+		t.Error("Expected the download to stay inline")
+	}
+}
+
+func TestAPIExportConfig(t *testing.T) {
+	oAdmin := newTestExportAdmin(t)
+	if err := oAdmin.storage.SignClient(testCSR(t, "token-user"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	call := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var r io.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			r = bytes.NewReader(data)
+		}
+		w := httptest.NewRecorder()
+		oAdmin.apiV1Handler(w, httptest.NewRequest(method, path, r))
+		return w
+	}
+
+	w := call(http.MethodGet, "/api/v1/users/alice/config", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<cert>") {
+		t.Fatalf("Expected the inline config, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := call(http.MethodGet, "/api/v1/users/alice/config?format=zip", nil); w.Header().Get("Content-Disposition") != `attachment; filename="alice.zip"` {
+		t.Errorf("Expected a zip download, got %d %v", w.Code, w.Header())
+	}
+	w = call(http.MethodPost, "/api/v1/users/alice/config", apiExportRequest{Format: exportFormatP12, Password: "secret-pass"})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-pkcs12" {
+		t.Fatalf("Expected a PKCS#12 bundle, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := pkcs12.ToPEM(w.Body.Bytes(), "secret-pass"); err != nil {
+		t.Error(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		status int
+		code   string
+	}{
+		{"password in the URL", http.MethodGet, "/api/v1/users/alice/config?format=p12", nil, http.StatusUnprocessableEntity, "validation_failed"},
+		{"short password", http.MethodPost, "/api/v1/users/alice/config", apiExportRequest{Format: exportFormatP12, Password: "123"}, http.StatusUnprocessableEntity, "validation_failed"},
+		{"unknown format", http.MethodPost, "/api/v1/users/alice/config", apiExportRequest{Format: "pem"}, http.StatusUnprocessableEntity, "validation_failed"},
+		{"no private key", http.MethodPost, "/api/v1/users/token-user/config", apiExportRequest{Format: exportFormatP12, Password: "secret-pass"}, http.StatusConflict, "no_private_key"},
+		{"unknown user", http.MethodGet, "/api/v1/users/nobody/config", nil, http.StatusNotFound, "user_not_found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := call(tt.method, tt.path, tt.body)
+			if w.Code != tt.status || decodeAPIError(t, w).Code != tt.code {
+				t.Errorf("Expected %d %s, got %d: %s", tt.status, tt.code, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestUserExportHandler(t *testing.T) {
+	oAdmin := newTestExportAdmin(t)
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/users/alice/export", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		oAdmin.userExportHandler(w, r)
+		return w
+	}
+
+	w := post(url.Values{"format": {exportFormatP12}, "password": {"secret-pass"}})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Disposition") != `attachment; filename="alice.p12"` {
+		t.Fatalf("Expected a PKCS#12 download, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := post(url.Values{"format": {exportFormatP12}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 without a password, got %d", w.Code)
+	}
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// groupsFile keeps the groups in the pki directory, and in the openvpn-pki-groups secret
+	groupsFile = "groups.json"
+	// ccdGroupsMarker starts the CCD lines rendered from the groups of the user, they aren't read back as user settings
+	ccdGroupsMarker = "# groups:"
+)
+
+// userGroup is a named set of users sharing routes, a static address pool and push options
+type userGroup struct {
+	Name    string     `json:"name"`
+	Members []string   `json:"members"`
+	Routes  []ccdRoute `json:"routes"`
+	// AddressPool is a CIDR inside --ovpn.network, members without a static address get a free address from it
+	AddressPool string `json:"address_pool,omitempty"`
+	// PushOptions are pushed as push "<option>", e.g. dhcp-option DNS 10.0.0.1
+	PushOptions []string `json:"push_options,omitempty"`
+}
+
+func (g userGroup) hasMember(username string) bool {
+	for _, member := range g.Members {
+		if member == username {
+			return true
+		}
+	}
+	return false
+}
+
+// marshalGroups returns the groups sorted by name in the groups.json format
+func marshalGroups(groups []userGroup) ([]byte, error) {
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	if groups == nil {
+		groups = []userGroup{}
+	}
+	return json.MarshalIndent(groups, "", "  ")
+}
+
+func parseGroups(data []byte) ([]userGroup, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	var groups []userGroup
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return nil, fmt.Errorf("can't parse groups: %w", err)
+	}
+	return groups, nil
+}
+
+func findGroup(groups []userGroup, name string) int {
+	for i, g := range groups {
+		if g.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// validateGroup checks the group and normalizes its members, routes, pool and push options
+func (oAdmin *OvpnAdmin) validateGroup(g *userGroup) error {
+	if !validUsername.MatchString(g.Name) {
+		return fmt.Errorf("Group name can only contain %s", usernameRegexp)
+	}
+
+	members := []string{}
+	for _, member := range g.Members {
+		member = strings.TrimSpace(member)
+		if member == "" || containsString(members, member) {
+			continue
+		}
+		if !oAdmin.userExists(member) {
+			return fmt.Errorf("User %q not found", member)
+		}
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	g.Members = members
+
+	if g.Routes == nil {
+		g.Routes = []ccdRoute{}
+	}
+	for _, route := range g.Routes {
+		if _, err := netip.ParseAddr(route.Address); err != nil {
+			return fmt.Errorf("Route address \"%s\" must be a valid IP address", route.Address)
+		}
+		if _, err := netip.ParseAddr(route.Mask); err != nil {
+			return fmt.Errorf("Route mask \"%s\" must be a valid IP address", route.Mask)
+		}
+		if strings.ContainsAny(route.Description, "\r\n") {
+			return fmt.Errorf("Route description %q must be a single line", route.Description)
+		}
+	}
+
+	if g.AddressPool = strings.TrimSpace(g.AddressPool); g.AddressPool != "" {
+		pool, err := netip.ParsePrefix(g.AddressPool)
+		if err != nil {
+			return fmt.Errorf("Address pool \"%s\" must be a CIDR, e.g. 172.16.100.64/26", g.AddressPool)
+		}
+		pool = pool.Masked()
+		m := oAdmin.addressIndex()
+		if !m.contains(pool) {
+			return fmt.Errorf("Address pool \"%s\" not belongs to openvpn server network", g.AddressPool)
+		}
+		if n := m.size(pool); n < len(g.Members) {
+			return fmt.Errorf("Address pool \"%s\" has %d addresses for %d members", pool, n, len(g.Members))
+		}
+		g.AddressPool = pool.String()
+	}
+
+	options := []string{}
+	for _, option := range g.PushOptions {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		if strings.ContainsAny(option, "\"\r\n") {
+			return fmt.Errorf("Push option %q can't contain quotes", option)
+		}
+		options = append(options, option)
+	}
+	g.PushOptions = options
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// setGroupSettings sets the groups of the user and the routes and push options they add to the CCD, and returns
+// the first address pool of the groups. Routes of the user win over group routes to the same network.
+func setGroupSettings(ccd *Ccd, groups []userGroup) string {
+	ccd.Groups, ccd.GroupRoutes, ccd.GroupPushOptions = nil, nil, nil
+	pool := ""
+	routes := map[string]bool{}
+	for _, route := range ccd.CustomRoutes {
+		routes[route.Address+" "+route.Mask] = true
+	}
+	for _, g := range groups {
+		if !g.hasMember(ccd.User) {
+			continue
+		}
+		ccd.Groups = append(ccd.Groups, g.Name)
+		for _, route := range g.Routes {
+			if !routes[route.Address+" "+route.Mask] {
+				routes[route.Address+" "+route.Mask] = true
+				ccd.GroupRoutes = append(ccd.GroupRoutes, route)
+			}
+		}
+		for _, option := range g.PushOptions {
+			if !containsString(ccd.GroupPushOptions, option) {
+				ccd.GroupPushOptions = append(ccd.GroupPushOptions, option)
+			}
+		}
+		if pool == "" {
+			pool = g.AddressPool
+		}
+	}
+	return pool
+}
+
+// writeCcd renders the CCD of the user merged with the groups of the user, stores it and updates the address index.
+// A user without a static address gets the address they already have from the pool of their group, or a free one.
+func (oAdmin *OvpnAdmin) writeCcd(ccd Ccd) error {
+	groups, err := oAdmin.storage.Groups()
+	if err != nil {
+		return fmt.Errorf("can't read groups: %w", err)
+	}
+	pool := setGroupSettings(&ccd, groups)
+	m := oAdmin.addressIndex()
+	address := ""
+	ccd.GroupAddress = ""
+	if ccd.ClientAddress != "dynamic" {
+		address = ccd.ClientAddress
+	} else if pool != "" {
+		prefix, err := netip.ParsePrefix(pool)
+		if err != nil {
+			return err
+		}
+		if ccd.GroupAddress, err = m.next(ccd.User, prefix); err != nil {
+			return err
+		}
+		address = ccd.GroupAddress
+	}
+
+	previous := m.address(ccd.User)
+	if err := m.claim(ccd.User, address); err != nil {
+		return err
+	}
+	content, err := oAdmin.renderCcd(ccd)
+	if err == nil {
+		err = oAdmin.storage.WriteCcd(ccd.User, content)
+	}
+	if err != nil {
+		m.set(ccd.User, previous)
+	}
+	return err
+}
+
+// ccdChange is the CCD of a member before and after a group change rendered it again
+type ccdChange struct {
+	User   string
+	Before string
+	After  string
+	Err    error
+}
+
+// applyGroups renders the CCD of the users again after their groups changed and returns the changed CCDs
+func (oAdmin *OvpnAdmin) applyGroups(usernames []string) ([]ccdChange, error) {
+	var changes []ccdChange
+	var errs []error
+	for _, username := range usernames {
+		if !oAdmin.userExists(username) {
+			continue
+		}
+		change := ccdChange{User: username, Before: oAdmin.readCcd(username)}
+		if change.Err = oAdmin.writeCcd(oAdmin.parseCcd(username)); change.Err != nil {
+			log.Errorf("groups: can't update the ccd of %s: %v", username, change.Err)
+			errs = append(errs, fmt.Errorf("%s: %w", username, change.Err))
+		}
+		change.After = oAdmin.readCcd(username)
+		if change.Err != nil || change.After != change.Before {
+			changes = append(changes, change)
+		}
+	}
+	return changes, errors.Join(errs...)
+}
+
+// saveGroup creates or replaces the validated group and updates the CCD of its old and new members
+func (oAdmin *OvpnAdmin) saveGroup(g userGroup) ([]ccdChange, error) {
+	oAdmin.groupsMu.Lock()
+	defer oAdmin.groupsMu.Unlock()
+
+	groups, err := oAdmin.storage.Groups()
+	if err != nil {
+		return nil, err
+	}
+	members := g.Members
+	if i := findGroup(groups, g.Name); i >= 0 {
+		members = append(members, groups[i].Members...)
+		groups[i] = g
+	} else {
+		groups = append(groups, g)
+	}
+	if err = oAdmin.storage.WriteGroups(groups); err != nil {
+		return nil, err
+	}
+	return oAdmin.applyGroups(members)
+}
+
+// deleteGroup removes the group and its settings from the CCD of its members
+func (oAdmin *OvpnAdmin) deleteGroup(name string) ([]ccdChange, error) {
+	oAdmin.groupsMu.Lock()
+	defer oAdmin.groupsMu.Unlock()
+
+	groups, err := oAdmin.storage.Groups()
+	if err != nil {
+		return nil, err
+	}
+	i := findGroup(groups, name)
+	if i < 0 {
+		return nil, nil
+	}
+	members := groups[i].Members
+	if err = oAdmin.storage.WriteGroups(append(groups[:i], groups[i+1:]...)); err != nil {
+		return nil, err
+	}
+	return oAdmin.applyGroups(members)
+}
+
+// removeGroupMember takes a deleted user out of every group
+func (oAdmin *OvpnAdmin) removeGroupMember(username string) error {
+	oAdmin.groupsMu.Lock()
+	defer oAdmin.groupsMu.Unlock()
+
+	groups, err := oAdmin.storage.Groups()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for i, g := range groups {
+		if !g.hasMember(username) {
+			continue
+		}
+		members := []string{}
+		for _, member := range g.Members {
+			if member != username {
+				members = append(members, member)
+			}
+		}
+		groups[i].Members = members
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return oAdmin.storage.WriteGroups(groups)
+}
+
+// groups returns the groups, logging instead of failing for pages
+func (oAdmin *OvpnAdmin) groups() []userGroup {
+	groups, err := oAdmin.storage.Groups()
+	if err != nil {
+		log.Errorf("groups: %v", err)
+	}
+	return groups
+}
+
+// parseGroupForm reads a group from the group modal form: one member per line or separated by commas,
+// one "ADDRESS MASK [description]" route and one push option per line
+func parseGroupForm(r *http.Request) (userGroup, error) {
+	g := userGroup{
+		Name:        strings.TrimSpace(r.FormValue("name")),
+		Members:     splitFormList(r.FormValue("members")),
+		AddressPool: r.FormValue("addressPool"),
+		PushOptions: strings.Split(r.FormValue("pushOptions"), "\n"),
+	}
+	var err error
+	g.Routes, err = parseRouteLines(r.FormValue("routes"))
+	return g, err
+}
+
+// auditGroup records a change of a group and the CCDs of its members the change rendered again
+func (oAdmin *OvpnAdmin) auditGroup(r *http.Request, name string, changes []ccdChange, err error, message string) {
+	if err != nil {
+		message = err.Error()
+	}
+	oAdmin.audit(r, auditEntry{Action: auditActionGroup, Target: name, Result: auditResult(err == nil), Message: message})
+	for _, change := range changes {
+		entry := auditEntry{
+			Action:    auditActionGroup,
+			Target:    change.User,
+			Result:    auditResult(change.Err == nil),
+			Message:   fmt.Sprintf("ccd updated by group %s", name),
+			CcdBefore: &change.Before,
+			CcdAfter:  &change.After,
+		}
+		if change.Err != nil {
+			entry.Message = change.Err.Error()
+		}
+		oAdmin.audit(r, entry)
+	}
+}
+
+func (oAdmin *OvpnAdmin) groupsPageHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+
+	data := oAdmin.pageData(r, "groups")
+	data["CcdEnabled"] = *ccdEnabled
+	data["Groups"] = oAdmin.groups()
+	if *ccdEnabled {
+		data["AddressPools"] = oAdmin.addressPoolUsage()
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := oAdmin.htmlTemplates.ExecuteTemplate(w, "base", data); err != nil {
+		log.Errorf("Error rendering groups template: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// addressPoolsHandler renders the address pool utilisation (HTMX partial)
+func (oAdmin *OvpnAdmin) addressPoolsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := oAdmin.htmlTemplates.ExecuteTemplate(w, "address_pools", oAdmin.addressPoolUsage()); err != nil {
+		log.Errorf("Error rendering address_pools template: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// groupRowsHandler renders the group table (HTMX partial)
+func (oAdmin *OvpnAdmin) groupRowsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+
+	data := oAdmin.pageData(r, "groups")
+	data["Groups"] = oAdmin.groups()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := oAdmin.htmlTemplates.ExecuteTemplate(w, "group_rows", data); err != nil {
+		log.Errorf("Error rendering group_rows template: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// modalGroupHandler renders the editor of the group in /modal/group/{name}, a new group without a name
+func (oAdmin *OvpnAdmin) modalGroupHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, *listenBaseUrl+"modal/group"), "/")
+	g := userGroup{}
+	if name != "" {
+		groups := oAdmin.groups()
+		i := findGroup(groups, name)
+		if i < 0 {
+			http.Error(w, fmt.Sprintf("Group %q not found", name), http.StatusNotFound)
+			return
+		}
+		g = groups[i]
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := oAdmin.htmlTemplates.ExecuteTemplate(w, "modal_group", map[string]interface{}{
+		"Group":      g,
+		"New":        name == "",
+		"ServerRole": oAdmin.role,
+		"UserRole":   oAdmin.requestRole(r),
+	})
+	if err != nil {
+		log.Errorf("Error rendering modal_group template: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// groupSaveHandler creates or replaces the group posted from the group modal
+func (oAdmin *OvpnAdmin) groupSaveHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if status, msg := oAdmin.checkAccess(r, permCcd); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+	_ = r.ParseForm()
+
+	g, err := parseGroupForm(r)
+	if err == nil {
+		err = oAdmin.validateGroup(&g)
+	}
+	var changes []ccdChange
+	if err == nil {
+		changes, err = oAdmin.saveGroup(g)
+	}
+	oAdmin.auditGroup(r, g.Name, changes, err, "group saved")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err != nil {
+		if tplErr := oAdmin.htmlTemplates.ExecuteTemplate(w, "alert_error", map[string]interface{}{"Message": err.Error()}); tplErr != nil {
+			log.Errorf("Error rendering alert template: %v", tplErr)
+		}
+		return
+	}
+	w.Header().Set("HX-Trigger", `{"showToast": {"message": "Group `+g.Name+` saved", "type": "success"}, "groupsChanged": true}`)
+	if err := oAdmin.htmlTemplates.ExecuteTemplate(w, "alert_success", map[string]interface{}{
+		"Message": fmt.Sprintf("Group saved, the CCD of %d members updated", len(g.Members)),
+	}); err != nil {
+		log.Errorf("Error rendering alert template: %v", err)
+	}
+}
+
+// groupDeleteHandler deletes the group in DELETE /groups/{name} and renders the group table
+func (oAdmin *OvpnAdmin) groupDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if status, msg := oAdmin.checkAccess(r, permCcd); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, *listenBaseUrl+"groups/"), "/")
+	changes, err := oAdmin.deleteGroup(name)
+	oAdmin.auditGroup(r, name, changes, err, "group deleted")
+	if err != nil {
+		w.Header().Set("HX-Trigger", fmt.Sprintf(`{"showToast": {"message": %q, "type": "danger"}}`, err.Error()))
+	} else {
+		w.Header().Set("HX-Trigger", `{"showToast": {"message": "Group `+name+` deleted", "type": "success"}}`)
+	}
+	oAdmin.groupRowsHandler(w, r)
+}
+
+// apiGroupsHandler serves /api/v1/groups and /api/v1/groups/{name}
+func (oAdmin *OvpnAdmin) apiGroupsHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	if !*ccdEnabled {
+		writeAPIError(w, http.StatusNotImplemented, "not_enabled", "client-config-dir is not enabled")
+		return
+	}
+	if len(parts) > 1 {
+		writeAPIError(w, http.StatusNotFound, "not_found", fmt.Sprintf("Unknown API endpoint %q", r.URL.Path))
+		return
+	}
+	name := ""
+	if len(parts) == 1 {
+		name = parts[0]
+	}
+
+	groups, err := oAdmin.storage.Groups()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "groups_read_failed", err.Error())
+		return
+	}
+	i := findGroup(groups, name)
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		if groups == nil {
+			groups = []userGroup{}
+		}
+		writeJSON(w, http.StatusOK, apiGroupsResponse{Groups: groups})
+	case name == "" && r.Method == http.MethodPost, name != "" && r.Method == http.MethodPut:
+		oAdmin.apiSaveGroup(w, r, name, i >= 0)
+	case name != "" && i < 0:
+		writeAPIError(w, http.StatusNotFound, "group_not_found", fmt.Sprintf("Group %q not found", name))
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, groups[i])
+	case r.Method == http.MethodDelete:
+		if !oAdmin.apiAuthorize(w, r, permCcd) {
+			return
+		}
+		changes, err := oAdmin.deleteGroup(name)
+		oAdmin.auditGroup(r, name, changes, err, "group deleted")
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "ccd_update_failed", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusNoContent, nil)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+	}
+}
+
+// apiSaveGroup creates a group with POST /groups, or creates or replaces the group named in PUT /groups/{name}
+func (oAdmin *OvpnAdmin) apiSaveGroup(w http.ResponseWriter, r *http.Request, name string, exists bool) {
+	if !oAdmin.apiAuthorize(w, r, permCcd) {
+		return
+	}
+	var g userGroup
+	if err := decodeJSONBody(r, &g); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if name != "" {
+		g.Name = name
+	} else if groups, _ := oAdmin.storage.Groups(); findGroup(groups, g.Name) >= 0 {
+		writeAPIError(w, http.StatusConflict, "group_exists", fmt.Sprintf("Group %q already exists", g.Name))
+		return
+	}
+	if err := oAdmin.validateGroup(&g); err != nil {
+		oAdmin.auditGroup(r, g.Name, nil, err, "")
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+		return
+	}
+	changes, err := oAdmin.saveGroup(g)
+	oAdmin.auditGroup(r, g.Name, changes, err, "group saved")
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "ccd_update_failed", err.Error())
+		return
+	}
+	status := http.StatusOK
+	if name == "" || !exists {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, g)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestGroupsAdmin returns an admin with alice, bob and carol, the CCD enabled and the default OpenVPN network
+func newTestGroupsAdmin(t *testing.T) *OvpnAdmin {
+	t.Helper()
+	oldNetwork, oldCcd := *openvpnNetwork, *ccdEnabled
+	*openvpnNetwork, *ccdEnabled = "172.16.100.0/24", true
+	t.Cleanup(func() { *openvpnNetwork, *ccdEnabled = oldNetwork, oldCcd })
+
+	oAdmin := newTestExportAdmin(t)
+	for _, name := range []string{"bob", "carol"} {
+		if err := oAdmin.storage.BuildClient(name, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return oAdmin
+}
+
+func testSaveGroup(t *testing.T, oAdmin *OvpnAdmin, g userGroup) {
+	t.Helper()
+	if err := oAdmin.validateGroup(&g); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := oAdmin.saveGroup(g); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupCcd(t *testing.T) {
+	oAdmin := newTestGroupsAdmin(t)
+	own := ccdRoute{Address: "192.168.1.0", Mask: "255.255.255.0", Description: "home"}
+	if ok, msg := oAdmin.modifyCcd(Ccd{User: "alice", ClientAddress: "dynamic", CustomRoutes: []ccdRoute{own}}); !ok {
+		t.Fatal(msg)
+	}
+
+	testSaveGroup(t, oAdmin, userGroup{
+		Name:        "sre",
+		Members:     []string{"bob", "alice"},
+		Routes:      []ccdRoute{{Address: "10.0.0.0", Mask: "255.255.0.0", Description: "prod"}, {Address: "192.168.1.0", Mask: "255.255.255.0"}},
+		AddressPool: "172.16.100.64/29",
+		PushOptions: []string{"dhcp-option DNS 10.0.0.53"},
+	})
+
+	ccd := oAdmin.readCcd("alice")
+	for _, line := range []string{"# groups: sre", "ifconfig-push 172.16.100.65 255.255.255.0", `push "route 10.0.0.0 255.255.0.0" # prod`, `push "dhcp-option DNS 10.0.0.53"`} {
+		if !strings.Contains(ccd, line) {
+			t.Errorf("Expected %q in the CCD of alice, got\n%s", line, ccd)
+		}
+	}
+	if strings.Count(ccd, "192.168.1.0") != 1 {
+		t.Errorf("Expected the route of alice to win over the group route, got\n%s", ccd)
+	}
+	if got := oAdmin.getCcd("alice"); got.ClientAddress != "dynamic" || len(got.CustomRoutes) != 1 || got.GroupAddress != "172.16.100.65" || len(got.GroupRoutes) != 1 {
+		t.Errorf("Expected the settings of alice apart from the group ones, got %+v", got)
+	}
+	if addr := oAdmin.getCcd("bob").GroupAddress; addr != "172.16.100.66" {
+		t.Errorf("Expected bob to get the next pool address, got %q", addr)
+	}
+
+	// a static address of the user wins over the pool, the others keep their pool address
+	if ok, msg := oAdmin.modifyCcd(Ccd{User: "alice", ClientAddress: "172.16.100.10", CustomRoutes: []ccdRoute{own}}); !ok {
+		t.Fatal(msg)
+	}
+	if got := oAdmin.getCcd("alice"); got.ClientAddress != "172.16.100.10" || got.GroupAddress != "" || len(got.Groups) != 1 {
+		t.Errorf("Expected the static address of alice instead of the pool, got %+v", got)
+	}
+	testSaveGroup(t, oAdmin, userGroup{Name: "sre", Members: []string{"bob", "carol"}, AddressPool: "172.16.100.64/29"})
+	if addr := oAdmin.getCcd("bob").GroupAddress; addr != "172.16.100.66" {
+		t.Errorf("Expected bob to keep his pool address, got %q", addr)
+	}
+	if addr := oAdmin.getCcd("carol").GroupAddress; addr != "172.16.100.65" {
+		t.Errorf("Expected carol to get the address alice gave up, got %q", addr)
+	}
+	if ccd := oAdmin.readCcd("bob"); strings.Contains(ccd, "10.0.0.0") {
+		t.Errorf("Expected the removed group route to be gone, got\n%s", ccd)
+	}
+
+	if _, err := oAdmin.deleteGroup("sre"); err != nil {
+		t.Fatal(err)
+	}
+	if ccd := oAdmin.readCcd("carol"); strings.Contains(ccd, ccdGroupsMarker) || strings.Contains(ccd, "ifconfig-push") {
+		t.Errorf("Expected the group settings to be removed, got\n%s", ccd)
+	}
+	if groups, err := oAdmin.storage.Groups(); err != nil || len(groups) != 0 {
+		t.Errorf("Expected no groups, got %v (%v)", groups, err)
+	}
+}
+
+func TestValidateGroup(t *testing.T) {
+	oAdmin := newTestGroupsAdmin(t)
+	tests := []struct {
+		name  string
+		group userGroup
+		err   string
+	}{
+		{"bad name", userGroup{Name: "s r e"}, "Group name"},
+		{"unknown member", userGroup{Name: "sre", Members: []string{"mallory"}}, "not found"},
+		{"bad route", userGroup{Name: "sre", Routes: []ccdRoute{{Address: "10.0.0", Mask: "255.0.0.0"}}}, "valid IP"},
+		{"multi-line route description", userGroup{Name: "sre", Routes: []ccdRoute{{Address: "10.0.0.0", Mask: "255.0.0.0", Description: "lab\npush \"redirect-gateway def1\""}}}, "single line"},
+		{"pool outside the network", userGroup{Name: "sre", AddressPool: "10.0.0.0/24"}, "openvpn server network"},
+		{"pool too small", userGroup{Name: "sre", Members: []string{"alice", "bob", "carol"}, AddressPool: "172.16.100.64/31"}, "2 addresses for 3 members"},
+		{"quoted push option", userGroup{Name: "sre", PushOptions: []string{`route "x"`}}, "quotes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := oAdmin.validateGroup(&tt.group); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	g := userGroup{Name: "sre", Members: []string{"bob", " alice", "bob", ""}, AddressPool: "172.16.100.70/28", PushOptions: []string{" redirect-gateway def1 ", ""}}
+	if err := oAdmin.validateGroup(&g); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(g.Members, ",") != "alice,bob" || g.AddressPool != "172.16.100.64/28" || len(g.PushOptions) != 1 || g.Routes == nil {
+		t.Errorf("Expected the group to be normalized, got %+v", g)
+	}
+}
+
+func TestRemoveGroupMember(t *testing.T) {
+	oAdmin := newTestGroupsAdmin(t)
+	testSaveGroup(t, oAdmin, userGroup{Name: "sre", Members: []string{"alice", "bob"}})
+	testSaveGroup(t, oAdmin, userGroup{Name: "dev", Members: []string{"alice"}})
+
+	if err := oAdmin.removeGroupMember("alice"); err != nil {
+		t.Fatal(err)
+	}
+	groups, _ := oAdmin.storage.Groups()
+	if len(groups) != 2 || groups[0].Name != "dev" || len(groups[0].Members) != 0 || strings.Join(groups[1].Members, ",") != "bob" {
+		t.Errorf("Expected alice to be removed from both groups, got %+v", groups)
+	}
+}
+
+func TestAPIGroups(t *testing.T) {
+	oAdmin := newTestGroupsAdmin(t)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		oAdmin.apiV1Handler(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	body := `{"name": "sre", "members": ["alice"], "routes": [{"Address": "10.0.0.0", "Mask": "255.0.0.0", "Description": ""}]}`
+	if w := do(http.MethodPost, "/api/v1/groups", body); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodPost, "/api/v1/groups", body); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for an existing group, got %d", w.Code)
+	}
+	if w := do(http.MethodPut, "/api/v1/groups/dev", `{"members": ["mallory"]}`); w.Code != http.StatusUnprocessableEntity || decodeAPIError(t, w).Code != "validation_failed" {
+		t.Errorf("Expected status 422 for an unknown member, got %d", w.Code)
+	}
+	if w := do(http.MethodPut, "/api/v1/groups/sre", `{"members": ["alice", "bob"]}`); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for a replaced group, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(oAdmin.readCcd("bob"), "# groups: sre") {
+		t.Error("Expected the CCD of the new member to be rendered")
+	}
+
+	w := do(http.MethodGet, "/api/v1/groups", "")
+	var resp apiGroupsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Groups) != 1 || len(resp.Groups[0].Members) != 2 {
+		t.Errorf("Expected the sre group with two members, got %s", w.Body.String())
+	}
+
+	if w := do(http.MethodDelete, "/api/v1/groups/sre", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/api/v1/groups/sre", ""); w.Code != http.StatusNotFound || decodeAPIError(t, w).Code != "group_not_found" {
+		t.Errorf("Expected status 404 for a deleted group, got %d", w.Code)
+	}
+}
+
+func TestAPIGroups_AuditsMemberCcd(t *testing.T) {
+	oAdmin := newTestGroupsAdmin(t)
+	oAdmin.auditLog = newAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	do := func(method, path, body string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		oAdmin.apiV1Handler(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		if w.Code >= 300 {
+			t.Fatalf("%s %s: got %d: %s", method, path, w.Code, w.Body.String())
+		}
+	}
+
+	do(http.MethodPost, "/api/v1/groups", `{"name": "sre", "members": ["alice"], "routes": [{"Address": "10.0.0.0", "Mask": "255.0.0.0", "Description": ""}]}`)
+	do(http.MethodDelete, "/api/v1/groups/sre", "")
+
+	entries, err := oAdmin.auditLog.query(auditFilter{Action: auditActionGroup, Target: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected the save and the delete to record the CCD of alice, got %+v", entries)
+	}
+	// newest first
+	deleted, saved := entries[0], entries[1]
+	if saved.CcdBefore == nil || saved.CcdAfter == nil || strings.Contains(*saved.CcdBefore, "# groups: sre") || !strings.Contains(*saved.CcdAfter, "# groups: sre") {
+		t.Errorf("Expected the save to record the CCD of alice before and after, got %+v", saved)
+	}
+	if deleted.CcdAfter == nil || strings.Contains(*deleted.CcdAfter, "# groups: sre") || deleted.Message != "ccd updated by group sre" {
+		t.Errorf("Expected the delete to record the CCD of alice without the group, got %+v", deleted)
+	}
+	if groupEntries, _ := oAdmin.auditLog.query(auditFilter{Action: auditActionGroup, Target: "sre"}); len(groupEntries) != 2 {
+		t.Errorf("Expected the save and the delete of the group, got %+v", groupEntries)
+	}
+}
+
+func TestGroupsPage(t *testing.T) {
+	oAdmin := newTestGroupsAdmin(t)
+	oAdmin.modules = append(oAdmin.modules, "ccd")
+	testSaveGroup(t, oAdmin, userGroup{Name: "sre", Members: []string{"alice"}, AddressPool: "172.16.100.64/29"})
+
+	w := httptest.NewRecorder()
+	oAdmin.groupsPageHandler(w, httptest.NewRequest(http.MethodGet, "/groups", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "172.16.100.64/29") || !strings.Contains(w.Body.String(), `hx-delete="/groups/sre"`) {
+		t.Errorf("Expected the sre group on the page, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	oAdmin.userShowCcdHandler(w, httptest.NewRequest(http.MethodGet, "/modal/ccd/alice", nil))
+	if !strings.Contains(w.Body.String(), "From Groups") || !strings.Contains(w.Body.String(), "172.16.100.65") {
+		t.Errorf("Expected the group settings in the CCD modal, got\n%s", w.Body.String())
+	}
+}
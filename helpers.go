@@ -42,6 +42,18 @@ func runBash(script string) string {
 	return string(stdout)
 }
 
+// runOpenvpnUser runs openvpn-user without a shell, so a password can't break or extend the command
+func runOpenvpnUser(args ...string) string {
+	// the arguments may contain a password
+	log.Debugln("openvpn-user", args[0])
+	cmd := exec.Command("openvpn-user", args...)
+	stdout, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Sprint(err) + " : " + string(stdout)
+	}
+	return string(stdout)
+}
+
 func fExist(path string) bool {
 	var _, err = os.Stat(path)
 
@@ -86,6 +98,28 @@ func fWrite(path, content string) error {
 	return nil
 }
 
+// fWriteAtomic replaces the file through a temporary file in the same directory,
+// readers see either the old or the new content
+func fWriteAtomic(path string, content []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(content); err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
 func fDelete(path string) error {
 	err := os.Remove(path)
 	if err != nil {
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	historyDefaultLimit  = 100
+	historyPruneInterval = time.Hour
+)
+
+// sessionRecord is one VPN session, DisconnectedAt is nil while the client is still connected
+type sessionRecord struct {
+	Username        string     `json:"username"`
+	RealAddress     string     `json:"real_address"`
+	VirtualAddress  string     `json:"virtual_address,omitempty"`
+	Server          string     `json:"server"`
+	ConnectedAt     time.Time  `json:"connected_at"`
+	DisconnectedAt  *time.Time `json:"disconnected_at,omitempty"`
+	BytesReceived   int64      `json:"bytes_received"`
+	BytesSent       int64      `json:"bytes_sent"`
+	DurationSeconds int64      `json:"duration_seconds"`
+}
+
+type sessionFilter struct {
+	Username string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+// sessionHistory keeps finished sessions in a JSON Lines file and the open ones in memory,
+// a nil history records nothing
+type sessionHistory struct {
+	mu          sync.Mutex
+	path        string
+	retention   time.Duration
+	maxSessions int
+	timeFormat  string
+
+	open     map[string]sessionRecord // by server and client key
+	lastSeen map[string]time.Time
+}
+
+func newSessionHistory(path string, retention time.Duration, maxSessions int, timeFormat string) *sessionHistory {
+	h := &sessionHistory{
+		path:        path,
+		retention:   retention,
+		maxSessions: maxSessions,
+		timeFormat:  timeFormat,
+		open:        make(map[string]sessionRecord),
+		lastSeen:    make(map[string]time.Time),
+	}
+	err := h.each(func(rec sessionRecord) error {
+		h.seen(rec)
+		return nil
+	})
+	if err != nil {
+		log.Errorf("history: can't read %s: %v", path, err)
+	}
+	return h
+}
+
+func (rec sessionRecord) overlaps(f sessionFilter) bool {
+	switch {
+	case f.Username != "" && rec.Username != f.Username:
+		return false
+	case !f.Until.IsZero() && rec.ConnectedAt.After(f.Until):
+		return false
+	case !f.Since.IsZero() && rec.DisconnectedAt != nil && rec.DisconnectedAt.Before(f.Since):
+		return false
+	}
+	return true
+}
+
+func (h *sessionHistory) seen(rec sessionRecord) {
+	if rec.DisconnectedAt != nil && rec.DisconnectedAt.After(h.lastSeen[rec.Username]) {
+		h.lastSeen[rec.Username] = *rec.DisconnectedAt
+	}
+}
+
+func sessionKey(server string, client clientStatus) string {
+	return server + "/" + client.key()
+}
+
+func (h *sessionHistory) record(server string, client clientStatus) sessionRecord {
+	rec := sessionRecord{
+		Username:       client.CommonName,
+		RealAddress:    client.RealAddress,
+		VirtualAddress: client.VirtualAddress,
+		Server:         server,
+		ConnectedAt:    time.Now().UTC(),
+	}
+	if t, err := time.ParseInLocation(h.timeFormat, client.ConnectedSince, time.Local); err == nil && client.ConnectedSince != "" {
+		rec.ConnectedAt = t.UTC()
+	}
+	rec.BytesReceived, _ = strconv.ParseInt(client.BytesReceived, 10, 64)
+	rec.BytesSent, _ = strconv.ParseInt(client.BytesSent, 10, 64)
+	return rec
+}
+
+// update starts or updates the session of a connected client
+func (h *sessionHistory) update(server string, client clientStatus) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.updateLocked(server, client)
+}
+
+func (h *sessionHistory) updateLocked(server string, client clientStatus) {
+	key := sessionKey(server, client)
+	rec, ok := h.open[key]
+	if !ok {
+		h.open[key] = h.record(server, client)
+		return
+	}
+	latest := h.record(server, client)
+	rec.BytesReceived, rec.BytesSent = latest.BytesReceived, latest.BytesSent
+	if rec.VirtualAddress == "" {
+		rec.VirtualAddress = latest.VirtualAddress
+	}
+	h.open[key] = rec
+}
+
+// finish closes the session of a disconnected client and writes it to the file
+func (h *sessionHistory) finish(server string, client clientStatus, at time.Time) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.finishLocked(server, client, at)
+}
+
+func (h *sessionHistory) finishLocked(server string, client clientStatus, at time.Time) {
+	h.updateLocked(server, client)
+	h.closeLocked(sessionKey(server, client), at)
+}
+
+func (h *sessionHistory) closeLocked(key string, at time.Time) {
+	rec := h.open[key]
+	delete(h.open, key)
+
+	at = at.UTC()
+	rec.DisconnectedAt = &at
+	rec.DurationSeconds = int64(at.Sub(rec.ConnectedAt).Seconds())
+	h.seen(rec)
+	if err := h.append(rec); err != nil {
+		log.Errorf("history: can't write session of %s: %v", rec.Username, err)
+	}
+}
+
+// reconcile matches the open sessions of a server with its current client list,
+// sessions of clients that are gone are finished at the given time
+func (h *sessionHistory) reconcile(server string, clients []clientStatus, at time.Time) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	current := make(map[string]bool, len(clients))
+	for _, client := range clients {
+		h.updateLocked(server, client)
+		current[sessionKey(server, client)] = true
+	}
+	for key, rec := range h.open {
+		if rec.Server == server && !current[key] {
+			h.closeLocked(key, at)
+		}
+	}
+}
+
+// lastSeenOf returns when the user's last session ended, zero if never
+func (h *sessionHistory) lastSeenOf(username string) time.Time {
+	if h == nil {
+		return time.Time{}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastSeen[username]
+}
+
+func (h *sessionHistory) append(rec sessionRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (h *sessionHistory) each(fn func(sessionRecord) error) error {
+	file, err := os.Open(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec sessionRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Warnf("history: skipping malformed session: %v", err)
+			continue
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// query returns the sessions overlapping the filter, open sessions included, newest first
+func (h *sessionHistory) query(filter sessionFilter) ([]sessionRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var sessions []sessionRecord
+	err := h.each(func(rec sessionRecord) error {
+		if rec.overlaps(filter) {
+			sessions = append(sessions, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	var open []sessionRecord
+	for _, rec := range h.open {
+		rec.DurationSeconds = int64(now.Sub(rec.ConnectedAt).Seconds())
+		if rec.overlaps(filter) {
+			open = append(open, rec)
+		}
+	}
+	sort.Slice(open, func(i, j int) bool { return open[i].ConnectedAt.After(open[j].ConnectedAt) })
+
+	for i, j := 0, len(sessions)-1; i < j; i, j = i+1, j-1 {
+		sessions[i], sessions[j] = sessions[j], sessions[i]
+	}
+	sessions = append(open, sessions...)
+	if filter.Limit > 0 && len(sessions) > filter.Limit {
+		sessions = sessions[:filter.Limit]
+	}
+	return sessions, nil
+}
+
+// prune drops sessions that ended before the retention period and the oldest ones above maxSessions
+func (h *sessionHistory) prune(now time.Time) error {
+	if h == nil || (h.retention <= 0 && h.maxSessions <= 0) {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var kept []sessionRecord
+	dropped := 0
+	err := h.each(func(rec sessionRecord) error {
+		if h.retention > 0 && rec.DisconnectedAt != nil && rec.DisconnectedAt.Before(now.Add(-h.retention)) {
+			dropped++
+			return nil
+		}
+		kept = append(kept, rec)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if h.maxSessions > 0 && len(kept) > h.maxSessions {
+		dropped += len(kept) - h.maxSessions
+		kept = kept[len(kept)-h.maxSessions:]
+	}
+	if dropped == 0 {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(h.path), filepath.Base(h.path)+".*")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(tmp)
+	for _, rec := range kept {
+		if err := encoder.Encode(rec); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), h.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	log.Infof("history: pruned %d sessions", dropped)
+	return nil
+}
+
+func (h *sessionHistory) pruneLoop() {
+	for {
+		if err := h.prune(time.Now()); err != nil {
+			log.Errorf("history: can't prune %s: %v", h.path, err)
+		}
+		time.Sleep(historyPruneInterval)
+	}
+}
+
+// historyHandleEvent keeps the session history in step with the management interfaces
+func (oAdmin *OvpnAdmin) historyHandleEvent(event mgmtEvent) {
+	switch event.Type {
+	case mgmtEventConnect, mgmtEventBytecount:
+		oAdmin.history.update(event.Server, event.Client)
+	case mgmtEventDisconnect:
+		oAdmin.history.finish(event.Server, event.Client, time.Now())
+	case mgmtEventSync:
+		if client, ok := oAdmin.mgmtClients[event.Server]; ok {
+			oAdmin.history.reconcile(event.Server, client.snapshot(), time.Now())
+		}
+	}
+}
+
+func parseSessionFilter(r *http.Request) (sessionFilter, error) {
+	q := r.URL.Query()
+	filter := sessionFilter{
+		Username: q.Get("user"),
+		Limit:    historyDefaultLimit,
+	}
+
+	for name, dest := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := q.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+			}
+			*dest = t
+		}
+	}
+
+	if value := q.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return filter, errors.New("limit must be a non-negative number")
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+type apiSessionsResponse struct {
+	Sessions []sessionRecord `json:"sessions"`
+}
+
+// apiSessionsHandler serves /api/v1/sessions
+func (oAdmin *OvpnAdmin) apiSessionsHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) > 0 && parts[0] != "" {
+		writeAPIError(w, http.StatusNotFound, "not_found", fmt.Sprintf("Unknown API endpoint %q", r.URL.Path))
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	if !oAdmin.apiAuthorize(w, r, permView) {
+		return
+	}
+	if oAdmin.history == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_enabled", "Session history is not enabled")
+		return
+	}
+
+	filter, err := parseSessionFilter(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	sessions, err := oAdmin.history.query(filter)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "history_read_failed", err.Error())
+		return
+	}
+	if sessions == nil {
+		sessions = []sessionRecord{}
+	}
+	writeJSON(w, http.StatusOK, apiSessionsResponse{Sessions: sessions})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHistoryTimeFormat = "2006-01-02 15:04:05"
+
+func newTestHistory(t *testing.T, retention time.Duration, maxSessions int) *sessionHistory {
+	t.Helper()
+	return newSessionHistory(filepath.Join(t.TempDir(), "sessions.log"), retention, maxSessions, testHistoryTimeFormat)
+}
+
+func testSessionClient(cid, name string, connectedAt time.Time) clientStatus {
+	return clientStatus{
+		ClientID:       cid,
+		CommonName:     name,
+		RealAddress:    "198.51.100.7:41000",
+		VirtualAddress: "10.8.0.6",
+		ConnectedSince: connectedAt.Local().Format(testHistoryTimeFormat),
+	}
+}
+
+func TestSessionHistory_UpdateAndFinish(t *testing.T) {
+	h := newTestHistory(t, 0, 0)
+	start := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	alice := testSessionClient("1", "alice", start)
+	h.update("main", alice)
+	alice.BytesReceived, alice.BytesSent = "1000", "2000"
+	h.update("main", alice)
+	h.finish("main", alice, start.Add(90*time.Second))
+
+	sessions, err := h.query(sessionFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("Expected one session, got %+v", sessions)
+	}
+	s := sessions[0]
+	if s.Username != "alice" || s.Server != "main" || s.VirtualAddress != "10.8.0.6" || !s.ConnectedAt.Equal(start) {
+		t.Errorf("Unexpected session %+v", s)
+	}
+	if s.DisconnectedAt == nil || s.DurationSeconds != 90 || s.BytesReceived != 1000 || s.BytesSent != 2000 {
+		t.Errorf("Expected a finished 90s session with its byte counters, got %+v", s)
+	}
+
+	// the last seen time survives a restart
+	reloaded := newSessionHistory(h.path, 0, 0, testHistoryTimeFormat)
+	if got := reloaded.lastSeenOf("alice"); !got.Equal(start.Add(90 * time.Second)) {
+		t.Errorf("Expected alice to be last seen at the disconnect, got %v", got)
+	}
+	if got := reloaded.lastSeenOf("bob"); !got.IsZero() {
+		t.Errorf("Expected bob to be never seen, got %v", got)
+	}
+}
+
+func TestSessionHistory_ReconcileClosesMissingSessions(t *testing.T) {
+	h := newTestHistory(t, 0, 0)
+	start := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	alice := testSessionClient("1", "alice", start)
+	bob := testSessionClient("2", "bob", start.Add(time.Minute))
+	h.update("main", alice)
+	h.update("main", bob)
+	h.update("backup", testSessionClient("1", "carol", start))
+
+	// bob disconnected while the management connection was down
+	h.reconcile("main", []clientStatus{alice}, start.Add(time.Hour))
+
+	sessions, _ := h.query(sessionFilter{})
+	if len(sessions) != 3 {
+		t.Fatalf("Expected 3 sessions, got %+v", sessions)
+	}
+	for _, s := range sessions {
+		finished := s.DisconnectedAt != nil
+		if finished != (s.Username == "bob") {
+			t.Errorf("Expected only bob's session to be finished, got %+v", s)
+		}
+	}
+	if sessions[len(sessions)-1].Username != "bob" {
+		t.Errorf("Expected open sessions before finished ones, got %+v", sessions)
+	}
+}
+
+func TestSessionHistory_QueryFilters(t *testing.T) {
+	h := newTestHistory(t, 0, 0)
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i, name := range []string{"alice", "bob", "alice"} {
+		at := start.Add(time.Duration(i) * 24 * time.Hour)
+		client := testSessionClient("1", name, at)
+		h.update("main", client)
+		h.finish("main", client, at.Add(time.Hour))
+	}
+	h.update("main", testSessionClient("2", "alice", start.Add(72*time.Hour)))
+
+	byUser, _ := h.query(sessionFilter{Username: "alice"})
+	if len(byUser) != 3 || byUser[0].DisconnectedAt != nil || !byUser[1].ConnectedAt.Equal(start.Add(48*time.Hour)) {
+		t.Errorf("Expected alice's open session and then her finished ones newest first, got %+v", byUser)
+	}
+
+	byTime, _ := h.query(sessionFilter{Since: start.Add(12 * time.Hour), Until: start.Add(36 * time.Hour)})
+	if len(byTime) != 1 || byTime[0].Username != "bob" {
+		t.Errorf("Expected only bob's session, got %+v", byTime)
+	}
+
+	limited, _ := h.query(sessionFilter{Limit: 2})
+	if len(limited) != 2 {
+		t.Errorf("Expected 2 sessions, got %d", len(limited))
+	}
+}
+
+func TestSessionHistory_Prune(t *testing.T) {
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	h := newTestHistory(t, 30*24*time.Hour, 2)
+
+	for i, age := range []time.Duration{60, 20, 10, 5} {
+		at := now.Add(-age * 24 * time.Hour)
+		client := testSessionClient("1", []string{"old", "a", "b", "c"}[i], at)
+		h.update("main", client)
+		h.finish("main", client, at.Add(time.Hour))
+	}
+
+	if err := h.prune(now); err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ := h.query(sessionFilter{})
+	if len(sessions) != 2 || sessions[0].Username != "c" || sessions[1].Username != "b" {
+		t.Errorf("Expected the two newest sessions to be kept, got %+v", sessions)
+	}
+}
+
+func TestUserRowsTemplate_LastSeen(t *testing.T) {
+	oAdmin := newTestOvpnAdmin()
+
+	w := httptest.NewRecorder()
+	err := oAdmin.htmlTemplates.ExecuteTemplate(w, "user_rows", map[string]interface{}{
+		"Users": []OpenvpnClient{
+			{Identity: "online", AccountStatus: "Active", ConnectionStatus: "Connected", Connections: 1, LastSeen: "2025-01-01 10:00:00"},
+			{Identity: "offline", AccountStatus: "Active", LastSeen: "2025-01-02 11:00:00"},
+		},
+		"ServerRole": "master",
+		"Modules":    []string{"core"},
+	})
+	if err != nil {
+		t.Fatalf("Template execution failed: %v", err)
+	}
+
+	body := w.Body.String()
+	if strings.Contains(body, "2025-01-01 10:00:00") {
+		t.Error("A connected user should not show an old last seen time")
+	}
+	if !strings.Contains(body, "2025-01-02 11:00:00") {
+		t.Error("A disconnected user should show the last seen time")
+	}
+}
+
+func TestAPISessions(t *testing.T) {
+	oAdmin := newTestOvpnAdmin()
+
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/sessions", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 without a history, got %d", w.Code)
+	}
+
+	oAdmin.history = newTestHistory(t, 0, 0)
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	alice := testSessionClient("1", "alice", start)
+	oAdmin.history.update("main", alice)
+	oAdmin.history.finish("main", alice, start.Add(time.Minute))
+
+	w = httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/sessions?user=alice&since=2025-01-01T00:00:30Z", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp apiSessionsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Sessions) != 1 || resp.Sessions[0].DurationSeconds != 60 {
+		t.Errorf("Expected alice's session, got %+v", resp.Sessions)
+	}
+
+	w = httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/sessions?since=yesterday", nil))
+	if w.Code != http.StatusBadRequest || decodeAPIError(t, w).Code != "bad_request" {
+		t.Errorf("Expected 400 for a bad since, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// clientAddressAuto assigns the next free address of the OpenVPN network, auto:<pool> the next one of an address pool
+	clientAddressAuto = "auto"
+	// ipamNetworkPool is the name of the whole OpenVPN network in the pool usage
+	ipamNetworkPool = "network"
+)
+
+// ipam indexes the static addresses assigned by the CCD of the users. It is built from the storage on first use
+// and kept up to date by writeCcd and userDelete, so checking and allocating an address doesn't read every CCD.
+type ipam struct {
+	mu sync.Mutex
+	// network is --ovpn.network, invalid if the flag can't be parsed
+	network   netip.Prefix
+	pools     []addressPool
+	owners    map[netip.Addr]string
+	addresses map[string]netip.Addr
+}
+
+// addressPool is a named part of the OpenVPN network static addresses are drawn from
+type addressPool struct {
+	Name   string
+	Prefix netip.Prefix
+}
+
+// addressPoolUsage is the utilisation of an address pool
+type addressPoolUsage struct {
+	Name    string `json:"name"`
+	Network string `json:"network"`
+	Size    int    `json:"size"`
+	Used    int    `json:"used"`
+}
+
+// newIPAM returns an empty index for the OpenVPN network and the NAME=CIDR address pools of --ovpn.address-pool
+func newIPAM(network string, pools []string) (*ipam, error) {
+	m := &ipam{owners: map[netip.Addr]string{}, addresses: map[string]netip.Addr{}}
+	prefix, err := netip.ParsePrefix(network)
+	if err != nil || !prefix.Addr().Is4() {
+		return m, fmt.Errorf("ipam: --ovpn.network %q must be an IPv4 NETWORK/MASK_PREFIX", network)
+	}
+	m.network = prefix.Masked()
+
+	for _, pool := range pools {
+		name, cidr, ok := strings.Cut(pool, "=")
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if !ok || name == "" || err != nil {
+			return m, fmt.Errorf("ipam: address pools have to be NAME=CIDR, got %q", pool)
+		}
+		if !m.contains(prefix) {
+			return m, fmt.Errorf("ipam: address pool %s is not inside --ovpn.network %s", pool, m.network)
+		}
+		if _, exists := m.pool(name); exists {
+			return m, fmt.Errorf("ipam: address pool %q is defined twice", name)
+		}
+		m.pools = append(m.pools, addressPool{Name: name, Prefix: prefix.Masked()})
+	}
+	return m, nil
+}
+
+// contains reports whether the network is inside the OpenVPN network
+func (m *ipam) contains(prefix netip.Prefix) bool {
+	return m.network.IsValid() && prefix.IsValid() && m.network.Bits() <= prefix.Bits() && m.network.Contains(prefix.Addr())
+}
+
+// reserved reports whether the address is the network, server or broadcast address of the OpenVPN network
+func (m *ipam) reserved(addr netip.Addr) bool {
+	return addr == m.network.Addr() || addr == m.network.Addr().Next() || addr == lastAddr(m.network)
+}
+
+// inPool reports whether the address is inside the network and not its network or broadcast address,
+// so a pool can be routed as a network of its own
+func inPool(prefix netip.Prefix, addr netip.Addr) bool {
+	prefix = prefix.Masked()
+	return prefix.Contains(addr) && (prefix.Bits() >= 31 || (addr != prefix.Addr() && addr != lastAddr(prefix)))
+}
+
+// assignable reports whether the address of the network can be assigned
+func (m *ipam) assignable(prefix netip.Prefix, addr netip.Addr) bool {
+	return inPool(prefix, addr) && !m.reserved(addr)
+}
+
+// size returns the number of assignable addresses of a network inside the OpenVPN network
+func (m *ipam) size(prefix netip.Prefix) int {
+	if !m.contains(prefix) {
+		return 0
+	}
+	size := 1 << (32 - prefix.Bits())
+	if prefix.Bits() < 31 {
+		size -= 2
+	}
+	reserved := []netip.Addr{m.network.Addr(), m.network.Addr().Next(), lastAddr(m.network)}
+	for i, addr := range reserved {
+		if !slices.Contains(reserved[:i], addr) && inPool(prefix, addr) {
+			size--
+		}
+	}
+	return size
+}
+
+// lastAddr returns the broadcast address of the network
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(addr)*8; i++ {
+		addr[i/8] |= 1 << (7 - i%8)
+	}
+	last, _ := netip.AddrFromSlice(addr)
+	return last
+}
+
+func (m *ipam) pool(name string) (netip.Prefix, bool) {
+	for _, pool := range m.pools {
+		if pool.Name == name {
+			return pool.Prefix, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// load replaces the index with the static addresses of the users
+func (m *ipam) load(addresses map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.owners = map[netip.Addr]string{}
+	m.addresses = map[string]netip.Addr{}
+	users := make([]string, 0, len(addresses))
+	for username := range addresses {
+		users = append(users, username)
+	}
+	sort.Strings(users)
+	for _, username := range users {
+		addr, err := netip.ParseAddr(addresses[username])
+		if err != nil {
+			log.Warnf("ipam: bad static address %q of %s", addresses[username], username)
+			continue
+		}
+		if owner, taken := m.owners[addr]; taken {
+			log.Warnf("ipam: %s is assigned to both %s and %s", addr, owner, username)
+		}
+		m.owners[addr] = username
+		m.addresses[username] = addr
+	}
+}
+
+// address returns the static address of the user, empty if there is none
+func (m *ipam) address(username string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if addr, ok := m.addresses[username]; ok {
+		return addr.String()
+	}
+	return ""
+}
+
+// check returns why the address can't be assigned to the user, nil if it can
+func (m *ipam) check(username, address string) error {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return fmt.Errorf("ClientAddress \"%s\" not a valid IP address", address)
+	}
+	if !m.network.Contains(addr) {
+		return fmt.Errorf("ClientAddress \"%s\" not belongs to openvpn server network", address)
+	}
+	if m.reserved(addr) {
+		return fmt.Errorf("ClientAddress \"%s\" is the network, server or broadcast address", address)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if owner, taken := m.owners[addr]; taken && owner != username {
+		log.Warnf("IP %s already assigned to user %s", address, owner)
+		return fmt.Errorf("ClientAddress \"%s\" already assigned to another user", address)
+	}
+	return nil
+}
+
+// claim assigns the address to the user if it is free, an empty address releases the address of the user
+func (m *ipam) claim(username, address string) error {
+	if address != "" {
+		if err := m.check(username, address); err != nil {
+			return err
+		}
+	}
+	m.set(username, address)
+	return nil
+}
+
+// set assigns the address to the user without checking it
+func (m *ipam) set(username, address string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.addresses[username]; ok {
+		delete(m.owners, old)
+		delete(m.addresses, username)
+	}
+	if addr, err := netip.ParseAddr(address); err == nil {
+		m.owners[addr] = username
+		m.addresses[username] = addr
+	}
+}
+
+func (m *ipam) release(username string) {
+	m.set(username, "")
+}
+
+// next returns the address the user has in the network, or the first free one
+func (m *ipam) next(username string, prefix netip.Prefix) (string, error) {
+	if !m.contains(prefix) {
+		return "", fmt.Errorf("address pool %s is not inside the openvpn server network", prefix)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if addr, ok := m.addresses[username]; ok && prefix.Contains(addr) && !m.reserved(addr) {
+		return addr.String(), nil
+	}
+	prefix = prefix.Masked()
+	for addr := prefix.Addr(); addr.IsValid() && prefix.Contains(addr); addr = addr.Next() {
+		if _, taken := m.owners[addr]; !taken && m.assignable(prefix, addr) {
+			return addr.String(), nil
+		}
+	}
+	return "", fmt.Errorf("address pool %s is exhausted", prefix)
+}
+
+// usage returns the utilisation of the OpenVPN network, the configured pools and the extra ones
+func (m *ipam) usage(extra []addressPool) []addressPoolUsage {
+	if !m.network.IsValid() {
+		return nil
+	}
+	pools := append([]addressPool{{Name: ipamNetworkPool, Prefix: m.network}}, m.pools...)
+	pools = append(pools, extra...)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var usage []addressPoolUsage
+	for _, pool := range pools {
+		u := addressPoolUsage{Name: pool.Name, Network: pool.Prefix.String(), Size: m.size(pool.Prefix)}
+		for addr := range m.owners {
+			if m.assignable(pool.Prefix, addr) {
+				u.Used++
+			}
+		}
+		usage = append(usage, u)
+	}
+	return usage
+}
+
+// addressIndex returns the IP address manager, it is built from the CCD of the users on first use
+func (oAdmin *OvpnAdmin) addressIndex() *ipam {
+	oAdmin.ipamOnce.Do(func() {
+		var err error
+		if oAdmin.ipam, err = newIPAM(*openvpnNetwork, *openvpnAddressPools); err != nil {
+			log.Error(err)
+		}
+		oAdmin.loadAddresses(oAdmin.ipam)
+	})
+	return oAdmin.ipam
+}
+
+// loadAddresses builds the address index from the CCD of the current users, deleted users don't hold addresses
+func (oAdmin *OvpnAdmin) loadAddresses(m *ipam) {
+	addresses, err := oAdmin.storage.StaticAddresses()
+	if err != nil {
+		log.Errorf("ipam: can't read static addresses: %v", err)
+		return
+	}
+	lines := oAdmin.index()
+	for username := range addresses {
+		if indexTxtFind(lines, username) < 0 {
+			delete(addresses, username)
+		}
+	}
+	m.load(addresses)
+}
+
+// resolveClientAddress replaces auto and auto:<pool> with the next free address of the OpenVPN network or the pool
+func (oAdmin *OvpnAdmin) resolveClientAddress(ccd *Ccd) error {
+	name, ok := strings.CutPrefix(ccd.ClientAddress, clientAddressAuto)
+	if !ok {
+		return nil
+	}
+	m := oAdmin.addressIndex()
+	prefix := m.network
+	if name != "" {
+		name, ok = strings.CutPrefix(name, ":")
+		if prefix, ok = m.pool(name); !ok {
+			return fmt.Errorf("Address pool %q not found", name)
+		}
+	}
+	address, err := m.next(ccd.User, prefix)
+	if err != nil {
+		return err
+	}
+	ccd.ClientAddress = address
+	return nil
+}
+
+// addressPoolUsage returns the utilisation of the OpenVPN network, the --ovpn.address-pool pools and the group pools
+func (oAdmin *OvpnAdmin) addressPoolUsage() []addressPoolUsage {
+	var groupPools []addressPool
+	for _, g := range oAdmin.groups() {
+		if prefix, err := netip.ParsePrefix(g.AddressPool); err == nil {
+			groupPools = append(groupPools, addressPool{Name: "group:" + g.Name, Prefix: prefix})
+		}
+	}
+	return oAdmin.addressIndex().usage(groupPools)
+}
+
+// setAddressPoolMetrics exports the pool utilisation
+func (oAdmin *OvpnAdmin) setAddressPoolMetrics() {
+	ovpnAddressPoolSize.Reset()
+	ovpnAddressPoolUsed.Reset()
+	for _, u := range oAdmin.addressPoolUsage() {
+		ovpnAddressPoolSize.WithLabelValues(u.Name, u.Network).Set(float64(u.Size))
+		ovpnAddressPoolUsed.WithLabelValues(u.Name, u.Network).Set(float64(u.Used))
+	}
+}
+
+// releaseAddress frees the static address of a deleted user, so it can be assigned again. The CCD the filesystem
+// backend keeps in --ccd.path loses the address, the kubernetes.secrets backend has no CCD for the name anymore.
+func (oAdmin *OvpnAdmin) releaseAddress(username string) {
+	m := oAdmin.addressIndex()
+	if m.address(username) == "" {
+		return
+	}
+	if content, err := oAdmin.storage.ReadCcd(username); err == nil && ccdStaticAddress(content) != "" {
+		ccd := oAdmin.parseCcd(username)
+		ccd.ClientAddress = "dynamic"
+		ccd.GroupAddress = ""
+		rendered, err := oAdmin.renderCcd(ccd)
+		if err == nil {
+			err = oAdmin.storage.WriteCcd(username, rendered)
+		}
+		if err != nil {
+			log.Errorf("ipam: can't remove the static address from the ccd of %s: %v", username, err)
+			return
+		}
+	}
+	m.release(username)
+}
+
+func (oAdmin *OvpnAdmin) renderCcd(ccd Ccd) ([]byte, error) {
+	var tmp bytes.Buffer
+	if err := oAdmin.getCcdTemplate().Execute(&tmp, ccd); err != nil {
+		return nil, err
+	}
+	return tmp.Bytes(), nil
+}
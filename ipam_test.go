@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestIPAM(t *testing.T) {
+	if _, err := newIPAM("172.16.100.0/24", []string{"servers=10.0.0.0/28"}); err == nil || !strings.Contains(err.Error(), "not inside") {
+		t.Errorf("Expected a pool outside the network to fail, got %v", err)
+	}
+	if _, err := newIPAM("172.16.100.0/24", []string{"172.16.100.0/28"}); err == nil {
+		t.Error("Expected a pool without a name to fail")
+	}
+
+	m, err := newIPAM("172.16.100.0/24", []string{"servers=172.16.100.16/30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.load(map[string]string{"alice": "172.16.100.2", "bob": "bad"})
+
+	for _, address := range []string{"172.16.100.0", "172.16.100.1", "172.16.100.255"} {
+		if err := m.check("carol", address); err == nil || !strings.Contains(err.Error(), "server or broadcast") {
+			t.Errorf("Expected %s to be reserved, got %v", address, err)
+		}
+	}
+	if err := m.check("carol", "172.16.100.2"); err == nil || !strings.Contains(err.Error(), "already assigned") {
+		t.Errorf("Expected the address of alice to be taken, got %v", err)
+	}
+	if err := m.check("alice", "172.16.100.2"); err != nil {
+		t.Errorf("Expected alice to keep the address, got %v", err)
+	}
+
+	if addr, _ := m.next("carol", m.network); addr != "172.16.100.3" {
+		t.Errorf("Expected the first free address, got %q", addr)
+	}
+	servers, _ := m.pool("servers")
+	if addr, _ := m.next("carol", servers); addr != "172.16.100.17" {
+		t.Errorf("Expected the first address of the pool after its network address, got %q", addr)
+	}
+	if err := m.claim("carol", "172.16.100.17"); err != nil {
+		t.Fatal(err)
+	}
+	if addr, _ := m.next("carol", servers); addr != "172.16.100.17" {
+		t.Errorf("Expected carol to keep her pool address, got %q", addr)
+	}
+	if err := m.claim("dave", "172.16.100.18"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.next("erin", servers); err == nil || !strings.Contains(err.Error(), "exhausted") {
+		t.Errorf("Expected the pool to be exhausted, got %v", err)
+	}
+
+	usage := m.usage([]addressPool{{Name: "group:sre", Prefix: netip.MustParsePrefix("172.16.100.0/29")}})
+	want := []addressPoolUsage{
+		{Name: "network", Network: "172.16.100.0/24", Size: 253, Used: 3},
+		{Name: "servers", Network: "172.16.100.16/30", Size: 2, Used: 2},
+		{Name: "group:sre", Network: "172.16.100.0/29", Size: 5, Used: 1},
+	}
+	if len(usage) != len(want) {
+		t.Fatalf("Expected %d pools, got %+v", len(want), usage)
+	}
+	for i := range want {
+		if usage[i] != want[i] {
+			t.Errorf("Expected %+v, got %+v", want[i], usage[i])
+		}
+	}
+
+	m.release("carol")
+	if addr, _ := m.next("erin", servers); addr != "172.16.100.17" {
+		t.Errorf("Expected the released address to be assigned again, got %q", addr)
+	}
+}
+
+func TestIPAMSize(t *testing.T) {
+	for _, network := range []string{"172.16.100.0/24", "172.16.100.0/30", "172.16.100.0/31", "172.16.100.0/32"} {
+		m, err := newIPAM(network, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for bits := m.network.Bits(); bits <= 32; bits++ {
+			for _, base := range []string{"172.16.100.0", "172.16.100.1", "172.16.100.254", "172.16.100.255"} {
+				prefix := netip.PrefixFrom(netip.MustParseAddr(base), bits).Masked()
+				if !m.contains(prefix) {
+					continue
+				}
+				want := 0
+				for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+					if m.assignable(prefix, addr) {
+						want++
+					}
+				}
+				if got := m.size(prefix); got != want {
+					t.Errorf("Expected %d assignable addresses in %s of %s, got %d", want, prefix, network, got)
+				}
+			}
+		}
+	}
+}
+
+func TestModifyCcdAutoAddress(t *testing.T) {
+	oldPools := *openvpnAddressPools
+	*openvpnAddressPools = []string{"servers=172.16.100.128/26"}
+	t.Cleanup(func() { *openvpnAddressPools = oldPools })
+	oAdmin := newTestGroupsAdmin(t)
+	if err := oAdmin.storage.WriteCcd("alice", []byte("ifconfig-push 172.16.100.2 255.255.255.0\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, msg := oAdmin.modifyCcd(Ccd{User: "bob", ClientAddress: clientAddressAuto}); !ok {
+		t.Fatal(msg)
+	}
+	if addr := oAdmin.getCcd("bob").ClientAddress; addr != "172.16.100.3" {
+		t.Errorf("Expected bob to get the address after the one of alice, got %q", addr)
+	}
+	if ok, msg := oAdmin.modifyCcd(Ccd{User: "carol", ClientAddress: "auto:servers"}); !ok {
+		t.Fatal(msg)
+	}
+	if addr := oAdmin.getCcd("carol").ClientAddress; addr != "172.16.100.129" {
+		t.Errorf("Expected carol to get the first address of the servers pool, got %q", addr)
+	}
+	if ok, msg := oAdmin.modifyCcd(Ccd{User: "carol", ClientAddress: "auto:office"}); ok || !strings.Contains(msg, "not found") {
+		t.Errorf("Expected an unknown pool to fail, got %q", msg)
+	}
+	if ok, msg := oAdmin.modifyCcd(Ccd{User: "carol", ClientAddress: "172.16.100.3"}); ok || !strings.Contains(msg, "already assigned") {
+		t.Errorf("Expected the address of bob to be taken, got %q", msg)
+	}
+	if ok, msg := oAdmin.modifyCcd(Ccd{User: "carol", ClientAddress: "172.16.100.1"}); ok || !strings.Contains(msg, "server") {
+		t.Errorf("Expected the server address to be reserved, got %q", msg)
+	}
+
+	if err, msg := oAdmin.userDelete("alice"); err != nil {
+		t.Fatal(msg)
+	}
+	if ccd := oAdmin.readCcd("alice"); strings.Contains(ccd, "ifconfig-push") {
+		t.Errorf("Expected the address to be removed from the CCD of the deleted user, got\n%s", ccd)
+	}
+	if ok, msg := oAdmin.modifyCcd(Ccd{User: "carol", ClientAddress: "172.16.100.2"}); !ok {
+		t.Errorf("Expected the address of the deleted user to be free, got %q", msg)
+	}
+
+	// a new index is built from the storage
+	m, _ := newIPAM(*openvpnNetwork, nil)
+	oAdmin.loadAddresses(m)
+	if m.address("bob") != "172.16.100.3" || m.address("carol") != "172.16.100.2" || m.address("alice") != "" {
+		t.Errorf("Expected the addresses of bob and carol, got %v", m.addresses)
+	}
+}
+
+func TestUserDelete_ReleasesAddressAfterDelete(t *testing.T) {
+	oldNetwork, oldCcd := *openvpnNetwork, *ccdEnabled
+	*openvpnNetwork, *ccdEnabled = "172.16.100.0/24", true
+	t.Cleanup(func() { *openvpnNetwork, *ccdEnabled = oldNetwork, oldCcd })
+	k := newTestKubernetesStorage(t, nil)
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.storage = k
+	if err := k.BuildClient("alice", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, msg := oAdmin.modifyCcd(Ccd{User: "alice", ClientAddress: "172.16.100.2"}); !ok {
+		t.Fatal(msg)
+	}
+
+	fail := true
+	k.KubeClient.(*fake.Clientset).PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		secret := action.(k8stesting.UpdateAction).GetObject().(*v1.Secret)
+		if fail && secret.Labels["revokedForever"] == "true" {
+			return true, nil, errors.New("conflict")
+		}
+		return false, nil, nil
+	})
+	if err, _ := oAdmin.userDelete("alice"); err == nil {
+		t.Fatal("Expected the failed update to fail the delete")
+	}
+	if addr := oAdmin.addressIndex().address("alice"); addr != "172.16.100.2" {
+		t.Errorf("Expected alice to keep the address when the delete fails, got %q", addr)
+	}
+
+	fail = false
+	if err, msg := oAdmin.userDelete("alice"); err != nil {
+		t.Fatal(msg)
+	}
+	if addr := oAdmin.addressIndex().address("alice"); addr != "" {
+		t.Errorf("Expected the address of the deleted user to be free, got %q", addr)
+	}
+}
+
+func TestAddressPoolsPanel(t *testing.T) {
+	oAdmin := newTestGroupsAdmin(t)
+	oAdmin.modules = append(oAdmin.modules, "ccd")
+	if ok, msg := oAdmin.modifyCcd(Ccd{User: "alice", ClientAddress: clientAddressAuto}); !ok {
+		t.Fatal(msg)
+	}
+
+	w := httptest.NewRecorder()
+	oAdmin.groupsPageHandler(w, httptest.NewRequest(http.MethodGet, "/groups", nil))
+	if !strings.Contains(w.Body.String(), "Address Pools") || !strings.Contains(w.Body.String(), "1 / 253") {
+		t.Errorf("Expected the utilisation of the network on the groups page, got\n%s", w.Body.String())
+	}
+
+	oAdmin.setAddressPoolMetrics()
+	if used := testutil.ToFloat64(ovpnAddressPoolUsed.WithLabelValues(ipamNetworkPool, "172.16.100.0/24")); used != 1 {
+		t.Errorf("Expected one used address in the metrics, got %v", used)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	encryptedKeyPEMType   = "OVPN-ADMIN ENCRYPTED PRIVATE KEY"
+	masterKeyIDHeader     = "Master-Key-Id"
+	wrappedDataKeyHeader  = "Wrapped-Data-Key"
+	masterKeySize         = 32
+	masterKeyIDPattern    = `^[a-zA-Z0-9_.\-]+$`
+	masterKeyMissingError = "the private key is encrypted, set --keys.master-key or --keys.master-key-file"
+)
+
+// keyring encrypts private keys at rest with envelope encryption. Every key is encrypted with its own AES-256-GCM
+// data key, which is encrypted with the active master key and stored next to it. Rotating the master key only
+// re-encrypts the data keys, older master keys are kept to read what isn't rewrapped yet.
+// A nil keyring leaves keys in plaintext.
+type keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// loadKeyring reads the master keys of --keys.master-key and --keys.master-key-file, nil if there are none.
+// Both hold <id>:<base64 encoded 32 bytes> entries separated by newlines or commas, the first one is active.
+func loadKeyring(value, path string) (*keyring, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("can't read master keys: %w", err)
+		}
+		value += "\n" + string(data)
+	}
+	return parseKeyring(value)
+}
+
+func parseKeyring(value string) (*keyring, error) {
+	validID := regexp.MustCompile(masterKeyIDPattern)
+	k := &keyring{keys: map[string]cipher.AEAD{}}
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool { return r == '\n' || r == ',' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || !validID.MatchString(id) {
+			return nil, fmt.Errorf("master keys have to be <id>:<base64 key>, the id matching %s", masterKeyIDPattern)
+		}
+		if _, exists := k.keys[id]; exists {
+			return nil, fmt.Errorf("master key %q is defined twice", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != masterKeySize {
+			return nil, fmt.Errorf("master key %q has to be %d base64 encoded random bytes", id, masterKeySize)
+		}
+		if k.keys[id], err = newGCM(key); err != nil {
+			return nil, err
+		}
+		if k.active == "" {
+			k.active = id
+		}
+	}
+	if k.active == "" {
+		return nil, nil
+	}
+	return k, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// gcmSeal returns the nonce followed by the ciphertext
+func gcmSeal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func gcmOpen(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+}
+
+// isEncryptedKey reports whether the key was encrypted by a keyring
+func isEncryptedKey(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil && block.Type == encryptedKeyPEMType
+}
+
+// wrap encrypts the data key with the active master key, the master key id is authenticated with it
+func (k *keyring) wrap(dataKey []byte) (map[string]string, error) {
+	wrapped, err := gcmSeal(k.keys[k.active], dataKey, []byte(k.active))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		masterKeyIDHeader:    k.active,
+		wrappedDataKeyHeader: base64.StdEncoding.EncodeToString(wrapped),
+	}, nil
+}
+
+func (k *keyring) unwrap(block *pem.Block) ([]byte, error) {
+	id := block.Headers[masterKeyIDHeader]
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("the private key is encrypted with the unknown master key %q", id)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(block.Headers[wrappedDataKeyHeader])
+	if err != nil {
+		return nil, fmt.Errorf("can't decode the data key: %w", err)
+	}
+	dataKey, err := gcmOpen(aead, wrapped, []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt the data key with master key %q: %w", id, err)
+	}
+	return dataKey, nil
+}
+
+// seal encrypts a PEM encoded private key, a nil keyring returns it unchanged
+func (k *keyring) seal(keyPEM []byte) ([]byte, error) {
+	if k == nil || len(keyPEM) == 0 {
+		return keyPEM, nil
+	}
+	dataKey := make([]byte, masterKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := gcmSeal(aead, keyPEM, nil)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := k.wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: encryptedKeyPEMType, Headers: headers, Bytes: sealed}), nil
+}
+
+// open decrypts a key encrypted by seal, plaintext keys are returned unchanged
+func (k *keyring) open(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != encryptedKeyPEMType {
+		return data, nil
+	}
+	if k == nil {
+		return nil, errors.New(masterKeyMissingError)
+	}
+	dataKey, err := k.unwrap(block)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := gcmOpen(aead, block.Bytes, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt the private key: %w", err)
+	}
+	return keyPEM, nil
+}
+
+// rewrap encrypts a plaintext key, or wraps the data key of a key encrypted with an older master key with the
+// active one. It reports whether the key changed.
+func (k *keyring) rewrap(data []byte) ([]byte, bool, error) {
+	if k == nil || len(data) == 0 {
+		return data, false, nil
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != encryptedKeyPEMType {
+		sealed, err := k.seal(data)
+		return sealed, err == nil, err
+	}
+	if block.Headers[masterKeyIDHeader] == k.active {
+		return data, false, nil
+	}
+	dataKey, err := k.unwrap(block)
+	if err != nil {
+		return nil, false, err
+	}
+	if block.Headers, err = k.wrap(dataKey); err != nil {
+		return nil, false, err
+	}
+	return pem.EncodeToMemory(block), true, nil
+}
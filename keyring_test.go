@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMasterKeys returns random master keys in the --keys.master-key format, the first id is active
+func testMasterKeys(t *testing.T, ids ...string) string {
+	t.Helper()
+	var entries []string
+	for _, id := range ids {
+		key := make([]byte, masterKeySize)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, id+":"+base64.StdEncoding.EncodeToString(key))
+	}
+	return strings.Join(entries, ",")
+}
+
+func testKeyring(t *testing.T, ids ...string) *keyring {
+	t.Helper()
+	k, err := parseKeyring(testMasterKeys(t, ids...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func masterKeyID(t *testing.T, data []byte) string {
+	t.Helper()
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != encryptedKeyPEMType {
+		t.Fatalf("Expected an encrypted key, got %.40q", data)
+	}
+	return block.Headers[masterKeyIDHeader]
+}
+
+func TestParseKeyring(t *testing.T) {
+	keys := strings.Split(testMasterKeys(t, "2025-02", "2024"), ",")
+	k, err := parseKeyring("# rotated in February\n" + keys[0] + "\n\n" + keys[1] + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.active != "2025-02" || len(k.keys) != 2 {
+		t.Errorf("Expected two keys with the first one active, got %q %d", k.active, len(k.keys))
+	}
+	if k, err := parseKeyring(" \n"); k != nil || err != nil {
+		t.Errorf("Expected no keyring without keys, got %v %v", k, err)
+	}
+
+	for _, value := range []string{
+		"no-id",
+		"a b:" + strings.SplitN(keys[0], ":", 2)[1],
+		"short:" + base64.StdEncoding.EncodeToString([]byte("16 bytes of key!")),
+		"1:not base64",
+		keys[0] + "," + keys[0],
+	} {
+		if _, err := parseKeyring(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.keys")
+	if err := os.WriteFile(path, []byte(testMasterKeys(t, "old")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := loadKeyring(testMasterKeys(t, "new"), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.active != "new" || k.keys["old"] == nil {
+		t.Errorf("Expected the flag key to be active and the file key to be known, got %q", k.active)
+	}
+	if k, err := loadKeyring("", ""); k != nil || err != nil {
+		t.Errorf("Expected no keyring, got %v %v", k, err)
+	}
+}
+
+func TestKeyringSealOpen(t *testing.T) {
+	k := testKeyring(t, "1")
+	keyPEM, err := genPrivKey(keyAlgoECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := k.seal(keyPEM.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(sealed), strings.Split(keyPEM.String(), "\n")[1]) || masterKeyID(t, sealed) != "1" {
+		t.Fatalf("Expected the key to be encrypted with master key 1, got\n%s", sealed)
+	}
+	opened, err := k.open(sealed)
+	if err != nil || string(opened) != keyPEM.String() {
+		t.Fatalf("Expected the key back, got %v", err)
+	}
+
+	if plain, err := k.open(keyPEM.Bytes()); err != nil || string(plain) != keyPEM.String() {
+		t.Error("Expected plaintext keys to be read as they are")
+	}
+	var none *keyring
+	if _, err := none.open(sealed); err == nil || !strings.Contains(err.Error(), "--keys.master-key") {
+		t.Errorf("Expected an error without master keys, got %v", err)
+	}
+	if _, err := testKeyring(t, "2").open(sealed); err == nil {
+		t.Error("Expected an error for an unknown master key")
+	}
+
+	block, _ := pem.Decode(sealed)
+	block.Bytes[len(block.Bytes)-1] ^= 0x01
+	if _, err := k.open(pem.EncodeToMemory(block)); err == nil {
+		t.Error("Expected a modified key to be rejected")
+	}
+	block, _ = pem.Decode(sealed)
+	block.Headers[masterKeyIDHeader] = "2"
+	if _, err := (&keyring{active: "2", keys: map[string]cipher.AEAD{"2": k.keys["1"]}}).open(pem.EncodeToMemory(block)); err == nil {
+		t.Error("Expected the master key id to be authenticated")
+	}
+}
+
+func TestKeyringRewrap(t *testing.T) {
+	old := testKeyring(t, "1")
+	keyPEM, _ := genPrivKey(keyAlgoECDSAP256)
+	sealed, _ := old.seal(keyPEM.Bytes())
+
+	// the new key is added in front of the old one
+	rotated := &keyring{active: "2", keys: map[string]cipher.AEAD{"1": old.keys["1"], "2": testKeyring(t, "2").keys["2"]}}
+	rewrapped, changed, err := rotated.rewrap(sealed)
+	if err != nil || !changed || masterKeyID(t, rewrapped) != "2" {
+		t.Fatalf("Expected the data key to be wrapped with master key 2, got %v %v", changed, err)
+	}
+	if _, changed, _ := rotated.rewrap(rewrapped); changed {
+		t.Error("Expected a key of the active master key to stay as it is")
+	}
+	withoutOld := &keyring{active: "2", keys: map[string]cipher.AEAD{"2": rotated.keys["2"]}}
+	if opened, err := withoutOld.open(rewrapped); err != nil || string(opened) != keyPEM.String() {
+		t.Errorf("Expected the old master key to be no longer needed, got %v", err)
+	}
+
+	if plain, changed, err := rotated.rewrap(keyPEM.Bytes()); err != nil || !changed || masterKeyID(t, plain) != "2" {
+		t.Errorf("Expected a plaintext key to be encrypted, got %v %v", changed, err)
+	}
+	if _, changed, _ := rotated.rewrap(nil); changed {
+		t.Error("Expected the empty key of a CSR user to stay empty")
+	}
+}
+
+func TestFilesystemRewrapKeys(t *testing.T) {
+	p := newTestPKI(t)
+	s := &filesystemStorage{pki: p, ccdDir: t.TempDir()}
+	for _, name := range []string{"alice", "bob"} {
+		if err := s.BuildClient(name, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.issue(serverCommonName, genServerCert, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, aliceKey, _ := s.ClientCert("alice")
+
+	p.keys = testKeyring(t, "1")
+	// ca.key, alice.key and the key of the deleted bob
+	if changed, err := s.RewrapKeys(); err != nil || changed != 3 {
+		t.Fatalf("Expected 3 keys to be encrypted, got %d %v", changed, err)
+	}
+	for _, path := range []string{caKeyFile, "private/alice.key"} {
+		data, _ := os.ReadFile(p.path(path))
+		masterKeyID(t, data)
+	}
+	if data, _ := os.ReadFile(p.path("private", serverCommonName+".key")); isEncryptedKey(data) {
+		t.Error("Expected the server key to stay readable for OpenVPN")
+	}
+	if _, key, err := s.ClientCert("alice"); err != nil || key != aliceKey {
+		t.Errorf("Expected the key of alice to be decrypted, got %v", err)
+	}
+	if changed, _ := s.RewrapKeys(); changed != 0 {
+		t.Errorf("Expected nothing left to encrypt, got %d", changed)
+	}
+
+	p.keys = &keyring{active: "2", keys: map[string]cipher.AEAD{"1": p.keys.keys["1"], "2": testKeyring(t, "2").keys["2"]}}
+	if changed, err := s.RewrapKeys(); err != nil || changed != 3 {
+		t.Fatalf("Expected 3 keys to be rewrapped, got %d %v", changed, err)
+	}
+	p.keys = &keyring{active: "2", keys: map[string]cipher.AEAD{"2": p.keys.keys["2"]}}
+	if err := s.BuildClient("carol", time.Time{}); err != nil {
+		t.Fatalf("Expected the CA key to be readable with the new master key only: %v", err)
+	}
+	if _, key, err := s.ClientCert("alice"); err != nil || key != aliceKey {
+		t.Errorf("Expected the key of alice to be decrypted with the new master key, got %v", err)
+	}
+}
+
+func TestKubernetesRewrapKeys(t *testing.T) {
+	pki := newTestKubernetesStorage(t, nil)
+	if err := pki.BuildClient("alice", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pki.SignClient(testCSR(t, "token-user"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	pki.Keyring = testKeyring(t, "1")
+	// the CA and alice, the CSR user has no key
+	if changed, err := pki.RewrapKeys(); err != nil || changed != 2 {
+		t.Fatalf("Expected 2 keys to be encrypted, got %d %v", changed, err)
+	}
+	ca, _ := pki.secretGetByName(secretCA)
+	masterKeyID(t, ca.Data[privKeyFileName])
+	alice, _ := pki.secretGetByLabels("name=alice")
+	masterKeyID(t, alice.Data[privKeyFileName])
+	if secret, _ := pki.secretGetByName(secretServer); isEncryptedKey(secret.Data[privKeyFileName]) {
+		t.Error("Expected the server key to stay readable for OpenVPN")
+	}
+	if _, key, err := pki.ClientCert("alice"); err != nil || !strings.Contains(key, "PRIVATE KEY") {
+		t.Errorf("Expected the decrypted key of alice, got %v", err)
+	}
+	if ca, err := pki.secretGetClientCert(secretCA); err != nil || ca.PrivKey == nil {
+		t.Errorf("Expected the CA key to be decrypted, got %v", err)
+	}
+}
@@ -3,12 +3,14 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"io/ioutil"
+	"math/big"
 	"os"
 	"os/exec"
 	"strings"
@@ -23,13 +25,17 @@ import (
 
 const (
 	secretCA         = "openvpn-pki-ca"
+	secretCANext     = "openvpn-pki-ca-next"
+	secretCARetired  = "openvpn-pki-ca-%s"
 	secretServer     = "openvpn-pki-server"
 	secretClientTmpl = "openvpn-pki-%d"
 	secretCRL        = "openvpn-pki-crl"
 	secretIndexTxt   = "openvpn-pki-index-txt"
 	secretDHandTA    = "openvpn-pki-dh-and-ta"
+	secretGroups     = "openvpn-pki-groups"
 	certFileName     = "tls.crt"
 	privKeyFileName  = "tls.key"
+	csrFileName      = "tls.csr"
 )
 
 // <year><month><day><hour><minute><second>Z
@@ -38,21 +44,26 @@ const indexTxtDateFormat = "060102150405Z"
 var namespace = "default"
 
 type OpenVPNPKI struct {
-	CAPrivKeyRSA     *rsa.PrivateKey
+	CAPrivKey        crypto.Signer
 	CAPrivKeyPEM     *bytes.Buffer
 	CACert           *x509.Certificate
 	CACertPEM        *bytes.Buffer
-	ServerPrivKeyRSA *rsa.PrivateKey
+	ServerPrivKey    crypto.Signer
 	ServerPrivKeyPEM *bytes.Buffer
 	ServerCert       *x509.Certificate
 	ServerCertPEM    *bytes.Buffer
 	ClientCerts      []ClientCert
 	RevokedCerts     []RevokedCert
-	KubeClient       *kubernetes.Clientset
+	KubeClient       kubernetes.Interface
+	// NextCAPrivKey and NextCACert are the new CA while a CA rollover is in progress, nil otherwise
+	NextCAPrivKey crypto.Signer
+	NextCACert    *x509.Certificate
+	// Keyring encrypts tls.key of the CA and client secrets, nil keeps them in plaintext
+	Keyring *keyring
 }
 
 type ClientCert struct {
-	PrivKeyRSA *rsa.PrivateKey
+	PrivKey    crypto.Signer
 	PrivKeyPEM *bytes.Buffer
 	Cert       *x509.Certificate
 	CertPEM    *bytes.Buffer
@@ -65,14 +76,6 @@ type RevokedCert struct {
 }
 
 func (openVPNPKI *OpenVPNPKI) run() (err error) {
-	if _, err := os.Stat(kubeNamespaceFilePath); err == nil {
-		file, err := ioutil.ReadFile(kubeNamespaceFilePath)
-		if err != nil {
-			return err
-		}
-		namespace = string(file)
-	}
-
 	err = openVPNPKI.initKubeClient()
 	if err != nil {
 		return
@@ -100,6 +103,13 @@ func (openVPNPKI *OpenVPNPKI) run() (err error) {
 		}
 	}
 
+	// installations older than tls-crypt-v2 support get the server key before OpenVPN waits for it
+	if *openvpnTLSMode == tlsModeCryptV2 {
+		if _, err := openVPNPKI.tlsCryptV2ServerKey(); err != nil {
+			log.Error(err)
+		}
+	}
+
 	err = openVPNPKI.updateFilesFromSecrets()
 	if err != nil {
 		log.Error(err)
@@ -124,6 +134,14 @@ func (openVPNPKI *OpenVPNPKI) run() (err error) {
 }
 
 func (openVPNPKI *OpenVPNPKI) initKubeClient() (err error) {
+	if _, err := os.Stat(kubeNamespaceFilePath); err == nil {
+		file, err := ioutil.ReadFile(kubeNamespaceFilePath)
+		if err != nil {
+			return err
+		}
+		namespace = string(file)
+	}
+
 	config, _ := rest.InClusterConfig()
 	openVPNPKI.KubeClient, err = kubernetes.NewForConfig(config)
 	return
@@ -137,17 +155,17 @@ func (openVPNPKI *OpenVPNPKI) initPKI() (err error) {
 		}
 
 		openVPNPKI.CAPrivKeyPEM = cert.PrivKeyPEM
-		openVPNPKI.CAPrivKeyRSA = cert.PrivKeyRSA
+		openVPNPKI.CAPrivKey = cert.PrivKey
 		openVPNPKI.CACertPEM = cert.CertPEM
 		openVPNPKI.CACert = cert.Cert
 	} else {
-		openVPNPKI.CAPrivKeyPEM, err = genPrivKey()
+		openVPNPKI.CAPrivKeyPEM, err = genPrivKey(*pkiKeyAlgo)
 		if err != nil {
 			return
 		}
-		openVPNPKI.CAPrivKeyRSA, err = decodePrivKey(openVPNPKI.CAPrivKeyPEM.Bytes())
+		openVPNPKI.CAPrivKey, err = decodePrivKey(openVPNPKI.CAPrivKeyPEM.Bytes())
 
-		openVPNPKI.CACertPEM, _ = genCA(openVPNPKI.CAPrivKeyRSA)
+		openVPNPKI.CACertPEM, _ = genCA(openVPNPKI.CAPrivKey)
 		openVPNPKI.CACert, err = decodeCert(openVPNPKI.CACertPEM.Bytes())
 		if err != nil {
 			return
@@ -155,9 +173,14 @@ func (openVPNPKI *OpenVPNPKI) initPKI() (err error) {
 
 		secretMetaData := metav1.ObjectMeta{Name: secretCA}
 
+		var caKey []byte
+		caKey, err = openVPNPKI.Keyring.seal(openVPNPKI.CAPrivKeyPEM.Bytes())
+		if err != nil {
+			return
+		}
 		secretData := map[string][]byte{
 			certFileName:    openVPNPKI.CACertPEM.Bytes(),
-			privKeyFileName: openVPNPKI.CAPrivKeyPEM.Bytes(),
+			privKeyFileName: caKey,
 		}
 
 		err = openVPNPKI.secretCreate(secretMetaData, secretData, v1.SecretTypeTLS)
@@ -166,6 +189,15 @@ func (openVPNPKI *OpenVPNPKI) initPKI() (err error) {
 		}
 	}
 
+	if res, _ := openVPNPKI.secretCheckExists(secretCANext); res {
+		next, err := openVPNPKI.secretGetClientCert(secretCANext)
+		if err != nil {
+			return err
+		}
+		openVPNPKI.NextCAPrivKey = next.PrivKey
+		openVPNPKI.NextCACert = next.Cert
+	}
+
 	if res, _ := openVPNPKI.secretCheckExists(secretServer); res {
 		cert, err := openVPNPKI.secretGetClientCert(secretServer)
 		if err != nil {
@@ -173,21 +205,22 @@ func (openVPNPKI *OpenVPNPKI) initPKI() (err error) {
 		}
 
 		openVPNPKI.ServerPrivKeyPEM = cert.PrivKeyPEM
-		openVPNPKI.ServerPrivKeyRSA = cert.PrivKeyRSA
+		openVPNPKI.ServerPrivKey = cert.PrivKey
 		openVPNPKI.ServerCertPEM = cert.CertPEM
 		openVPNPKI.ServerCert = cert.Cert
 	} else {
-		openVPNPKI.ServerPrivKeyPEM, err = genPrivKey()
+		openVPNPKI.ServerPrivKeyPEM, err = genPrivKey(*pkiKeyAlgo)
 		if err != nil {
 			return
 		}
 
-		openVPNPKI.ServerPrivKeyRSA, err = decodePrivKey(openVPNPKI.ServerPrivKeyPEM.Bytes())
+		openVPNPKI.ServerPrivKey, err = decodePrivKey(openVPNPKI.ServerPrivKeyPEM.Bytes())
 		if err != nil {
 			return
 		}
 
-		openVPNPKI.ServerCertPEM, _ = genServerCert(openVPNPKI.ServerPrivKeyRSA, openVPNPKI.CAPrivKeyRSA, openVPNPKI.CACert, "server")
+		caCert, caKey := openVPNPKI.signingCA()
+		openVPNPKI.ServerCertPEM, _ = genServerCert(openVPNPKI.ServerPrivKey.Public(), caKey, caCert, serverCommonName)
 		openVPNPKI.ServerCert, err = decodeCert(openVPNPKI.ServerCertPEM.Bytes())
 
 		secretMetaData := metav1.ObjectMeta{
@@ -284,15 +317,33 @@ func (openVPNPKI *OpenVPNPKI) easyrsaGenCRL() (err error) {
 		}
 	}
 
-	crl, err := genCRL(revoked, openVPNPKI.CACert, openVPNPKI.CAPrivKeyRSA)
+	// the CRL number is kept next to the CRL, so it keeps increasing across restarts
+	var number *big.Int
+	if secret, err := openVPNPKI.secretGetByName(secretCRL); err == nil {
+		number = nextCRLNumber(string(secret.Data[crlNumberFile]), secret.Data["crl.pem"])
+	} else {
+		number = nextCRLNumber("", nil)
+	}
+
+	// while a CA rollover is in progress crl.pem holds a CRL of each CA
+	cas, caKeys, err := openVPNPKI.CertificateAuthorities()
 	if err != nil {
 		return
 	}
+	var crls bytes.Buffer
+	for i := range cas {
+		crl, err := genCRL(revoked, cas[i], caKeys[i], number, *crlValidity)
+		if err != nil {
+			return err
+		}
+		crls.Write(crl.Bytes())
+	}
 
 	secretMetaData := metav1.ObjectMeta{Name: secretCRL}
 
 	secretData := map[string][]byte{
-		"crl.pem": crl.Bytes(),
+		"crl.pem":     crls.Bytes(),
+		crlNumberFile: []byte(formatCRLNumber(number.Add(number, big.NewInt(1)))),
 	}
 
 	//err = openVPNPKI.secretCreate(secretMetaData, secretData)
@@ -306,25 +357,52 @@ func (openVPNPKI *OpenVPNPKI) easyrsaGenCRL() (err error) {
 	return
 }
 
-func (openVPNPKI *OpenVPNPKI) easyrsaBuildClient(commonName string) (err error) {
+// easyrsaBuildClient issues a client certificate expiring at notAfter, zero for --client-cert.expiration-days
+func (openVPNPKI *OpenVPNPKI) easyrsaBuildClient(commonName string, notAfter time.Time) (err error) {
+	return openVPNPKI.easyrsaIssueClient(commonName, notAfter, nil)
+}
+
+// easyrsaIssueClient issues a client certificate for a new key, or for the key of the CSR which is kept instead of the key
+func (openVPNPKI *OpenVPNPKI) easyrsaIssueClient(commonName string, notAfter time.Time, csr *x509.CertificateRequest) (err error) {
 	// check certificate exists
 	_, err = openVPNPKI.secretGetByLabels("name=" + commonName)
 	if err == nil {
 		return errors.New(fmt.Sprintf("certificate for user (%s) already exists", commonName))
 	}
 
-	clientPrivKeyPEM, err := genPrivKey()
-	if err != nil {
-		return
+	secretData := map[string][]byte{}
+	var clientPubKey crypto.PublicKey
+	if csr != nil {
+		clientPubKey = csr.PublicKey
+		// the TLS secret type needs the key entry
+		secretData[privKeyFileName] = []byte{}
+		secretData[csrFileName] = encodeCSR(csr).Bytes()
+	} else {
+		clientPrivKeyPEM, err := genPrivKey(*pkiKeyAlgo)
+		if err != nil {
+			return err
+		}
+
+		clientPrivKey, err := decodePrivKey(clientPrivKeyPEM.Bytes())
+		if err != nil {
+			return err
+		}
+		clientPubKey = clientPrivKey.Public()
+		if secretData[privKeyFileName], err = openVPNPKI.Keyring.seal(clientPrivKeyPEM.Bytes()); err != nil {
+			return err
+		}
 	}
 
-	clientPrivKeyRSA, err := decodePrivKey(clientPrivKeyPEM.Bytes())
+	caCert, caKey := openVPNPKI.signingCA()
+	clientCertPEM, err := genClientCertUntil(clientPubKey, caKey, caCert, commonName, notAfter)
 	if err != nil {
 		return
 	}
-
-	clientCertPEM, _ := genClientCert(clientPrivKeyRSA, openVPNPKI.CAPrivKeyRSA, openVPNPKI.CACert, commonName)
+	secretData[certFileName] = clientCertPEM.Bytes()
 	clientCert, err := decodeCert(clientCertPEM.Bytes())
+	if err != nil {
+		return
+	}
 
 	secretMetaData := metav1.ObjectMeta{
 		Name: fmt.Sprintf(secretClientTmpl, clientCert.SerialNumber),
@@ -343,11 +421,6 @@ func (openVPNPKI *OpenVPNPKI) easyrsaBuildClient(commonName string) (err error)
 		},
 	}
 
-	secretData := map[string][]byte{
-		certFileName:    clientCertPEM.Bytes(),
-		privKeyFileName: clientPrivKeyPEM.Bytes(),
-	}
-
 	err = openVPNPKI.secretCreate(secretMetaData, secretData, v1.SecretTypeTLS)
 	if err != nil {
 		return
@@ -364,25 +437,30 @@ func (openVPNPKI *OpenVPNPKI) easyrsaBuildClient(commonName string) (err error)
 }
 
 func (openVPNPKI *OpenVPNPKI) easyrsaGetCACert() string {
-	return openVPNPKI.CACertPEM.String()
+	return string(openVPNPKI.caBundle())
 }
 
-func (openVPNPKI *OpenVPNPKI) easyrsaGetClientCert(commonName string) (cert, key string) {
-	secret, err := openVPNPKI.secretGetByLabels("name=" + commonName)
-	if err != nil {
-		log.Error(err)
+// signingCA returns the CA new certificates are signed with, the new CA while a rollover is in progress
+func (openVPNPKI *OpenVPNPKI) signingCA() (*x509.Certificate, crypto.Signer) {
+	if openVPNPKI.NextCACert != nil {
+		return openVPNPKI.NextCACert, openVPNPKI.NextCAPrivKey
 	}
+	return openVPNPKI.CACert, openVPNPKI.CAPrivKey
+}
 
-	cert = string(secret.Data[certFileName])
-	key = string(secret.Data[privKeyFileName])
-
-	return
+// caBundle returns the certificates of every trusted CA for ca.crt, the current CA comes first
+func (openVPNPKI *OpenVPNPKI) caBundle() []byte {
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: openVPNPKI.CACert.Raw})
+	if openVPNPKI.NextCACert != nil {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: openVPNPKI.NextCACert.Raw})...)
+	}
+	return bundle
 }
 
 func (openVPNPKI *OpenVPNPKI) easyrsaRevoke(commonName string) (err error) {
 	secret, err := openVPNPKI.secretGetByLabels("name=" + commonName)
 	if err != nil {
-		log.Error(err)
+		return
 	}
 
 	if secret.Annotations["revokedAt"] != "" {
@@ -397,6 +475,11 @@ func (openVPNPKI *OpenVPNPKI) easyrsaRevoke(commonName string) (err error) {
 		return
 	}
 
+	_, err = openVPNPKI.revokeRenewedSecrets(commonName)
+	if err != nil {
+		return
+	}
+
 	err = openVPNPKI.indexTxtUpdate()
 	if err != nil {
 		return
@@ -420,7 +503,7 @@ func (openVPNPKI *OpenVPNPKI) easyrsaRevoke(commonName string) (err error) {
 func (openVPNPKI *OpenVPNPKI) easyrsaUnrevoke(commonName string) (err error) {
 	secret, err := openVPNPKI.secretGetByLabels("name=" + commonName)
 	if err != nil {
-		log.Error(err)
+		return
 	}
 
 	secret.Annotations["revokedAt"] = ""
@@ -450,22 +533,33 @@ func (openVPNPKI *OpenVPNPKI) easyrsaUnrevoke(commonName string) (err error) {
 	return
 }
 
-func (openVPNPKI *OpenVPNPKI) easyrsaRotate(commonName, newPassword string) (err error) {
+func (openVPNPKI *OpenVPNPKI) easyrsaRotate(commonName, newPassword string, notAfter time.Time) (err error) {
 	secret, err := openVPNPKI.secretGetByLabels("name=" + commonName)
 	if err != nil {
-		log.Error(err)
+		return
+	}
+	// users who signed a CSR keep their key, the new certificate is issued for the same CSR
+	var csr *x509.CertificateRequest
+	if len(secret.Data[privKeyFileName]) == 0 {
+		if csr, err = decodeCSR(secret.Data[csrFileName]); err != nil {
+			return fmt.Errorf("user (%s) has neither a private key nor a CSR: %w", commonName, err)
+		}
 	}
 	uniqHash := strings.Replace(uuid.New().String(), "-", "", -1)
 	secret.Annotations["commonName"] = "REVOKED-" + commonName + "-" + uniqHash
 	secret.Labels["name"] = "REVOKED" + commonName
 	secret.Labels["revokedForever"] = "true"
+	// the old certificate must not stay valid next to the new one
+	if secret.Annotations["revokedAt"] == "" {
+		secret.Annotations["revokedAt"] = time.Now().Format(indexTxtDateFormat)
+	}
 
 	_, err = openVPNPKI.KubeClient.CoreV1().Secrets(namespace).Update(context.TODO(), secret, metav1.UpdateOptions{})
 	if err != nil {
 		return
 	}
 
-	err = openVPNPKI.easyrsaBuildClient(commonName)
+	err = openVPNPKI.easyrsaIssueClient(commonName, notAfter, csr)
 	if err != nil {
 		return
 	}
@@ -475,6 +569,11 @@ func (openVPNPKI *OpenVPNPKI) easyrsaRotate(commonName, newPassword string) (err
 		return
 	}
 
+	_, err = openVPNPKI.revokeRenewedSecrets(commonName)
+	if err != nil {
+		return
+	}
+
 	err = openVPNPKI.indexTxtUpdate()
 	if err != nil {
 		return
@@ -493,21 +592,131 @@ func (openVPNPKI *OpenVPNPKI) easyrsaRotate(commonName, newPassword string) (err
 	err = openVPNPKI.updateCRLOnDisk()
 	return
 }
-func (openVPNPKI *OpenVPNPKI) easyrsaDelete(commonName string) (err error) {
+
+// easyrsaRenew issues a new certificate for the user like easyrsaRotate, but the old one stays valid until it expires
+// or easyrsaRevokeRenewed revokes it
+func (openVPNPKI *OpenVPNPKI) easyrsaRenew(commonName string, notAfter time.Time) (err error) {
 	secret, err := openVPNPKI.secretGetByLabels("name=" + commonName)
+	if err != nil {
+		return
+	}
+	if secret.Annotations["revokedAt"] != "" {
+		return fmt.Errorf("user (%s) has no valid certificate", commonName)
+	}
+	var csr *x509.CertificateRequest
+	if len(secret.Data[privKeyFileName]) == 0 {
+		if csr, err = decodeCSR(secret.Data[csrFileName]); err != nil {
+			return fmt.Errorf("user (%s) has neither a private key nor a CSR: %w", commonName, err)
+		}
+	}
+	uniqHash := strings.Replace(uuid.New().String(), "-", "", -1)
+	secret.Annotations["commonName"] = "REVOKED-" + commonName + "-" + uniqHash
+	secret.Labels["name"] = "REVOKED-" + commonName + "-" + uniqHash
+	secret.Labels["revokedForever"] = "true"
+
+	secret, err = openVPNPKI.KubeClient.CoreV1().Secrets(namespace).Update(context.TODO(), secret, metav1.UpdateOptions{})
+	if err != nil {
+		return
+	}
+
+	err = openVPNPKI.easyrsaIssueClient(commonName, notAfter, csr)
+	if err != nil {
+		// the old certificate keeps the name
+		secret.Annotations["commonName"] = commonName
+		secret.Labels["name"] = commonName
+		delete(secret.Labels, "revokedForever")
+		if _, restoreErr := openVPNPKI.KubeClient.CoreV1().Secrets(namespace).Update(context.TODO(), secret, metav1.UpdateOptions{}); restoreErr != nil {
+			log.Errorf("can't restore the certificate of %s: %v", commonName, restoreErr)
+		}
+		return
+	}
+
+	err = openVPNPKI.transferRoutes(secret, commonName)
+	if err != nil {
+		return
+	}
+
+	err = openVPNPKI.indexTxtUpdate()
+	if err != nil {
+		return
+	}
+
+	err = openVPNPKI.updateIndexTxtOnDisk()
+	return
+}
+
+// easyrsaRevokeRenewed revokes the certificates of the user replaced by easyrsaRenew that are still valid
+func (openVPNPKI *OpenVPNPKI) easyrsaRevokeRenewed(commonName string) (err error) {
+	revoked, err := openVPNPKI.revokeRenewedSecrets(commonName)
+	if err != nil || !revoked {
+		return
+	}
+
+	err = openVPNPKI.indexTxtUpdate()
+	if err != nil {
+		return
+	}
+
+	err = openVPNPKI.updateIndexTxtOnDisk()
+	if err != nil {
+		return
+	}
+
+	err = openVPNPKI.easyrsaGenCRL()
 	if err != nil {
 		log.Error(err)
 	}
+
+	err = openVPNPKI.updateCRLOnDisk()
+	return
+}
+
+// revokeRenewedSecrets marks the secrets of certificates replaced by easyrsaRenew revoked and reports whether there were any,
+// the caller updates index.txt and the CRL
+func (openVPNPKI *OpenVPNPKI) revokeRenewedSecrets(commonName string) (bool, error) {
+	secrets, err := openVPNPKI.secretsGetByLabels("index.txt=,type=clientAuth")
+	if err != nil {
+		return false, err
+	}
+
+	revoked := false
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if secret.Annotations["revokedAt"] != "" || retiredCommonName(secret.Annotations["commonName"]) != commonName {
+			continue
+		}
+		secret.Annotations["revokedAt"] = time.Now().Format(indexTxtDateFormat)
+		if _, err = openVPNPKI.KubeClient.CoreV1().Secrets(namespace).Update(context.TODO(), secret, metav1.UpdateOptions{}); err != nil {
+			return revoked, err
+		}
+		revoked = true
+	}
+	return revoked, nil
+}
+
+func (openVPNPKI *OpenVPNPKI) easyrsaDelete(commonName string) (err error) {
+	secret, err := openVPNPKI.secretGetByLabels("name=" + commonName)
+	if err != nil {
+		return
+	}
 	uniqHash := strings.Replace(uuid.New().String(), "-", "", -1)
 	secret.Annotations["commonName"] = "REVOKED-" + commonName + "-" + uniqHash
 	secret.Labels["name"] = "REVOKED-" + commonName + "-" + uniqHash
 	secret.Labels["revokedForever"] = "true"
+	if secret.Annotations["revokedAt"] == "" {
+		secret.Annotations["revokedAt"] = time.Now().Format(indexTxtDateFormat)
+	}
 
 	_, err = openVPNPKI.KubeClient.CoreV1().Secrets(namespace).Update(context.TODO(), secret, metav1.UpdateOptions{})
 	if err != nil {
 		return
 	}
 
+	_, err = openVPNPKI.revokeRenewedSecrets(commonName)
+	if err != nil {
+		return
+	}
+
 	err = openVPNPKI.indexTxtUpdate()
 	if err != nil {
 		return
@@ -539,8 +748,12 @@ func (openVPNPKI *OpenVPNPKI) secretGetClientCert(name string) (cert ClientCert,
 		return
 	}
 
-	cert.PrivKeyPEM = bytes.NewBuffer(secret.Data[privKeyFileName])
-	cert.PrivKeyRSA, err = decodePrivKey(cert.PrivKeyPEM.Bytes())
+	keyPEM, err := openVPNPKI.Keyring.open(secret.Data[privKeyFileName])
+	if err != nil {
+		return
+	}
+	cert.PrivKeyPEM = bytes.NewBuffer(keyPEM)
+	cert.PrivKey, err = decodePrivKey(cert.PrivKeyPEM.Bytes())
 	if err != nil {
 		return
 	}
@@ -549,11 +762,6 @@ func (openVPNPKI *OpenVPNPKI) secretGetClientCert(name string) (cert ClientCert,
 }
 
 func (openVPNPKI *OpenVPNPKI) updateFilesFromSecrets() (err error) {
-	ca, err := openVPNPKI.secretGetClientCert(secretCA)
-	if err != nil {
-		return
-	}
-
 	server, err := openVPNPKI.secretGetClientCert(secretServer)
 	if err != nil {
 		return
@@ -571,7 +779,7 @@ func (openVPNPKI *OpenVPNPKI) updateFilesFromSecrets() (err error) {
 		err = os.MkdirAll(fmt.Sprintf("%s/pki/private", *easyrsaDirPath), 0755)
 	}
 
-	err = ioutil.WriteFile(fmt.Sprintf("%s/pki/ca.crt", *easyrsaDirPath), ca.CertPEM.Bytes(), 0600)
+	err = openVPNPKI.updateCAOnDisk()
 	if err != nil {
 		return
 	}
@@ -596,10 +804,22 @@ func (openVPNPKI *OpenVPNPKI) updateFilesFromSecrets() (err error) {
 		return
 	}
 
+	if tlsCryptV2ServerKey := secret.Data[tlsCryptV2ServerKeyFile]; len(tlsCryptV2ServerKey) > 0 {
+		err = ioutil.WriteFile(fmt.Sprintf("%s/pki/%s", *easyrsaDirPath, tlsCryptV2ServerKeyFile), tlsCryptV2ServerKey, 0600)
+		if err != nil {
+			return
+		}
+	}
+
 	err = openVPNPKI.updateCRLOnDisk()
 	return
 }
 
+// updateCAOnDisk writes ca.crt, it holds the old and the new CA while a rollover is in progress
+func (openVPNPKI *OpenVPNPKI) updateCAOnDisk() error {
+	return ioutil.WriteFile(fmt.Sprintf("%s/pki/ca.crt", *easyrsaDirPath), openVPNPKI.caBundle(), 0600)
+}
+
 func (openVPNPKI *OpenVPNPKI) updateCRLOnDisk() (err error) {
 	secret, err := openVPNPKI.secretGetByName(secretCRL)
 	crl := secret.Data["crl.pem"]
@@ -611,17 +831,17 @@ func (openVPNPKI *OpenVPNPKI) updateCRLOnDisk() (err error) {
 }
 
 func (openVPNPKI *OpenVPNPKI) secretGenTaKeyAndDHParam() (err error) {
-	taKeyPath := "/tmp/ta.key"
-	cmd := exec.Command("bash", "-c", fmt.Sprintf("/usr/sbin/openvpn --genkey --secret %s", taKeyPath))
-	stdout, err := cmd.CombinedOutput()
-	log.Info(fmt.Sprintf("/usr/sbin/openvpn --genkey --secret %s: %s", taKeyPath, string(stdout)))
+	taKey, err := genStaticKey()
+	if err != nil {
+		return
+	}
+	tlsCryptV2ServerKey, err := genTLSCryptV2ServerKey()
 	if err != nil {
 		return
 	}
-	taKey, err := ioutil.ReadFile(taKeyPath)
 
 	dhparamPath := "/tmp/dh.pem"
-	cmd = exec.Command("bash", "-c", fmt.Sprintf("openssl dhparam -out %s 2048", dhparamPath))
+	cmd := exec.Command("bash", "-c", fmt.Sprintf("openssl dhparam -out %s 2048", dhparamPath))
 	_, err = cmd.CombinedOutput()
 	if err != nil {
 		return
@@ -631,8 +851,9 @@ func (openVPNPKI *OpenVPNPKI) secretGenTaKeyAndDHParam() (err error) {
 	secretMetaData := metav1.ObjectMeta{Name: secretDHandTA}
 
 	secretData := map[string][]byte{
-		"ta.key": taKey,
-		"dh.pem": dhparam,
+		"ta.key":                taKey,
+		"dh.pem":                dhparam,
+		tlsCryptV2ServerKeyFile: tlsCryptV2ServerKey,
 	}
 
 	err = openVPNPKI.secretCreate(secretMetaData, secretData, v1.SecretTypeOpaque)
@@ -645,22 +866,6 @@ func (openVPNPKI *OpenVPNPKI) secretGenTaKeyAndDHParam() (err error) {
 
 // ccd
 
-func (openVPNPKI *OpenVPNPKI) secretGetCcd(commonName string) (ccd string) {
-	secret, err := openVPNPKI.secretGetByLabels("name=" + commonName)
-	if err != nil {
-		log.Error(err)
-		return
-	}
-
-	for k, _ := range secret.Data {
-		if k == "ccd" {
-			ccd = string(secret.Data["ccd"])
-			return
-		}
-	}
-	return
-}
-
 func (openVPNPKI *OpenVPNPKI) secretUpdateCcd(commonName string, ccd []byte) {
 	secret, err := openVPNPKI.secretGetByLabels("name=" + commonName)
 	if err != nil {
@@ -792,3 +997,308 @@ func (openVPNPKI *OpenVPNPKI) transferRoutes(revokedSecret *v1.Secret, newNameCe
 
 	return nil
 }
+
+// storage
+
+func (openVPNPKI *OpenVPNPKI) Name() string {
+	return storageKubernetes
+}
+
+func (openVPNPKI *OpenVPNPKI) Index() ([]indexTxtLine, error) {
+	secret, err := openVPNPKI.secretGetByName(secretIndexTxt)
+	if err != nil {
+		return nil, err
+	}
+	return indexTxtParser(string(secret.Data["index.txt"])), nil
+}
+
+func (openVPNPKI *OpenVPNPKI) BuildClient(commonName string, notAfter time.Time) error {
+	return openVPNPKI.easyrsaBuildClient(commonName, notAfter)
+}
+
+func (openVPNPKI *OpenVPNPKI) SignClient(csr *x509.CertificateRequest, notAfter time.Time) error {
+	return openVPNPKI.easyrsaIssueClient(csr.Subject.CommonName, notAfter, csr)
+}
+
+func (openVPNPKI *OpenVPNPKI) Revoke(commonName string) error {
+	return openVPNPKI.easyrsaRevoke(commonName)
+}
+
+func (openVPNPKI *OpenVPNPKI) Unrevoke(commonName string) error {
+	return openVPNPKI.easyrsaUnrevoke(commonName)
+}
+
+func (openVPNPKI *OpenVPNPKI) Rotate(commonName string, notAfter time.Time) error {
+	return openVPNPKI.easyrsaRotate(commonName, "", notAfter)
+}
+
+func (openVPNPKI *OpenVPNPKI) Renew(commonName string, notAfter time.Time) error {
+	return openVPNPKI.easyrsaRenew(commonName, notAfter)
+}
+
+func (openVPNPKI *OpenVPNPKI) RevokeRenewed(commonName string) error {
+	return openVPNPKI.easyrsaRevokeRenewed(commonName)
+}
+
+func (openVPNPKI *OpenVPNPKI) Delete(commonName string) error {
+	return openVPNPKI.easyrsaDelete(commonName)
+}
+
+func (openVPNPKI *OpenVPNPKI) ClientCert(commonName string) (cert, key string, err error) {
+	secret, err := openVPNPKI.secretGetByLabels("name=" + commonName)
+	if err != nil {
+		return
+	}
+	keyPEM, err := openVPNPKI.Keyring.open(secret.Data[privKeyFileName])
+	return string(secret.Data[certFileName]), string(keyPEM), err
+}
+
+// TLSCryptV2Key returns the tls-crypt-v2 key kept in the secret of the current certificate of the user,
+// it is generated on first use
+func (openVPNPKI *OpenVPNPKI) TLSCryptV2Key(commonName string) (string, error) {
+	secret, err := openVPNPKI.secretGetByLabels("name=" + commonName)
+	if err != nil {
+		return "", err
+	}
+	if sealed := secret.Data[tlsCryptV2KeyFile]; len(sealed) > 0 {
+		key, err := openVPNPKI.Keyring.open(sealed)
+		return string(key), err
+	}
+
+	serverKey, err := openVPNPKI.tlsCryptV2ServerKey()
+	if err != nil {
+		return "", err
+	}
+	key, err := genTLSCryptV2ClientKey(serverKey, secret.Annotations["serialNumber"])
+	if err != nil {
+		return "", err
+	}
+	if secret.Data[tlsCryptV2KeyFile], err = openVPNPKI.Keyring.seal(key); err != nil {
+		return "", err
+	}
+	if err = openVPNPKI.secretUpdate(secret.ObjectMeta, secret.Data, secret.Type); err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+// tlsCryptV2ServerKey returns the tls-crypt-v2 server key, it is added to the secret of installations older than it
+func (openVPNPKI *OpenVPNPKI) tlsCryptV2ServerKey() ([]byte, error) {
+	secret, err := openVPNPKI.secretGetByName(secretDHandTA)
+	if err != nil {
+		return nil, err
+	}
+	if key := secret.Data[tlsCryptV2ServerKeyFile]; len(key) > 0 {
+		return key, nil
+	}
+
+	key, err := genTLSCryptV2ServerKey()
+	if err != nil {
+		return nil, err
+	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[tlsCryptV2ServerKeyFile] = key
+	if err = openVPNPKI.secretUpdate(secret.ObjectMeta, secret.Data, secret.Type); err != nil {
+		return nil, err
+	}
+	log.Infof("created the tls-crypt-v2 server key, restart OpenVPN with --tls-crypt-v2 %s/pki/%s", *easyrsaDirPath, tlsCryptV2ServerKeyFile)
+	return key, ioutil.WriteFile(fmt.Sprintf("%s/pki/%s", *easyrsaDirPath, tlsCryptV2ServerKeyFile), key, 0600)
+}
+
+// RewrapKeys rewraps tls.key of the CA secrets and the tls.key and tls-crypt-v2 key of every client secret, also of revoked certificates
+func (openVPNPKI *OpenVPNPKI) RewrapKeys() (int, error) {
+	secrets, err := openVPNPKI.secretsGetByLabels(labelKeyType + "=" + labelValueClientAuth)
+	if err != nil {
+		return 0, err
+	}
+	retiredCAs, err := openVPNPKI.secretsGetByLabels(labelKeyType + "=" + labelValueRetiredCA)
+	if err != nil {
+		return 0, err
+	}
+	ca, err := openVPNPKI.secretGetByName(secretCA)
+	if err != nil {
+		return 0, err
+	}
+	items := append(append(secrets.Items, retiredCAs.Items...), *ca)
+	if exists, _ := openVPNPKI.secretCheckExists(secretCANext); exists {
+		next, err := openVPNPKI.secretGetByName(secretCANext)
+		if err != nil {
+			return 0, err
+		}
+		items = append(items, *next)
+	}
+
+	changed := 0
+	for _, secret := range items {
+		updated := false
+		for _, name := range []string{privKeyFileName, tlsCryptV2KeyFile} {
+			key, ok, err := openVPNPKI.Keyring.rewrap(secret.Data[name])
+			if err != nil {
+				return changed, fmt.Errorf("secret (%s): %w", secret.Name, err)
+			}
+			if ok {
+				secret.Data[name], updated = key, true
+			}
+		}
+		if !updated {
+			continue
+		}
+		if err = openVPNPKI.secretUpdate(secret.ObjectMeta, secret.Data, secret.Type); err != nil {
+			return changed, fmt.Errorf("secret (%s) update error: %w", secret.Name, err)
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+func (openVPNPKI *OpenVPNPKI) ReadCcd(commonName string) (string, error) {
+	secret, err := openVPNPKI.secretGetByLabels("name=" + commonName)
+	if err != nil {
+		return "", err
+	}
+	return string(secret.Data["ccd"]), nil
+}
+
+func (openVPNPKI *OpenVPNPKI) WriteCcd(commonName string, ccd []byte) error {
+	secret, err := openVPNPKI.secretGetByLabels("name=" + commonName)
+	if err != nil {
+		return err
+	}
+	secret.Data["ccd"] = ccd
+
+	err = openVPNPKI.secretUpdate(secret.ObjectMeta, secret.Data, v1.SecretTypeTLS)
+	if err != nil {
+		return fmt.Errorf("secret (%s) update error: %w", secret.Name, err)
+	}
+	return openVPNPKI.updateCcdOnDisk()
+}
+
+func (openVPNPKI *OpenVPNPKI) StaticAddresses() (map[string]string, error) {
+	labelSelector := fmt.Sprintf("%s=%s,%s=%s",
+		labelKeyType, labelValueClientAuth,
+		labelKeyManagedBy, labelValueManagedByApp)
+
+	secrets, err := openVPNPKI.secretsGetByLabels(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := map[string]string{}
+	for _, secret := range secrets.Items {
+		// the CCD of rotated certificates moved to the current secret, deleted users don't hold their address
+		if secret.Labels["revokedForever"] == "true" {
+			continue
+		}
+		if address := ccdStaticAddress(string(secret.Data["ccd"])); address != "" {
+			addresses[secret.Labels["name"]] = address
+		}
+	}
+	return addresses, nil
+}
+
+func (openVPNPKI *OpenVPNPKI) Groups() ([]userGroup, error) {
+	if exists, _ := openVPNPKI.secretCheckExists(secretGroups); !exists {
+		return nil, nil
+	}
+	secret, err := openVPNPKI.secretGetByName(secretGroups)
+	if err != nil {
+		return nil, err
+	}
+	return parseGroups(secret.Data[groupsFile])
+}
+
+func (openVPNPKI *OpenVPNPKI) WriteGroups(groups []userGroup) error {
+	content, err := marshalGroups(groups)
+	if err != nil {
+		return err
+	}
+	objectMeta := metav1.ObjectMeta{
+		Name:   secretGroups,
+		Labels: map[string]string{labelKeyManagedBy: labelValueManagedByApp},
+	}
+	data := map[string][]byte{groupsFile: content}
+	if exists, _ := openVPNPKI.secretCheckExists(secretGroups); !exists {
+		return openVPNPKI.secretCreate(objectMeta, data, v1.SecretTypeOpaque)
+	}
+	return openVPNPKI.secretUpdate(objectMeta, data, v1.SecretTypeOpaque)
+}
+
+func (openVPNPKI *OpenVPNPKI) CertificateAuthorities() ([]*x509.Certificate, []crypto.Signer, error) {
+	if openVPNPKI.CACert == nil || openVPNPKI.CAPrivKey == nil {
+		return nil, nil, errors.New("CA is not loaded")
+	}
+	certs, keys := []*x509.Certificate{openVPNPKI.CACert}, []crypto.Signer{openVPNPKI.CAPrivKey}
+	if openVPNPKI.NextCACert != nil {
+		certs, keys = append(certs, openVPNPKI.NextCACert), append(keys, openVPNPKI.NextCAPrivKey)
+	}
+	return certs, keys, nil
+}
+
+func (openVPNPKI *OpenVPNPKI) CertificateStatus(serial *big.Int) (*certificateStatus, error) {
+	secrets, err := openVPNPKI.secretsGetByLabels("index.txt=")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, secret := range secrets.Items {
+		cert, err := decodeCert(secret.Data[certFileName])
+		if err != nil || cert.SerialNumber.Cmp(serial) != 0 {
+			continue
+		}
+		status := &certificateStatus{CommonName: secret.Labels["name"], NotAfter: cert.NotAfter}
+		if revokedAt := secret.Annotations["revokedAt"]; revokedAt != "" {
+			if status.RevokedAt, err = time.Parse(indexTxtDateFormat, revokedAt); err != nil {
+				log.Warnf("bad revokedAt annotation of %s: %v", secret.Name, err)
+				status.RevokedAt = cert.NotBefore
+			}
+		}
+		return status, nil
+	}
+	return nil, nil
+}
+
+func (openVPNPKI *OpenVPNPKI) Certificates(commonName string) ([]issuedCertificate, error) {
+	secrets, err := openVPNPKI.secretsGetByLabels("index.txt=")
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []issuedCertificate
+	for _, secret := range secrets.Items {
+		current := secret.Annotations["commonName"] == commonName
+		if !current && retiredCommonName(secret.Annotations["commonName"]) != commonName {
+			continue
+		}
+		cert, err := decodeCert(secret.Data[certFileName])
+		if err != nil {
+			log.Warnf("can't decode the certificate of secret %s: %v", secret.Name, err)
+			continue
+		}
+		c := issuedCertificate{Cert: cert, Current: current}
+		if revokedAt := secret.Annotations["revokedAt"]; revokedAt != "" {
+			if c.RevokedAt, err = time.Parse(indexTxtDateFormat, revokedAt); err != nil {
+				log.Warnf("bad revokedAt annotation of %s: %v", secret.Name, err)
+			}
+		}
+		certs = append(certs, c)
+	}
+	sortIssuedCertificates(certs)
+	return certs, nil
+}
+
+func (openVPNPKI *OpenVPNPKI) CRL() ([]byte, error) {
+	secret, err := openVPNPKI.secretGetByName(secretCRL)
+	if err != nil {
+		return nil, err
+	}
+	return secret.Data["crl.pem"], nil
+}
+
+func (openVPNPKI *OpenVPNPKI) GenCRL() error {
+	if err := openVPNPKI.easyrsaGenCRL(); err != nil {
+		return err
+	}
+	return openVPNPKI.updateCRLOnDisk()
+}
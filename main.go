@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"crypto/x509"
@@ -17,6 +16,7 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,7 +24,6 @@ import (
 	"time"
 	"unicode/utf8"
 
-	"github.com/google/uuid"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -56,10 +55,13 @@ const (
 	labelKeyName           = "name"
 	labelKeyManagedBy      = "app.kubernetes.io/managed-by"
 	labelValueClientAuth   = "clientAuth"
+	labelValueRetiredCA    = "retiredCA"
 	labelValueManagedByApp = "ovpn-admin"
 	prefixStaticRoute      = "ifconfig-push"
 
 	kubeNamespaceFilePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	mgmtTimeout = 5 * time.Second
 )
 
 var (
@@ -73,14 +75,17 @@ var (
 	masterSyncFrequency      = kingpin.Flag("master.sync-frequency", "master host data sync frequency in seconds").Default("600").Envar("OVPN_MASTER_SYNC_FREQUENCY").Int()
 	masterSyncToken          = kingpin.Flag("master.sync-token", "master host data sync security token").Default("VerySecureToken").Envar("OVPN_MASTER_TOKEN").PlaceHolder("TOKEN").String()
 	openvpnNetwork           = kingpin.Flag("ovpn.network", "NETWORK/MASK_PREFIX for OpenVPN server").Default("172.16.100.0/24").Envar("OVPN_NETWORK").String()
+	openvpnAddressPools      = kingpin.Flag("ovpn.address-pool", "NAME=CIDR part of --ovpn.network static addresses can be drawn from with auto:NAME; can have multiple values").Envar("OVPN_ADDRESS_POOL").PlaceHolder("NAME=CIDR").Strings()
 	openvpnServer            = kingpin.Flag("ovpn.server", "HOST:PORT:PROTOCOL for OpenVPN server; can have multiple values").Default("127.0.0.1:7777:tcp").Envar("OVPN_SERVER").PlaceHolder("HOST:PORT:PROTOCOL").Strings()
 	openvpnServerBehindLB    = kingpin.Flag("ovpn.server.behindLB", "enable if your OpenVPN server is behind Kubernetes Service having the LoadBalancer type").Default("false").Envar("OVPN_LB").Bool()
 	openvpnServiceName       = kingpin.Flag("ovpn.service", "the name of Kubernetes Service having the LoadBalancer type if your OpenVPN server is behind it").Default("openvpn-external").Envar("OVPN_LB_SERVICE").Strings()
+	openvpnTLSMode           = kingpin.Flag("ovpn.tls-mode", "control channel protection of client configs: tls-auth, tls-crypt or tls-crypt-v2 with a key per user").Default(tlsModeAuth).Envar("OVPN_TLS_MODE").Enum(tlsModes...)
 	mgmtAddress              = kingpin.Flag("mgmt", "ALIAS=HOST:PORT for OpenVPN server mgmt interface; can have multiple values").Default("main=127.0.0.1:8989").Envar("OVPN_MGMT").Strings()
+	mgmtBytecountInterval    = kingpin.Flag("mgmt.bytecount-interval", "interval in seconds of the per-client traffic notifications from the OpenVPN mgmt interface, 0 to disable").Default("5").Envar("OVPN_MGMT_BYTECOUNT_INTERVAL").Int()
 	metricsPath              = kingpin.Flag("metrics.path", "URL path for exposing collected metrics").Default("/metrics").Envar("OVPN_METRICS_PATH").String()
 	easyrsaDirPath           = kingpin.Flag("easyrsa.path", "path to easyrsa dir").Default("./easyrsa").Envar("EASYRSA_PATH").String()
 	indexTxtPath             = kingpin.Flag("easyrsa.index-path", "path to easyrsa index file").Default("").Envar("OVPN_INDEX_PATH").String()
-	easyrsaBinPath           = kingpin.Flag("easyrsa.bin-path", "path to easyrsa script").Default("easyrsa").Envar("EASYRSA_BIN_PATH").String()
+	easyrsaBinPath           = kingpin.Flag("easyrsa.bin-path", "deprecated and ignored, certificates are issued without the easyrsa script").Default("easyrsa").Envar("EASYRSA_BIN_PATH").Hidden().String()
 	ccdEnabled               = kingpin.Flag("ccd", "enable client-config-dir").Default("false").Envar("OVPN_CCD").Bool()
 	ccdDir                   = kingpin.Flag("ccd.path", "path to client-config-dir").Default("./ccd").Envar("OVPN_CCD_PATH").String()
 	clientConfigTemplatePath = kingpin.Flag("templates.clientconfig-path", "path to custom client.conf.tpl").Default("").Envar("OVPN_TEMPLATES_CC_PATH").String()
@@ -91,7 +96,40 @@ var (
 	logLevel                 = kingpin.Flag("log.level", "set log level: trace, debug, info, warn, error (default info)").Default("info").Envar("LOG_LEVEL").String()
 	logFormat                = kingpin.Flag("log.format", "set log format: text, json (default text)").Default("text").Envar("LOG_FORMAT").String()
 	storageBackend           = kingpin.Flag("storage.backend", "storage backend: filesystem, kubernetes.secrets (default filesystem)").Default("filesystem").Envar("STORAGE_BACKEND").String()
+	storageImport            = kingpin.Flag("storage.import", "import the easyrsa pki in DIR/pki and the CCD in DIR/ccd into the kubernetes.secrets backend and exit").Default("").Envar("OVPN_STORAGE_IMPORT").PlaceHolder("DIR").String()
+	storageExport            = kingpin.Flag("storage.export", "export the kubernetes.secrets backend as an easyrsa pki into DIR/pki and the CCD into DIR/ccd and exit").Default("").Envar("OVPN_STORAGE_EXPORT").PlaceHolder("DIR").String()
+	clientCertExternalKey    = kingpin.Flag("client-cert.external-key", "config directive referencing the private key of users who signed a CSR, {username} is replaced by the user").Default("key {username}.key").Envar("OVPN_CLIENT_CERT_EXTERNAL_KEY").String()
 	clientCertExpirationDays = kingpin.Flag("client-cert.expiration-days", "Expiration period of OpenVPN client certificates in days, the period will shrink automatically to the CA expiration period").Default("3650").Envar("CLIENT_CERT_EXPIRATION_DAYS").String()
+	pkiKeyAlgo               = kingpin.Flag("pki.key-algo", "algorithm of new private keys, a CA with another algorithm keeps signing them").Default(keyAlgoRSA2048).Envar("OVPN_PKI_KEY_ALGO").Enum(keyAlgorithms...)
+	keysMasterKey            = kingpin.Flag("keys.master-key", "master keys encrypting client and CA private keys at rest, comma separated <id>:<base64 of 32 random bytes>, the first one encrypts").Default("").Envar("OVPN_KEYS_MASTER_KEY").String()
+	keysMasterKeyFile        = kingpin.Flag("keys.master-key-file", "file with one <id>:<base64 of 32 random bytes> master key per line, read after --keys.master-key").Default("").Envar("OVPN_KEYS_MASTER_KEY_FILE").String()
+	pkiSignatureHash         = kingpin.Flag("pki.signature-hash", "hash of certificate and CRL signatures made with RSA and ECDSA keys").Default("sha256").Envar("OVPN_PKI_SIGNATURE_HASH").Enum("sha256", "sha384", "sha512")
+	uiAuthEnabled            = kingpin.Flag("ui.auth", "enable built-in authentication for the web UI and API").Default("false").Envar("OVPN_UI_AUTH").Bool()
+	uiAuthUsersFile          = kingpin.Flag("ui.auth.users-file", "path to the file with web UI users in the username:role:bcrypt-hash format").Default("./easyrsa/pki/ui-users.txt").Envar("OVPN_UI_AUTH_USERS_FILE").String()
+	uiAuthAdminUser          = kingpin.Flag("ui.auth.admin-user", "name of the initial admin user created if the users file is empty").Default("admin").Envar("OVPN_UI_AUTH_ADMIN_USER").String()
+	uiAuthAdminPassword      = kingpin.Flag("ui.auth.admin-password", "password of the initial admin user created if the users file is empty").Default("").Envar("OVPN_UI_AUTH_ADMIN_PASSWORD").String()
+	uiAuthSessionTTL         = kingpin.Flag("ui.auth.session-ttl", "lifetime of web UI sessions").Default("12h").Envar("OVPN_UI_AUTH_SESSION_TTL").Duration()
+	historyPath              = kingpin.Flag("history.path", "path to the VPN session history in JSON Lines format, empty to disable").Default("./easyrsa/pki/sessions.log").Envar("OVPN_HISTORY_PATH").String()
+	historyRetention         = kingpin.Flag("history.retention", "how long finished sessions are kept in the history, 0 to keep them forever").Default("2160h").Envar("OVPN_HISTORY_RETENTION").Duration()
+	historyMaxSessions       = kingpin.Flag("history.max-sessions", "maximum number of finished sessions kept in the history, 0 for no limit").Default("100000").Envar("OVPN_HISTORY_MAX_SESSIONS").Int()
+	crlValidity              = kingpin.Flag("crl.validity", "how long a newly signed CRL is valid").Default("4320h").Envar("OVPN_CRL_VALIDITY").Duration()
+	crlRefreshMargin         = kingpin.Flag("crl.refresh-margin", "re-sign the CRL when it expires within this time").Default("720h").Envar("OVPN_CRL_REFRESH_MARGIN").Duration()
+	renewalEnabled           = kingpin.Flag("renewal", "renew client certificates automatically before they expire").Default("false").Envar("OVPN_RENEWAL").Bool()
+	renewalDaysBefore        = kingpin.Flag("renewal.days-before", "renew client certificates expiring within this number of days").Default("14").Envar("OVPN_RENEWAL_DAYS_BEFORE").Int()
+	renewalDryRun            = kingpin.Flag("renewal.dry-run", "only log the certificates automatic renewal would renew").Default("false").Envar("OVPN_RENEWAL_DRY_RUN").Bool()
+	renewalStatePath         = kingpin.Flag("renewal.state-path", "per-user automatic renewal state in JSON format").Default("./easyrsa/pki/renewal.json").Envar("OVPN_RENEWAL_STATE_PATH").String()
+	ocspEnabled              = kingpin.Flag("ocsp", "serve an OCSP responder for the issued certificates at <base-url>ocsp").Default("false").Envar("OVPN_OCSP").Bool()
+	ocspURL                  = kingpin.Flag("ocsp.url", "OCSP responder URL written to new client certificates, e.g. http://vpn.example.com:8080/ocsp, empty to leave it out").Default("").Envar("OVPN_OCSP_URL").String()
+	ocspValidity             = kingpin.Flag("ocsp.validity", "how long OCSP responses are valid and may be cached").Default("1h").Envar("OVPN_OCSP_VALIDITY").Duration()
+	auditLogPath             = kingpin.Flag("audit.log-path", "path to the append-only audit log in JSON Lines format, empty to disable").Default("./easyrsa/pki/audit.log").Envar("OVPN_AUDIT_LOG_PATH").String()
+	oidcIssuerURL            = kingpin.Flag("oidc.issuer-url", "OpenID Connect issuer URL, enables single sign-on for the web UI").Default("").Envar("OVPN_OIDC_ISSUER_URL").String()
+	oidcClientID             = kingpin.Flag("oidc.client-id", "OpenID Connect client ID").Default("").Envar("OVPN_OIDC_CLIENT_ID").String()
+	oidcClientSecret         = kingpin.Flag("oidc.client-secret", "OpenID Connect client secret").Default("").Envar("OVPN_OIDC_CLIENT_SECRET").String()
+	oidcRedirectURL          = kingpin.Flag("oidc.redirect-url", "external URL of the OpenID Connect callback, e.g. https://vpn-admin.example.com/oidc/callback").Default("").Envar("OVPN_OIDC_REDIRECT_URL").String()
+	oidcScopes               = kingpin.Flag("oidc.scopes", "OpenID Connect scopes to request").Default("openid", "profile", "email", "groups").Envar("OVPN_OIDC_SCOPES").Strings()
+	oidcUsernameClaim        = kingpin.Flag("oidc.username-claim", "ID token claim used as the user name").Default("preferred_username").Envar("OVPN_OIDC_USERNAME_CLAIM").String()
+	oidcGroupsClaim          = kingpin.Flag("oidc.groups-claim", "ID token claim with the user's groups").Default("groups").Envar("OVPN_OIDC_GROUPS_CLAIM").String()
+	oidcRoleMapping          = kingpin.Flag("oidc.role-mapping", "GROUP=ROLE mapping of IdP groups to viewer, operator or admin; can have multiple values").Envar("OVPN_OIDC_ROLE_MAPPING").Strings()
 
 	certsArchivePath = "/tmp/" + certsArchiveFileName
 	ccdArchivePath   = "/tmp/" + ccdArchiveFileName
@@ -189,6 +227,37 @@ var (
 	},
 		[]string{"client"},
 	)
+
+	ovpnAddressPoolSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ovpn_address_pool_size",
+		Help: "static addresses that can be assigned from the pool. pool - network for the whole --ovpn.network, the --ovpn.address-pool name or group:<name>",
+	},
+		[]string{"pool", "network"},
+	)
+
+	ovpnAddressPoolUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ovpn_address_pool_used",
+		Help: "static addresses of the pool assigned to users",
+	},
+		[]string{"pool", "network"},
+	)
+
+	ovpnCRLNextUpdate = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ovpn_crl_next_update",
+		Help: "time the CRL expires at in unix seconds",
+	})
+
+	ovpnCRLNumber = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ovpn_crl_number",
+		Help: "number of the current CRL",
+	})
+
+	ovpnOCSPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ovpn_ocsp_requests_total",
+		Help: "OCSP requests answered by the responder. status - good, revoked, unknown or the error returned",
+	},
+		[]string{"status"},
+	)
 )
 
 type OvpnAdmin struct {
@@ -198,13 +267,28 @@ type OvpnAdmin struct {
 	masterHostBasicAuth    bool
 	masterSyncToken        string
 	clients                []OpenvpnClient
+	clientsMu              sync.Mutex
+	lastStats              DashboardStats
+	events                 *eventBroker
 	activeClients          []clientStatus
+	activeClientIndex      map[string]int // position in activeClients by server and client key
+	activeClientsMu        sync.RWMutex
 	promRegistry           *prometheus.Registry
 	mgmtInterfaces         map[string]string
+	mgmtClients            map[string]*mgmtClient
 	modules                []string
 	mgmtStatusTimeFormat   string
 	createUserMutex        *sync.Mutex
 	htmlTemplates          *template.Template
+	auth                   *uiAuth
+	oidc                   *oidcAuth
+	auditLog               *auditLog
+	history                *sessionHistory
+	renewal                *renewalState
+	storage                Storage
+	groupsMu               sync.Mutex
+	ipam                   *ipam
+	ipamOnce               sync.Once
 }
 
 type OpenvpnServer struct {
@@ -214,22 +298,33 @@ type OpenvpnServer struct {
 }
 
 type openvpnClientConfig struct {
-	Hosts      []OpenvpnServer
-	CA         string
-	Cert       string
-	Key        string
+	Hosts []OpenvpnServer
+	CA    string
+	Cert  string
+	Key   string
+	// ExternalKey replaces the inline key of users who signed a CSR
+	ExternalKey string
+	// TLSMode is the --ovpn.tls-mode directive TLS is used with
+	TLSMode    string
 	TLS        string
 	PasswdAuth bool
+	// SplitFiles references ca.crt, client.crt, client.key and the TLS key file next to the config instead of inlining them
+	SplitFiles bool
 }
 
 type OpenvpnClient struct {
-	Identity         string `json:"Identity"`
-	AccountStatus    string `json:"AccountStatus"`
-	ExpirationDate   string `json:"ExpirationDate"`
-	RevocationDate   string `json:"RevocationDate"`
-	ConnectionStatus string `json:"ConnectionStatus"`
-	Connections      int    `json:"Connections"`
-	ExpiringSoon     bool   `json:"ExpiringSoon"`
+	Identity         string   `json:"Identity"`
+	AccountStatus    string   `json:"AccountStatus"`
+	ExpirationDate   string   `json:"ExpirationDate"`
+	RevocationDate   string   `json:"RevocationDate"`
+	ConnectionStatus string   `json:"ConnectionStatus"`
+	Connections      int      `json:"Connections"`
+	ConnectedTo      []string `json:"ConnectedTo,omitempty"`
+	LastSeen         string   `json:"LastSeen,omitempty"`
+	ExpiringSoon     bool     `json:"ExpiringSoon"`
+	// RenewalOptOut and RenewedConfigReady are only set with --renewal
+	RenewalOptOut      bool `json:"RenewalOptOut,omitempty"`
+	RenewedConfigReady bool `json:"RenewedConfigReady,omitempty"`
 }
 
 type DashboardStats struct {
@@ -249,6 +344,24 @@ type Ccd struct {
 	User          string     `json:"User"`
 	ClientAddress string     `json:"ClientAddress"`
 	CustomRoutes  []ccdRoute `json:"CustomRoutes"`
+	// Groups of the user and what they add to the CCD, rendered after the settings of the user
+	Groups           []string   `json:"Groups,omitempty"`
+	GroupAddress     string     `json:"GroupAddress,omitempty"`
+	GroupRoutes      []ccdRoute `json:"GroupRoutes,omitempty"`
+	GroupPushOptions []string   `json:"GroupPushOptions,omitempty"`
+	// ClientAddressIPv6 is pushed with ifconfig-ipv6-push as ADDRESS/PREFIX [REMOTE]
+	ClientAddressIPv6 string `json:"ClientAddressIPv6,omitempty"`
+	// IRoutes are the networks behind a site-to-site client
+	IRoutes         []ccdRoute `json:"IRoutes,omitempty"`
+	DNSServers      []string   `json:"DNSServers,omitempty"`
+	DNSDomains      []string   `json:"DNSDomains,omitempty"`
+	RedirectGateway bool       `json:"RedirectGateway,omitempty"`
+	PushReset       bool       `json:"PushReset,omitempty"`
+	Disable         bool       `json:"Disable,omitempty"`
+	// ConfigIncludes are files read with the config directive
+	ConfigIncludes []string `json:"ConfigIncludes,omitempty"`
+	// ExtraLines are the lines of the CCD without a field, written back as they are
+	ExtraLines []string `json:"ExtraLines,omitempty"`
 }
 
 type indexTxtLine struct {
@@ -272,19 +385,12 @@ type clientStatus struct {
 	ConnectedSinceFormatted string
 	LastRefFormatted        string
 	ConnectedTo             string
+	ClientID                string
 }
 
 func (oAdmin *OvpnAdmin) userListHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
 
-	if *storageBackend == "kubernetes.secrets" {
-		err := app.updateIndexTxtOnDisk()
-		if err != nil {
-			log.Errorln(err)
-		}
-		oAdmin.clients = oAdmin.usersList()
-	}
-
 	// Check if hide revoked filter is set
 	hideRevoked := false
 	if cookie, err := r.Cookie("hideRevoked"); err == nil {
@@ -292,7 +398,7 @@ func (oAdmin *OvpnAdmin) userListHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Filter users if hideRevoked is set
-	users := oAdmin.clients
+	users := oAdmin.getClients()
 	if hideRevoked {
 		var filtered []OpenvpnClient
 		for _, u := range users {
@@ -320,6 +426,7 @@ func (oAdmin *OvpnAdmin) userListHandler(w http.ResponseWriter, r *http.Request)
 	err := oAdmin.htmlTemplates.ExecuteTemplate(w, "user_rows", map[string]interface{}{
 		"Users":      users,
 		"ServerRole": oAdmin.role,
+		"UserRole":   oAdmin.requestRole(r),
 		"Modules":    oAdmin.modules,
 	})
 	if err != nil {
@@ -337,15 +444,30 @@ func (oAdmin *OvpnAdmin) userStatisticHandler(w http.ResponseWriter, r *http.Req
 
 func (oAdmin *OvpnAdmin) userCreateHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
-	if oAdmin.role == "slave" {
-		http.Error(w, "Operation not allowed in slave mode", http.StatusLocked)
+	if status, msg := oAdmin.checkAccess(r, permCreate); status != 0 {
+		http.Error(w, msg, status)
 		return
 	}
 	_ = r.ParseForm()
-	userCreated, userCreateStatus := oAdmin.userCreate(r.FormValue("username"), r.FormValue("password"))
+	notAfter, err := parseCertExpiry(r.FormValue("expires_at"), 0, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	username := r.FormValue("username")
+	csr, err := formCSR(r, username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if csr != nil {
+		username = csr.Subject.CommonName
+	}
+	userCreated, userCreateStatus := oAdmin.userCreate(username, r.FormValue("password"), notAfter, csr)
+	oAdmin.audit(r, auditEntry{Action: auditActionCreate, Target: username, Result: auditResult(userCreated), Message: userCreateStatus})
 
 	if userCreated {
-		oAdmin.clients = oAdmin.usersList()
+		oAdmin.refreshClients()
 		w.Header().Set("HX-Trigger", `{"showToast": {"message": "`+userCreateStatus+`", "type": "success"}}`)
 		oAdmin.renderUserRows(w, r)
 		return
@@ -355,13 +477,19 @@ func (oAdmin *OvpnAdmin) userCreateHandler(w http.ResponseWriter, r *http.Reques
 }
 func (oAdmin *OvpnAdmin) userRotateHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
-	if oAdmin.role == "slave" {
-		http.Error(w, "Operation not allowed in slave mode", http.StatusLocked)
+	if status, msg := oAdmin.checkAccess(r, permRotate); status != 0 {
+		http.Error(w, msg, status)
 		return
 	}
 	_ = r.ParseForm()
 	username := oAdmin.extractUsername(r)
-	err, _ := oAdmin.userRotate(username, r.FormValue("password"))
+	notAfter, err := parseCertExpiry(r.FormValue("expires_at"), 0, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	err, msg := oAdmin.userRotate(username, r.FormValue("password"), notAfter)
+	oAdmin.audit(r, auditEntry{Action: auditActionRotate, Target: username, Result: auditResult(err == nil), Message: msg})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 	} else {
@@ -372,13 +500,14 @@ func (oAdmin *OvpnAdmin) userRotateHandler(w http.ResponseWriter, r *http.Reques
 
 func (oAdmin *OvpnAdmin) userDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
-	if oAdmin.role == "slave" {
-		http.Error(w, "Operation not allowed in slave mode", http.StatusLocked)
+	if status, msg := oAdmin.checkAccess(r, permDelete); status != 0 {
+		http.Error(w, msg, status)
 		return
 	}
 	_ = r.ParseForm()
 	username := oAdmin.extractUsername(r)
-	err, _ := oAdmin.userDelete(username)
+	err, msg := oAdmin.userDelete(username)
+	oAdmin.audit(r, auditEntry{Action: auditActionDelete, Target: username, Result: auditResult(err == nil), Message: msg})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 	} else {
@@ -389,13 +518,14 @@ func (oAdmin *OvpnAdmin) userDeleteHandler(w http.ResponseWriter, r *http.Reques
 
 func (oAdmin *OvpnAdmin) userRevokeHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
-	if oAdmin.role == "slave" {
-		http.Error(w, "Operation not allowed in slave mode", http.StatusLocked)
+	if status, msg := oAdmin.checkAccess(r, permRevoke); status != 0 {
+		http.Error(w, msg, status)
 		return
 	}
 	_ = r.ParseForm()
 	username := oAdmin.extractUsername(r)
-	err, _ := oAdmin.userRevoke(username)
+	err, msg := oAdmin.userRevoke(username)
+	oAdmin.audit(r, auditEntry{Action: auditActionRevoke, Target: username, Result: auditResult(err == nil), Message: msg})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 	} else {
@@ -406,13 +536,14 @@ func (oAdmin *OvpnAdmin) userRevokeHandler(w http.ResponseWriter, r *http.Reques
 
 func (oAdmin *OvpnAdmin) userUnrevokeHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
-	if oAdmin.role == "slave" {
-		http.Error(w, "Operation not allowed in slave mode", http.StatusLocked)
+	if status, msg := oAdmin.checkAccess(r, permUnrevoke); status != 0 {
+		http.Error(w, msg, status)
 		return
 	}
 	_ = r.ParseForm()
 	username := oAdmin.extractUsername(r)
-	err, _ := oAdmin.userUnrevoke(username)
+	err, msg := oAdmin.userUnrevoke(username)
+	oAdmin.audit(r, auditEntry{Action: auditActionUnrevoke, Target: username, Result: auditResult(err == nil), Message: msg})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 	} else {
@@ -429,20 +560,24 @@ func (oAdmin *OvpnAdmin) extractUsername(r *http.Request) string {
 	if len(parts) >= 2 && parts[0] == "users" {
 		return parts[1]
 	}
+	// modals of a user (e.g., /modal/cert/john)
+	if len(parts) >= 3 && parts[0] == "modal" {
+		return parts[2]
+	}
 	// Fall back to form value
 	return r.FormValue("username")
 }
 
 // Helper function to render user rows
 func (oAdmin *OvpnAdmin) renderUserRows(w http.ResponseWriter, r *http.Request) {
-	oAdmin.clients = oAdmin.usersList()
+	oAdmin.refreshClients()
 
 	hideRevoked := false
 	if cookie, err := r.Cookie("hideRevoked"); err == nil {
 		hideRevoked = cookie.Value == "true"
 	}
 
-	users := oAdmin.clients
+	users := oAdmin.getClients()
 	if hideRevoked {
 		var filtered []OpenvpnClient
 		for _, u := range users {
@@ -457,6 +592,7 @@ func (oAdmin *OvpnAdmin) renderUserRows(w http.ResponseWriter, r *http.Request)
 	err := oAdmin.htmlTemplates.ExecuteTemplate(w, "user_rows", map[string]interface{}{
 		"Users":      users,
 		"ServerRole": oAdmin.role,
+		"UserRole":   oAdmin.requestRole(r),
 		"Modules":    oAdmin.modules,
 	})
 	if err != nil {
@@ -466,10 +602,15 @@ func (oAdmin *OvpnAdmin) renderUserRows(w http.ResponseWriter, r *http.Request)
 
 func (oAdmin *OvpnAdmin) userChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if status, msg := oAdmin.checkAccess(r, permPassword); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
 	_ = r.ParseForm()
 	if *authByPassword {
 		username := oAdmin.extractUsername(r)
 		err, msg := oAdmin.userChangePassword(username, r.FormValue("password"))
+		oAdmin.audit(r, auditEntry{Action: auditActionPassword, Target: username, Result: auditResult(err == nil), Message: msg})
 		if err != nil {
 			http.Error(w, msg, http.StatusInternalServerError)
 		} else {
@@ -483,6 +624,10 @@ func (oAdmin *OvpnAdmin) userChangePasswordHandler(w http.ResponseWriter, r *htt
 
 func (oAdmin *OvpnAdmin) userShowConfigHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if status, msg := oAdmin.checkAccess(r, permConfig); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
 	_ = r.ParseForm()
 	username := oAdmin.extractUsername(r)
 	w.Header().Set("Content-Type", "text/plain")
@@ -491,9 +636,35 @@ func (oAdmin *OvpnAdmin) userShowConfigHandler(w http.ResponseWriter, r *http.Re
 
 func (oAdmin *OvpnAdmin) userDisconnectHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if status, msg := oAdmin.checkAccess(r, permDisconnect); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
 	_ = r.ParseForm()
-	// 	fmt.Fprintf(w, "%s", userDisconnect(r.FormValue("username")))
-	fmt.Fprintf(w, "%s", r.FormValue("username"))
+	username := oAdmin.extractUsername(r)
+	results, err := oAdmin.userDisconnect(username, r.FormValue("server"))
+	if err != nil {
+		oAdmin.audit(r, auditEntry{Action: auditActionDisconnect, Target: username, Result: auditResultFailure, Message: err.Error()})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	disconnected, summary := summarizeKillResults(results)
+	oAdmin.audit(r, auditEntry{Action: auditActionDisconnect, Target: username, Result: auditResult(disconnected), Message: summary})
+
+	if r.Header.Get("HX-Request") != "true" {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(results)
+		return
+	}
+
+	toast := map[string]interface{}{"showToast": map[string]string{"message": summary, "type": "warning"}}
+	if disconnected {
+		toast["showToast"] = map[string]string{"message": "User " + username + " disconnected: " + summary, "type": "success"}
+		oAdmin.mgmtRefresh()
+	}
+	trigger, _ := json.Marshal(toast)
+	w.Header().Set("HX-Trigger", string(trigger))
+	oAdmin.renderUserRows(w, r)
 }
 
 func (oAdmin *OvpnAdmin) userShowCcdHandler(w http.ResponseWriter, r *http.Request) {
@@ -505,9 +676,11 @@ func (oAdmin *OvpnAdmin) userShowCcdHandler(w http.ResponseWriter, r *http.Reque
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	err := oAdmin.htmlTemplates.ExecuteTemplate(w, "modal_ccd", map[string]interface{}{
-		"Ccd":        ccd,
-		"ServerRole": oAdmin.role,
-		"Modules":    oAdmin.modules,
+		"Ccd":          ccd,
+		"AddressPools": oAdmin.addressIndex().pools,
+		"ServerRole":   oAdmin.role,
+		"UserRole":     oAdmin.requestRole(r),
+		"Modules":      oAdmin.modules,
 	})
 	if err != nil {
 		log.Errorf("Error rendering modal_ccd template: %v", err)
@@ -517,8 +690,8 @@ func (oAdmin *OvpnAdmin) userShowCcdHandler(w http.ResponseWriter, r *http.Reque
 
 func (oAdmin *OvpnAdmin) userApplyCcdHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
-	if oAdmin.role == "slave" {
-		http.Error(w, "Operation not allowed in slave mode", http.StatusLocked)
+	if status, msg := oAdmin.checkAccess(r, permCcd); status != 0 {
+		http.Error(w, msg, status)
 		return
 	}
 	_ = r.ParseForm()
@@ -547,7 +720,14 @@ func (oAdmin *OvpnAdmin) userApplyCcdHandler(w http.ResponseWriter, r *http.Requ
 		})
 	}
 
-	ccdApplied, applyStatus := oAdmin.modifyCcd(ccd)
+	ccdApplied, applyStatus := false, ""
+	ccdBefore := oAdmin.readCcd(username)
+	if err := parseCcdForm(r, &ccd); err != nil {
+		applyStatus = err.Error()
+	} else {
+		ccdApplied, applyStatus = oAdmin.modifyCcd(ccd)
+	}
+	oAdmin.auditCcd(r, username, ccdBefore, ccdApplied, applyStatus)
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	if ccdApplied {
@@ -579,11 +759,15 @@ func (oAdmin *OvpnAdmin) serverSettingsHandler(w http.ResponseWriter, r *http.Re
 
 // calculateStats computes dashboard statistics from clients
 func (oAdmin *OvpnAdmin) calculateStats() DashboardStats {
+	return dashboardStats(oAdmin.getClients())
+}
+
+func dashboardStats(clients []OpenvpnClient) DashboardStats {
 	stats := DashboardStats{}
 	now := time.Now()
 	thirtyDaysFromNow := now.AddDate(0, 0, 30)
 
-	for _, client := range oAdmin.clients {
+	for _, client := range clients {
 		stats.TotalUsers++
 		stats.ActiveConnections += client.Connections
 
@@ -607,16 +791,6 @@ func (oAdmin *OvpnAdmin) calculateStats() DashboardStats {
 func (oAdmin *OvpnAdmin) statsHandler(w http.ResponseWriter, r *http.Request) {
 	log.Debug(r.RemoteAddr, " ", r.RequestURI)
 
-	// Refresh state to get latest data
-	if *storageBackend == "kubernetes.secrets" {
-		err := app.updateIndexTxtOnDisk()
-		if err != nil {
-			log.Errorln(err)
-		}
-	}
-	oAdmin.activeClients = oAdmin.mgmtGetActiveClients()
-	oAdmin.clients = oAdmin.usersList()
-
 	stats := oAdmin.calculateStats()
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -629,6 +803,20 @@ func (oAdmin *OvpnAdmin) statsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// pageData returns the data every page rendered with the base template needs
+func (oAdmin *OvpnAdmin) pageData(r *http.Request, page string) map[string]interface{} {
+	session, _ := oAdmin.requestSession(r)
+	return map[string]interface{}{
+		"Page":        page,
+		"ServerRole":  oAdmin.role,
+		"UserRole":    session.Role,
+		"CurrentUser": session.Username,
+		"AuthEnabled": oAdmin.auth != nil,
+		"Modules":     oAdmin.modules,
+		"LastSync":    oAdmin.lastSuccessfulSyncTime,
+	}
+}
+
 // Index page handler - renders the main page
 func (oAdmin *OvpnAdmin) indexPageHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
@@ -638,15 +826,13 @@ func (oAdmin *OvpnAdmin) indexPageHandler(w http.ResponseWriter, r *http.Request
 		hideRevoked = cookie.Value == "true"
 	}
 
+	data := oAdmin.pageData(r, "index")
+	data["Users"] = oAdmin.getClients()
+	data["HideRevoked"] = hideRevoked
+	data["Stats"] = oAdmin.calculateStats()
+
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	err := oAdmin.htmlTemplates.ExecuteTemplate(w, "base", map[string]interface{}{
-		"Users":       oAdmin.clients,
-		"ServerRole":  oAdmin.role,
-		"Modules":     oAdmin.modules,
-		"HideRevoked": hideRevoked,
-		"LastSync":    oAdmin.lastSuccessfulSyncTime,
-		"Stats":       oAdmin.calculateStats(),
-	})
+	err := oAdmin.htmlTemplates.ExecuteTemplate(w, "base", data)
 	if err != nil {
 		log.Errorf("Error rendering index template: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -658,7 +844,9 @@ func (oAdmin *OvpnAdmin) modalCreateHandler(w http.ResponseWriter, r *http.Reque
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	err := oAdmin.htmlTemplates.ExecuteTemplate(w, "modal_create", map[string]interface{}{
-		"Modules": oAdmin.modules,
+		"Modules":               oAdmin.modules,
+		"DefaultExpirationDays": *clientCertExpirationDays,
+		"MinExpiresAt":          time.Now().UTC().Format("2006-01-02"),
 	})
 	if err != nil {
 		log.Errorf("Error rendering modal_create template: %v", err)
@@ -685,8 +873,10 @@ func (oAdmin *OvpnAdmin) modalRotateHandler(w http.ResponseWriter, r *http.Reque
 	username := oAdmin.extractUsername(r)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	err := oAdmin.htmlTemplates.ExecuteTemplate(w, "modal_rotate", map[string]interface{}{
-		"Username": username,
-		"Modules":  oAdmin.modules,
+		"Username":              username,
+		"Modules":               oAdmin.modules,
+		"DefaultExpirationDays": *clientCertExpirationDays,
+		"MinExpiresAt":          time.Now().UTC().Format("2006-01-02"),
 	})
 	if err != nil {
 		log.Errorf("Error rendering modal_rotate template: %v", err)
@@ -723,7 +913,7 @@ func (oAdmin *OvpnAdmin) downloadCertsHandler(w http.ResponseWriter, r *http.Req
 		http.Error(w, `{"status":"error"}`, http.StatusBadRequest)
 		return
 	}
-	if *storageBackend == "kubernetes.secrets" {
+	if oAdmin.storage.Name() != storageFilesystem {
 		http.Error(w, `{"status":"error"}`, http.StatusBadRequest)
 		return
 	}
@@ -746,7 +936,7 @@ func (oAdmin *OvpnAdmin) downloadCcdHandler(w http.ResponseWriter, r *http.Reque
 		http.Error(w, `{"status":"error"}`, http.StatusBadRequest)
 		return
 	}
-	if *storageBackend == "kubernetes.secrets" {
+	if oAdmin.storage.Name() != storageFilesystem {
 		http.Error(w, `{"status":"error"}`, http.StatusBadRequest)
 		return
 	}
@@ -772,7 +962,21 @@ func main() {
 	log.SetLevel(logLevels[*logLevel])
 	log.SetFormatter(logFormats[*logFormat])
 
-	if *storageBackend == "kubernetes.secrets" {
+	keys, err := loadKeyring(*keysMasterKey, *keysMasterKeyFile)
+	if err != nil {
+		log.Fatalf("keys: %v", err)
+	}
+	app.Keyring = keys
+
+	// before app.run(), which creates a new CA in a namespace without one
+	if *storageImport != "" || *storageExport != "" {
+		if err := migrateStorage(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *storageBackend == storageKubernetes {
 		err := app.run()
 		if err != nil {
 			log.Error(err)
@@ -796,6 +1000,32 @@ func main() {
 	ovpnAdmin.promRegistry = prometheus.NewRegistry()
 	ovpnAdmin.modules = []string{}
 	ovpnAdmin.createUserMutex = &sync.Mutex{}
+	ovpnAdmin.events = newEventBroker()
+
+	// the address index is only built on first use
+	if _, err := newIPAM(*openvpnNetwork, *openvpnAddressPools); err != nil {
+		log.Fatal(err)
+	}
+
+	switch *storageBackend {
+	case storageKubernetes:
+		ovpnAdmin.storage = &app
+	case storageFilesystem:
+		storage := newFilesystemStorage(*easyrsaDirPath+"/pki", *indexTxtPath, *ccdDir)
+		storage.pki.keys = keys
+		ovpnAdmin.storage = storage
+	default:
+		log.Fatalf("Unknown storage backend %q, use %s or %s", *storageBackend, storageFilesystem, storageKubernetes)
+	}
+	// slaves get the keys of the master as they are
+	if keys != nil && ovpnAdmin.role != "slave" {
+		if changed, err := ovpnAdmin.storage.RewrapKeys(); err != nil {
+			log.Errorf("keys: can't encrypt the private keys with master key %q: %v", keys.active, err)
+		} else if changed > 0 {
+			log.Infof("keys: encrypted %d private key(s) with master key %q", changed, keys.active)
+		}
+	}
+
 	ovpnAdmin.mgmtInterfaces = make(map[string]string)
 
 	for _, mgmtInterface := range *mgmtAddress {
@@ -805,11 +1035,23 @@ func main() {
 
 	ovpnAdmin.mgmtSetTimeFormat()
 
+	if *historyPath != "" {
+		ovpnAdmin.history = newSessionHistory(*historyPath, *historyRetention, *historyMaxSessions, ovpnAdmin.mgmtStatusTimeFormat)
+		go ovpnAdmin.history.pruneLoop()
+	}
+
+	ovpnAdmin.mgmtStart()
+
 	ovpnAdmin.registerMetrics()
 	ovpnAdmin.setState()
 
 	go ovpnAdmin.updateState()
 
+	if *crlRefreshMargin >= *crlValidity {
+		log.Fatalf("--crl.refresh-margin (%s) has to be shorter than --crl.validity (%s)", *crlRefreshMargin, *crlValidity)
+	}
+	go ovpnAdmin.crlRefreshLoop()
+
 	if *masterBasicAuthPassword != "" && *masterBasicAuthUser != "" {
 		ovpnAdmin.masterHostBasicAuth = true
 	} else {
@@ -819,7 +1061,7 @@ func main() {
 	ovpnAdmin.modules = append(ovpnAdmin.modules, "core")
 
 	if *authByPassword {
-		if *storageBackend != "kubernetes.secrets" {
+		if *storageBackend != storageKubernetes {
 			ovpnAdmin.modules = append(ovpnAdmin.modules, "passwdAuth")
 		} else {
 			log.Fatal("Right now the keys `--storage.backend=kubernetes.secret` and `--auth.password` are not working together. Please use only one of them ")
@@ -830,36 +1072,47 @@ func main() {
 		ovpnAdmin.modules = append(ovpnAdmin.modules, "ccd")
 	}
 
+	if *renewalEnabled {
+		ovpnAdmin.modules = append(ovpnAdmin.modules, "renewal")
+		ovpnAdmin.renewal = newRenewalState(*renewalStatePath)
+		if ovpnAdmin.role != "slave" {
+			go ovpnAdmin.renewalLoop()
+		}
+	}
+
 	if ovpnAdmin.role == "slave" {
 		ovpnAdmin.syncDataFromMaster()
 		go ovpnAdmin.syncWithMaster()
 	}
 
-	// Load HTML templates with helper functions
-	funcMap := template.FuncMap{
-		"hasModule": func(modules []string, module string) bool {
-			for _, m := range modules {
-				if m == module {
-					return true
-				}
-			}
-			return false
-		},
-		"add": func(a, b int) int {
-			return a + b
-		},
-		"dict": func(values ...interface{}) map[string]interface{} {
-			dict := make(map[string]interface{})
-			for i := 0; i < len(values); i += 2 {
-				key, _ := values[i].(string)
-				dict[key] = values[i+1]
-			}
-			return dict
-		},
+	if *uiAuthEnabled || *oidcIssuerURL != "" {
+		ovpnAdmin.auth = newUIAuth(*uiAuthSessionTTL)
 	}
 
-	var err error
-	ovpnAdmin.htmlTemplates, err = template.New("").Funcs(funcMap).ParseFS(templatesFS, "templates/*.html", "templates/partials/*.html")
+	if *uiAuthEnabled {
+		if err := ovpnAdmin.auth.bootstrapAdmin(*uiAuthUsersFile, *uiAuthAdminUser, *uiAuthAdminPassword); err != nil {
+			log.Fatalf("ui auth: %v", err)
+		}
+		if err := ovpnAdmin.auth.loadUsers(*uiAuthUsersFile); err != nil {
+			log.Fatalf("ui auth: can't load users: %v", err)
+		}
+	}
+
+	if *auditLogPath != "" {
+		ovpnAdmin.auditLog = newAuditLog(*auditLogPath)
+	}
+
+	if *oidcIssuerURL != "" {
+		var err error
+		ovpnAdmin.oidc, err = newOIDCAuth(context.Background(), *oidcIssuerURL, *oidcClientID, *oidcClientSecret, *oidcRedirectURL, *oidcScopes, *oidcUsernameClaim, *oidcGroupsClaim, *oidcRoleMapping)
+		if err != nil {
+			log.Fatalf("oidc: %v", err)
+		}
+		log.Infof("oidc: single sign-on enabled with issuer %s", *oidcIssuerURL)
+	}
+
+	// Load HTML templates with helper functions
+	ovpnAdmin.htmlTemplates, err = template.New("").Funcs(templateFuncMap()).ParseFS(templatesFS, "templates/*.html", "templates/partials/*.html")
 	if err != nil {
 		log.Fatalf("Error loading HTML templates: %v", err)
 	}
@@ -874,26 +1127,35 @@ func main() {
 	// Static files route
 	http.Handle(*listenBaseUrl+"static/", http.StripPrefix(strings.TrimRight(*listenBaseUrl, "/")+"/static", staticHandler))
 
+	// Login and logout
+	http.HandleFunc(*listenBaseUrl+"login", ovpnAdmin.loginHandler)
+	http.HandleFunc(*listenBaseUrl+"logout", ovpnAdmin.logoutHandler)
+	http.HandleFunc(*listenBaseUrl+"oidc/login", ovpnAdmin.oidcLoginHandler)
+	http.HandleFunc(*listenBaseUrl+"oidc/callback", ovpnAdmin.oidcCallbackHandler)
+
 	// Main page route
-	http.HandleFunc(*listenBaseUrl, func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc(*listenBaseUrl, ovpnAdmin.requirePermission(permView, func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == *listenBaseUrl || r.URL.Path == strings.TrimRight(*listenBaseUrl, "/") {
 			ovpnAdmin.indexPageHandler(w, r)
 		} else {
 			http.NotFound(w, r)
 		}
-	})
+	}))
 
 	// User list (HTMX partial) and create user
-	http.HandleFunc(*listenBaseUrl+"users", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc(*listenBaseUrl+"users", ovpnAdmin.requirePermission(permView, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
-			ovpnAdmin.userCreateHandler(w, r)
+			ovpnAdmin.requirePermission(permCreate, ovpnAdmin.userCreateHandler)(w, r)
 			return
 		}
 		ovpnAdmin.userListHandler(w, r)
-	})
+	}))
 
 	// Stats (HTMX partial for dashboard refresh)
-	http.HandleFunc(*listenBaseUrl+"stats", ovpnAdmin.statsHandler)
+	http.HandleFunc(*listenBaseUrl+"stats", ovpnAdmin.requirePermission(permView, ovpnAdmin.statsHandler))
+
+	// Live connection, stats and user row changes (Server-Sent Events)
+	http.HandleFunc(*listenBaseUrl+"events", ovpnAdmin.requirePermission(permView, ovpnAdmin.eventsHandler))
 
 	// User operations
 	http.HandleFunc(*listenBaseUrl+"users/", func(w http.ResponseWriter, r *http.Request) {
@@ -903,7 +1165,7 @@ func main() {
 		if len(parts) == 0 || parts[0] == "" {
 			// POST /users - create user
 			if r.Method == http.MethodPost {
-				ovpnAdmin.userCreateHandler(w, r)
+				ovpnAdmin.requirePermission(permCreate, ovpnAdmin.userCreateHandler)(w, r)
 				return
 			}
 			http.NotFound(w, r)
@@ -912,62 +1174,71 @@ func main() {
 
 		username := parts[0]
 
-		if len(parts) == 1 {
-			// DELETE /users/{username} - delete user
-			if r.Method == http.MethodDelete {
-				ovpnAdmin.userDeleteHandler(w, r)
-				return
-			}
-			http.NotFound(w, r)
-			return
+		action := ""
+		if len(parts) > 1 {
+			action = parts[1]
 		}
+		ovpnAdmin.requirePermission(userActionPermission(action, r.Method), func(w http.ResponseWriter, r *http.Request) {
+			ovpnAdmin.userActionHandler(w, r, username, parts)
+		})(w, r)
+	})
 
-		action := parts[1]
-		switch action {
-		case "revoke":
-			ovpnAdmin.userRevokeHandler(w, r)
-		case "unrevoke":
-			ovpnAdmin.userUnrevokeHandler(w, r)
-		case "rotate":
-			ovpnAdmin.userRotateHandler(w, r)
-		case "password":
-			ovpnAdmin.userChangePasswordHandler(w, r)
-		case "config":
-			if len(parts) > 2 && parts[2] == "download" {
-				ovpnAdmin.userShowConfigHandler(w, r)
-			} else {
-				ovpnAdmin.userShowConfigHandler(w, r)
-			}
-		case "ccd":
-			if r.Method == http.MethodPost {
-				ovpnAdmin.userApplyCcdHandler(w, r)
-			} else {
-				ovpnAdmin.userShowCcdHandler(w, r)
-			}
-		default:
-			log.Warnf("Unknown action: %s for user: %s", action, username)
+	// Modal routes
+	http.HandleFunc(*listenBaseUrl+"modal/create", ovpnAdmin.requirePermission(permCreate, ovpnAdmin.modalCreateHandler))
+	http.HandleFunc(*listenBaseUrl+"modal/password/", ovpnAdmin.requirePermission(permPassword, ovpnAdmin.modalPasswordHandler))
+	http.HandleFunc(*listenBaseUrl+"modal/rotate/", ovpnAdmin.requirePermission(permRotate, ovpnAdmin.modalRotateHandler))
+	http.HandleFunc(*listenBaseUrl+"modal/delete/", ovpnAdmin.requirePermission(permDelete, ovpnAdmin.modalDeleteHandler))
+	http.HandleFunc(*listenBaseUrl+"modal/ccd/", ovpnAdmin.requirePermission(permView, ovpnAdmin.userShowCcdHandler))
+	http.HandleFunc(*listenBaseUrl+"modal/cert/", ovpnAdmin.requirePermission(permView, ovpnAdmin.modalCertHandler))
+	http.HandleFunc(*listenBaseUrl+"modal/export/", ovpnAdmin.requirePermission(permConfig, ovpnAdmin.modalExportHandler))
+
+	// User groups
+	http.HandleFunc(*listenBaseUrl+"groups", ovpnAdmin.requirePermission(permView, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			ovpnAdmin.requirePermission(permCcd, ovpnAdmin.groupSaveHandler)(w, r)
+			return
+		}
+		ovpnAdmin.groupsPageHandler(w, r)
+	}))
+	http.HandleFunc(*listenBaseUrl+"groups/rows", ovpnAdmin.requirePermission(permView, ovpnAdmin.groupRowsHandler))
+	http.HandleFunc(*listenBaseUrl+"groups/pools", ovpnAdmin.requirePermission(permView, ovpnAdmin.addressPoolsHandler))
+	http.HandleFunc(*listenBaseUrl+"groups/", ovpnAdmin.requirePermission(permCcd, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
 			http.NotFound(w, r)
+			return
 		}
-	})
+		ovpnAdmin.groupDeleteHandler(w, r)
+	}))
+	http.HandleFunc(*listenBaseUrl+"modal/group/", ovpnAdmin.requirePermission(permView, ovpnAdmin.modalGroupHandler))
 
-	// Modal routes
-	http.HandleFunc(*listenBaseUrl+"modal/create", ovpnAdmin.modalCreateHandler)
-	http.HandleFunc(*listenBaseUrl+"modal/password/", ovpnAdmin.modalPasswordHandler)
-	http.HandleFunc(*listenBaseUrl+"modal/rotate/", ovpnAdmin.modalRotateHandler)
-	http.HandleFunc(*listenBaseUrl+"modal/delete/", ovpnAdmin.modalDeleteHandler)
-	http.HandleFunc(*listenBaseUrl+"modal/ccd/", ovpnAdmin.userShowCcdHandler)
+	// Audit log
+	http.HandleFunc(*listenBaseUrl+"audit", ovpnAdmin.requirePermission(permAudit, ovpnAdmin.auditPageHandler))
+	http.HandleFunc(*listenBaseUrl+"audit/rows", ovpnAdmin.requirePermission(permAudit, ovpnAdmin.auditRowsHandler))
+
+	// OCSP responder, OCSP clients don't authenticate
+	if *ocspEnabled {
+		http.HandleFunc(*listenBaseUrl+"ocsp", ovpnAdmin.ocspHandler)
+		http.HandleFunc(*listenBaseUrl+"ocsp/", ovpnAdmin.ocspHandler)
+	}
+
+	// CA rollover
+	http.HandleFunc(*listenBaseUrl+"ca", ovpnAdmin.requirePermission(permCA, ovpnAdmin.caPageHandler))
+	http.HandleFunc(*listenBaseUrl+"ca/", ovpnAdmin.requirePermission(permCA, ovpnAdmin.caStatusHandler))
+
+	// Versioned JSON API
+	http.HandleFunc(*listenBaseUrl+apiV1Prefix, ovpnAdmin.requirePermission(permView, ovpnAdmin.apiV1Handler))
 
 	// Keep API routes for backwards compatibility and internal use
-	http.HandleFunc(*listenBaseUrl+"api/server/settings", ovpnAdmin.serverSettingsHandler)
-	http.HandleFunc(*listenBaseUrl+"api/user/unrevoke", ovpnAdmin.userUnrevokeHandler)
-	http.HandleFunc(*listenBaseUrl+"api/user/config/show", ovpnAdmin.userShowConfigHandler)
-	http.HandleFunc(*listenBaseUrl+"api/user/disconnect", ovpnAdmin.userDisconnectHandler)
-	http.HandleFunc(*listenBaseUrl+"api/user/statistic", ovpnAdmin.userStatisticHandler)
-	http.HandleFunc(*listenBaseUrl+"api/user/ccd", ovpnAdmin.userShowCcdHandler)
-	http.HandleFunc(*listenBaseUrl+"api/user/ccd/apply", ovpnAdmin.userApplyCcdHandler)
-
-	http.HandleFunc(*listenBaseUrl+"api/sync/last/try", ovpnAdmin.lastSyncTimeHandler)
-	http.HandleFunc(*listenBaseUrl+"api/sync/last/successful", ovpnAdmin.lastSuccessfulSyncTimeHandler)
+	http.HandleFunc(*listenBaseUrl+"api/server/settings", ovpnAdmin.requirePermission(permView, ovpnAdmin.serverSettingsHandler))
+	http.HandleFunc(*listenBaseUrl+"api/user/unrevoke", ovpnAdmin.requirePermission(permUnrevoke, ovpnAdmin.userUnrevokeHandler))
+	http.HandleFunc(*listenBaseUrl+"api/user/config/show", ovpnAdmin.requirePermission(permConfig, ovpnAdmin.userShowConfigHandler))
+	http.HandleFunc(*listenBaseUrl+"api/user/disconnect", ovpnAdmin.requirePermission(permDisconnect, ovpnAdmin.userDisconnectHandler))
+	http.HandleFunc(*listenBaseUrl+"api/user/statistic", ovpnAdmin.requirePermission(permView, ovpnAdmin.userStatisticHandler))
+	http.HandleFunc(*listenBaseUrl+"api/user/ccd", ovpnAdmin.requirePermission(permView, ovpnAdmin.userShowCcdHandler))
+	http.HandleFunc(*listenBaseUrl+"api/user/ccd/apply", ovpnAdmin.requirePermission(permCcd, ovpnAdmin.userApplyCcdHandler))
+
+	http.HandleFunc(*listenBaseUrl+"api/sync/last/try", ovpnAdmin.requirePermission(permView, ovpnAdmin.lastSyncTimeHandler))
+	http.HandleFunc(*listenBaseUrl+"api/sync/last/successful", ovpnAdmin.requirePermission(permView, ovpnAdmin.lastSuccessfulSyncTimeHandler))
 	http.HandleFunc(*listenBaseUrl+downloadCertsApiUrl, ovpnAdmin.downloadCertsHandler)
 	http.HandleFunc(*listenBaseUrl+downloadCcdApiUrl, ovpnAdmin.downloadCcdHandler)
 
@@ -980,6 +1251,92 @@ func main() {
 	log.Fatal(http.ListenAndServe(*listenHost+":"+*listenPort, nil))
 }
 
+// userActionHandler dispatches /users/{username}/{action} requests
+func (oAdmin *OvpnAdmin) userActionHandler(w http.ResponseWriter, r *http.Request, username string, parts []string) {
+
+	if len(parts) == 1 {
+		// DELETE /users/{username} - delete user
+		if r.Method == http.MethodDelete {
+			oAdmin.userDeleteHandler(w, r)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	action := parts[1]
+	switch action {
+	case "revoke":
+		oAdmin.userRevokeHandler(w, r)
+	case "unrevoke":
+		oAdmin.userUnrevokeHandler(w, r)
+	case "rotate":
+		oAdmin.userRotateHandler(w, r)
+	case "password":
+		oAdmin.userChangePasswordHandler(w, r)
+	case "config":
+		oAdmin.userShowConfigHandler(w, r)
+	case "export":
+		oAdmin.userExportHandler(w, r)
+	case "disconnect":
+		oAdmin.userDisconnectHandler(w, r)
+	case "renewal":
+		if len(parts) > 2 && parts[2] == "confirm" {
+			oAdmin.userConfirmRenewalHandler(w, r)
+			return
+		}
+		oAdmin.userRenewalHandler(w, r)
+	case "ccd":
+		if r.Method == http.MethodPost {
+			oAdmin.userApplyCcdHandler(w, r)
+		} else {
+			oAdmin.userShowCcdHandler(w, r)
+		}
+	default:
+		log.Warnf("Unknown action: %s for user: %s", action, username)
+		http.NotFound(w, r)
+	}
+}
+
+// templateFuncMap returns helper functions available in HTML templates
+func templateFuncMap() template.FuncMap {
+	return template.FuncMap{
+		"hasModule": func(modules []string, module string) bool {
+			for _, m := range modules {
+				if m == module {
+					return true
+				}
+			}
+			return false
+		},
+		"add": func(a, b int) int {
+			return a + b
+		},
+		"percent": func(part, total int) int {
+			if total == 0 {
+				return 100
+			}
+			return part * 100 / total
+		},
+		"dict": func(values ...interface{}) map[string]interface{} {
+			dict := make(map[string]interface{})
+			for i := 0; i < len(values); i += 2 {
+				key, _ := values[i].(string)
+				dict[key] = values[i+1]
+			}
+			return dict
+		},
+		// can reports whether the UI role has the permission, an unset role means UI auth is not in use
+		"can": func(role interface{}, permission string) bool {
+			roleName, _ := role.(string)
+			if roleName == "" {
+				return true
+			}
+			return roleHasPermission(roleName, permission)
+		},
+	}
+}
+
 func CacheControlWrapper(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "max-age=2592000") // 30 days
@@ -1000,22 +1357,32 @@ func (oAdmin *OvpnAdmin) registerMetrics() {
 	oAdmin.promRegistry.MustRegister(ovpnClientConnectionFrom)
 	oAdmin.promRegistry.MustRegister(ovpnClientBytesReceived)
 	oAdmin.promRegistry.MustRegister(ovpnClientBytesSent)
+	oAdmin.promRegistry.MustRegister(ovpnAddressPoolSize)
+	oAdmin.promRegistry.MustRegister(ovpnAddressPoolUsed)
+	oAdmin.promRegistry.MustRegister(ovpnCRLNextUpdate)
+	oAdmin.promRegistry.MustRegister(ovpnCRLNumber)
+	oAdmin.promRegistry.MustRegister(ovpnOCSPRequests)
 }
 
 func (oAdmin *OvpnAdmin) setState() {
-	oAdmin.activeClients = oAdmin.mgmtGetActiveClients()
-	oAdmin.clients = oAdmin.usersList()
+	oAdmin.mgmtRefresh()
+	oAdmin.refreshClients()
 
 	ovpnServerCaCertExpire.Set(float64((getOvpnCaCertExpireDate().Unix() - time.Now().Unix()) / 3600 / 24))
+
+	// the CRL changes on every revocation, not only when crlRefreshLoop re-signs it
+	if crls, err := oAdmin.currentCRLs(); err == nil {
+		setCRLMetrics(crls)
+	}
+
+	if *ccdEnabled {
+		oAdmin.setAddressPoolMetrics()
+	}
 }
 
 func (oAdmin *OvpnAdmin) updateState() {
 	for {
 		time.Sleep(time.Duration(28) * time.Second)
-		ovpnClientBytesSent.Reset()
-		ovpnClientBytesReceived.Reset()
-		ovpnClientConnectionFrom.Reset()
-		ovpnClientConnectionInfo.Reset()
 		ovpnClientCertificateExpire.Reset()
 		go oAdmin.setState()
 	}
@@ -1030,8 +1397,7 @@ func indexTxtParser(txt string) []indexTxtLine {
 		str := strings.Fields(v)
 		if len(str) > 0 {
 			switch {
-			// case strings.HasPrefix(str[0], "E"):
-			case strings.HasPrefix(str[0], "V"):
+			case strings.HasPrefix(str[0], "V"), strings.HasPrefix(str[0], "E"):
 				indexTxt = append(indexTxt, indexTxtLine{Flag: str[0], ExpirationDate: str[1], SerialNumber: str[2], Filename: str[3], DistinguishedName: str[4], Identity: str[4][strings.Index(str[4], "=")+1:]})
 			case strings.HasPrefix(str[0], "R"):
 				indexTxt = append(indexTxt, indexTxtLine{Flag: str[0], ExpirationDate: str[1], RevocationDate: str[2], SerialNumber: str[3], Filename: str[4], DistinguishedName: str[5], Identity: str[5][strings.Index(str[5], "=")+1:]})
@@ -1046,11 +1412,10 @@ func renderIndexTxt(data []indexTxtLine) string {
 	indexTxt := ""
 	for _, line := range data {
 		switch {
-		case line.Flag == "V":
+		case line.Flag == "V", line.Flag == "E":
 			indexTxt += fmt.Sprintf("%s\t%s\t\t%s\t%s\t%s\n", line.Flag, line.ExpirationDate, line.SerialNumber, line.Filename, line.DistinguishedName)
 		case line.Flag == "R":
 			indexTxt += fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\n", line.Flag, line.ExpirationDate, line.RevocationDate, line.SerialNumber, line.Filename, line.DistinguishedName)
-			// case line.flag == "E":
 		}
 	}
 	return indexTxt
@@ -1068,53 +1433,68 @@ func (oAdmin *OvpnAdmin) getClientConfigTemplate() *texttemplate.Template {
 	}
 }
 
-func (oAdmin *OvpnAdmin) renderClientConfig(username string) string {
-	if checkUserExist(username) {
-		var hosts []OpenvpnServer
+// clientConfig collects what the client config of the user is rendered from
+func (oAdmin *OvpnAdmin) clientConfig(username string) (openvpnClientConfig, error) {
+	var hosts []OpenvpnServer
 
-		for _, server := range *openvpnServer {
-			parts := strings.SplitN(server, ":", 3)
-			hosts = append(hosts, OpenvpnServer{Host: parts[0], Port: parts[1], Protocol: parts[2]})
-		}
+	for _, server := range *openvpnServer {
+		parts := strings.SplitN(server, ":", 3)
+		hosts = append(hosts, OpenvpnServer{Host: parts[0], Port: parts[1], Protocol: parts[2]})
+	}
 
-		if *openvpnServerBehindLB {
-			var err error
-			hosts, err = getOvpnServerHostsFromKubeApi()
-			if err != nil {
-				log.Error(err)
-			}
+	if *openvpnServerBehindLB {
+		var err error
+		hosts, err = getOvpnServerHostsFromKubeApi()
+		if err != nil {
+			log.Error(err)
 		}
+	}
 
-		log.Tracef("hosts for %s\n %v", username, hosts)
+	log.Tracef("hosts for %s\n %v", username, hosts)
 
-		conf := openvpnClientConfig{}
-		conf.Hosts = hosts
-		conf.CA = fRead(*easyrsaDirPath + "/pki/ca.crt")
-		conf.TLS = fRead(*easyrsaDirPath + "/pki/ta.key")
+	conf := openvpnClientConfig{}
+	conf.Hosts = hosts
+	conf.CA = fRead(*easyrsaDirPath + "/pki/ca.crt")
+	conf.TLSMode = *openvpnTLSMode
 
-		if *storageBackend == "kubernetes.secrets" {
-			conf.Cert, conf.Key = app.easyrsaGetClientCert(username)
-		} else {
-			conf.Cert = fRead(*easyrsaDirPath + "/pki/issued/" + username + ".crt")
-			conf.Key = fRead(*easyrsaDirPath + "/pki/private/" + username + ".key")
-		}
+	var err error
+	conf.Cert, conf.Key, err = oAdmin.storage.ClientCert(username)
+	if err == nil && conf.Key == "" {
+		conf.ExternalKey = externalKeyDirective(username)
+	}
+	if conf.TLSMode != tlsModeCryptV2 {
+		conf.TLS = fRead(*easyrsaDirPath + "/pki/ta.key")
+	} else if err == nil {
+		conf.TLS, err = oAdmin.storage.TLSCryptV2Key(username)
+	}
 
-		conf.PasswdAuth = *authByPassword
+	conf.PasswdAuth = *authByPassword
+	return conf, err
+}
 
-		t := oAdmin.getClientConfigTemplate()
+// executeClientConfig renders the client config template
+func (oAdmin *OvpnAdmin) executeClientConfig(username string, conf openvpnClientConfig) string {
+	t := oAdmin.getClientConfigTemplate()
 
-		var tmp bytes.Buffer
-		err := t.Execute(&tmp, conf)
-		if err != nil {
-			log.Errorf("something goes wrong during rendering config for %s", username)
-			log.Debugf("rendering config for %s failed with error %v", username, err)
-		}
+	var tmp bytes.Buffer
+	err := t.Execute(&tmp, conf)
+	if err != nil {
+		log.Errorf("something goes wrong during rendering config for %s", username)
+		log.Debugf("rendering config for %s failed with error %v", username, err)
+	}
 
-		hosts = nil
+	log.Tracef("Rendered config for user %s: %+v", username, tmp.String())
 
-		log.Tracef("Rendered config for user %s: %+v", username, tmp.String())
+	return fmt.Sprintf("%+v", tmp.String())
+}
 
-		return fmt.Sprintf("%+v", tmp.String())
+func (oAdmin *OvpnAdmin) renderClientConfig(username string) string {
+	if oAdmin.userExists(username) {
+		conf, err := oAdmin.clientConfig(username)
+		if err != nil {
+			log.Errorf("can't read certificate of %s: %v", username, err)
+		}
+		return oAdmin.executeClientConfig(username, conf)
 	}
 	log.Warnf("user \"%s\" not found", username)
 	return fmt.Sprintf("user \"%s\" not found", username)
@@ -1132,56 +1512,42 @@ func (oAdmin *OvpnAdmin) getCcdTemplate() *texttemplate.Template {
 	}
 }
 
+// readCcd returns the raw client-config-dir content of the user
+func (oAdmin *OvpnAdmin) readCcd(username string) string {
+	ccd, err := oAdmin.storage.ReadCcd(username)
+	if err != nil {
+		log.Warnf("can't read ccd of %s: %v", username, err)
+	}
+	return ccd
+}
+
 func (oAdmin *OvpnAdmin) parseCcd(username string) Ccd {
 	ccd := Ccd{}
 	ccd.User = username
 	ccd.ClientAddress = "dynamic"
 	ccd.CustomRoutes = []ccdRoute{}
 
-	var txtLinesArray []string
-	if *storageBackend == "kubernetes.secrets" {
-		txtLinesArray = strings.Split(app.secretGetCcd(ccd.User), "\n")
-	} else {
-		if fExist(*ccdDir + "/" + username) {
-			txtLinesArray = strings.Split(fRead(*ccdDir+"/"+username), "\n")
-		}
-	}
-
-	for _, v := range txtLinesArray {
-		str := strings.Fields(v)
-		if len(str) > 0 {
-			switch {
-			case strings.HasPrefix(str[0], "ifconfig-push"):
-				ccd.ClientAddress = str[1]
-			case strings.HasPrefix(str[0], "push"):
-				ccd.CustomRoutes = append(ccd.CustomRoutes, ccdRoute{Address: strings.Trim(str[2], "\""), Mask: strings.Trim(str[3], "\""), Description: strings.Trim(strings.Join(str[4:], ""), "#")})
-			}
-		}
-	}
+	parseCcdContent(&ccd, oAdmin.readCcd(username))
 
 	return ccd
 }
 
 func (oAdmin *OvpnAdmin) modifyCcd(ccd Ccd) (bool, string) {
-	ccdValid, err := validateCcd(ccd)
+	if err := oAdmin.resolveClientAddress(&ccd); err != nil {
+		log.Debugf("modify ccd for user %s: %v", ccd.User, err)
+		return false, err.Error()
+	}
+	normalizeCcd(&ccd)
+	ccdValid, err := oAdmin.validateCcd(ccd)
 	if err != "" {
 		return false, err
 	}
 
 	if ccdValid {
-		t := oAdmin.getCcdTemplate()
-		var tmp bytes.Buffer
-		err := t.Execute(&tmp, ccd)
+		err := oAdmin.writeCcd(ccd)
 		if err != nil {
-			log.Error(err)
-		}
-		if *storageBackend == "kubernetes.secrets" {
-			app.secretUpdateCcd(ccd.User, tmp.Bytes())
-		} else {
-			err = fWrite(*ccdDir+"/"+ccd.User, tmp.String())
-			if err != nil {
-				log.Errorf("modifyCcd: fWrite(): %v", err)
-			}
+			log.Errorf("modifyCcd: %v", err)
+			return false, fmt.Sprintf("Can't write ccd: %v", err)
 		}
 
 		return true, "ccd updated successfully"
@@ -1190,30 +1556,13 @@ func (oAdmin *OvpnAdmin) modifyCcd(ccd Ccd) (bool, string) {
 	return false, "something goes wrong"
 }
 
-func validateCcd(ccd Ccd) (bool, string) {
+func (oAdmin *OvpnAdmin) validateCcd(ccd Ccd) (bool, string) {
 
 	ccdErr := ""
 
 	if ccd.ClientAddress != "dynamic" {
-		_, ovpnNet, err := net.ParseCIDR(*openvpnNetwork)
-		if err != nil {
-			log.Error(err)
-		}
-
-		if !checkStaticAddressIsFree(ccd.ClientAddress, ccd.User) {
-			ccdErr = fmt.Sprintf("ClientAddress \"%s\" already assigned to another user", ccd.ClientAddress)
-			log.Debugf("modify ccd for user %s: %s", ccd.User, ccdErr)
-			return false, ccdErr
-		}
-
-		if net.ParseIP(ccd.ClientAddress) == nil {
-			ccdErr = fmt.Sprintf("ClientAddress \"%s\" not a valid IP address", ccd.ClientAddress)
-			log.Debugf("modify ccd for user %s: %s", ccd.User, ccdErr)
-			return false, ccdErr
-		}
-
-		if !ovpnNet.Contains(net.ParseIP(ccd.ClientAddress)) {
-			ccdErr = fmt.Sprintf("ClientAddress \"%s\" not belongs to openvpn server network", ccd.ClientAddress)
+		if err := oAdmin.addressIndex().check(ccd.User, ccd.ClientAddress); err != nil {
+			ccdErr = err.Error()
 			log.Debugf("modify ccd for user %s: %s", ccd.User, ccdErr)
 			return false, ccdErr
 		}
@@ -1231,6 +1580,18 @@ func validateCcd(ccd Ccd) (bool, string) {
 			log.Debugf("modify ccd for user %s: %s", ccd.User, ccdErr)
 			return false, ccdErr
 		}
+
+		if strings.ContainsAny(route.Description, "\r\n") {
+			ccdErr = fmt.Sprintf("CustomRoute.Description %q must be a single line", route.Description)
+			log.Debugf("modify ccd for user %s: %s", ccd.User, ccdErr)
+			return false, ccdErr
+		}
+	}
+
+	if err := validateCcdDirectives(ccd); err != nil {
+		ccdErr = err.Error()
+		log.Debugf("modify ccd for user %s: %s", ccd.User, ccdErr)
+		return false, ccdErr
 	}
 
 	return true, ccdErr
@@ -1243,63 +1604,14 @@ func (oAdmin *OvpnAdmin) getCcd(username string) Ccd {
 	ccd.CustomRoutes = []ccdRoute{}
 
 	ccd = oAdmin.parseCcd(username)
+	setGroupSettings(&ccd, oAdmin.groups())
 
 	return ccd
 }
 
-func checkStaticAddressIsFree(staticAddress string, username string) bool {
-
-	if *storageBackend == "kubernetes.secrets" {
-
-		log.Infof("Static address: %s", staticAddress)
-
-		labelSelector := fmt.Sprintf("%s=%s,%s=%s",
-			labelKeyType, labelValueClientAuth,
-			labelKeyManagedBy, labelValueManagedByApp)
-
-		secrets, err := app.secretsGetByLabels(labelSelector)
-		if err != nil {
-			log.Error(err)
-		}
-
-		for _, secret := range secrets.Items {
-			otherUser := secret.Labels["name"]
-			if otherUser == username {
-				continue
-			}
-
-			dataCCD, ok := secret.Data["ccd"]
-			if !ok {
-				continue
-			}
-
-			lines := strings.Split(string(dataCCD), "\n")
-
-			for _, line := range lines {
-				if strings.HasPrefix(line, prefixStaticRoute) {
-					fields := strings.Fields(line)
-					if len(fields) >= 2 && fields[1] == staticAddress {
-						log.Warnf("IP %s already assigned to user %s", staticAddress, otherUser)
-						return false
-					}
-				}
-			}
-		}
-
-		return true
-	}
-
-	o := runBash(fmt.Sprintf("grep -rl ' %[1]s ' %[2]s | grep -vx %[2]s/%[3]s | wc -l", staticAddress, *ccdDir, username))
-
-	if strings.TrimSpace(o) == "0" {
-		return true
-	}
-
-	return false
-}
+var validUsername = regexp.MustCompile(usernameRegexp)
 
 func validateUsername(username string) error {
-	var validUsername = regexp.MustCompile(usernameRegexp)
 	if validUsername.MatchString(username) {
 		return nil
 	} else {
@@ -1315,13 +1627,46 @@ func validatePassword(password string) error {
 	}
 }
 
-func checkUserExist(username string) bool {
-	for _, u := range indexTxtParser(fRead(*indexTxtPath)) {
-		if u.DistinguishedName == ("/CN=" + username) {
-			return true
+// parseCertExpiry returns when a certificate requested with an expiration date or a number of days expires,
+// zero for the --client-cert.expiration-days default. A date without a time means the end of that day in UTC.
+func parseCertExpiry(expiresAt string, validDays int, now time.Time) (time.Time, error) {
+	expiresAt = strings.TrimSpace(expiresAt)
+	switch {
+	case expiresAt != "" && validDays != 0:
+		return time.Time{}, errors.New("set either the expiration date or the number of valid days")
+	case validDays < 0:
+		return time.Time{}, errors.New("number of valid days must be positive")
+	case validDays > 0:
+		return now.Add(time.Duration(validDays) * 24 * time.Hour), nil
+	case expiresAt == "":
+		return time.Time{}, nil
+	}
+
+	notAfter, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil {
+		date, dateErr := time.Parse("2006-01-02", expiresAt)
+		if dateErr != nil {
+			return time.Time{}, fmt.Errorf("expiration date %q must be YYYY-MM-DD or RFC 3339", expiresAt)
 		}
+		notAfter = date.Add(24*time.Hour - time.Second)
+	}
+	if !notAfter.After(now) {
+		return time.Time{}, fmt.Errorf("expiration date %s is in the past", expiresAt)
 	}
-	return false
+	return notAfter, nil
+}
+
+// index returns the certificates of the storage, empty if it can't be read
+func (oAdmin *OvpnAdmin) index() []indexTxtLine {
+	lines, err := oAdmin.storage.Index()
+	if err != nil {
+		log.Errorf("can't read the certificate index: %v", err)
+	}
+	return lines
+}
+
+func (oAdmin *OvpnAdmin) userExists(username string) bool {
+	return indexTxtFind(oAdmin.index(), username) >= 0
 }
 
 func (oAdmin *OvpnAdmin) usersList() []OpenvpnClient {
@@ -1336,7 +1681,7 @@ func (oAdmin *OvpnAdmin) usersList() []OpenvpnClient {
 	apochNow := time.Now().Unix()
 	thirtyDaysFromNow := time.Now().AddDate(0, 0, 30).Unix()
 
-	for _, line := range indexTxtParser(fRead(*indexTxtPath)) {
+	for _, line := range oAdmin.index() {
 		if line.Identity != "server" && !strings.Contains(line.Identity, "REVOKED") {
 			totalCerts += 1
 			ovpnClient := OpenvpnClient{Identity: line.Identity, ExpirationDate: parseDateToString(indexTxtDateLayout, line.ExpirationDate, stringDateFormat)}
@@ -1365,17 +1710,27 @@ func (oAdmin *OvpnAdmin) usersList() []OpenvpnClient {
 				ovpnClient.ExpiringSoon = true
 			}
 
+			renewal := oAdmin.renewal.get(line.Identity)
+			ovpnClient.RenewalOptOut = renewal.OptOut
+			ovpnClient.RenewedConfigReady = renewal.ConfigReady && ovpnClient.AccountStatus == "Active"
+
 			ovpnClient.Connections = 0
 
-			userConnected, userConnectedTo := isUserConnected(line.Identity, oAdmin.activeClients)
+			userConnected, userConnectedTo := isUserConnected(line.Identity, oAdmin.getActiveClients())
 			if userConnected {
 				ovpnClient.ConnectionStatus = "Connected"
-				for range userConnectedTo {
+				for _, srv := range userConnectedTo {
 					ovpnClient.Connections += 1
 					totalActiveConnections += 1
+					if !slices.Contains(ovpnClient.ConnectedTo, srv) {
+						ovpnClient.ConnectedTo = append(ovpnClient.ConnectedTo, srv)
+					}
 				}
 				connectedUniqUsers += 1
 			}
+			if lastSeen := oAdmin.history.lastSeenOf(line.Identity); !lastSeen.IsZero() {
+				ovpnClient.LastSeen = lastSeen.Local().Format(stringDateFormat)
+			}
 
 			users = append(users, ovpnClient)
 
@@ -1399,15 +1754,17 @@ func (oAdmin *OvpnAdmin) usersList() []OpenvpnClient {
 	return users
 }
 
-func (oAdmin *OvpnAdmin) userCreate(username, password string) (bool, string) {
+// userCreate issues a certificate for a new user expiring at notAfter, zero for --client-cert.expiration-days.
+// With a CSR the certificate is issued for its key and ovpn-admin never sees the private key.
+func (oAdmin *OvpnAdmin) userCreate(username, password string, notAfter time.Time, csr *x509.CertificateRequest) (bool, string) {
 	ucErr := fmt.Sprintf("User \"%s\" created", username)
 
 	oAdmin.createUserMutex.Lock()
 	defer oAdmin.createUserMutex.Unlock()
 
-	if checkUserExist(username) {
+	if oAdmin.userExists(username) {
 		ucErr = fmt.Sprintf("User \"%s\" already exists\n", username)
-		log.Debugf("userCreate: checkUserExist():  %s", ucErr)
+		log.Debugf("userCreate: userExists():  %s", ucErr)
 		return false, ucErr
 	}
 
@@ -1423,18 +1780,22 @@ func (oAdmin *OvpnAdmin) userCreate(username, password string) (bool, string) {
 		}
 	}
 
-	if *storageBackend == "kubernetes.secrets" {
-		err := app.easyrsaBuildClient(username)
-		if err != nil {
-			log.Error(err)
-		}
+	var err error
+	if csr != nil {
+		err = oAdmin.storage.SignClient(csr, notAfter)
 	} else {
-		o := runBash(fmt.Sprintf("cd %s && %s --batch build-client-full %s nopass 1>/dev/null", *easyrsaDirPath, *easyrsaBinPath, username))
-		log.Debug(o)
+		err = oAdmin.storage.BuildClient(username, notAfter)
+	}
+	if err != nil {
+		log.Errorf("userCreate: %s", err)
+		return false, fmt.Sprintf("Can't issue certificate for user \"%s\": %s", username, err)
+	}
+	if !notAfter.IsZero() {
+		oAdmin.renewalKeepExpiry(username)
 	}
 
 	if *authByPassword {
-		o := runBash(fmt.Sprintf("openvpn-user create --db.path %s --user %s --password %s", *authDatabase, username, password))
+		o := runOpenvpnUser("create", "--db.path", *authDatabase, "--user", username, "--password", password)
 		log.Debug(o)
 	}
 
@@ -1447,8 +1808,8 @@ func (oAdmin *OvpnAdmin) userCreate(username, password string) (bool, string) {
 
 func (oAdmin *OvpnAdmin) userChangePassword(username, password string) (error, string) {
 
-	if checkUserExist(username) {
-		o := runBash(fmt.Sprintf("openvpn-user check --db.path %[1]s --user %[2]s | grep %[2]s | wc -l", *authDatabase, username))
+	if oAdmin.userExists(username) {
+		o := runOpenvpnUser("check", "--db.path", *authDatabase, "--user", username)
 		log.Debug(o)
 
 		if err := validatePassword(password); err != nil {
@@ -1456,12 +1817,12 @@ func (oAdmin *OvpnAdmin) userChangePassword(username, password string) (error, s
 			return err, err.Error()
 		}
 
-		if strings.TrimSpace(o) == "0" {
-			o = runBash(fmt.Sprintf("openvpn-user create --db.path %s --user %s --password %s", *authDatabase, username, password))
+		if !strings.Contains(o, username) {
+			o = runOpenvpnUser("create", "--db.path", *authDatabase, "--user", username, "--password", password)
 			log.Debug(o)
 		}
 
-		o = runBash(fmt.Sprintf("openvpn-user change-password --db.path %s --user %s --password %s", *authDatabase, username, password))
+		o = runOpenvpnUser("change-password", "--db.path", *authDatabase, "--user", username, "--password", password)
 		log.Debug(o)
 
 		log.Infof("Password for user %s was changed", username)
@@ -1474,7 +1835,7 @@ func (oAdmin *OvpnAdmin) userChangePassword(username, password string) (error, s
 
 func (oAdmin *OvpnAdmin) getUserStatistic(username string) []clientStatus {
 	var userStatistic []clientStatus
-	for _, u := range oAdmin.activeClients {
+	for _, u := range oAdmin.getActiveClients() {
 		if u.CommonName == username {
 			userStatistic = append(userStatistic, u)
 		}
@@ -1484,25 +1845,19 @@ func (oAdmin *OvpnAdmin) getUserStatistic(username string) []clientStatus {
 
 func (oAdmin *OvpnAdmin) userRevoke(username string) (error, string) {
 	log.Infof("Revoke certificate for user %s", username)
-	if checkUserExist(username) {
-		// check certificate valid flag 'V'
-		if *storageBackend == "kubernetes.secrets" {
-			err := app.easyrsaRevoke(username)
-			if err != nil {
-				log.Error(err)
-			}
-		} else {
-			o := runBash(fmt.Sprintf("cd %[1]s && echo yes | %[2]s revoke %[3]s 1>/dev/null && %[2]s gen-crl 1>/dev/null", *easyrsaDirPath, *easyrsaBinPath, username))
-			log.Debugln(o)
+	if oAdmin.userExists(username) {
+		if err := oAdmin.storage.Revoke(username); err != nil {
+			log.Error(err)
+			return err, err.Error()
 		}
 
 		if *authByPassword {
-			o := runBash(fmt.Sprintf("openvpn-user revoke --db.path %s --user %s", *authDatabase, username))
+			o := runOpenvpnUser("revoke", "--db.path", *authDatabase, "--user", username)
 			log.Debug(o)
 		}
 
 		crlFix()
-		userConnected, userConnectedTo := isUserConnected(username, oAdmin.activeClients)
+		userConnected, userConnectedTo := isUserConnected(username, oAdmin.getActiveClients())
 		log.Tracef("User %s connected: %t", username, userConnected)
 		if userConnected {
 			for _, connection := range userConnectedTo {
@@ -1519,170 +1874,70 @@ func (oAdmin *OvpnAdmin) userRevoke(username string) (error, string) {
 }
 
 func (oAdmin *OvpnAdmin) userUnrevoke(username string) (error, string) {
-	if checkUserExist(username) {
-		if *storageBackend == "kubernetes.secrets" {
-			err := app.easyrsaUnrevoke(username)
-			if err != nil {
-				log.Error(err)
-			}
-		} else {
-			// check certificate revoked flag 'R'
-			usersFromIndexTxt := indexTxtParser(fRead(*indexTxtPath))
-			for i := range usersFromIndexTxt {
-				if usersFromIndexTxt[i].DistinguishedName == "/CN="+username {
-					if usersFromIndexTxt[i].Flag == "R" {
-
-						usersFromIndexTxt[i].Flag = "V"
-						usersFromIndexTxt[i].RevocationDate = ""
-
-						err := fMove(fmt.Sprintf("%s/pki/revoked/certs_by_serial/%s.crt", *easyrsaDirPath, usersFromIndexTxt[i].SerialNumber), fmt.Sprintf("%s/pki/issued/%s.crt", *easyrsaDirPath, username))
-						if err != nil {
-							log.Error(err)
-						}
-						err = fMove(fmt.Sprintf("%s/pki/revoked/certs_by_serial/%s.crt", *easyrsaDirPath, usersFromIndexTxt[i].SerialNumber), fmt.Sprintf("%s/pki/certs_by_serial/%s.pem", *easyrsaDirPath, usersFromIndexTxt[i].SerialNumber))
-						if err != nil {
-							log.Error(err)
-						}
-						err = fMove(fmt.Sprintf("%s/pki/revoked/private_by_serial/%s.key", *easyrsaDirPath, usersFromIndexTxt[i].SerialNumber), fmt.Sprintf("%s/pki/private/%s.key", *easyrsaDirPath, username))
-						if err != nil {
-							log.Error(err)
-						}
-						err = fMove(fmt.Sprintf("%s/pki/revoked/reqs_by_serial/%s.req", *easyrsaDirPath, usersFromIndexTxt[i].SerialNumber), fmt.Sprintf("%s/pki/reqs/%s.req", *easyrsaDirPath, username))
-						if err != nil {
-							log.Error(err)
-						}
-						err = fWrite(*indexTxtPath, renderIndexTxt(usersFromIndexTxt))
-						if err != nil {
-							log.Error(err)
-						}
-
-						_ = runBash(fmt.Sprintf("cd %s && %s gen-crl 1>/dev/null", *easyrsaDirPath, *easyrsaBinPath))
-
-						if *authByPassword {
-							o := runBash(fmt.Sprintf("openvpn-user restore --db.path %s --user %s", *authDatabase, username))
-							log.Debug(o)
-						}
-
-						crlFix()
-
-						break
-					}
-				}
-			}
-			err := fWrite(*indexTxtPath, renderIndexTxt(usersFromIndexTxt))
-			if err != nil {
-				log.Error(err)
-			}
-			//fmt.Print(renderIndexTxt(usersFromIndexTxt))
+	if oAdmin.userExists(username) {
+		if err := oAdmin.storage.Unrevoke(username); err != nil {
+			log.Error(err)
+			return err, err.Error()
+		}
+		if *authByPassword {
+			o := runOpenvpnUser("restore", "--db.path", *authDatabase, "--user", username)
+			log.Debug(o)
 		}
 		crlFix()
-		oAdmin.clients = oAdmin.usersList()
+		oAdmin.refreshClients()
 		return nil, fmt.Sprintf("{\"msg\":\"User %s successfully unrevoked\"}", username)
 	}
 	return errors.New(fmt.Sprintf("user \"%s\" not found", username)), fmt.Sprintf("{\"msg\":\"User \"%s\" not found\"}", username)
 }
 
-func (oAdmin *OvpnAdmin) userRotate(username, newPassword string) (error, string) {
-	if checkUserExist(username) {
-		if *storageBackend == "kubernetes.secrets" {
-			err := app.easyrsaRotate(username, newPassword)
-			if err != nil {
-				log.Error(err)
-			}
-		} else {
-
-			var oldUserIndex, newUserIndex int
-			var oldUserSerial string
-
-			uniqHash := strings.Replace(uuid.New().String(), "-", "", -1)
-
-			usersFromIndexTxt := indexTxtParser(fRead(*indexTxtPath))
-			for i := range usersFromIndexTxt {
-				if usersFromIndexTxt[i].DistinguishedName == "/CN="+username {
-					oldUserSerial = usersFromIndexTxt[i].SerialNumber
-					usersFromIndexTxt[i].DistinguishedName = "/CN=REVOKED-" + username + "-" + uniqHash
-					oldUserIndex = i
-					break
-				}
-			}
-			err := fWrite(*indexTxtPath, renderIndexTxt(usersFromIndexTxt))
-			if err != nil {
-				log.Error(err)
-			}
-
-			if *authByPassword {
-				o := runBash(fmt.Sprintf("openvpn-user delete --force --db.path %s --user %s", *authDatabase, username))
-				log.Debug(o)
-			}
-
-			userCreated, userCreateMessage := oAdmin.userCreate(username, newPassword)
-			if !userCreated {
-				usersFromIndexTxt = indexTxtParser(fRead(*indexTxtPath))
-				for i := range usersFromIndexTxt {
-					if usersFromIndexTxt[i].SerialNumber == oldUserSerial {
-						usersFromIndexTxt[i].DistinguishedName = "/CN=" + username
-						break
-					}
-				}
-				err = fWrite(*indexTxtPath, renderIndexTxt(usersFromIndexTxt))
-				if err != nil {
-					log.Error(err)
-				}
-				return errors.New(fmt.Sprintf("error rotaing user due:  %s", userCreateMessage)), userCreateMessage
-			}
-
-			usersFromIndexTxt = indexTxtParser(fRead(*indexTxtPath))
-			for i := range usersFromIndexTxt {
-				if usersFromIndexTxt[i].DistinguishedName == "/CN="+username {
-					newUserIndex = i
-				}
-				if usersFromIndexTxt[i].SerialNumber == oldUserSerial {
-					oldUserIndex = i
-				}
-			}
-			usersFromIndexTxt[oldUserIndex], usersFromIndexTxt[newUserIndex] = usersFromIndexTxt[newUserIndex], usersFromIndexTxt[oldUserIndex]
-
-			err = fWrite(*indexTxtPath, renderIndexTxt(usersFromIndexTxt))
-			if err != nil {
-				log.Error(err)
+// userRotate replaces the certificate of the user with one expiring at notAfter, zero for --client-cert.expiration-days
+func (oAdmin *OvpnAdmin) userRotate(username, newPassword string, notAfter time.Time) (error, string) {
+	if oAdmin.userExists(username) {
+		if *authByPassword {
+			if err := validatePassword(newPassword); err != nil {
+				return err, err.Error()
 			}
-
-			_ = runBash(fmt.Sprintf("cd %s && %s gen-crl 1>/dev/null", *easyrsaDirPath, *easyrsaBinPath))
+		}
+		if err := oAdmin.storage.Rotate(username, notAfter); err != nil {
+			log.Error(err)
+			return err, err.Error()
+		}
+		if !notAfter.IsZero() {
+			oAdmin.renewalKeepExpiry(username)
+		}
+		if *authByPassword {
+			o := runOpenvpnUser("delete", "--force", "--db.path", *authDatabase, "--user", username)
+			log.Debug(o)
+			o = runOpenvpnUser("create", "--db.path", *authDatabase, "--user", username, "--password", newPassword)
+			log.Debug(o)
 		}
 		crlFix()
-		oAdmin.clients = oAdmin.usersList()
+		oAdmin.refreshClients()
 		return nil, fmt.Sprintf("{\"msg\":\"User %s successfully rotated\"}", username)
 	}
 	return errors.New(fmt.Sprintf("user \"%s\" not found", username)), fmt.Sprintf("{\"msg\":\"User \"%s\" not found\"}", username)
 }
 
 func (oAdmin *OvpnAdmin) userDelete(username string) (error, string) {
-	if checkUserExist(username) {
-		if *storageBackend == "kubernetes.secrets" {
-			err := app.easyrsaDelete(username)
-			if err != nil {
-				log.Error(err)
-			}
-		} else {
-			uniqHash := strings.Replace(uuid.New().String(), "-", "", -1)
-			usersFromIndexTxt := indexTxtParser(fRead(*indexTxtPath))
-			for i := range usersFromIndexTxt {
-				if usersFromIndexTxt[i].DistinguishedName == "/CN="+username {
-					usersFromIndexTxt[i].DistinguishedName = "/CN=REVOKED-" + username + "-" + uniqHash
-					break
-				}
-			}
-			if *authByPassword {
-				_ = runBash(fmt.Sprintf("openvpn-user delete --force --db.path %s --user %s", *authDatabase, username))
-			}
-			err := fWrite(*indexTxtPath, renderIndexTxt(usersFromIndexTxt))
-			if err != nil {
-				log.Error(err)
-			}
-			_ = runBash(fmt.Sprintf("cd %s && %s gen-crl 1>/dev/null ", *easyrsaDirPath, *easyrsaBinPath))
+	if oAdmin.userExists(username) {
+		if err := oAdmin.storage.Delete(username); err != nil {
+			log.Error(err)
+			return err, err.Error()
+		}
+		if *ccdEnabled {
+			oAdmin.releaseAddress(username)
+		}
+		if err := oAdmin.renewal.forget(username); err != nil {
+			log.Errorf("renewal: can't forget %s: %v", username, err)
+		}
+		if err := oAdmin.removeGroupMember(username); err != nil {
+			log.Errorf("groups: can't remove %s: %v", username, err)
+		}
+		if *authByPassword {
+			_ = runOpenvpnUser("delete", "--force", "--db.path", *authDatabase, "--user", username)
 		}
 		crlFix()
-		oAdmin.clients = oAdmin.usersList()
+		oAdmin.refreshClients()
 		return nil, fmt.Sprintf("{\"msg\":\"User %s successfully deleted\"}", username)
 	}
 	return errors.New(fmt.Sprintf("User \"%s\" not found}", username)), fmt.Sprintf("{\"msg\":\"User \"%s\" not found\"}", username)
@@ -1707,90 +1962,6 @@ func (oAdmin *OvpnAdmin) mgmtRead(conn net.Conn) string {
 	return out
 }
 
-func (oAdmin *OvpnAdmin) mgmtConnectedUsersParser(text, serverName string) []clientStatus {
-	var u []clientStatus
-	isClientList := false
-	isRouteTable := false
-	scanner := bufio.NewScanner(strings.NewReader(text))
-	for scanner.Scan() {
-		txt := scanner.Text()
-		if regexp.MustCompile(`^Common Name,Real Address,Bytes Received,Bytes Sent,Connected Since$`).MatchString(txt) {
-			isClientList = true
-			continue
-		}
-		if regexp.MustCompile(`^ROUTING TABLE$`).MatchString(txt) {
-			isClientList = false
-			continue
-		}
-		if regexp.MustCompile(`^Virtual Address,Common Name,Real Address,Last Ref$`).MatchString(txt) {
-			isRouteTable = true
-			continue
-		}
-		if regexp.MustCompile(`^GLOBAL STATS$`).MatchString(txt) {
-			// isRouteTable = false // ineffectual assignment to isRouteTable (ineffassign)
-			break
-		}
-		if isClientList {
-			user := strings.Split(txt, ",")
-
-			userName := user[0]
-			userAddress := user[1]
-			userBytesReceived := user[2]
-			userBytesSent := user[3]
-			userConnectedSince := user[4]
-
-			userStatus := clientStatus{CommonName: userName, RealAddress: userAddress, BytesReceived: userBytesReceived, BytesSent: userBytesSent, ConnectedSince: userConnectedSince, ConnectedTo: serverName}
-			u = append(u, userStatus)
-			bytesSent, _ := strconv.Atoi(userBytesSent)
-			bytesReceive, _ := strconv.Atoi(userBytesReceived)
-			ovpnClientConnectionFrom.WithLabelValues(userName, userAddress).Set(float64(parseDateToUnix(oAdmin.mgmtStatusTimeFormat, userConnectedSince)))
-			ovpnClientBytesSent.WithLabelValues(userName).Set(float64(bytesSent))
-			ovpnClientBytesReceived.WithLabelValues(userName).Set(float64(bytesReceive))
-		}
-		if isRouteTable {
-			user := strings.Split(txt, ",")
-			for i := range u {
-				if u[i].CommonName == user[1] {
-					u[i].VirtualAddress = user[0]
-					u[i].LastRef = user[3]
-					ovpnClientConnectionInfo.WithLabelValues(user[1], user[0]).Set(float64(parseDateToUnix(oAdmin.mgmtStatusTimeFormat, user[3])))
-					break
-				}
-			}
-		}
-	}
-	return u
-}
-
-func (oAdmin *OvpnAdmin) mgmtKillUserConnection(username, serverName string) {
-	conn, err := net.Dial("tcp", oAdmin.mgmtInterfaces[serverName])
-	if err != nil {
-		log.Errorf("openvpn mgmt interface for %s is not reachable by addr %s", serverName, oAdmin.mgmtInterfaces[serverName])
-		return
-	}
-	oAdmin.mgmtRead(conn) // read welcome message
-	conn.Write([]byte(fmt.Sprintf("kill %s\n", username)))
-	fmt.Printf("%v", oAdmin.mgmtRead(conn))
-	conn.Close()
-}
-
-func (oAdmin *OvpnAdmin) mgmtGetActiveClients() []clientStatus {
-	var activeClients []clientStatus
-
-	for srv, addr := range oAdmin.mgmtInterfaces {
-		conn, err := net.Dial("tcp", addr)
-		if err != nil {
-			log.Warnf("openvpn mgmt interface for %s is not reachable by addr %s", srv, addr)
-			break
-		}
-		oAdmin.mgmtRead(conn) // read welcome message
-		conn.Write([]byte("status 1\n"))
-		activeClients = append(activeClients, oAdmin.mgmtConnectedUsersParser(oAdmin.mgmtRead(conn), srv)...)
-		conn.Close()
-	}
-	return activeClients
-}
-
 func (oAdmin *OvpnAdmin) mgmtSetTimeFormat() {
 	// time format for version 2.5 and may be newer
 	oAdmin.mgmtStatusTimeFormat = "2006-01-02 15:04:05"
@@ -1947,7 +2118,9 @@ func unArchiveCcd() {
 
 func ovpnUserInitDb() {
 	if fi, err := os.Stat(*authDatabase); errors.Is(err, os.ErrNotExist) || fi.Size() == 0 {
-		i := runBash(fmt.Sprintf("openvpn-user --db.path %[1]s db-init && openvpn-user --db.path %[1]s db-migrate", *authDatabase))
+		i := runOpenvpnUser("db-init", "--db.path", *authDatabase)
+		log.Debug(i)
+		i = runOpenvpnUser("db-migrate", "--db.path", *authDatabase)
 		log.Debug(i)
 	}
 }
@@ -1983,6 +2156,11 @@ func (oAdmin *OvpnAdmin) syncDataFromMaster() {
 		}
 	}
 
+	// the ccd of the master replaced the local one
+	if *ccdEnabled && !ccdDownloadFailed {
+		oAdmin.loadAddresses(oAdmin.addressIndex())
+	}
+
 	oAdmin.lastSyncTime = time.Now().Format(stringDateFormat)
 	if !ccdDownloadFailed && !certsDownloadFailed {
 		oAdmin.lastSuccessfulSyncTime = time.Now().Format(stringDateFormat)
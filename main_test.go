@@ -4,6 +4,8 @@ import (
 	"html/template"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
@@ -12,29 +14,7 @@ import (
 
 // Helper function to create a test OvpnAdmin instance
 func newTestOvpnAdmin() *OvpnAdmin {
-	funcMap := template.FuncMap{
-		"hasModule": func(modules []string, module string) bool {
-			for _, m := range modules {
-				if m == module {
-					return true
-				}
-			}
-			return false
-		},
-		"add": func(a, b int) int {
-			return a + b
-		},
-		"dict": func(values ...interface{}) map[string]interface{} {
-			dict := make(map[string]interface{})
-			for i := 0; i < len(values); i += 2 {
-				key, _ := values[i].(string)
-				dict[key] = values[i+1]
-			}
-			return dict
-		},
-	}
-
-	tmpl := template.Must(template.New("").Funcs(funcMap).ParseGlob("templates/*.html"))
+	tmpl := template.Must(template.New("").Funcs(templateFuncMap()).ParseGlob("templates/*.html"))
 	template.Must(tmpl.ParseGlob("templates/partials/*.html"))
 
 	return &OvpnAdmin{
@@ -44,6 +24,7 @@ func newTestOvpnAdmin() *OvpnAdmin {
 		modules:                []string{"core"},
 		createUserMutex:        &sync.Mutex{},
 		htmlTemplates:          tmpl,
+		storage:                newFilesystemStorage(*easyrsaDirPath+"/pki", *indexTxtPath, *ccdDir),
 	}
 }
 
@@ -328,6 +309,9 @@ func TestModalCreateHandler(t *testing.T) {
 	if !strings.Contains(body, "Create User") {
 		t.Error("Create modal should have 'Create User' button")
 	}
+	if !strings.Contains(body, `name="expires_at"`) {
+		t.Error("Create modal should have an expiration date field")
+	}
 }
 
 func TestModalCreateHandler_WithPasswordAuth(t *testing.T) {
@@ -1281,3 +1265,26 @@ func TestUsernamePatternInCreateModal(t *testing.T) {
 		t.Error("Username field should have correct regex pattern with hyphen at start")
 	}
 }
+
+// =============================================================================
+// openvpn-user Tests
+// =============================================================================
+
+func TestRunOpenvpnUser_PasswordIsOneArgument(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\nfor arg in \"$@\"; do echo \"[$arg]\"; done\n"
+	if err := os.WriteFile(filepath.Join(dir, "openvpn-user"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	password := "pa ss'; touch " + filepath.Join(dir, "pwned") + " #"
+	out := runOpenvpnUser("create", "--db.path", "/tmp/users.db", "--user", "alice", "--password", password)
+
+	if !strings.Contains(out, "["+password+"]") {
+		t.Errorf("Expected the password as a single argument, got %q", out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pwned")); err == nil {
+		t.Error("The password was run by a shell")
+	}
+}
@@ -0,0 +1,756 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	mgmtEventConnect    = "connect"
+	mgmtEventDisconnect = "disconnect"
+	mgmtEventBytecount  = "bytecount"
+	mgmtEventSync       = "sync"
+	mgmtEventLost       = "lost"
+
+	mgmtReconnectMin = time.Second
+	mgmtReconnectMax = 30 * time.Second
+)
+
+var errMgmtNotConnected = errors.New("not connected")
+
+// mgmtEvent is a change in the client list of one OpenVPN server
+type mgmtEvent struct {
+	Type   string
+	Server string
+	Client clientStatus
+}
+
+// mgmtClient keeps a connection to one OpenVPN management interface open, reconnects when it is lost
+// and tracks the connected clients from the status output and the notifications
+type mgmtClient struct {
+	name              string
+	addr              string
+	bytecountInterval int
+	timeFormat        string
+	notify            func(mgmtEvent)
+
+	// replies are not tagged, so only one command can wait for its reply at a time
+	cmdMu sync.Mutex
+
+	mu        sync.Mutex
+	conn      net.Conn
+	replies   chan string
+	clients   map[string]clientStatus // by client ID
+	lastCount map[string]time.Time    // last traffic notification by client ID
+	resyncing bool
+	stopped   bool
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// mgmtNotification collects a >CLIENT: notification and the ENV lines that follow it
+type mgmtNotification struct {
+	kind string
+	cid  string
+	env  map[string]string
+}
+
+type mgmtKillResult struct {
+	Server  string `json:"server"`
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+func newMgmtClient(name, addr string, bytecountInterval int, timeFormat string, notify func(mgmtEvent)) *mgmtClient {
+	return &mgmtClient{
+		name:              name,
+		addr:              addr,
+		bytecountInterval: bytecountInterval,
+		timeFormat:        timeFormat,
+		notify:            notify,
+		clients:           make(map[string]clientStatus),
+		lastCount:         make(map[string]time.Time),
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
+	}
+}
+
+// run connects to the management interface until close is called, the delay between attempts doubles up to mgmtReconnectMax
+func (c *mgmtClient) run() {
+	defer close(c.done)
+	delay := mgmtReconnectMin
+	for {
+		conn, err := net.DialTimeout("tcp", c.addr, mgmtTimeout)
+		if err != nil {
+			log.Warnf("openvpn mgmt interface for %s is not reachable by addr %s, retrying in %s", c.name, c.addr, delay)
+		} else {
+			log.Infof("mgmt %s: connected to %s", c.name, c.addr)
+			started := time.Now()
+			c.serve(conn)
+			if time.Since(started) > mgmtReconnectMax {
+				delay = mgmtReconnectMin
+			}
+		}
+
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, mgmtReconnectMax)
+	}
+}
+
+// close stops the client and waits until its connection is closed
+func (c *mgmtClient) close() {
+	c.mu.Lock()
+	if !c.stopped {
+		c.stopped = true
+		close(c.stop)
+	}
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.mu.Unlock()
+	<-c.done
+}
+
+func (c *mgmtClient) connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+// serve reads from the connection until it is closed, the clients of the server are forgotten afterwards
+func (c *mgmtClient) serve(conn net.Conn) {
+	replies := make(chan string, 1)
+
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		conn.Close()
+		return
+	}
+	c.conn, c.replies = conn, replies
+	c.mu.Unlock()
+
+	closed := make(chan struct{})
+	go c.setup()
+	if c.bytecountInterval > 0 {
+		go c.watch(closed)
+	}
+	c.read(conn, replies)
+	close(closed)
+
+	conn.Close()
+	c.mu.Lock()
+	c.conn = nil
+	forgotten := len(c.clients) > 0
+	c.clients = make(map[string]clientStatus)
+	c.lastCount = make(map[string]time.Time)
+	c.mu.Unlock()
+	close(replies)
+
+	log.Warnf("mgmt %s: connection to %s closed", c.name, c.addr)
+	if forgotten {
+		c.notify(mgmtEvent{Type: mgmtEventLost, Server: c.name})
+	}
+}
+
+// setup enables the traffic notifications and loads the clients connected before we were
+func (c *mgmtClient) setup() {
+	if c.bytecountInterval > 0 {
+		out, err := c.command(fmt.Sprintf("bytecount %d", c.bytecountInterval))
+		if err != nil {
+			log.Warnf("mgmt %s: can't enable bytecount: %v", c.name, err)
+		} else if ok, msg := mgmtParseReply(out); !ok {
+			log.Warnf("mgmt %s: can't enable bytecount: %s", c.name, msg)
+		}
+	}
+
+	if _, _, err := c.sync(); err != nil {
+		log.Warnf("mgmt %s: can't read status: %v", c.name, err)
+		return
+	}
+	c.notify(mgmtEvent{Type: mgmtEventSync, Server: c.name})
+}
+
+// watch re-reads the status when a client stops sending its traffic counters, OpenVPN only sends the
+// >CLIENT: notifications with management-client-auth, so this is how disconnects are found early
+func (c *mgmtClient) watch(closed <-chan struct{}) {
+	interval := time.Duration(c.bytecountInterval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			if c.silent(2 * interval) {
+				c.requestResync()
+			}
+		}
+	}
+}
+
+// silent reports whether a client sent no traffic counters for longer than d,
+// clients of old OpenVPN versions without a client ID are never reported
+func (c *mgmtClient) silent(d time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, client := range c.clients {
+		if client.ClientID != "" && time.Since(c.lastCount[key]) > d {
+			return true
+		}
+	}
+	return false
+}
+
+// requestResync starts a resync unless one is running already, it can't run on the reading goroutine
+// as the status reply is read there
+func (c *mgmtClient) requestResync() {
+	c.mu.Lock()
+	if c.resyncing {
+		c.mu.Unlock()
+		return
+	}
+	c.resyncing = true
+	c.mu.Unlock()
+
+	go func() {
+		c.resync()
+		c.mu.Lock()
+		c.resyncing = false
+		c.mu.Unlock()
+	}()
+}
+
+// resync re-reads the status and reports the clients that connected or disconnected in the meantime
+func (c *mgmtClient) resync() {
+	connected, disconnected, err := c.sync()
+	if err != nil {
+		if !errors.Is(err, errMgmtNotConnected) {
+			log.Warnf("mgmt %s: can't read status: %v", c.name, err)
+		}
+		return
+	}
+	c.report(connected, disconnected)
+}
+
+func (c *mgmtClient) report(connected, disconnected []clientStatus) {
+	for _, client := range disconnected {
+		c.notify(mgmtEvent{Type: mgmtEventDisconnect, Server: c.name, Client: client})
+	}
+	for _, client := range connected {
+		c.notify(mgmtEvent{Type: mgmtEventConnect, Server: c.name, Client: client})
+	}
+}
+
+// read passes notifications to handleNotification and command replies to the waiting command
+func (c *mgmtClient) read(conn net.Conn, replies chan<- string) {
+	var reply strings.Builder
+	var pending *mgmtNotification
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, ">") {
+			pending = c.handleNotification(line, pending)
+			continue
+		}
+
+		reply.WriteString(line + "\n")
+		if line == "END" || strings.HasPrefix(line, "SUCCESS:") || strings.HasPrefix(line, "ERROR:") {
+			select {
+			case replies <- reply.String():
+			default:
+				log.Debugf("mgmt %s: dropping unexpected reply %q", c.name, reply.String())
+			}
+			reply.Reset()
+		}
+	}
+}
+
+// command sends a command and waits for its reply
+func (c *mgmtClient) command(cmd string) (string, error) {
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+
+	c.mu.Lock()
+	conn, replies := c.conn, c.replies
+	c.mu.Unlock()
+	if conn == nil {
+		return "", errMgmtNotConnected
+	}
+
+	_ = conn.SetWriteDeadline(time.Now().Add(mgmtTimeout))
+	if _, err := fmt.Fprintf(conn, "%s\n", cmd); err != nil {
+		return "", err
+	}
+
+	select {
+	case out, ok := <-replies:
+		if !ok {
+			return "", errors.New("connection closed")
+		}
+		log.Tracef("mgmt %s: %s: %s", c.name, cmd, out)
+		return out, nil
+	case <-time.After(mgmtTimeout):
+		// a late reply would be taken for the reply to the next command
+		conn.Close()
+		return "", fmt.Errorf("no reply to %q within %s", strings.Fields(cmd)[0], mgmtTimeout)
+	}
+}
+
+// sync replaces the client list with the output of the status command and returns the clients
+// that connected and disconnected since the list was last changed
+func (c *mgmtClient) sync() (connected, disconnected []clientStatus, err error) {
+	out, err := c.command("status 2")
+	if err != nil {
+		return nil, nil, err
+	}
+	if strings.HasPrefix(out, "ERROR:") {
+		_, msg := mgmtParseReply(out)
+		return nil, nil, errors.New(msg)
+	}
+
+	clients := make(map[string]clientStatus)
+	for _, client := range mgmtParseStatus(out, c.name) {
+		clients[client.key()] = client
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, client := range c.clients {
+		if _, ok := clients[key]; !ok {
+			disconnected = append(disconnected, client)
+		}
+	}
+	lastCount := make(map[string]time.Time, len(clients))
+	for key, client := range clients {
+		if _, ok := c.clients[key]; !ok {
+			connected = append(connected, client)
+		}
+		lastCount[key] = now
+	}
+	c.clients, c.lastCount = clients, lastCount
+	return connected, disconnected, nil
+}
+
+// snapshot returns the connected clients ordered by client ID
+func (c *mgmtClient) snapshot() []clientStatus {
+	c.mu.Lock()
+	clients := make([]clientStatus, 0, len(c.clients))
+	for _, client := range c.clients {
+		clients = append(clients, client)
+	}
+	c.mu.Unlock()
+
+	sort.Slice(clients, func(i, j int) bool {
+		a, errA := strconv.Atoi(clients[i].ClientID)
+		b, errB := strconv.Atoi(clients[j].ClientID)
+		if errA != nil || errB != nil {
+			return clients[i].ClientID < clients[j].ClientID
+		}
+		return a < b
+	})
+	return clients
+}
+
+func (c *mgmtClient) handleNotification(line string, pending *mgmtNotification) *mgmtNotification {
+	kind, args, _ := strings.Cut(strings.TrimPrefix(line, ">"), ":")
+	switch kind {
+	case "BYTECOUNT_CLI":
+		// >BYTECOUNT_CLI:{CID},{BYTES_IN},{BYTES_OUT}
+		fields := strings.Split(args, ",")
+		if len(fields) == 3 {
+			c.bytecount(fields[0], fields[1], fields[2])
+		}
+	case "CLIENT":
+		if value, ok := strings.CutPrefix(args, "ENV,"); ok {
+			if pending == nil {
+				return nil
+			}
+			if value == "END" {
+				c.clientEvent(pending)
+				return nil
+			}
+			name, val, _ := strings.Cut(value, "=")
+			pending.env[name] = val
+			return pending
+		}
+		// >CLIENT:{CONNECT|REAUTH|ESTABLISHED|DISCONNECT},{CID},... followed by ENV lines
+		fields := strings.Split(args, ",")
+		if len(fields) >= 2 {
+			return &mgmtNotification{kind: fields[0], cid: fields[1], env: make(map[string]string)}
+		}
+	}
+	return pending
+}
+
+func (c *mgmtClient) clientEvent(n *mgmtNotification) {
+	switch n.kind {
+	case "ESTABLISHED":
+		client := c.clientFromEnv(n.cid, n.env)
+		c.mu.Lock()
+		c.clients[n.cid] = client
+		c.lastCount[n.cid] = time.Now()
+		c.mu.Unlock()
+		c.notify(mgmtEvent{Type: mgmtEventConnect, Server: c.name, Client: client})
+	case "DISCONNECT":
+		c.mu.Lock()
+		client, ok := c.clients[n.cid]
+		delete(c.clients, n.cid)
+		delete(c.lastCount, n.cid)
+		c.mu.Unlock()
+		if !ok {
+			return
+		}
+		// the final traffic counters are only in the environment
+		if v := n.env["bytes_received"]; v != "" {
+			client.BytesReceived = v
+		}
+		if v := n.env["bytes_sent"]; v != "" {
+			client.BytesSent = v
+		}
+		c.notify(mgmtEvent{Type: mgmtEventDisconnect, Server: c.name, Client: client})
+	}
+}
+
+func (c *mgmtClient) clientFromEnv(cid string, env map[string]string) clientStatus {
+	client := clientStatus{
+		ClientID:       cid,
+		CommonName:     env["common_name"],
+		VirtualAddress: env["ifconfig_pool_remote_ip"],
+		BytesReceived:  "0",
+		BytesSent:      "0",
+		ConnectedTo:    c.name,
+	}
+
+	realIP := env["trusted_ip"]
+	if realIP == "" {
+		realIP = env["trusted_ip6"]
+	}
+	client.RealAddress = realIP
+	if port := env["trusted_port"]; port != "" {
+		client.RealAddress = realIP + ":" + port
+	}
+
+	if ts, err := strconv.ParseInt(env["time_unix"], 10, 64); err == nil {
+		client.ConnectedSince = time.Unix(ts, 0).Format(c.timeFormat)
+	}
+	return client
+}
+
+// bytecount updates the traffic counters of a client, a client ID we don't know yet connected after the last status
+func (c *mgmtClient) bytecount(cid, bytesIn, bytesOut string) {
+	c.mu.Lock()
+	client, ok := c.clients[cid]
+	if ok {
+		client.BytesReceived, client.BytesSent = bytesIn, bytesOut
+		c.clients[cid] = client
+		c.lastCount[cid] = time.Now()
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		c.requestResync()
+		return
+	}
+	c.notify(mgmtEvent{Type: mgmtEventBytecount, Server: c.name, Client: client})
+}
+
+// key identifies the connection on its server, old OpenVPN versions don't report client IDs
+func (client clientStatus) key() string {
+	if client.ClientID != "" {
+		return client.ClientID
+	}
+	return client.CommonName + "/" + client.RealAddress
+}
+
+// mgmtParseStatus parses the CLIENT_LIST and ROUTING_TABLE rows of the "status 2" output,
+// columns are looked up by the names in the HEADER rows as they differ between OpenVPN versions
+func mgmtParseStatus(text, serverName string) []clientStatus {
+	var clients []clientStatus
+	headers := make(map[string]map[string]int)
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimRight(scanner.Text(), "\r"), ",")
+		switch fields[0] {
+		case "HEADER":
+			if len(fields) < 2 {
+				continue
+			}
+			columns := make(map[string]int)
+			for i, name := range fields[2:] {
+				columns[name] = i + 1
+			}
+			headers[fields[1]] = columns
+		case "CLIENT_LIST":
+			col := mgmtColumn(headers["CLIENT_LIST"], fields)
+			clients = append(clients, clientStatus{
+				CommonName:     col("Common Name"),
+				RealAddress:    col("Real Address"),
+				VirtualAddress: col("Virtual Address"),
+				BytesReceived:  col("Bytes Received"),
+				BytesSent:      col("Bytes Sent"),
+				ConnectedSince: col("Connected Since"),
+				ClientID:       col("Client ID"),
+				ConnectedTo:    serverName,
+			})
+		case "ROUTING_TABLE":
+			col := mgmtColumn(headers["ROUTING_TABLE"], fields)
+			for i := range clients {
+				if clients[i].CommonName == col("Common Name") && clients[i].RealAddress == col("Real Address") && clients[i].LastRef == "" {
+					clients[i].LastRef = col("Last Ref")
+					if clients[i].VirtualAddress == "" {
+						clients[i].VirtualAddress = col("Virtual Address")
+					}
+				}
+			}
+		}
+	}
+	return clients
+}
+
+func mgmtColumn(columns map[string]int, fields []string) func(string) string {
+	return func(name string) string {
+		if i, ok := columns[name]; ok && i < len(fields) {
+			return fields[i]
+		}
+		return ""
+	}
+}
+
+// mgmtParseReply returns the first SUCCESS: or ERROR: reply of the management interface
+func mgmtParseReply(out string) (bool, string) {
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "SUCCESS:"):
+			return true, strings.TrimSpace(strings.TrimPrefix(line, "SUCCESS:"))
+		case strings.HasPrefix(line, "ERROR:"):
+			return false, strings.TrimSpace(strings.TrimPrefix(line, "ERROR:"))
+		}
+	}
+	return false, "no reply from management interface"
+}
+
+// summarizeKillResults reports whether the user was disconnected from at least one server
+func summarizeKillResults(results []mgmtKillResult) (bool, string) {
+	disconnected := false
+	var parts []string
+	for _, r := range results {
+		status := "failed"
+		if r.Success {
+			status = "ok"
+			disconnected = true
+		}
+		parts = append(parts, fmt.Sprintf("%s: %s (%s)", r.Server, status, r.Message))
+	}
+	if len(parts) == 0 {
+		return false, "no management interfaces configured"
+	}
+	return disconnected, strings.Join(parts, "; ")
+}
+
+// mgmtStart opens a persistent connection to every management interface
+func (oAdmin *OvpnAdmin) mgmtStart() {
+	oAdmin.mgmtClients = make(map[string]*mgmtClient)
+	for name, addr := range oAdmin.mgmtInterfaces {
+		client := newMgmtClient(name, addr, *mgmtBytecountInterval, oAdmin.mgmtStatusTimeFormat, oAdmin.mgmtHandleEvent)
+		oAdmin.mgmtClients[name] = client
+		go client.run()
+	}
+}
+
+func (oAdmin *OvpnAdmin) mgmtStop() {
+	for _, client := range oAdmin.mgmtClients {
+		client.close()
+	}
+}
+
+// mgmtHandleEvent updates the active clients as soon as a management interface reports a change
+func (oAdmin *OvpnAdmin) mgmtHandleEvent(event mgmtEvent) {
+	switch event.Type {
+	case mgmtEventConnect:
+		log.Infof("client %s connected to %s from %s", event.Client.CommonName, event.Server, event.Client.RealAddress)
+	case mgmtEventDisconnect:
+		log.Infof("client %s disconnected from %s", event.Client.CommonName, event.Server)
+	}
+
+	oAdmin.historyHandleEvent(event)
+	if event.Type == mgmtEventBytecount {
+		oAdmin.mgmtUpdateClientTraffic(event.Server, event.Client)
+	} else {
+		oAdmin.mgmtUpdateActiveClients()
+		oAdmin.refreshClients()
+	}
+	if event.Type == mgmtEventConnect || event.Type == mgmtEventDisconnect {
+		oAdmin.events.publish(uiEvent{Name: uiEventConnection, Connection: event})
+	}
+}
+
+// mgmtRefresh re-reads the status of every server, unreachable servers are skipped
+func (oAdmin *OvpnAdmin) mgmtRefresh() {
+	for name, client := range oAdmin.mgmtClients {
+		connected, disconnected, err := client.sync()
+		if err == nil {
+			client.report(connected, disconnected)
+			oAdmin.history.reconcile(name, client.snapshot(), time.Now())
+		} else if !errors.Is(err, errMgmtNotConnected) {
+			log.Warnf("mgmt %s: can't read status: %v", name, err)
+		}
+	}
+	oAdmin.mgmtUpdateActiveClients()
+}
+
+// mgmtUpdateActiveClients merges the client lists of all servers and refreshes the per-client metrics
+func (oAdmin *OvpnAdmin) mgmtUpdateActiveClients() {
+	var servers []string
+	for name := range oAdmin.mgmtClients {
+		servers = append(servers, name)
+	}
+	sort.Strings(servers)
+
+	var active []clientStatus
+	for _, name := range servers {
+		active = append(active, oAdmin.mgmtClients[name].snapshot()...)
+	}
+
+	bytesSent := make(map[string]float64)
+	bytesReceived := make(map[string]float64)
+	connectionFrom := make(map[[2]string]float64)
+	connectionInfo := make(map[[2]string]float64)
+	index := make(map[string]int, len(active))
+	for i, u := range active {
+		index[u.ConnectedTo+"/"+u.key()] = i
+		if u.ConnectedSince != "" {
+			connectionFrom[[2]string{u.CommonName, u.RealAddress}] = float64(parseDateToUnix(oAdmin.mgmtStatusTimeFormat, u.ConnectedSince))
+		}
+		if u.VirtualAddress != "" && u.LastRef != "" {
+			connectionInfo[[2]string{u.CommonName, u.VirtualAddress}] = float64(parseDateToUnix(oAdmin.mgmtStatusTimeFormat, u.LastRef))
+		}
+		bytesSent[u.CommonName] += parseByteCount(u.BytesSent)
+		bytesReceived[u.CommonName] += parseByteCount(u.BytesReceived)
+	}
+
+	oAdmin.activeClientsMu.Lock()
+	defer oAdmin.activeClientsMu.Unlock()
+	previous := oAdmin.activeClients
+	oAdmin.activeClients, oAdmin.activeClientIndex = active, index
+
+	// the series are set before the ones of gone clients are deleted, so a scrape never sees them missing
+	for cn, v := range bytesSent {
+		ovpnClientBytesSent.WithLabelValues(cn).Set(v)
+		ovpnClientBytesReceived.WithLabelValues(cn).Set(bytesReceived[cn])
+	}
+	for labels, v := range connectionFrom {
+		ovpnClientConnectionFrom.WithLabelValues(labels[0], labels[1]).Set(v)
+	}
+	for labels, v := range connectionInfo {
+		ovpnClientConnectionInfo.WithLabelValues(labels[0], labels[1]).Set(v)
+	}
+	for _, u := range previous {
+		if _, ok := bytesSent[u.CommonName]; !ok {
+			ovpnClientBytesSent.DeleteLabelValues(u.CommonName)
+			ovpnClientBytesReceived.DeleteLabelValues(u.CommonName)
+		}
+		if _, ok := connectionFrom[[2]string{u.CommonName, u.RealAddress}]; !ok {
+			ovpnClientConnectionFrom.DeleteLabelValues(u.CommonName, u.RealAddress)
+		}
+		if _, ok := connectionInfo[[2]string{u.CommonName, u.VirtualAddress}]; !ok {
+			ovpnClientConnectionInfo.DeleteLabelValues(u.CommonName, u.VirtualAddress)
+		}
+	}
+}
+
+// mgmtUpdateClientTraffic updates the counters of one client, the traffic notifications arrive for every
+// client every few seconds, so they don't rebuild the client list
+func (oAdmin *OvpnAdmin) mgmtUpdateClientTraffic(server string, client clientStatus) {
+	oAdmin.activeClientsMu.Lock()
+	defer oAdmin.activeClientsMu.Unlock()
+	i, ok := oAdmin.activeClientIndex[server+"/"+client.key()]
+	if !ok {
+		return
+	}
+	u := &oAdmin.activeClients[i]
+	// the metrics sum all sessions of a user, so only the change of this session is added
+	ovpnClientBytesSent.WithLabelValues(u.CommonName).Add(parseByteCount(client.BytesSent) - parseByteCount(u.BytesSent))
+	ovpnClientBytesReceived.WithLabelValues(u.CommonName).Add(parseByteCount(client.BytesReceived) - parseByteCount(u.BytesReceived))
+	u.BytesSent, u.BytesReceived = client.BytesSent, client.BytesReceived
+}
+
+func parseByteCount(s string) float64 {
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return float64(n)
+}
+
+func (oAdmin *OvpnAdmin) getActiveClients() []clientStatus {
+	oAdmin.activeClientsMu.RLock()
+	defer oAdmin.activeClientsMu.RUnlock()
+	return slices.Clone(oAdmin.activeClients)
+}
+
+func (oAdmin *OvpnAdmin) mgmtKillUserConnection(username, serverName string) mgmtKillResult {
+	result := mgmtKillResult{Server: serverName}
+	addr := oAdmin.mgmtInterfaces[serverName]
+
+	client, ok := oAdmin.mgmtClients[serverName]
+	if !ok {
+		result.Message = fmt.Sprintf("management interface %s is not reachable", addr)
+		return result
+	}
+	out, err := client.command("kill " + username)
+	if err != nil {
+		log.Errorf("openvpn mgmt interface for %s is not reachable by addr %s: %v", serverName, addr, err)
+		result.Message = fmt.Sprintf("management interface %s is not reachable: %v", addr, err)
+		return result
+	}
+	log.Debugf("mgmtKillUserConnection %s on %s: %s", username, serverName, strings.TrimSpace(out))
+
+	result.Success, result.Message = mgmtParseReply(out)
+	return result
+}
+
+// userDisconnect kills the user's sessions on one server or, if serverName is empty, on every server
+func (oAdmin *OvpnAdmin) userDisconnect(username, serverName string) ([]mgmtKillResult, error) {
+	if !oAdmin.userExists(username) {
+		return nil, fmt.Errorf("user %q not found", username)
+	}
+
+	var servers []string
+	if serverName != "" {
+		if _, ok := oAdmin.mgmtInterfaces[serverName]; !ok {
+			return nil, fmt.Errorf("unknown server %q", serverName)
+		}
+		servers = []string{serverName}
+	} else {
+		for srv := range oAdmin.mgmtInterfaces {
+			servers = append(servers, srv)
+		}
+		sort.Strings(servers)
+	}
+
+	var results []mgmtKillResult
+	for _, srv := range servers {
+		result := oAdmin.mgmtKillUserConnection(username, srv)
+		log.Infof("disconnect %s from %s: success=%t %s", username, srv, result.Success, result.Message)
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeMgmtServer emulates the commands and notifications of the OpenVPN management interface used by mgmtClient
+type fakeMgmtServer struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	sessions map[int]string // common name by client ID
+	nextCID  int
+	commands []string
+}
+
+func newFakeMgmtServer(t *testing.T, connected ...string) *fakeMgmtServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeMgmtServer{listener: listener, sessions: make(map[int]string)}
+	for _, cn := range connected {
+		s.sessions[s.nextCID] = cn
+		s.nextCID++
+	}
+	t.Cleanup(func() {
+		listener.Close()
+		s.dropConnections()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeMgmtServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+// push sends a notification to every connected management client
+func (s *fakeMgmtServer) push(lines ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		fmt.Fprint(conn, strings.Join(lines, "\r\n")+"\r\n")
+	}
+}
+
+func (s *fakeMgmtServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeMgmtServer) countCommands(cmd string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, c := range s.commands {
+		if c == cmd {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *fakeMgmtServer) status() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := "TITLE,OpenVPN 2.6.12 x86_64-pc-linux-gnu\r\n" +
+		"HEADER,CLIENT_LIST,Common Name,Real Address,Virtual Address,Virtual IPv6 Address,Bytes Received,Bytes Sent,Connected Since,Connected Since (time_t),Username,Client ID,Peer ID,Data Channel Cipher\r\n"
+	for cid, cn := range s.sessions {
+		out += fmt.Sprintf("CLIENT_LIST,%s,192.0.2.%d:50000,10.8.0.%d,,1000,2000,2025-01-01 10:00:00,1735725600,UNDEF,%d,%d,AES-256-GCM\r\n", cn, cid+10, cid+10, cid, cid)
+	}
+	return out + "GLOBAL_STATS,Max bcast/mcast queue length,0\r\nEND\r\n"
+}
+
+func (s *fakeMgmtServer) kill(cn string) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var killed []int
+	for cid, name := range s.sessions {
+		if name == cn {
+			killed = append(killed, cid)
+			delete(s.sessions, cid)
+		}
+	}
+	return killed
+}
+
+// connect adds a session without a notification like OpenVPN without management-client-auth does
+func (s *fakeMgmtServer) connect(cn string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cid := s.nextCID
+	s.sessions[cid] = cn
+	s.nextCID++
+	return cid
+}
+
+func (s *fakeMgmtServer) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprint(conn, ">INFO:OpenVPN Management Interface Version 5 -- type 'help' for more info\r\n")
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		cmd := strings.TrimSpace(scanner.Text())
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		s.mu.Unlock()
+
+		fields := strings.Fields(cmd)
+		switch {
+		case len(fields) == 2 && fields[0] == "kill":
+			killed := s.kill(fields[1])
+			if len(killed) == 0 {
+				fmt.Fprintf(conn, "ERROR: common name '%s' not found\r\n", fields[1])
+				continue
+			}
+			fmt.Fprintf(conn, "SUCCESS: common name '%s' found, %d client(s) killed\r\n", fields[1], len(killed))
+			for _, cid := range killed {
+				fmt.Fprintf(conn, ">CLIENT:DISCONNECT,%d\r\n>CLIENT:ENV,common_name=%s\r\n>CLIENT:ENV,END\r\n", cid, fields[1])
+			}
+		case len(fields) == 2 && fields[0] == "bytecount":
+			fmt.Fprint(conn, "SUCCESS: bytecount interval changed\r\n")
+		case cmd == "status 2":
+			fmt.Fprint(conn, s.status())
+		default:
+			fmt.Fprint(conn, "ERROR: unknown command, enter 'help' for more options\r\n")
+		}
+	}
+}
+
+// startTestMgmt connects oAdmin to the management interfaces and waits until the given servers are connected
+func startTestMgmt(t *testing.T, oAdmin *OvpnAdmin, interfaces map[string]string, waitFor ...string) {
+	t.Helper()
+	oAdmin.mgmtInterfaces = interfaces
+	oAdmin.mgmtStatusTimeFormat = "2006-01-02 15:04:05"
+	oAdmin.mgmtStart()
+	t.Cleanup(oAdmin.mgmtStop)
+	for _, name := range waitFor {
+		eventually(t, "connect to "+name, oAdmin.mgmtClients[name].connected)
+	}
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting to %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func findClient(clients []clientStatus, cn string) (clientStatus, bool) {
+	for _, c := range clients {
+		if c.CommonName == cn {
+			return c, true
+		}
+	}
+	return clientStatus{}, false
+}
+
+func TestMgmtParseReply(t *testing.T) {
+	tests := []struct {
+		out     string
+		success bool
+		message string
+	}{
+		{"SUCCESS: common name 'alice' found, 1 client(s) killed\r\n", true, "common name 'alice' found, 1 client(s) killed"},
+		{">INFO:something\r\nERROR: common name 'bob' not found\r\n", false, "common name 'bob' not found"},
+		{"", false, "no reply from management interface"},
+	}
+
+	for _, tt := range tests {
+		success, message := mgmtParseReply(tt.out)
+		if success != tt.success || message != tt.message {
+			t.Errorf("mgmtParseReply(%q) = %v, %q; expected %v, %q", tt.out, success, message, tt.success, tt.message)
+		}
+	}
+}
+
+func TestUserDisconnect_AllServers(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	primary := newFakeMgmtServer(t, "alice")
+	backup := newFakeMgmtServer(t)
+
+	oAdmin := newTestOvpnAdmin()
+	startTestMgmt(t, oAdmin, map[string]string{"main": primary.addr(), "backup": backup.addr()}, "main", "backup")
+
+	results, err := oAdmin.userDisconnect("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected results for 2 servers, got %+v", results)
+	}
+	// results are sorted by server name
+	if results[0].Server != "backup" || results[0].Success || !strings.Contains(results[0].Message, "not found") {
+		t.Errorf("Unexpected backup result: %+v", results[0])
+	}
+	if results[1].Server != "main" || !results[1].Success || !strings.Contains(results[1].Message, "1 client(s) killed") {
+		t.Errorf("Unexpected main result: %+v", results[1])
+	}
+
+	disconnected, summary := summarizeKillResults(results)
+	if !disconnected || !strings.Contains(summary, "main: ok") {
+		t.Errorf("Unexpected summary: %v %s", disconnected, summary)
+	}
+}
+
+func TestUserDisconnect_OneServer(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	primary := newFakeMgmtServer(t, "alice")
+	backup := newFakeMgmtServer(t, "alice")
+
+	oAdmin := newTestOvpnAdmin()
+	startTestMgmt(t, oAdmin, map[string]string{"main": primary.addr(), "backup": backup.addr()}, "main", "backup")
+
+	results, err := oAdmin.userDisconnect("alice", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Server != "backup" || !results[0].Success {
+		t.Fatalf("Unexpected results: %+v", results)
+	}
+
+	if n := primary.countCommands("kill alice"); n != 0 {
+		t.Errorf("Server main should not be asked to kill alice, got %d commands", n)
+	}
+}
+
+func TestUserDisconnect_Errors(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	oAdmin := newTestOvpnAdmin()
+	startTestMgmt(t, oAdmin, map[string]string{"main": "127.0.0.1:1"})
+
+	if _, err := oAdmin.userDisconnect("nobody", ""); err == nil {
+		t.Error("Expected error for unknown user")
+	}
+	if _, err := oAdmin.userDisconnect("alice", "other"); err == nil {
+		t.Error("Expected error for unknown server")
+	}
+
+	results, err := oAdmin.userDisconnect("alice", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Success || !strings.Contains(results[0].Message, "not reachable") {
+		t.Errorf("Expected unreachable server to fail, got %+v", results)
+	}
+}
+
+func TestAPIDisconnectUser(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	primary := newFakeMgmtServer(t, "alice")
+
+	oAdmin := newTestOvpnAdmin()
+	startTestMgmt(t, oAdmin, map[string]string{"main": primary.addr()}, "main")
+
+	w := httptest.NewRecorder()
+	oAdmin.apiV1Handler(w, httptest.NewRequest(http.MethodPost, "/api/v1/users/alice/disconnect", strings.NewReader(`{"server":"main"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d (%s)", w.Code, w.Body.String())
+	}
+
+	var resp apiDisconnectResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Disconnected || len(resp.Results) != 1 || resp.Results[0].Server != "main" {
+		t.Errorf("Unexpected response: %+v", resp)
+	}
+}
+
+func TestMgmtParseStatus(t *testing.T) {
+	out := "TITLE,OpenVPN 2.6.12 x86_64-pc-linux-gnu\r\n" +
+		"HEADER,CLIENT_LIST,Common Name,Real Address,Virtual Address,Virtual IPv6 Address,Bytes Received,Bytes Sent,Connected Since,Connected Since (time_t),Username,Client ID,Peer ID,Data Channel Cipher\r\n" +
+		"CLIENT_LIST,alice,192.0.2.10:50000,10.8.0.6,,1234,5678,2025-01-01 10:00:00,1735725600,UNDEF,3,0,AES-256-GCM\r\n" +
+		"HEADER,ROUTING_TABLE,Virtual Address,Common Name,Real Address,Last Ref,Last Ref (time_t)\r\n" +
+		"ROUTING_TABLE,10.8.0.6,alice,192.0.2.10:50000,2025-01-01 10:05:00,1735725900\r\n" +
+		"GLOBAL_STATS,Max bcast/mcast queue length,0\r\n" +
+		"END\r\n"
+
+	clients := mgmtParseStatus(out, "main")
+	if len(clients) != 1 {
+		t.Fatalf("Expected 1 client, got %+v", clients)
+	}
+	expected := clientStatus{
+		CommonName:     "alice",
+		RealAddress:    "192.0.2.10:50000",
+		VirtualAddress: "10.8.0.6",
+		BytesReceived:  "1234",
+		BytesSent:      "5678",
+		ConnectedSince: "2025-01-01 10:00:00",
+		LastRef:        "2025-01-01 10:05:00",
+		ClientID:       "3",
+		ConnectedTo:    "main",
+	}
+	if clients[0] != expected {
+		t.Errorf("Unexpected client:\n%+v\nexpected:\n%+v", clients[0], expected)
+	}
+}
+
+func TestMgmtClient_Notifications(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	server := newFakeMgmtServer(t, "alice")
+
+	oAdmin := newTestOvpnAdmin()
+	startTestMgmt(t, oAdmin, map[string]string{"main": server.addr()}, "main")
+
+	eventually(t, "load alice from status", func() bool {
+		_, ok := findClient(oAdmin.getActiveClients(), "alice")
+		return ok
+	})
+
+	server.push(">CLIENT:ESTABLISHED,7",
+		">CLIENT:ENV,common_name=bob",
+		">CLIENT:ENV,trusted_ip=198.51.100.7",
+		">CLIENT:ENV,trusted_port=41000",
+		">CLIENT:ENV,ifconfig_pool_remote_ip=10.8.0.7",
+		">CLIENT:ENV,time_unix=1735725600",
+		">CLIENT:ENV,END")
+	eventually(t, "see bob connect", func() bool {
+		bob, ok := findClient(oAdmin.getActiveClients(), "bob")
+		return ok && bob.RealAddress == "198.51.100.7:41000" && bob.VirtualAddress == "10.8.0.7" && bob.ClientID == "7"
+	})
+
+	server.push(">BYTECOUNT_CLI:7,100,200")
+	eventually(t, "see bob's traffic", func() bool {
+		bob, _ := findClient(oAdmin.getActiveClients(), "bob")
+		return bob.BytesReceived == "100" && bob.BytesSent == "200"
+	})
+
+	server.push(">CLIENT:DISCONNECT,7", ">CLIENT:ENV,common_name=bob", ">CLIENT:ENV,END")
+	eventually(t, "see bob disconnect", func() bool {
+		_, ok := findClient(oAdmin.getActiveClients(), "bob")
+		return !ok
+	})
+	if _, ok := findClient(oAdmin.getActiveClients(), "alice"); !ok {
+		t.Error("Expected alice to stay connected")
+	}
+}
+
+func TestMgmtClient_ResyncWithoutClientNotifications(t *testing.T) {
+	server := newFakeMgmtServer(t, "alice")
+
+	events := make(chan mgmtEvent, 16)
+	client := newMgmtClient("main", server.addr(), 1, "2006-01-02 15:04:05", func(e mgmtEvent) { events <- e })
+	go client.run()
+	t.Cleanup(client.close)
+
+	expectEvent := func(typ, cn string) {
+		t.Helper()
+		for {
+			select {
+			case e := <-events:
+				if e.Type == typ && e.Client.CommonName == cn {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for %s of %q", typ, cn)
+			}
+		}
+	}
+	expectEvent(mgmtEventSync, "")
+
+	// a client ID we don't know connected after the last status
+	cid := server.connect("bob")
+	server.push(fmt.Sprintf(">BYTECOUNT_CLI:%d,100,200", cid))
+	expectEvent(mgmtEventConnect, "bob")
+	if _, ok := findClient(client.snapshot(), "bob"); !ok {
+		t.Error("Expected bob in the client list")
+	}
+
+	// alice doesn't send traffic counters anymore
+	server.kill("alice")
+	expectEvent(mgmtEventDisconnect, "alice")
+	if _, ok := findClient(client.snapshot(), "alice"); ok {
+		t.Error("Expected alice to be removed from the client list")
+	}
+}
+
+func TestMgmtClient_Reconnect(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	server := newFakeMgmtServer(t, "alice")
+
+	oAdmin := newTestOvpnAdmin()
+	startTestMgmt(t, oAdmin, map[string]string{"main": server.addr()}, "main")
+	eventually(t, "read the status", func() bool { return server.countCommands("status 2") == 1 })
+
+	server.dropConnections()
+	eventually(t, "forget the clients of the lost server", func() bool { return len(oAdmin.getActiveClients()) == 0 })
+	eventually(t, "reconnect and read the status again", func() bool { return server.countCommands("status 2") == 2 })
+	eventually(t, "load alice again", func() bool { return len(oAdmin.getActiveClients()) == 1 })
+}
+
+func TestMgmtRefresh_SkipsUnreachableServers(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	server := newFakeMgmtServer(t, "alice")
+
+	oAdmin := newTestOvpnAdmin()
+	// "a-down" sorts first, the old poller stopped at the first unreachable server
+	startTestMgmt(t, oAdmin, map[string]string{"a-down": "127.0.0.1:1", "main": server.addr()}, "main")
+
+	oAdmin.mgmtRefresh()
+	if clients := oAdmin.getActiveClients(); len(clients) != 1 || clients[0].ConnectedTo != "main" {
+		t.Errorf("Expected alice on main, got %+v", clients)
+	}
+}
+
+func TestMgmtUpdateClientTraffic(t *testing.T) {
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.mgmtStatusTimeFormat = "2006-01-02 15:04:05"
+	oAdmin.mgmtClients = make(map[string]*mgmtClient)
+	for _, name := range []string{"a", "b"} {
+		client := newMgmtClient(name, "", 0, oAdmin.mgmtStatusTimeFormat, nil)
+		client.clients["1"] = clientStatus{ClientID: "1", CommonName: "alice", BytesSent: "1000", BytesReceived: "10", ConnectedTo: name}
+		oAdmin.mgmtClients[name] = client
+	}
+	oAdmin.mgmtClients["b"].clients["2"] = clientStatus{ClientID: "2", CommonName: "bob", BytesSent: "5", BytesReceived: "5", ConnectedTo: "b"}
+	t.Cleanup(func() {
+		oAdmin.mgmtClients = nil
+		oAdmin.mgmtUpdateActiveClients()
+	})
+
+	oAdmin.mgmtUpdateActiveClients()
+	if got := testutil.ToFloat64(ovpnClientBytesSent.WithLabelValues("alice")); got != 2000 {
+		t.Errorf("Expected the sessions of alice summed to 2000 bytes, got %v", got)
+	}
+
+	oAdmin.mgmtUpdateClientTraffic("a", clientStatus{ClientID: "1", CommonName: "alice", BytesSent: "1500", BytesReceived: "20"})
+	if got := testutil.ToFloat64(ovpnClientBytesSent.WithLabelValues("alice")); got != 2500 {
+		t.Errorf("Expected 2500 bytes sent by alice after the traffic update, got %v", got)
+	}
+	if got := testutil.ToFloat64(ovpnClientBytesReceived.WithLabelValues("alice")); got != 30 {
+		t.Errorf("Expected 30 bytes received by alice after the traffic update, got %v", got)
+	}
+	if alice, _ := findClient(oAdmin.getActiveClients(), "alice"); alice.BytesSent != "1500" {
+		t.Errorf("Expected the active client to be updated, got %+v", alice)
+	}
+
+	delete(oAdmin.mgmtClients, "b")
+	oAdmin.mgmtUpdateActiveClients()
+	if got := testutil.ToFloat64(ovpnClientBytesSent.WithLabelValues("alice")); got != 1000 {
+		t.Errorf("Expected 1000 bytes sent by the remaining session of alice, got %v", got)
+	}
+	if n := testutil.CollectAndCount(ovpnClientBytesSent); n != 1 {
+		t.Errorf("Expected the series of bob to be deleted, got %d series", n)
+	}
+}
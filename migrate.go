@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The import and export directory has the layout of the easyrsa and ccd volumes: <dir>/pki is an easyrsa pki
+// and <dir>/ccd the client-config-dir. Keys are copied as they are, encrypted keys need the same master keys
+// in both backends. tls-crypt-v2 client keys are left behind, they carry the serial in the index.txt format of
+// their backend and are generated again on the next config download.
+
+// migrateStorage runs --storage.import or --storage.export against the kubernetes.secrets backend
+func migrateStorage() error {
+	if *storageBackend != storageKubernetes {
+		return fmt.Errorf("--storage.import and --storage.export need --storage.backend=%s", storageKubernetes)
+	}
+	if err := app.initKubeClient(); err != nil {
+		return err
+	}
+	if *storageImport != "" {
+		n, err := app.importEasyrsa(*storageImport)
+		if err != nil {
+			return fmt.Errorf("import of %s: %w", *storageImport, err)
+		}
+		log.Infof("imported the CA, the server and %d client certificate(s) from %s into namespace %s", n, *storageImport, namespace)
+		return nil
+	}
+	n, err := app.exportEasyrsa(*storageExport)
+	if err != nil {
+		return fmt.Errorf("export to %s: %w", *storageExport, err)
+	}
+	log.Infof("exported the CA, the server and %d client certificate(s) of namespace %s to %s", n, namespace, *storageExport)
+	return nil
+}
+
+// importEasyrsa creates the secrets of the PKI in dir, the namespace must not have a CA yet.
+// A raw PKI without index.txt is imported with every certificate in issued/ valid.
+// The secrets already created are deleted again when the import fails, so it can be retried.
+func (openVPNPKI *OpenVPNPKI) importEasyrsa(dir string) (n int, err error) {
+	if exists, _ := openVPNPKI.secretCheckExists(secretCA); exists {
+		return 0, fmt.Errorf("secret %s already exists, import into a namespace without a PKI", secretCA)
+	}
+	p := newFilesystemPKI(filepath.Join(dir, "pki"), filepath.Join(dir, "pki", "index.txt"))
+	p.keys = openVPNPKI.Keyring
+	if p.rolloverInProgress() {
+		return 0, errors.New("finish the CA rollover first, only the files of a single CA are imported")
+	}
+	// the CA key has to be readable with the master keys of this backend
+	if _, _, err := p.loadCA(); err != nil {
+		return 0, err
+	}
+
+	caCert, err := os.ReadFile(p.path(caCertFile))
+	if err != nil {
+		return 0, err
+	}
+	caKey, err := os.ReadFile(p.path(caKeyFile))
+	if err != nil {
+		return 0, err
+	}
+	serverCert, err := os.ReadFile(p.path("issued", serverCommonName+".crt"))
+	if err != nil {
+		return 0, fmt.Errorf("can't read the server certificate: %w", err)
+	}
+	serverKey, err := os.ReadFile(p.path("private", serverCommonName+".key"))
+	if err != nil {
+		return 0, fmt.Errorf("can't read the server key: %w", err)
+	}
+
+	lines, err := importIndex(p)
+	if err != nil {
+		return 0, err
+	}
+	// easyrsa keeps the name of a revoked certificate, ovpn-admin needs it free for the newer one
+	for i := range lines {
+		commonName := strings.TrimPrefix(lines[i].DistinguishedName, "/CN=")
+		if lines[i].Flag == "R" && indexTxtFind(lines[i+1:], commonName) >= 0 {
+			if err = p.retire(&lines[i], commonName); err != nil {
+				return 0, err
+			}
+		}
+	}
+	var clients []*v1.Secret
+	for _, line := range lines {
+		if line.DistinguishedName == "/CN="+serverCommonName {
+			continue
+		}
+		secret, err := importClientSecret(p, filepath.Join(dir, "ccd"), line)
+		if err != nil {
+			log.Warnf("import: skipping certificate %s of %s: %v", line.SerialNumber, line.Identity, err)
+			continue
+		}
+		clients = append(clients, secret)
+	}
+
+	var created []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(created) - 1; i >= 0; i-- {
+			if delErr := openVPNPKI.KubeClient.CoreV1().Secrets(namespace).Delete(context.TODO(), created[i], metav1.DeleteOptions{}); delErr != nil {
+				log.Errorf("import: can't delete secret %s, delete it before the next import: %v", created[i], delErr)
+			}
+		}
+	}()
+	secretCreate := func(objectMeta metav1.ObjectMeta, data map[string][]byte, secretType v1.SecretType) error {
+		if err := openVPNPKI.secretCreate(objectMeta, data, secretType); err != nil {
+			return err
+		}
+		created = append(created, objectMeta.Name)
+		return nil
+	}
+
+	if err = secretCreate(metav1.ObjectMeta{Name: secretCA}, map[string][]byte{
+		certFileName:    caCert,
+		privKeyFileName: caKey,
+	}, v1.SecretTypeTLS); err != nil {
+		return 0, err
+	}
+	if err = secretCreate(metav1.ObjectMeta{
+		Name: secretServer,
+		Labels: map[string]string{
+			labelKeyIndexTxt: "",
+			labelKeyName:     serverCommonName,
+			labelKeyType:     "serverAuth",
+		},
+	}, map[string][]byte{
+		certFileName:    serverCert,
+		privKeyFileName: serverKey,
+	}, v1.SecretTypeTLS); err != nil {
+		return 0, err
+	}
+	for _, secret := range clients {
+		if err = secretCreate(secret.ObjectMeta, secret.Data, v1.SecretTypeTLS); err != nil {
+			return 0, fmt.Errorf("secret (%s): %w", secret.Name, err)
+		}
+	}
+
+	// without ta.key and dh.pem the next start generates them
+	if dhAndTA := readPKIFiles(p, "ta.key", "dh.pem", tlsCryptV2ServerKeyFile); len(dhAndTA) > 0 {
+		if err = secretCreate(metav1.ObjectMeta{Name: secretDHandTA}, dhAndTA, v1.SecretTypeOpaque); err != nil {
+			return 0, err
+		}
+	}
+	if groups := readPKIFiles(p, groupsFile); len(groups) > 0 {
+		if err = secretCreate(metav1.ObjectMeta{
+			Name:   secretGroups,
+			Labels: map[string]string{labelKeyManagedBy: labelValueManagedByApp},
+		}, groups, v1.SecretTypeOpaque); err != nil {
+			return 0, err
+		}
+	}
+	// the CRL numbers continue where the easyrsa pki stopped
+	if crl := readPKIFiles(p, "crl.pem", crlNumberFile); len(crl["crl.pem"]) > 0 {
+		if err = secretCreate(metav1.ObjectMeta{Name: secretCRL}, crl, v1.SecretTypeOpaque); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = openVPNPKI.initPKI(); err != nil {
+		return 0, err
+	}
+	return len(clients), openVPNPKI.easyrsaGenCRL()
+}
+
+// importIndex returns the lines of index.txt, or a valid line for every certificate in issued/ if there is none
+func importIndex(p *filesystemPKI) ([]indexTxtLine, error) {
+	if _, err := os.Stat(p.indexPath); !errors.Is(err, os.ErrNotExist) {
+		return p.readIndex()
+	}
+	paths, err := filepath.Glob(p.path("issued", "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	var lines []indexTxtLine
+	for _, path := range paths {
+		certPEM, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := decodeCert(certPEM)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		commonName := strings.TrimSuffix(filepath.Base(path), ".crt")
+		lines = append(lines, indexTxtLine{
+			Flag:              "V",
+			ExpirationDate:    cert.NotAfter.UTC().Format(indexTxtDateLayout),
+			SerialNumber:      indexTxtSerial(cert.SerialNumber),
+			Filename:          "unknown",
+			DistinguishedName: "/CN=" + commonName,
+			Identity:          commonName,
+		})
+	}
+	return lines, nil
+}
+
+// importClientSecret returns the secret easyrsaIssueClient would have created for the index.txt line,
+// retired certificates get the labels of easyrsaDelete
+func importClientSecret(p *filesystemPKI, ccdDir string, line indexTxtLine) (*v1.Secret, error) {
+	identity := strings.TrimPrefix(line.DistinguishedName, "/CN=")
+	commonName, current := retiredCommonName(identity), false
+	if commonName == "" {
+		commonName, current = identity, true
+	}
+	cert, err := p.readCert(commonName, line.SerialNumber, current)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := line.Flag == "R"
+	at := 0
+	if revoked {
+		at = 1
+	}
+	files := p.certFiles(commonName, line.SerialNumber)
+	data := map[string][]byte{certFileName: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})}
+	key, err := readOptionalFile(files[1][at])
+	if err != nil {
+		return nil, err
+	}
+	// the TLS secret type needs the key entry, users who signed a CSR keep it instead
+	data[privKeyFileName] = append([]byte{}, key...)
+	if len(key) == 0 {
+		csr, err := readOptionalFile(files[2][at])
+		if err != nil {
+			return nil, err
+		}
+		if len(csr) > 0 {
+			data[csrFileName] = csr
+		}
+	}
+	if current {
+		if ccd, err := readOptionalFile(filepath.Join(ccdDir, commonName)); err != nil {
+			return nil, err
+		} else if len(ccd) > 0 {
+			data["ccd"] = ccd
+		}
+	}
+
+	var revokedAt string
+	if revoked {
+		revokedAt, _, _ = strings.Cut(line.RevocationDate, ",")
+	}
+	labels := map[string]string{
+		labelKeyIndexTxt:  "",
+		labelKeyType:      labelValueClientAuth,
+		labelKeyName:      identity,
+		labelKeyManagedBy: labelValueManagedByApp,
+	}
+	if !current {
+		labels["revokedForever"] = "true"
+	}
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   fmt.Sprintf(secretClientTmpl, cert.SerialNumber),
+			Labels: labels,
+			Annotations: map[string]string{
+				"commonName":   identity,
+				"notBefore":    cert.NotBefore.Format(indexTxtDateFormat),
+				"notAfter":     cert.NotAfter.Format(indexTxtDateFormat),
+				"revokedAt":    revokedAt,
+				"serialNumber": fmt.Sprintf("%d", cert.SerialNumber),
+			},
+		},
+		Data: data,
+	}, nil
+}
+
+// exportEasyrsa writes the secrets as an easyrsa pki into dir/pki and the CCD into dir/ccd.
+// The pki must not exist yet.
+func (openVPNPKI *OpenVPNPKI) exportEasyrsa(dir string) (int, error) {
+	p := newFilesystemPKI(filepath.Join(dir, "pki"), filepath.Join(dir, "pki", "index.txt"))
+	p.keys = openVPNPKI.Keyring
+	if _, err := os.Stat(p.path(caCertFile)); err == nil {
+		return 0, fmt.Errorf("%s already exists, export into an empty directory", p.path(caCertFile))
+	}
+	if exists, _ := openVPNPKI.secretCheckExists(secretCANext); exists {
+		return 0, errors.New("finish the CA rollover first, only the secrets of a single CA are exported")
+	}
+	ccdDir := filepath.Join(dir, "ccd")
+
+	ca, err := openVPNPKI.secretGetByName(secretCA)
+	if err != nil {
+		return 0, err
+	}
+	server, err := openVPNPKI.secretGetByName(secretServer)
+	if err != nil {
+		return 0, err
+	}
+	files := map[string][]byte{
+		p.path(caCertFile):                         ca.Data[certFileName],
+		p.path(caKeyFile):                          ca.Data[privKeyFileName],
+		p.path("issued", serverCommonName+".crt"):  server.Data[certFileName],
+		p.path("private", serverCommonName+".key"): server.Data[privKeyFileName],
+		p.path("index.txt.attr"):                   []byte("unique_subject = no\n"),
+	}
+	if dhAndTA, err := openVPNPKI.secretGetByName(secretDHandTA); err == nil {
+		for _, name := range []string{"ta.key", "dh.pem", tlsCryptV2ServerKeyFile} {
+			files[p.path(name)] = dhAndTA.Data[name]
+		}
+	}
+	if crl, err := openVPNPKI.secretGetByName(secretCRL); err == nil {
+		files[p.path("crl.pem")] = crl.Data["crl.pem"]
+		files[p.path(crlNumberFile)] = crl.Data[crlNumberFile]
+	}
+	if groups, err := openVPNPKI.secretGetByName(secretGroups); err == nil {
+		files[p.path(groupsFile)] = groups.Data[groupsFile]
+	}
+
+	secrets, err := openVPNPKI.secretsGetByLabels(labelKeyIndexTxt + "=")
+	if err != nil {
+		return 0, err
+	}
+	sort.SliceStable(secrets.Items, func(i, j int) bool {
+		return secrets.Items[i].Annotations["notBefore"] < secrets.Items[j].Annotations["notBefore"]
+	})
+	var lines []indexTxtLine
+	clients := 0
+	for _, secret := range secrets.Items {
+		cert, err := decodeCert(secret.Data[certFileName])
+		if err != nil {
+			log.Warnf("export: skipping secret %s: %v", secret.Name, err)
+			continue
+		}
+		serial := indexTxtSerial(cert.SerialNumber)
+		identity := secret.Annotations["commonName"]
+		if secret.Labels[labelKeyType] != labelValueClientAuth {
+			identity = serverCommonName
+		}
+		commonName := retiredCommonName(identity)
+		current := commonName == ""
+		if current {
+			commonName = identity
+		}
+		line := indexTxtLine{
+			Flag:              "V",
+			ExpirationDate:    cert.NotAfter.UTC().Format(indexTxtDateLayout),
+			SerialNumber:      serial,
+			Filename:          "unknown",
+			DistinguishedName: "/CN=" + identity,
+			Identity:          identity,
+		}
+		lines = append(lines, line)
+		if identity == serverCommonName {
+			files[p.path("certs_by_serial", serial+".pem")] = secret.Data[certFileName]
+			continue
+		}
+		clients++
+
+		// the files are where easyrsa keeps them for valid and revoked certificates
+		at := 0
+		if revokedAt := secret.Annotations["revokedAt"]; revokedAt != "" {
+			lines[len(lines)-1].Flag, lines[len(lines)-1].RevocationDate = "R", revokedAt
+			at = 1
+		} else {
+			files[p.path("certs_by_serial", serial+".pem")] = secret.Data[certFileName]
+		}
+		certFiles := p.certFiles(commonName, serial)
+		files[certFiles[0][at]] = secret.Data[certFileName]
+		files[certFiles[1][at]] = secret.Data[privKeyFileName]
+		files[certFiles[2][at]] = secret.Data[csrFileName]
+		if current {
+			files[filepath.Join(ccdDir, commonName)] = secret.Data["ccd"]
+		}
+	}
+
+	for path, content := range files {
+		if len(content) == 0 {
+			continue
+		}
+		perm := os.FileMode(0644)
+		if strings.HasSuffix(path, ".key") {
+			perm = 0600
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return 0, err
+		}
+		if err = os.WriteFile(path, content, perm); err != nil {
+			return 0, err
+		}
+	}
+	if err = p.writeIndex(lines); err != nil {
+		return 0, err
+	}
+	return clients, p.easyrsaGenCRL()
+}
+
+// readPKIFiles returns the files of the pki directory that exist and aren't empty, keyed by name
+func readPKIFiles(p *filesystemPKI, names ...string) map[string][]byte {
+	files := map[string][]byte{}
+	for _, name := range names {
+		if content, err := os.ReadFile(p.path(name)); err == nil && len(content) > 0 {
+			files[name] = content
+		}
+	}
+	return files
+}
+
+// readOptionalFile returns the content of the file, empty if it doesn't exist
+func readOptionalFile(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return content, err
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newTestMigrationPKI returns the directory of an easyrsa pki with a rotated, a CSR, a revoked and a deleted user,
+// and a user easyrsa revoked and created again under the same name
+func newTestMigrationPKI(t *testing.T) (string, *filesystemPKI) {
+	t.Helper()
+	p := newTestRolloverPKI(t, "alice", "carol", "dave", "erin")
+	dir := filepath.Dir(p.dir)
+	if err := p.easyrsaSignClient(testCSR(t, "bob"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.easyrsaRotate("alice", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.easyrsaRevoke("carol"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.easyrsaDelete("dave"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.easyrsaRevoke("erin"); err != nil {
+		t.Fatal(err)
+	}
+	lines, _ := p.readIndex()
+	erin, err := p.issue("erin", genClientCert, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.writeIndex(append(lines, erin)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "ccd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{
+		filepath.Join(dir, "ccd", "alice"): "ifconfig-push 172.16.100.10 255.255.255.0\n",
+		p.path("ta.key"):                   "ta",
+		p.path("dh.pem"):                   "dh",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.easyrsaGenCRL(); err != nil {
+		t.Fatal(err)
+	}
+	return dir, p
+}
+
+// hexIndex maps the serials of index.txt lines in hex to their flag
+func hexIndex(t *testing.T, lines []indexTxtLine, base int) map[string]string {
+	t.Helper()
+	flags := map[string]string{}
+	for _, line := range lines {
+		serial, ok := new(big.Int).SetString(line.SerialNumber, base)
+		if !ok {
+			t.Fatalf("Bad serial %q", line.SerialNumber)
+		}
+		flags[indexTxtSerial(serial)] = line.Flag
+	}
+	return flags
+}
+
+// newTestEmptyKubernetesStorage returns the kubernetes.secrets backend of a namespace without a PKI
+func newTestEmptyKubernetesStorage(t *testing.T) *OpenVPNPKI {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "pki"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldDir := *easyrsaDirPath
+	*easyrsaDirPath = dir
+	t.Cleanup(func() { *easyrsaDirPath = oldDir })
+	return &OpenVPNPKI{KubeClient: fake.NewSimpleClientset()}
+}
+
+func readCRLSerials(t *testing.T, crlPEM []byte) map[string]bool {
+	t.Helper()
+	block, _ := pem.Decode(crlPEM)
+	if block == nil {
+		t.Fatal("Expected a PEM encoded CRL")
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serials := map[string]bool{}
+	for _, entry := range crl.RevokedCertificateEntries {
+		serials[indexTxtSerial(entry.SerialNumber)] = true
+	}
+	return serials
+}
+
+func TestImportExportEasyrsa(t *testing.T) {
+	dir, p := newTestMigrationPKI(t)
+	fsStorage := &filesystemStorage{pki: p, ccdDir: filepath.Join(dir, "ccd")}
+	fsLines, _ := p.readIndex()
+	aliceCert, aliceKey, _ := fsStorage.ClientCert("alice")
+
+	k := newTestEmptyKubernetesStorage(t)
+	n, err := k.importEasyrsa(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(fsLines)-1 {
+		t.Errorf("Expected every certificate but the server one to be imported, got %d of %d", n, len(fsLines))
+	}
+	ca, _, _ := p.loadCA()
+	if !k.CACert.Equal(ca) {
+		t.Fatal("Expected the CA to be imported instead of a new one")
+	}
+	kLines, err := k.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, got := hexIndex(t, fsLines, 16), hexIndex(t, kLines, 10)
+	for serial, flag := range want {
+		if got[serial] != flag {
+			t.Errorf("Expected certificate %s to be %s, got %q", serial, flag, got[serial])
+		}
+	}
+	if cert, key, err := k.ClientCert("alice"); err != nil || cert != aliceCert || key != aliceKey {
+		t.Errorf("Expected the certificate and key of alice to be imported (%v)", err)
+	}
+	if ccd, _ := k.ReadCcd("alice"); ccd == "" {
+		t.Error("Expected the CCD of alice to be imported")
+	}
+	if _, key, err := k.ClientCert("bob"); err != nil || key != "" {
+		t.Errorf("Expected bob to have no private key, got %v", err)
+	}
+	if err := k.Rotate("bob", time.Time{}); err != nil {
+		t.Errorf("Expected bob's CSR to be imported for rotations: %v", err)
+	}
+	if certs, _ := k.Certificates("erin"); len(certs) != 2 || !certs[0].Current || certs[1].Current {
+		t.Errorf("Expected the valid erin certificate to be current and the revoked one retired, got %+v", certs)
+	}
+	crlPEM, err := k.CRL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := readCRLSerials(t, crlPEM)
+	for serial, flag := range want {
+		if flag == "R" && !revoked[serial] {
+			t.Errorf("Expected revoked certificate %s in the CRL", serial)
+		}
+	}
+	if _, err := k.importEasyrsa(dir); err == nil {
+		t.Error("Expected an import into a namespace with a CA to fail")
+	}
+
+	out := t.TempDir()
+	if n, err = k.exportEasyrsa(out); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(fsLines) {
+		t.Errorf("Expected the imported certificates and bob's rotated one to be exported, got %d", n)
+	}
+	exported := newFilesystemStorage(filepath.Join(out, "pki"), filepath.Join(out, "pki", "index.txt"), filepath.Join(out, "ccd"))
+	if cert, key, err := exported.ClientCert("alice"); err != nil || cert != aliceCert || key != aliceKey {
+		t.Errorf("Expected the certificate and key of alice to be exported (%v)", err)
+	}
+	if ccd, _ := exported.ReadCcd("alice"); ccd == "" {
+		t.Error("Expected the CCD of alice to be exported")
+	}
+	if certs, err := exported.Certificates("alice"); err != nil || len(certs) != 2 {
+		t.Errorf("Expected both certificates of alice, got %d (%v)", len(certs), err)
+	}
+	aliceSerial := indexTxtSerial(testClientCert(t, &OvpnAdmin{storage: exported}, "alice").SerialNumber)
+	if fRead(filepath.Join(out, "pki", "ta.key")) != "ta" {
+		t.Error("Expected ta.key to be exported")
+	}
+	for _, err := range []error{exported.Revoke("alice"), exported.Unrevoke("carol"), exported.Rotate("bob", time.Time{}), exported.BuildClient("frank", time.Time{})} {
+		if err != nil {
+			t.Errorf("Expected the exported pki to be usable: %v", err)
+		}
+	}
+	if crl, _ := exported.CRL(); !readCRLSerials(t, crl)[aliceSerial] {
+		t.Error("Expected the revocation of alice in the CRL of the exported pki")
+	}
+	if _, err := k.exportEasyrsa(out); err == nil {
+		t.Error("Expected an export over an existing pki to fail")
+	}
+}
+
+func TestImportEasyrsa_RawPKI(t *testing.T) {
+	p := newTestRolloverPKI(t, "alice")
+	if err := os.Remove(p.indexPath); err != nil {
+		t.Fatal(err)
+	}
+	k := newTestEmptyKubernetesStorage(t)
+
+	if n, err := k.importEasyrsa(filepath.Dir(p.dir)); err != nil || n != 1 {
+		t.Fatalf("Expected alice to be imported, got %d (%v)", n, err)
+	}
+	if _, key, err := k.ClientCert("alice"); err != nil || key == "" {
+		t.Errorf("Expected the key of alice to be imported (%v)", err)
+	}
+}
+
+func TestImportEasyrsa_FailureDeletesSecrets(t *testing.T) {
+	dir, _ := newTestMigrationPKI(t)
+	k := newTestEmptyKubernetesStorage(t)
+	client := k.KubeClient.(*fake.Clientset)
+	fail := true
+	client.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		secret := action.(k8stesting.CreateAction).GetObject().(*v1.Secret)
+		if fail && secret.Labels[labelKeyName] == "erin" {
+			return true, nil, errors.New("quota exceeded")
+		}
+		return false, nil, nil
+	})
+
+	if _, err := k.importEasyrsa(dir); err == nil {
+		t.Fatal("Expected the failed secret to fail the import")
+	}
+	if secrets, _ := client.CoreV1().Secrets(namespace).List(context.TODO(), metav1.ListOptions{}); len(secrets.Items) != 0 {
+		t.Errorf("Expected the created secrets to be deleted, got %d", len(secrets.Items))
+	}
+
+	fail = false
+	if _, err := k.importEasyrsa(dir); err != nil {
+		t.Errorf("Expected the import to be retried: %v", err)
+	}
+}
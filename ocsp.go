@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+)
+
+// RFC 6960 doesn't limit the request size, a request for a single certificate is about 100 bytes
+const ocspMaxRequestSize = 10 * 1024
+
+// ocspIssuerMatches reports whether the request asks about a certificate issued by the CA
+func ocspIssuerMatches(req *ocsp.Request, ca *x509.Certificate) bool {
+	if !req.HashAlgorithm.Available() {
+		return false
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(ca.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return false
+	}
+
+	h := req.HashAlgorithm.New()
+	h.Write(ca.RawSubject)
+	nameHash := h.Sum(nil)
+	h.Reset()
+	h.Write(spki.PublicKey.RightAlign())
+	keyHash := h.Sum(nil)
+	return bytes.Equal(nameHash, req.IssuerNameHash) && bytes.Equal(keyHash, req.IssuerKeyHash)
+}
+
+// ocspRespond answers a DER encoded OCSP request with the status the storage backend has for the certificate.
+// Responses are signed by the CA which issued the certificate.
+func (oAdmin *OvpnAdmin) ocspRespond(der []byte) ([]byte, string) {
+	req, err := ocsp.ParseRequest(der)
+	if err != nil {
+		log.Debugf("ocsp: malformed request: %v", err)
+		return ocsp.MalformedRequestErrorResponse, "malformed"
+	}
+
+	cas, caKeys, err := oAdmin.storage.CertificateAuthorities()
+	if err != nil {
+		log.Errorf("ocsp: can't load the CA: %v", err)
+		return ocsp.InternalErrorErrorResponse, "internal_error"
+	}
+	var ca *x509.Certificate
+	var caKey crypto.Signer
+	for i := range cas {
+		if ocspIssuerMatches(req, cas[i]) {
+			ca, caKey = cas[i], caKeys[i]
+		}
+	}
+	if ca == nil {
+		return ocsp.UnauthorizedErrorResponse, "unauthorized"
+	}
+
+	certStatus, err := oAdmin.storage.CertificateStatus(req.SerialNumber)
+	if err != nil {
+		log.Errorf("ocsp: can't read the status of %s: %v", indexTxtSerial(req.SerialNumber), err)
+		return ocsp.InternalErrorErrorResponse, "internal_error"
+	}
+
+	now := time.Now().UTC().Truncate(time.Minute)
+	template := ocsp.Response{
+		Status:             ocsp.Unknown,
+		SerialNumber:       req.SerialNumber,
+		ThisUpdate:         now,
+		NextUpdate:         now.Add(*ocspValidity),
+		IssuerHash:         req.HashAlgorithm,
+		SignatureAlgorithm: signatureAlgorithm(caKey),
+	}
+	status := "unknown"
+	switch {
+	case certStatus == nil:
+	case !certStatus.RevokedAt.IsZero():
+		template.Status = ocsp.Revoked
+		template.RevokedAt = certStatus.RevokedAt
+		template.RevocationReason = ocsp.Unspecified
+		status = "revoked"
+	default:
+		template.Status = ocsp.Good
+		status = "good"
+	}
+
+	resp, err := ocsp.CreateResponse(ca, ca, template, caKey)
+	if err != nil {
+		log.Errorf("ocsp: can't sign the response (Ed25519 CAs are not supported): %v", err)
+		return ocsp.InternalErrorErrorResponse, "internal_error"
+	}
+	return resp, status
+}
+
+// ocspHandler serves OCSP requests as POST bodies or base64 encoded in the URL of a GET (RFC 6960 appendix A)
+func (oAdmin *OvpnAdmin) ocspHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+
+	var der []byte
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		der, err = io.ReadAll(io.LimitReader(r.Body, ocspMaxRequestSize+1))
+		if err == nil && len(der) > ocspMaxRequestSize {
+			err = errors.New("request too large")
+		}
+	case http.MethodGet:
+		encoded := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, *listenBaseUrl), "/")
+		encoded = strings.TrimPrefix(strings.TrimPrefix(encoded, "ocsp"), "/")
+		if encoded, err = url.PathUnescape(encoded); err == nil {
+			der, err = base64.StdEncoding.DecodeString(encoded)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp, status := ocsp.MalformedRequestErrorResponse, "malformed"
+	if err != nil {
+		log.Debugf("ocsp: can't read request: %v", err)
+	} else {
+		resp, status = oAdmin.ocspRespond(der)
+	}
+	ovpnOCSPRequests.WithLabelValues(status).Inc()
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	if r.Method == http.MethodGet && (status == "good" || status == "revoked" || status == "unknown") {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(ocspValidity.Seconds())))
+	}
+	_, _ = w.Write(resp)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func newTestOCSPAdmin(t *testing.T) (*OvpnAdmin, *filesystemPKI) {
+	t.Helper()
+	oldValidity := *ocspValidity
+	*ocspValidity = time.Hour
+	t.Cleanup(func() { *ocspValidity = oldValidity })
+	setTestSignatureHash(t, "sha256")
+
+	p := newTestPKI(t)
+	for _, name := range []string{"alice", "bob"} {
+		if err := p.easyrsaBuildClient(name, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.storage = &filesystemStorage{pki: p, ccdDir: t.TempDir()}
+	return oAdmin, p
+}
+
+func testClientCert(t *testing.T, oAdmin *OvpnAdmin, name string) *x509.Certificate {
+	t.Helper()
+	certPEM, _, err := oAdmin.storage.ClientCert(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := decodeCert([]byte(certPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func postOCSP(t *testing.T, oAdmin *OvpnAdmin, cert, issuer *x509.Certificate) *httptest.ResponseRecorder {
+	t.Helper()
+	req, err := ocsp.CreateRequest(cert, issuer, &ocsp.RequestOptions{Hash: crypto.SHA1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	oAdmin.ocspHandler(w, httptest.NewRequest(http.MethodPost, "/ocsp", bytes.NewReader(req)))
+	if ct := w.Header().Get("Content-Type"); ct != "application/ocsp-response" {
+		t.Errorf("Expected an OCSP response, got %q", ct)
+	}
+	return w
+}
+
+func TestOCSPHandler(t *testing.T) {
+	oAdmin, p := newTestOCSPAdmin(t)
+	ca, _, _ := p.loadCA()
+	alice := testClientCert(t, oAdmin, "alice")
+	bob := testClientCert(t, oAdmin, "bob")
+	if err := oAdmin.storage.Revoke("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cert   *x509.Certificate
+		status int
+	}{
+		{"good", alice, ocsp.Good},
+		{"revoked", bob, ocsp.Revoked},
+		{"unknown", &x509.Certificate{SerialNumber: new(big.Int).Add(alice.SerialNumber, bob.SerialNumber)}, ocsp.Unknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postOCSP(t, oAdmin, tt.cert, ca)
+			resp, err := ocsp.ParseResponse(w.Body.Bytes(), ca)
+			if err != nil {
+				t.Fatalf("Expected a response signed by the CA: %v", err)
+			}
+			if resp.Status != tt.status || resp.SerialNumber.Cmp(tt.cert.SerialNumber) != 0 {
+				t.Errorf("Expected status %d, got %d", tt.status, resp.Status)
+			}
+			if got := resp.NextUpdate.Sub(resp.ThisUpdate); got != time.Hour {
+				t.Errorf("Expected responses to be valid for an hour, got %v", got)
+			}
+			if tt.status == ocsp.Revoked && resp.RevokedAt.IsZero() {
+				t.Error("Expected a revocation time")
+			}
+		})
+	}
+}
+
+func TestOCSPHandler_Errors(t *testing.T) {
+	oAdmin, _ := newTestOCSPAdmin(t)
+	alice := testClientCert(t, oAdmin, "alice")
+
+	otherCA, _ := newTestCA(t, keyAlgoRSA2048)
+	if w := postOCSP(t, oAdmin, alice, otherCA); !bytes.Equal(w.Body.Bytes(), ocsp.UnauthorizedErrorResponse) {
+		t.Errorf("Expected unauthorized for a foreign issuer, got %x", w.Body.Bytes())
+	}
+
+	w := httptest.NewRecorder()
+	oAdmin.ocspHandler(w, httptest.NewRequest(http.MethodPost, "/ocsp", bytes.NewReader([]byte("garbage"))))
+	if !bytes.Equal(w.Body.Bytes(), ocsp.MalformedRequestErrorResponse) {
+		t.Errorf("Expected malformed request, got %x", w.Body.Bytes())
+	}
+
+	w = httptest.NewRecorder()
+	oAdmin.ocspHandler(w, httptest.NewRequest(http.MethodPut, "/ocsp", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", w.Code)
+	}
+}
+
+// RFC 6960 appendix A.1, GET requests carry the url encoded base64 request in the path
+func TestOCSPHandler_Get(t *testing.T) {
+	oAdmin, p := newTestOCSPAdmin(t)
+	ca, _, _ := p.loadCA()
+	alice := testClientCert(t, oAdmin, "alice")
+
+	req, err := ocsp.CreateRequest(alice, ca, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	oAdmin.ocspHandler(w, httptest.NewRequest(http.MethodGet, "/ocsp/"+url.PathEscape(base64.StdEncoding.EncodeToString(req)), nil))
+	resp, err := ocsp.ParseResponseForCert(w.Body.Bytes(), alice, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != ocsp.Good {
+		t.Errorf("Expected alice to be good, got %d", resp.Status)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "max-age=3600" {
+		t.Errorf("Expected the response to be cacheable, got %q", cc)
+	}
+}
+
+func TestGenClientCert_OCSPServer(t *testing.T) {
+	oAdmin, _ := newTestOCSPAdmin(t)
+	oldURL := *ocspURL
+	*ocspURL = "http://vpn.example.com/ocsp"
+	t.Cleanup(func() { *ocspURL = oldURL })
+
+	if got := testClientCert(t, oAdmin, "alice").OCSPServer; len(got) != 0 {
+		t.Errorf("Expected certificates issued without --ocsp.url to have no OCSP server, got %v", got)
+	}
+	if err := oAdmin.storage.BuildClient("carol", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := testClientCert(t, oAdmin, "carol").OCSPServer; len(got) != 1 || got[0] != *ocspURL {
+		t.Errorf("Expected the OCSP server in the certificate, got %v", got)
+	}
+}
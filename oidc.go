@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcStateCookieName = "ovpn_admin_oidc_state"
+	oidcLoginTimeout    = 10 * time.Minute
+)
+
+// oidcPendingLogin keeps everything needed to finish an authorization-code flow started by the browser
+type oidcPendingLogin struct {
+	Verifier string
+	Nonce    string
+	Next     string
+	Expires  time.Time
+}
+
+type oidcAuth struct {
+	verifier      *oidc.IDTokenVerifier
+	oauth2Config  oauth2.Config
+	usernameClaim string
+	groupsClaim   string
+	roleMapping   map[string]string
+
+	mu      sync.Mutex
+	pending map[string]oidcPendingLogin
+}
+
+// parseRoleMapping parses "group=role" pairs
+func parseRoleMapping(values []string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, value := range values {
+		group, role, found := strings.Cut(value, "=")
+		group = strings.TrimSpace(group)
+		role = strings.TrimSpace(role)
+		if !found || group == "" {
+			return nil, fmt.Errorf("invalid role mapping %q, expected group=role", value)
+		}
+		if _, ok := uiRoleLevels[role]; !ok {
+			return nil, fmt.Errorf("invalid role mapping %q: unknown role %q", value, role)
+		}
+		mapping[group] = role
+	}
+	return mapping, nil
+}
+
+// newOIDCAuth discovers the provider configuration from the issuer
+func newOIDCAuth(ctx context.Context, issuerURL, clientID, clientSecret, redirectURL string, scopes []string, usernameClaim, groupsClaim string, roleMapping []string) (*oidcAuth, error) {
+	mapping, err := parseRoleMapping(roleMapping)
+	if err != nil {
+		return nil, err
+	}
+	if len(mapping) == 0 {
+		return nil, errors.New("at least one group to role mapping is required")
+	}
+
+	provider, err := oidc.NewProvider(ctx, issuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("provider discovery failed: %w", err)
+	}
+
+	hasOpenID := false
+	for _, scope := range scopes {
+		if scope == oidc.ScopeOpenID {
+			hasOpenID = true
+		}
+	}
+	if !hasOpenID {
+		scopes = append([]string{oidc.ScopeOpenID}, scopes...)
+	}
+
+	return &oidcAuth{
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+		oauth2Config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       scopes,
+		},
+		usernameClaim: usernameClaim,
+		groupsClaim:   groupsClaim,
+		roleMapping:   mapping,
+		pending:       make(map[string]oidcPendingLogin),
+	}, nil
+}
+
+// startLogin registers a new pending login and returns its state and the provider URL to redirect to
+func (o *oidcAuth) startLogin(next string) (string, string, error) {
+	state, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	o.mu.Lock()
+	now := time.Now()
+	for s, p := range o.pending {
+		if now.After(p.Expires) {
+			delete(o.pending, s)
+		}
+	}
+	o.pending[state] = oidcPendingLogin{Verifier: verifier, Nonce: nonce, Next: next, Expires: now.Add(oidcLoginTimeout)}
+	o.mu.Unlock()
+
+	authURL := o.oauth2Config.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oidc.Nonce(nonce))
+	return state, authURL, nil
+}
+
+// finishLogin removes the pending login, a state can be used only once
+func (o *oidcAuth) finishLogin(state string) (oidcPendingLogin, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	pending, found := o.pending[state]
+	delete(o.pending, state)
+	if !found || time.Now().After(pending.Expires) {
+		return oidcPendingLogin{}, false
+	}
+	return pending, true
+}
+
+// claimStrings returns a claim as a list, a single string is treated as a list with one element
+func claimStrings(claims map[string]interface{}, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// roleForGroups returns the highest role mapped to any of the groups
+func (o *oidcAuth) roleForGroups(groups []string) string {
+	role := ""
+	for _, group := range groups {
+		if mapped, ok := o.roleMapping[group]; ok && uiRoleLevels[mapped] > uiRoleLevels[role] {
+			role = mapped
+		}
+	}
+	return role
+}
+
+// exchange redeems the code with the PKCE verifier and returns the verified user name and groups
+func (o *oidcAuth) exchange(ctx context.Context, code string, pending oidcPendingLogin) (string, []string, error) {
+	token, err := o.oauth2Config.Exchange(ctx, code, oauth2.VerifierOption(pending.Verifier))
+	if err != nil {
+		return "", nil, fmt.Errorf("code exchange failed: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", nil, errors.New("no id_token in token response")
+	}
+	idToken, err := o.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return "", nil, fmt.Errorf("id_token verification failed: %w", err)
+	}
+	if idToken.Nonce != pending.Nonce {
+		return "", nil, errors.New("id_token nonce mismatch")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return "", nil, err
+	}
+
+	username := ""
+	if names := claimStrings(claims, o.usernameClaim); len(names) > 0 {
+		username = names[0]
+	}
+	if username == "" {
+		username = idToken.Subject
+	}
+
+	return username, claimStrings(claims, o.groupsClaim), nil
+}
+
+func (oAdmin *OvpnAdmin) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if oAdmin.oidc == nil || oAdmin.auth == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	state, authURL, err := oAdmin.oidc.startLogin(safeRedirectTarget(r.URL.Query().Get("next")))
+	if err != nil {
+		log.Errorf("oidc: can't start login: %v", err)
+		http.Error(w, "Can't start login", http.StatusInternalServerError)
+		return
+	}
+
+	// binds the state to the browser which started the login
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     *listenBaseUrl,
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (oAdmin *OvpnAdmin) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.URL.Path)
+	if oAdmin.oidc == nil || oAdmin.auth == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookieName, Value: "", Path: *listenBaseUrl, MaxAge: -1})
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		log.Warnf("oidc: provider returned error %q: %s", errCode, query.Get("error_description"))
+		http.Error(w, "Login failed: "+errCode, http.StatusUnauthorized)
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if state == "" || err != nil || cookie.Value != state {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	pending, ok := oAdmin.oidc.finishLogin(state)
+	if !ok {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	username, groups, err := oAdmin.oidc.exchange(r.Context(), query.Get("code"), pending)
+	if err != nil {
+		log.Warnf("oidc: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	role := oAdmin.oidc.roleForGroups(groups)
+	if role == "" {
+		log.Warnf("oidc: %s has no mapped role, groups: %v", username, groups)
+		http.Error(w, fmt.Sprintf("User %s is not allowed to use ovpn-admin", username), http.StatusForbidden)
+		return
+	}
+
+	token, session, err := oAdmin.auth.createSession(username, role)
+	if err != nil {
+		log.Errorf("ui auth: can't create session: %v", err)
+		http.Error(w, "Can't create session", http.StatusInternalServerError)
+		return
+	}
+	oAdmin.setSessionCookie(w, r, token, session.Expires)
+	log.Infof("oidc: %s (%s) logged in from %s", username, role, r.RemoteAddr)
+	http.Redirect(w, r, pending.Next, http.StatusSeeOther)
+}
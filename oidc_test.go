@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// fakeOIDCProvider is a minimal in-process OpenID Connect provider supporting the authorization-code flow with PKCE
+type fakeOIDCProvider struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+	secret   string
+	groups   []string
+
+	mu    sync.Mutex
+	codes map[string]fakeOIDCCode
+}
+
+type fakeOIDCCode struct {
+	challenge string
+	nonce     string
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &fakeOIDCProvider{key: key, clientID: "ovpn-admin", secret: "client-secret", codes: make(map[string]fakeOIDCCode)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/keys", p.keys)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *fakeOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.server.URL,
+		"authorization_endpoint":                p.server.URL + "/authorize",
+		"token_endpoint":                        p.server.URL + "/token",
+		"jwks_uri":                              p.server.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *fakeOIDCProvider) keys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &p.key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+	}})
+}
+
+// authorize approves every request immediately and redirects back with a code
+func (p *fakeOIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "PKCE required", http.StatusBadRequest)
+		return
+	}
+
+	code, _ := randomToken()
+	p.mu.Lock()
+	p.codes[code] = fakeOIDCCode{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+	p.mu.Unlock()
+
+	redirect, _ := url.Parse(q.Get("redirect_uri"))
+	values := redirect.Query()
+	values.Set("code", code)
+	values.Set("state", q.Get("state"))
+	redirect.RawQuery = values.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *fakeOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	if clientID, secret, ok := r.BasicAuth(); !ok || clientID != p.clientID || secret != p.secret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	p.mu.Lock()
+	code, found := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !found || base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: p.key}, (&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":                p.server.URL,
+		"sub":                "1234",
+		"aud":                p.clientID,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              code.nonce,
+		"preferred_username": "jdoe",
+		"groups":             p.groups,
+	})
+	signed, err := signer.Sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	idToken, _ := signed.CompactSerialize()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func newTestOIDCAdmin(t *testing.T, provider *fakeOIDCProvider) *OvpnAdmin {
+	t.Helper()
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.auth = newUIAuth(time.Hour)
+
+	var err error
+	oAdmin.oidc, err = newOIDCAuth(context.Background(), provider.server.URL, provider.clientID, provider.secret,
+		"http://ovpn-admin.test/oidc/callback", []string{"profile", "groups"}, "preferred_username", "groups",
+		[]string{"vpn-viewers=viewer", "vpn-admins=admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oAdmin
+}
+
+// oidcLogin runs the browser side of the flow and returns the callback response
+func oidcLogin(t *testing.T, oAdmin *OvpnAdmin, provider *fakeOIDCProvider) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	oAdmin.oidcLoginHandler(w, httptest.NewRequest(http.MethodGet, "/oidc/login?next=/users", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected redirect to the provider, got %d", w.Code)
+	}
+	stateCookies := w.Result().Cookies()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Provider rejected the authorization request: %d", resp.StatusCode)
+	}
+
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+	req := httptest.NewRequest(http.MethodGet, "/oidc/callback?"+callback.RawQuery, nil)
+	for _, c := range stateCookies {
+		req.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	oAdmin.oidcCallbackHandler(w, req)
+	return w
+}
+
+func sessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookieName && c.Value != "" {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestParseRoleMapping(t *testing.T) {
+	mapping, err := parseRoleMapping([]string{"vpn-admins=admin", " ops = operator "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping["vpn-admins"] != uiRoleAdmin || mapping["ops"] != uiRoleOperator {
+		t.Errorf("Unexpected mapping: %v", mapping)
+	}
+
+	for _, invalid := range []string{"vpn-admins", "=admin", "vpn-admins=root"} {
+		if _, err := parseRoleMapping([]string{invalid}); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+}
+
+func TestRoleForGroups_HighestWins(t *testing.T) {
+	o := &oidcAuth{roleMapping: map[string]string{"a": uiRoleViewer, "b": uiRoleAdmin, "c": uiRoleOperator}}
+	if role := o.roleForGroups([]string{"a", "c", "b"}); role != uiRoleAdmin {
+		t.Errorf("Expected admin, got %q", role)
+	}
+	if role := o.roleForGroups([]string{"unknown"}); role != "" {
+		t.Errorf("Expected no role, got %q", role)
+	}
+}
+
+func TestOIDCLogin_Success(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	provider.groups = []string{"staff", "vpn-admins"}
+	oAdmin := newTestOIDCAdmin(t, provider)
+
+	w := oidcLogin(t, oAdmin, provider)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/users" {
+		t.Fatalf("Expected redirect to /users, got %d %s (%s)", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+	cookie := sessionCookie(w)
+	if cookie == nil {
+		t.Fatal("Expected session cookie")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	session, ok := oAdmin.requestSession(req)
+	if !ok || session.Username != "jdoe" || session.Role != uiRoleAdmin {
+		t.Errorf("Unexpected session: %+v", session)
+	}
+}
+
+func TestOIDCLogin_UnmappedGroup(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	provider.groups = []string{"staff"}
+	oAdmin := newTestOIDCAdmin(t, provider)
+
+	w := oidcLogin(t, oAdmin, provider)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected status 403, got %d", w.Code)
+	}
+	if sessionCookie(w) != nil {
+		t.Error("No session should be created without a mapped role")
+	}
+}
+
+func TestOIDCCallback_StateMismatch(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	oAdmin := newTestOIDCAdmin(t, provider)
+
+	req := httptest.NewRequest(http.MethodGet, "/oidc/callback?code=abc&state=forged", nil)
+	req.AddCookie(&http.Cookie{Name: oidcStateCookieName, Value: "other"})
+	w := httptest.NewRecorder()
+	oAdmin.oidcCallbackHandler(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+}
+
+func TestOIDCExchange_WrongVerifier(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	provider.groups = []string{"vpn-admins"}
+	oAdmin := newTestOIDCAdmin(t, provider)
+
+	_, authURL, err := oAdmin.oidc.startLogin("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+
+	pending, ok := oAdmin.oidc.finishLogin(callback.Query().Get("state"))
+	if !ok {
+		t.Fatal("Expected pending login")
+	}
+	pending.Verifier = "not-the-original-verifier-not-the-original-verifier"
+	if _, _, err := oAdmin.oidc.exchange(context.Background(), callback.Query().Get("code"), pending); err == nil {
+		t.Error("Expected code exchange to fail with a wrong PKCE verifier")
+	}
+}
+
+func TestOIDC_IndexAndUserActionsRequireSession(t *testing.T) {
+	setTestIndexTxt(t, testIndexTxt)
+	provider := newFakeOIDCProvider(t)
+	provider.groups = []string{"vpn-viewers"}
+	oAdmin := newTestOIDCAdmin(t, provider)
+
+	index := oAdmin.requirePermission(permView, oAdmin.indexPageHandler)
+	revoke := oAdmin.requirePermission(userActionPermission("revoke", http.MethodPost), oAdmin.userRevokeHandler)
+
+	w := httptest.NewRecorder()
+	index(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("Expected index to redirect to login without a session, got %d", w.Code)
+	}
+
+	cookie := sessionCookie(oidcLogin(t, oAdmin, provider))
+	if cookie == nil {
+		t.Fatal("Expected session cookie")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	index(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected index with a session to render, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/users/alice/revoke", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	revoke(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected viewer to be denied revoke, got %d", w.Code)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"unicode/utf16"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+var (
+	oidDataContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS8ShroudedKeyBag = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidFriendlyName        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidSHA1                = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+type pkcs12PFX struct {
+	Version  int
+	AuthSafe pkcs12ContentInfo
+	MacData  pkcs12MacData
+}
+
+type pkcs12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type pkcs12MacData struct {
+	Mac        pkcs12DigestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type pkcs12DigestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type pkcs12SafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+// encodePKCS12 bundles the key, the certificate and the CA chain into a PKCS#12 (RFC 7292) file with the key named friendlyName.
+// Bundles are encrypted with 3DES and authenticated with HMAC-SHA1, like openssl pkcs12 -export -legacy does.
+// The macOS keychain, older Windows releases and most routers can't read the AES encrypted bundles of OpenSSL 3.
+func encodePKCS12(key crypto.Signer, cert *x509.Certificate, caCerts []*x509.Certificate, friendlyName, password string) ([]byte, error) {
+	pfxData, err := pkcs12.Legacy.Encode(key, cert, caCerts, password)
+	if err != nil || friendlyName == "" {
+		return pfxData, err
+	}
+	return pkcs12NameKey(pfxData, friendlyName, password)
+}
+
+// pkcs12NameKey adds the friendlyName attribute to the key bag, go-pkcs12 doesn't name bags.
+// The key bag is outside the encrypted certificates, only the MAC over the contents has to be computed again.
+func pkcs12NameKey(pfxData []byte, friendlyName, password string) ([]byte, error) {
+	var pfx pkcs12PFX
+	if _, err := asn1.Unmarshal(pfxData, &pfx); err != nil {
+		return nil, err
+	}
+	if !pfx.MacData.Mac.Algorithm.Algorithm.Equal(oidSHA1) {
+		return nil, fmt.Errorf("unexpected PKCS#12 MAC algorithm %s", pfx.MacData.Mac.Algorithm.Algorithm)
+	}
+	var authenticatedSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafe); err != nil {
+		return nil, err
+	}
+	var contents []pkcs12ContentInfo
+	if _, err := asn1.Unmarshal(authenticatedSafe, &contents); err != nil {
+		return nil, err
+	}
+
+	name, err := pkcs12FriendlyName(friendlyName)
+	if err != nil {
+		return nil, err
+	}
+	for i, content := range contents {
+		if !content.ContentType.Equal(oidDataContentType) {
+			continue
+		}
+		var safeContents []byte
+		if _, err := asn1.Unmarshal(content.Content.Bytes, &safeContents); err != nil {
+			return nil, err
+		}
+		var bags []pkcs12SafeBag
+		if _, err := asn1.Unmarshal(safeContents, &bags); err != nil {
+			return nil, err
+		}
+		for j := range bags {
+			if bags[j].ID.Equal(oidPKCS8ShroudedKeyBag) {
+				bags[j].Attributes = append(bags[j].Attributes, name)
+			}
+		}
+		if safeContents, err = asn1.Marshal(bags); err != nil {
+			return nil, err
+		}
+		data, err := asn1.Marshal(safeContents)
+		if err != nil {
+			return nil, err
+		}
+		contents[i].Content = asn1Explicit(data)
+	}
+
+	if authenticatedSafe, err = asn1.Marshal(contents); err != nil {
+		return nil, err
+	}
+	authSafe, err := asn1.Marshal(authenticatedSafe)
+	if err != nil {
+		return nil, err
+	}
+	pfx.AuthSafe.Content = asn1Explicit(authSafe)
+
+	mac := hmac.New(sha1.New, pkcs12KDF(pfx.MacData.MacSalt, bmpString(password), pfx.MacData.Iterations, 3, sha1.Size))
+	mac.Write(authenticatedSafe)
+	pfx.MacData.Mac.Digest = mac.Sum(nil)
+	return asn1.Marshal(pfx)
+}
+
+// asn1Explicit wraps DER bytes in the [0] EXPLICIT tag PKCS#7 and PKCS#12 use for their content
+func asn1Explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// pkcs12FriendlyName names a bag in the keychain
+func pkcs12FriendlyName(friendlyName string) (pkcs12Attribute, error) {
+	// BMPString, without the terminating zero of the password encoding
+	name := bmpString(friendlyName)
+	nameDER, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: name[:len(name)-2]})
+	if err != nil {
+		return pkcs12Attribute{}, err
+	}
+	return pkcs12Attribute{ID: oidFriendlyName, Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: nameDER}}, nil
+}
+
+// bmpString encodes the password like PKCS#12 expects it, UTF-16BE with a terminating zero
+func bmpString(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return append(b, 0, 0)
+}
+
+// pkcs12KDF derives MAC keys (id 3) from the password with SHA-1, RFC 7292 appendix B.2
+func pkcs12KDF(salt, password []byte, iterations int, id byte, size int) []byte {
+	const u, v = sha1.Size, 64
+
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	D := bytes.Repeat([]byte{id}, v)
+	I := append(fill(salt), fill(password)...)
+
+	var key []byte
+	for len(key) < size {
+		A := sha1.Sum(append(bytes.Clone(D), I...))
+		for i := 1; i < iterations; i++ {
+			A = sha1.Sum(A[:])
+		}
+		key = append(key, A[:]...)
+
+		// I_j = (I_j + B + 1) mod 2^(8v) for every v byte block of I
+		B := new(big.Int).SetBytes(fill(A[:u]))
+		B.Add(B, big.NewInt(1))
+		for j := 0; j < len(I); j += v {
+			Ij := new(big.Int).SetBytes(I[j : j+v])
+			sum := Ij.Add(Ij, B).Bytes()
+			if len(sum) > v {
+				sum = sum[len(sum)-v:]
+			}
+			block := I[j : j+v]
+			for k := range block {
+				block[k] = 0
+			}
+			copy(block[v-len(sum):], sum)
+		}
+	}
+	return key[:size]
+}
@@ -0,0 +1,726 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// filesystemPKI issues, revokes and rotates client certificates in Go for the filesystem storage backend.
+// It keeps the easyrsa layout under the pki directory, so easyrsa and openvpn keep working with the same files.
+type filesystemPKI struct {
+	mu        sync.Mutex
+	dir       string
+	indexPath string
+	// keys encrypts the client and CA keys in private/, nil keeps them in plaintext
+	keys *keyring
+}
+
+func newFilesystemPKI(dir, indexPath string) *filesystemPKI {
+	return &filesystemPKI{dir: dir, indexPath: indexPath}
+}
+
+func (p *filesystemPKI) path(elem ...string) string {
+	return filepath.Join(append([]string{p.dir}, elem...)...)
+}
+
+// loadCA reads the CA new certificates are signed with. It is the CA made by easyrsa build-ca, or the new CA while
+// a rollover is in progress. It is read on every use because the openvpn container may create the pki after ovpn-admin has started.
+func (p *filesystemPKI) loadCA() (*x509.Certificate, crypto.Signer, error) {
+	if p.rolloverInProgress() {
+		return p.loadCAFiles(caNextCertFile, caNextKeyFile)
+	}
+	return p.loadCAFiles(caCertFile, caKeyFile)
+}
+
+// loadCAs returns every CA certificates are trusted from, the current CA comes first
+func (p *filesystemPKI) loadCAs() ([]*x509.Certificate, []crypto.Signer, error) {
+	cert, key, err := p.loadCAFiles(caCertFile, caKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	certs, keys := []*x509.Certificate{cert}, []crypto.Signer{key}
+	if p.rolloverInProgress() {
+		cert, key, err = p.loadCAFiles(caNextCertFile, caNextKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs, keys = append(certs, cert), append(keys, key)
+	}
+	return certs, keys, nil
+}
+
+// loadCAFiles reads a CA certificate and key, the certificate is the first one of the file
+func (p *filesystemPKI) loadCAFiles(certFile, keyFile string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := os.ReadFile(p.path(certFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't read CA certificate: %w", err)
+	}
+	cert, err := decodeCert(certPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't parse CA certificate: %w", err)
+	}
+
+	keyPEM, err := os.ReadFile(p.path(keyFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't read CA key: %w", err)
+	}
+	if keyPEM, err = p.keys.open(keyPEM); err != nil {
+		return nil, nil, fmt.Errorf("can't decrypt CA key: %w", err)
+	}
+	key, err := decodePrivKey(keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't parse CA key (it must be an unencrypted key): %w", err)
+	}
+	return cert, key, nil
+}
+
+func (p *filesystemPKI) readIndex() ([]indexTxtLine, error) {
+	content, err := os.ReadFile(p.indexPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return indexTxtParser(string(content)), nil
+}
+
+func (p *filesystemPKI) writeIndex(lines []indexTxtLine) error {
+	return fWriteAtomic(p.indexPath, []byte(renderIndexTxt(lines)), 0644)
+}
+
+// indexTxtFind returns the position of the certificate of the user, -1 if there is none
+func indexTxtFind(lines []indexTxtLine, commonName string) int {
+	for i := range lines {
+		if lines[i].DistinguishedName == "/CN="+commonName {
+			return i
+		}
+	}
+	return -1
+}
+
+// indexTxtSerial formats a serial the way openssl writes it to index.txt
+func indexTxtSerial(serial *big.Int) string {
+	hex := strings.ToUpper(serial.Text(16))
+	if len(hex)%2 != 0 {
+		hex = "0" + hex
+	}
+	return hex
+}
+
+// indexTxtRevocation parses the revocation date of index.txt, openssl may append the reason to it
+func indexTxtRevocation(date string) (time.Time, string, error) {
+	date, reason, _ := strings.Cut(date, ",")
+	revokedAt, err := time.Parse(indexTxtDateLayout, date)
+	return revokedAt, reason, err
+}
+
+// readCert returns the certificate with the serial, the current one is in issued/ and revoked ones are moved into revoked/
+func (p *filesystemPKI) readCert(commonName, serial string, current bool) (*x509.Certificate, error) {
+	paths := []string{p.path("certs_by_serial", serial+".pem"), p.path("renewed", "certs_by_serial", serial+".crt"), p.path("revoked", "certs_by_serial", serial+".crt")}
+	if current {
+		paths = append([]string{p.path("issued", commonName+".crt")}, paths...)
+	}
+	for _, path := range paths {
+		certPEM, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		cert, err := decodeCert(certPEM)
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(indexTxtSerial(cert.SerialNumber), serial) {
+			return cert, nil
+		}
+	}
+	return nil, errors.New("certificate file not found")
+}
+
+// certFiles maps the files easyrsa keeps for an issued certificate to the place revoke moves them to
+func (p *filesystemPKI) certFiles(commonName, serial string) [][2]string {
+	return [][2]string{
+		{p.path("issued", commonName+".crt"), p.path("revoked", "certs_by_serial", serial+".crt")},
+		{p.path("private", commonName+".key"), p.path("revoked", "private_by_serial", serial+".key")},
+		{p.path("reqs", commonName+".req"), p.path("revoked", "reqs_by_serial", serial+".req")},
+	}
+}
+
+// renewedCertFiles maps the files renew moves into renewed/, like easyrsa renew does, to the place revoke moves them to
+func (p *filesystemPKI) renewedCertFiles(serial string) [][2]string {
+	return [][2]string{
+		{p.path("renewed", "certs_by_serial", serial+".crt"), p.path("revoked", "certs_by_serial", serial+".crt")},
+		{p.path("renewed", "private_by_serial", serial+".key"), p.path("revoked", "private_by_serial", serial+".key")},
+		{p.path("renewed", "reqs_by_serial", serial+".req"), p.path("revoked", "reqs_by_serial", serial+".req")},
+	}
+}
+
+// renameFiles moves every file from the first path of the pair to the second, or back, files that don't exist are skipped
+func renameFiles(pairs [][2]string, back bool) error {
+	for _, files := range pairs {
+		src, dst := files[0], files[1]
+		if back {
+			src, dst = dst, src
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(src, dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveCertFiles moves the files of a certificate into revoked/ or back, files that don't exist are skipped
+func (p *filesystemPKI) moveCertFiles(commonName, serial string, toRevoked bool) error {
+	if err := renameFiles(p.certFiles(commonName, serial), !toRevoked); err != nil {
+		return err
+	}
+
+	bySerial := p.path("certs_by_serial", serial+".pem")
+	if toRevoked {
+		if err := os.Remove(bySerial); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	cert, err := os.ReadFile(p.path("issued", commonName+".crt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(bySerial, cert, 0644)
+}
+
+// certGenerator signs a client or server certificate for the public key, genClientCert or genServerCert
+type certGenerator func(pub crypto.PublicKey, caPrivKey crypto.Signer, ca *x509.Certificate, cn string) (*bytes.Buffer, error)
+
+// issue writes the key, request and certificate of a new client or server and returns its index.txt line.
+// The key uses --pki.key-algo whatever the algorithm of the CA key is. With a CSR the certificate is issued
+// for the key of the CSR and no private key is written, the user keeps it. Client keys are encrypted with the
+// master keys, the server key stays readable for OpenVPN.
+func (p *filesystemPKI) issue(commonName string, genCert certGenerator, csr *x509.CertificateRequest) (line indexTxtLine, err error) {
+	ca, caKey, err := p.loadCA()
+	if err != nil {
+		return
+	}
+
+	var keyPEM, reqPEM *bytes.Buffer
+	var pub crypto.PublicKey
+	if csr != nil {
+		reqPEM, pub = encodeCSR(csr), csr.PublicKey
+	} else {
+		if keyPEM, err = genPrivKey(*pkiKeyAlgo); err != nil {
+			return
+		}
+		var key crypto.Signer
+		if key, err = decodePrivKey(keyPEM.Bytes()); err != nil {
+			return
+		}
+		if reqPEM, err = genCSR(key, commonName); err != nil {
+			return
+		}
+		pub = key.Public()
+	}
+	certPEM, err := genCert(pub, caKey, ca, commonName)
+	if err != nil {
+		return
+	}
+	cert, err := decodeCert(certPEM.Bytes())
+	if err != nil {
+		return
+	}
+	serial := indexTxtSerial(cert.SerialNumber)
+
+	type file struct {
+		path    string
+		content []byte
+		perm    os.FileMode
+	}
+	files := []file{
+		{p.path("reqs", commonName+".req"), reqPEM.Bytes(), 0644},
+		{p.path("issued", commonName+".crt"), certPEM.Bytes(), 0644},
+		{p.path("certs_by_serial", serial+".pem"), certPEM.Bytes(), 0644},
+	}
+	if keyPEM != nil {
+		key := keyPEM.Bytes()
+		if commonName != serverCommonName {
+			if key, err = p.keys.seal(key); err != nil {
+				return
+			}
+		}
+		files = append(files, file{p.path("private", commonName+".key"), key, 0600})
+	}
+	for _, f := range files {
+		if err = os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			return
+		}
+		if err = os.WriteFile(f.path, f.content, f.perm); err != nil {
+			return
+		}
+	}
+
+	line = indexTxtLine{
+		Flag:              "V",
+		ExpirationDate:    cert.NotAfter.UTC().Format(indexTxtDateLayout),
+		SerialNumber:      serial,
+		Filename:          "unknown",
+		DistinguishedName: "/CN=" + commonName,
+		Identity:          commonName,
+	}
+	return
+}
+
+// revoke marks a valid certificate revoked and moves its files like easyrsa revoke does
+func (p *filesystemPKI) revoke(line *indexTxtLine, commonName string) error {
+	if err := p.moveCertFiles(commonName, line.SerialNumber, true); err != nil {
+		return err
+	}
+	line.Flag = "R"
+	line.RevocationDate = time.Now().UTC().Format(indexTxtDateLayout)
+	return nil
+}
+
+// retire revokes the certificate of the user if it is still valid and renames it in index.txt,
+// so the name is free for a new certificate and the old one stays in the CRL
+func (p *filesystemPKI) retire(line *indexTxtLine, commonName string) error {
+	if line.Flag != "R" {
+		if err := p.revoke(line, commonName); err != nil {
+			return err
+		}
+	}
+	renameReplaced(line, commonName)
+	return nil
+}
+
+// renameReplaced gives the line of a replaced certificate a REVOKED-<name>-<hash> identity, so the name is free for a new certificate
+func renameReplaced(line *indexTxtLine, commonName string) {
+	uniqHash := strings.Replace(uuid.New().String(), "-", "", -1)
+	line.DistinguishedName = "/CN=REVOKED-" + commonName + "-" + uniqHash
+	line.Identity = "REVOKED-" + commonName + "-" + uniqHash
+}
+
+// revokeRenewed revokes the certificates of the user replaced by renew that are still valid and reports whether there were any
+func (p *filesystemPKI) revokeRenewed(lines []indexTxtLine, commonName string) (bool, error) {
+	revoked := false
+	for i := range lines {
+		if lines[i].Flag != "V" || retiredCommonName(lines[i].Identity) != commonName {
+			continue
+		}
+		serial := lines[i].SerialNumber
+		if err := renameFiles(p.renewedCertFiles(serial), false); err != nil {
+			return revoked, err
+		}
+		if err := os.Remove(p.path("certs_by_serial", serial+".pem")); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return revoked, err
+		}
+		lines[i].Flag = "R"
+		lines[i].RevocationDate = time.Now().UTC().Format(indexTxtDateLayout)
+		revoked = true
+	}
+	return revoked, nil
+}
+
+// genCRL writes crl.pem, while a CA rollover is in progress it holds a CRL of each CA
+func (p *filesystemPKI) genCRL(lines []indexTxtLine) error {
+	cas, caKeys, err := p.loadCAs()
+	if err != nil {
+		return err
+	}
+
+	var revoked []*RevokedCert
+	for _, line := range lines {
+		if line.Flag != "R" {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(line.SerialNumber, 16)
+		if !ok {
+			log.Warnf("pki: skipping revoked certificate with bad serial %q", line.SerialNumber)
+			continue
+		}
+		revokedAt, _, err := indexTxtRevocation(line.RevocationDate)
+		if err != nil {
+			log.Warnf("pki: bad revocation date of %s: %v", line.Identity, err)
+		}
+		revoked = append(revoked, &RevokedCert{RevokedTime: revokedAt, CommonName: line.Identity, Cert: &x509.Certificate{SerialNumber: serial}})
+	}
+
+	stored, _ := os.ReadFile(p.path(crlNumberFile))
+	current, _ := os.ReadFile(p.path("crl.pem"))
+	number := nextCRLNumber(string(stored), current)
+
+	// serials are random, so listing every revoked serial in the CRL of each CA is safe
+	var crls bytes.Buffer
+	for i := range cas {
+		crl, err := genCRL(revoked, cas[i], caKeys[i], number, *crlValidity)
+		if err != nil {
+			return err
+		}
+		crls.Write(crl.Bytes())
+	}
+	if err := fWriteAtomic(p.path("crl.pem"), crls.Bytes(), 0644); err != nil {
+		return err
+	}
+	return fWriteAtomic(p.path(crlNumberFile), []byte(formatCRLNumber(number.Add(number, big.NewInt(1)))), 0644)
+}
+
+func (p *filesystemPKI) easyrsaGenCRL() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lines, err := p.readIndex()
+	if err != nil {
+		return err
+	}
+	return p.genCRL(lines)
+}
+
+// easyrsaBuildClient issues a client certificate expiring at notAfter, zero for --client-cert.expiration-days
+func (p *filesystemPKI) easyrsaBuildClient(commonName string, notAfter time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lines, err := p.readIndex()
+	if err != nil {
+		return err
+	}
+	if indexTxtFind(lines, commonName) >= 0 {
+		return fmt.Errorf("certificate for user (%s) already exists", commonName)
+	}
+
+	line, err := p.issue(commonName, clientCertGenerator(notAfter), nil)
+	if err != nil {
+		return err
+	}
+	return p.writeIndex(append(lines, line))
+}
+
+// easyrsaSignClient issues a client certificate for the key of the CSR, the common name of the CSR is the user
+func (p *filesystemPKI) easyrsaSignClient(csr *x509.CertificateRequest, notAfter time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	commonName := csr.Subject.CommonName
+	lines, err := p.readIndex()
+	if err != nil {
+		return err
+	}
+	if indexTxtFind(lines, commonName) >= 0 {
+		return fmt.Errorf("certificate for user (%s) already exists", commonName)
+	}
+
+	line, err := p.issue(commonName, clientCertGenerator(notAfter), csr)
+	if err != nil {
+		return err
+	}
+	return p.writeIndex(append(lines, line))
+}
+
+// externalKeyCSR returns the CSR of a user whose private key is not kept in the pki, nil if ovpn-admin has the key
+func (p *filesystemPKI) externalKeyCSR(line indexTxtLine, commonName string) (*x509.CertificateRequest, error) {
+	files, at := p.certFiles(commonName, line.SerialNumber), 0
+	if line.Flag == "R" {
+		at = 1
+	}
+	if _, err := os.Stat(files[1][at]); !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	reqPEM, err := os.ReadFile(files[2][at])
+	if err != nil {
+		return nil, fmt.Errorf("user (%s) has neither a private key nor a CSR: %w", commonName, err)
+	}
+	return decodeCSR(reqPEM)
+}
+
+// tlsCryptV2Key returns the tls-crypt-v2 key of the current certificate of the user from tls-crypt-v2/<serial>.key,
+// it is generated on first use, the server key too if the openvpn container hasn't created it
+func (p *filesystemPKI) tlsCryptV2Key(commonName string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lines, err := p.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	i := indexTxtFind(lines, commonName)
+	if i < 0 {
+		return nil, fmt.Errorf("user (%s) has no certificate", commonName)
+	}
+	path := p.path("tls-crypt-v2", lines[i].SerialNumber+".key")
+	sealed, err := os.ReadFile(path)
+	if err == nil {
+		return p.keys.open(sealed)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	serverKey, err := p.tlsCryptV2ServerKey()
+	if err != nil {
+		return nil, err
+	}
+	key, err := genTLSCryptV2ClientKey(serverKey, lines[i].SerialNumber)
+	if err != nil {
+		return nil, err
+	}
+	if sealed, err = p.keys.seal(key); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, sealed, 0600)
+}
+
+// tlsCryptV2ServerKey reads the server key OpenVPN unwraps the client keys with, it stays in plaintext for OpenVPN
+func (p *filesystemPKI) tlsCryptV2ServerKey() ([]byte, error) {
+	path := p.path(tlsCryptV2ServerKeyFile)
+	key, err := os.ReadFile(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		return key, err
+	}
+	if key, err = genTLSCryptV2ServerKey(); err != nil {
+		return nil, err
+	}
+	log.Infof("pki: created the tls-crypt-v2 server key, restart OpenVPN with --tls-crypt-v2 %s", path)
+	return key, os.WriteFile(path, key, 0600)
+}
+
+// rewrapKeys rewraps the keys in private/, revoked/private_by_serial/, renewed/private_by_serial/ and tls-crypt-v2/ except the one of the OpenVPN server
+func (p *filesystemPKI) rewrapKeys() (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var paths []string
+	for _, pattern := range []string{p.path("private", "*.key"), p.path("revoked", "private_by_serial", "*.key"), p.path("renewed", "private_by_serial", "*.key"), p.path("tls-crypt-v2", "*.key")} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return 0, err
+		}
+		paths = append(paths, matches...)
+	}
+
+	changed := 0
+	for _, path := range paths {
+		if path == p.path("private", serverCommonName+".key") {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return changed, err
+		}
+		data, ok, err := p.keys.rewrap(data)
+		if err != nil {
+			return changed, fmt.Errorf("%s: %w", path, err)
+		}
+		if !ok {
+			continue
+		}
+		if err = fWriteAtomic(path, data, 0600); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+func (p *filesystemPKI) easyrsaRevoke(commonName string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lines, err := p.readIndex()
+	if err != nil {
+		return err
+	}
+	i := indexTxtFind(lines, commonName)
+	if i < 0 || lines[i].Flag != "V" {
+		return fmt.Errorf("user (%s) has no valid certificate", commonName)
+	}
+
+	if err = p.revoke(&lines[i], commonName); err != nil {
+		return err
+	}
+	if _, err = p.revokeRenewed(lines, commonName); err != nil {
+		return err
+	}
+	if err = p.writeIndex(lines); err != nil {
+		return err
+	}
+	return p.genCRL(lines)
+}
+
+func (p *filesystemPKI) easyrsaUnrevoke(commonName string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lines, err := p.readIndex()
+	if err != nil {
+		return err
+	}
+	i := indexTxtFind(lines, commonName)
+	if i < 0 || lines[i].Flag != "R" {
+		return fmt.Errorf("user (%s) is not revoked", commonName)
+	}
+
+	if err = p.moveCertFiles(commonName, lines[i].SerialNumber, false); err != nil {
+		return err
+	}
+	lines[i].Flag = "V"
+	lines[i].RevocationDate = ""
+	if err = p.writeIndex(lines); err != nil {
+		return err
+	}
+	return p.genCRL(lines)
+}
+
+// easyrsaRotate replaces the certificate of the user with one expiring at notAfter, zero for --client-cert.expiration-days
+func (p *filesystemPKI) easyrsaRotate(commonName string, notAfter time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.rotate(commonName, clientCertGenerator(notAfter))
+}
+
+func (p *filesystemPKI) rotate(commonName string, genCert certGenerator) error {
+	lines, err := p.readIndex()
+	if err != nil {
+		return err
+	}
+	i := indexTxtFind(lines, commonName)
+	if i < 0 {
+		return fmt.Errorf("user (%s) not found", commonName)
+	}
+
+	// users who signed a CSR keep their key, the new certificate is issued for the same CSR
+	csr, err := p.externalKeyCSR(lines[i], commonName)
+	if err != nil {
+		return err
+	}
+
+	old := lines[i]
+	if err = p.retire(&old, commonName); err != nil {
+		return err
+	}
+	line, err := p.issue(commonName, genCert, csr)
+	if err != nil {
+		if old.Flag != lines[i].Flag {
+			if restoreErr := p.moveCertFiles(commonName, old.SerialNumber, false); restoreErr != nil {
+				log.Errorf("pki: can't restore the certificate of %s: %v", commonName, restoreErr)
+			}
+		}
+		return err
+	}
+
+	// the new certificate takes the place of the old one
+	lines[i] = line
+	lines = append(lines, old)
+	if _, err = p.revokeRenewed(lines, commonName); err != nil {
+		return err
+	}
+	if err = p.writeIndex(lines); err != nil {
+		return err
+	}
+	return p.genCRL(lines)
+}
+
+// easyrsaRenew issues a new certificate for the user like easyrsaRotate, but the old one stays valid until it expires
+// or easyrsaRevokeRenewed revokes it. Its files are moved into renewed/ like easyrsa renew does.
+func (p *filesystemPKI) easyrsaRenew(commonName string, notAfter time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lines, err := p.readIndex()
+	if err != nil {
+		return err
+	}
+	i := indexTxtFind(lines, commonName)
+	if i < 0 || lines[i].Flag != "V" {
+		return fmt.Errorf("user (%s) has no valid certificate", commonName)
+	}
+	csr, err := p.externalKeyCSR(lines[i], commonName)
+	if err != nil {
+		return err
+	}
+
+	old := lines[i]
+	var renamed [][2]string
+	renewed := p.renewedCertFiles(old.SerialNumber)
+	for k, files := range p.certFiles(commonName, old.SerialNumber) {
+		renamed = append(renamed, [2]string{files[0], renewed[k][0]})
+	}
+	if err = renameFiles(renamed, false); err != nil {
+		return err
+	}
+	renameReplaced(&old, commonName)
+	line, err := p.issue(commonName, clientCertGenerator(notAfter), csr)
+	if err != nil {
+		if restoreErr := renameFiles(renamed, true); restoreErr != nil {
+			log.Errorf("pki: can't restore the certificate of %s: %v", commonName, restoreErr)
+		}
+		return err
+	}
+
+	lines[i] = line
+	lines = append(lines, old)
+	return p.writeIndex(lines)
+}
+
+// easyrsaRevokeRenewed revokes the certificates of the user replaced by easyrsaRenew that are still valid
+func (p *filesystemPKI) easyrsaRevokeRenewed(commonName string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lines, err := p.readIndex()
+	if err != nil {
+		return err
+	}
+	revoked, err := p.revokeRenewed(lines, commonName)
+	if err != nil || !revoked {
+		return err
+	}
+	if err = p.writeIndex(lines); err != nil {
+		return err
+	}
+	return p.genCRL(lines)
+}
+
+// easyrsaDelete revokes the certificate of the user and frees the name
+func (p *filesystemPKI) easyrsaDelete(commonName string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lines, err := p.readIndex()
+	if err != nil {
+		return err
+	}
+	i := indexTxtFind(lines, commonName)
+	if i < 0 {
+		return fmt.Errorf("user (%s) not found", commonName)
+	}
+
+	if err = p.retire(&lines[i], commonName); err != nil {
+		return err
+	}
+	if _, err = p.revokeRenewed(lines, commonName); err != nil {
+		return err
+	}
+	if err = p.writeIndex(lines); err != nil {
+		return err
+	}
+	return p.genCRL(lines)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestPKI creates a pki directory with a CA the way easyrsa build-ca leaves it
+func newTestPKI(t *testing.T) *filesystemPKI {
+	t.Helper()
+	return newTestPKIWithCA(t, keyAlgoRSA2048)
+}
+
+// setTestKeyAlgo sets --pki.key-algo for the test
+func setTestKeyAlgo(t *testing.T, algo string) {
+	oldAlgo := *pkiKeyAlgo
+	*pkiKeyAlgo = algo
+	t.Cleanup(func() { *pkiKeyAlgo = oldAlgo })
+}
+
+// newTestPKIWithCA is newTestPKI with a CA key of the algorithm, new keys are RSA unless the test sets --pki.key-algo
+func newTestPKIWithCA(t *testing.T, caAlgo string) *filesystemPKI {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "pki")
+	if err := os.MkdirAll(filepath.Join(dir, "private"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	keyPEM, err := genPrivKey(caAlgo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := decodePrivKey(keyPEM.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := genCA(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ca.crt"), certPEM.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "private", "ca.key"), keyPEM.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldDays := *clientCertExpirationDays
+	*clientCertExpirationDays = "30"
+	t.Cleanup(func() { *clientCertExpirationDays = oldDays })
+	if *pkiKeyAlgo == "" {
+		setTestKeyAlgo(t, keyAlgoRSA2048)
+	}
+
+	return newFilesystemPKI(dir, filepath.Join(dir, "index.txt"))
+}
+
+func readTestCRL(t *testing.T, p *filesystemPKI) *x509.RevocationList {
+	t.Helper()
+	content, err := os.ReadFile(p.path("crl.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "X509 CRL" {
+		t.Fatalf("crl.pem is not a PEM encoded CRL")
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _, err := p.loadCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crl.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("CRL is not signed by the CA: %v", err)
+	}
+	return crl
+}
+
+func crlHasSerial(crl *x509.RevocationList, serial string) bool {
+	for _, entry := range crl.RevokedCertificateEntries {
+		if indexTxtSerial(entry.SerialNumber) == serial {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFilesystemPKI_BuildClient(t *testing.T) {
+	p := newTestPKI(t)
+	if err := p.easyrsaBuildClient("alice", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, _ := p.readIndex()
+	if len(lines) != 1 || lines[0].Flag != "V" || lines[0].DistinguishedName != "/CN=alice" {
+		t.Fatalf("Unexpected index.txt %+v", lines)
+	}
+	serial := lines[0].SerialNumber
+
+	for _, name := range []string{"issued/alice.crt", "private/alice.key", "reqs/alice.req", "certs_by_serial/" + serial + ".pem"} {
+		if _, err := os.Stat(p.path(name)); err != nil {
+			t.Errorf("Expected %s to exist: %v", name, err)
+		}
+	}
+
+	cert, err := decodeCert([]byte(fRead(p.path("issued", "alice.crt"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _, _ := p.loadCA()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("Client certificate doesn't verify against the CA: %v", err)
+	}
+	if indexTxtSerial(cert.SerialNumber) != serial || cert.Subject.CommonName != "alice" {
+		t.Errorf("index.txt doesn't match the certificate: %+v", lines[0])
+	}
+
+	keyBlock, _ := pem.Decode([]byte(fRead(p.path("private", "alice.key"))))
+	if keyBlock == nil || keyBlock.Type != "PRIVATE KEY" {
+		t.Errorf("Expected a PKCS#8 PRIVATE KEY block")
+	}
+	if info, _ := os.Stat(p.path("private", "alice.key")); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the key to be private, got %v", info.Mode().Perm())
+	}
+
+	if err := p.easyrsaBuildClient("alice", time.Time{}); err == nil {
+		t.Error("Expected an error for an existing user")
+	}
+}
+
+func TestFilesystemPKI_RevokeAndUnrevoke(t *testing.T) {
+	p := newTestPKI(t)
+	if err := p.easyrsaBuildClient("alice", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	lines, _ := p.readIndex()
+	serial := lines[0].SerialNumber
+
+	if err := p.easyrsaRevoke("alice"); err != nil {
+		t.Fatal(err)
+	}
+	lines, _ = p.readIndex()
+	if lines[0].Flag != "R" || lines[0].RevocationDate == "" {
+		t.Errorf("Expected alice to be revoked, got %+v", lines[0])
+	}
+	if _, err := os.Stat(p.path("revoked", "certs_by_serial", serial+".crt")); err != nil {
+		t.Errorf("Expected the certificate under revoked/: %v", err)
+	}
+	if _, err := os.Stat(p.path("issued", "alice.crt")); !os.IsNotExist(err) {
+		t.Error("Expected issued/alice.crt to be moved")
+	}
+	if !crlHasSerial(readTestCRL(t, p), serial) {
+		t.Error("Expected the CRL to list alice's certificate")
+	}
+	if err := p.easyrsaRevoke("alice"); err == nil {
+		t.Error("Expected an error revoking twice")
+	}
+
+	if err := p.easyrsaUnrevoke("alice"); err != nil {
+		t.Fatal(err)
+	}
+	lines, _ = p.readIndex()
+	if lines[0].Flag != "V" || lines[0].RevocationDate != "" {
+		t.Errorf("Expected alice to be valid again, got %+v", lines[0])
+	}
+	for _, name := range []string{"issued/alice.crt", "private/alice.key", "certs_by_serial/" + serial + ".pem"} {
+		if _, err := os.Stat(p.path(name)); err != nil {
+			t.Errorf("Expected %s to be restored: %v", name, err)
+		}
+	}
+	if crlHasSerial(readTestCRL(t, p), serial) {
+		t.Error("Expected the CRL to no longer list alice's certificate")
+	}
+}
+
+func TestFilesystemPKI_RotateAndDelete(t *testing.T) {
+	p := newTestPKI(t)
+	for _, name := range []string{"alice", "bob"} {
+		if err := p.easyrsaBuildClient(name, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines, _ := p.readIndex()
+	oldSerial := lines[0].SerialNumber
+
+	if err := p.easyrsaRotate("alice", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	lines, _ = p.readIndex()
+	if len(lines) != 3 || lines[0].Identity != "alice" || lines[0].Flag != "V" || lines[0].SerialNumber == oldSerial {
+		t.Fatalf("Expected a new certificate for alice in place of the old one, got %+v", lines)
+	}
+	if !strings.HasPrefix(lines[2].Identity, "REVOKED-alice-") || lines[2].Flag != "R" || lines[2].SerialNumber != oldSerial {
+		t.Errorf("Expected the old certificate to be renamed and revoked, got %+v", lines[2])
+	}
+	if !crlHasSerial(readTestCRL(t, p), oldSerial) {
+		t.Error("Expected the CRL to list the rotated certificate")
+	}
+
+	bobSerial := lines[1].SerialNumber
+	if err := p.easyrsaDelete("bob"); err != nil {
+		t.Fatal(err)
+	}
+	lines, _ = p.readIndex()
+	if indexTxtFind(lines, "bob") >= 0 || lines[1].Flag != "R" {
+		t.Errorf("Expected bob's certificate to be renamed and revoked, got %+v", lines[1])
+	}
+	if !crlHasSerial(readTestCRL(t, p), bobSerial) {
+		t.Error("Expected the CRL to list the deleted certificate")
+	}
+	if err := p.easyrsaBuildClient("bob", time.Time{}); err != nil {
+		t.Errorf("Expected the name of a deleted user to be free: %v", err)
+	}
+}
+
+func TestFilesystemPKI_MissingCA(t *testing.T) {
+	dir := t.TempDir()
+	p := newFilesystemPKI(dir, filepath.Join(dir, "index.txt"))
+
+	if err := p.easyrsaBuildClient("alice", time.Time{}); err == nil || !strings.Contains(err.Error(), "CA certificate") {
+		t.Errorf("Expected a CA error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "index.txt")); !os.IsNotExist(err) {
+		t.Error("index.txt should not be written when issuing fails")
+	}
+}
+
+func TestUserLifecycle_FilesystemPKI(t *testing.T) {
+	p := newTestPKI(t)
+	oldDir := *easyrsaDirPath
+	*easyrsaDirPath = filepath.Dir(p.dir)
+	t.Cleanup(func() { *easyrsaDirPath = oldDir })
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.storage = &filesystemStorage{pki: p, ccdDir: t.TempDir()}
+
+	if ok, msg := oAdmin.userCreate("carol", "", time.Time{}, nil); !ok {
+		t.Fatalf("userCreate failed: %s", msg)
+	}
+	if !oAdmin.userExists("carol") {
+		t.Fatal("Expected carol in index.txt")
+	}
+	if err, msg := oAdmin.userRevoke("carol"); err != nil {
+		t.Fatalf("userRevoke failed: %s", msg)
+	}
+	if len(oAdmin.clients) != 1 || oAdmin.clients[0].AccountStatus != "Revoked" {
+		t.Errorf("Expected carol to be listed as revoked, got %+v", oAdmin.clients)
+	}
+	if err, _ := oAdmin.userRevoke("carol"); err == nil {
+		t.Error("Expected revoking a revoked user to fail")
+	}
+}
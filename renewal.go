@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	renewalCheckInterval = time.Hour
+
+	renewalActionRenew = "renew"
+	renewalActionSkip  = "skip"
+)
+
+var errRenewalNotPending = errors.New("the certificate wasn't renewed since the last confirmation")
+
+// renewalUser is the renewal state of a user, ConfigReady is set when the certificate was renewed
+// and the renewal hasn't been confirmed since
+type renewalUser struct {
+	OptOut      bool       `json:"opt_out,omitempty"`
+	RenewedAt   *time.Time `json:"renewed_at,omitempty"`
+	ConfigReady bool       `json:"config_ready,omitempty"`
+}
+
+// renewalState keeps the per-user renewal state in a JSON file, a nil state keeps nothing
+type renewalState struct {
+	mu    sync.Mutex
+	path  string
+	users map[string]renewalUser
+}
+
+func newRenewalState(path string) *renewalState {
+	s := &renewalState{path: path, users: make(map[string]renewalUser)}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("renewal: can't read %s: %v", path, err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(content, &s.users); err != nil {
+		log.Errorf("renewal: can't parse %s: %v", path, err)
+	}
+	return s
+}
+
+func (s *renewalState) get(username string) renewalUser {
+	if s == nil {
+		return renewalUser{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.users[username]
+}
+
+// update changes the state of the user and writes the file, users without state are removed from it
+func (s *renewalState) update(username string, change func(u *renewalUser)) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := s.users[username]
+	change(&u)
+	if u == (renewalUser{}) {
+		delete(s.users, username)
+	} else {
+		s.users[username] = u
+	}
+	content, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fWriteAtomic(s.path, content, 0600)
+}
+
+func (s *renewalState) setOptOut(username string, optOut bool) error {
+	return s.update(username, func(u *renewalUser) { u.OptOut = optOut })
+}
+
+func (s *renewalState) renewed(username string, at time.Time) error {
+	return s.update(username, func(u *renewalUser) {
+		at = at.UTC()
+		u.RenewedAt = &at
+		u.ConfigReady = true
+	})
+}
+
+func (s *renewalState) confirmed(username string) error {
+	return s.update(username, func(u *renewalUser) { u.ConfigReady = false })
+}
+
+func (s *renewalState) forget(username string) error {
+	return s.update(username, func(u *renewalUser) { *u = renewalUser{} })
+}
+
+// renewalCandidate is a certificate expiring within --renewal.days-before and what renewal does with it
+type renewalCandidate struct {
+	Username  string    `json:"username"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Action    string    `json:"action"`
+	Reason    string    `json:"reason,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type renewalReport struct {
+	DryRun     bool               `json:"dry_run"`
+	DaysBefore int                `json:"days_before"`
+	Candidates []renewalCandidate `json:"candidates"`
+}
+
+// renewalCandidates returns the valid client certificates expiring within --renewal.days-before, soonest first.
+// Expired certificates are left alone, renewing them would let a locked out user back in.
+func (oAdmin *OvpnAdmin) renewalCandidates(now time.Time) []renewalCandidate {
+	deadline := now.AddDate(0, 0, *renewalDaysBefore)
+	candidates := []renewalCandidate{}
+	for _, line := range oAdmin.index() {
+		if line.Flag != "V" || line.Identity == serverCommonName || strings.Contains(line.Identity, "REVOKED") {
+			continue
+		}
+		expiresAt, err := time.Parse(indexTxtDateLayout, line.ExpirationDate)
+		if err != nil {
+			log.Warnf("renewal: bad expiration date of %s: %v", line.Identity, err)
+			continue
+		}
+		if !expiresAt.After(now) || expiresAt.After(deadline) {
+			continue
+		}
+		candidate := renewalCandidate{Username: line.Identity, ExpiresAt: expiresAt, Action: renewalActionRenew}
+		if oAdmin.renewal.get(line.Identity).OptOut {
+			candidate.Action, candidate.Reason = renewalActionSkip, "opted out"
+		}
+		candidates = append(candidates, candidate)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].ExpiresAt.Before(candidates[j].ExpiresAt) })
+	return candidates
+}
+
+// renewExpiring renews the certificates expiring within --renewal.days-before unless dryRun is set.
+// The old certificate stays valid until the renewal is confirmed, so the user isn't locked out before.
+// The CCD and the password of the user are kept. A nil request records the renewals as made by the system.
+func (oAdmin *OvpnAdmin) renewExpiring(r *http.Request, now time.Time, dryRun bool) renewalReport {
+	report := renewalReport{DryRun: dryRun, DaysBefore: *renewalDaysBefore, Candidates: oAdmin.renewalCandidates(now)}
+	if dryRun {
+		return report
+	}
+
+	renewed := 0
+	for i := range report.Candidates {
+		c := &report.Candidates[i]
+		if c.Action != renewalActionRenew {
+			continue
+		}
+		err := oAdmin.storage.Renew(c.Username, time.Time{})
+		if err == nil {
+			renewed++
+			if stateErr := oAdmin.renewal.renewed(c.Username, now); stateErr != nil {
+				log.Errorf("renewal: can't record the renewal of %s: %v", c.Username, stateErr)
+			}
+			log.Infof("renewal: renewed the certificate of %s expiring at %s", c.Username, c.ExpiresAt.Format(time.RFC3339))
+		} else {
+			c.Error = err.Error()
+			log.Errorf("renewal: can't renew the certificate of %s: %v", c.Username, err)
+		}
+
+		entry := auditEntry{Action: auditActionRenew, Target: c.Username, Result: auditResult(err == nil),
+			Message: fmt.Sprintf("Certificate expiring at %s renewed", c.ExpiresAt.Format(time.RFC3339))}
+		if err != nil {
+			entry.Message = err.Error()
+		}
+		if r != nil {
+			oAdmin.audit(r, entry)
+		} else {
+			oAdmin.auditSystem(entry)
+		}
+	}
+	if renewed > 0 {
+		oAdmin.refreshClients()
+	}
+	return report
+}
+
+// confirmRenewal revokes the certificate the renewal replaced and clears the renewed badge of the user.
+// It is an explicit action rather than a side effect of the config download, so a prefetched or
+// cross-site download can't lock out a user who doesn't have the new config yet.
+func (oAdmin *OvpnAdmin) confirmRenewal(username string) (string, error) {
+	if oAdmin.renewal == nil {
+		return "", errors.New("automatic renewal is not enabled")
+	}
+	if !oAdmin.userExists(username) {
+		return "", fmt.Errorf("user %q not found", username)
+	}
+	if !oAdmin.renewal.get(username).ConfigReady {
+		return "", errRenewalNotPending
+	}
+	if err := oAdmin.storage.RevokeRenewed(username); err != nil {
+		return "", fmt.Errorf("can't revoke the renewed certificate: %w", err)
+	}
+	crlFix()
+	if err := oAdmin.renewal.confirmed(username); err != nil {
+		log.Errorf("renewal: can't record the confirmation of %s: %v", username, err)
+	}
+	oAdmin.refreshClients()
+	return fmt.Sprintf("Renewal of %s confirmed, the replaced certificate was revoked", username), nil
+}
+
+func (oAdmin *OvpnAdmin) renewalLoop() {
+	for {
+		report := oAdmin.renewExpiring(nil, time.Now(), *renewalDryRun)
+		if report.DryRun {
+			for _, c := range report.Candidates {
+				log.Infof("renewal (dry run): would %s %s expiring at %s %s", c.Action, c.Username, c.ExpiresAt.Format(time.RFC3339), c.Reason)
+			}
+		}
+		time.Sleep(renewalCheckInterval)
+	}
+}
+
+// renewalKeepExpiry opts the user out of automatic renewal, so an expiration date chosen for the user stands
+func (oAdmin *OvpnAdmin) renewalKeepExpiry(username string) {
+	if err := oAdmin.renewal.setOptOut(username, true); err != nil {
+		log.Errorf("renewal: can't opt %s out: %v", username, err)
+	}
+}
+
+// setRenewalOptOut turns automatic renewal off or on for the user
+func (oAdmin *OvpnAdmin) setRenewalOptOut(username string, optOut bool) (string, error) {
+	if oAdmin.renewal == nil {
+		return "", errors.New("automatic renewal is not enabled")
+	}
+	if !oAdmin.userExists(username) {
+		return "", fmt.Errorf("user %q not found", username)
+	}
+	if err := oAdmin.renewal.setOptOut(username, optOut); err != nil {
+		return "", err
+	}
+	oAdmin.refreshClients()
+	if optOut {
+		return fmt.Sprintf("Automatic renewal disabled for %s", username), nil
+	}
+	return fmt.Sprintf("Automatic renewal enabled for %s", username), nil
+}
+
+// userRenewalHandler handles POST /users/{username}/renewal with enabled=true or false
+func (oAdmin *OvpnAdmin) userRenewalHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if status, msg := oAdmin.checkAccess(r, permRotate); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+	_ = r.ParseForm()
+	username := oAdmin.extractUsername(r)
+	msg, err := oAdmin.setRenewalOptOut(username, r.FormValue("enabled") != "true")
+	if err != nil {
+		msg = err.Error()
+	}
+	oAdmin.audit(r, auditEntry{Action: auditActionRenew, Target: username, Result: auditResult(err == nil), Message: msg})
+	if err != nil {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("HX-Trigger", `{"showToast": {"message": "`+msg+`", "type": "success"}}`)
+	oAdmin.renderUserRows(w, r)
+}
+
+// userConfirmRenewalHandler handles POST /users/{username}/renewal/confirm
+func (oAdmin *OvpnAdmin) userConfirmRenewalHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if status, msg := oAdmin.checkAccess(r, permRotate); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+	username := oAdmin.extractUsername(r)
+	msg, err := oAdmin.confirmRenewal(username)
+	if err != nil {
+		msg = err.Error()
+	}
+	oAdmin.audit(r, auditEntry{Action: auditActionRenew, Target: username, Result: auditResult(err == nil), Message: msg})
+	if err != nil {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("HX-Trigger", `{"showToast": {"message": "`+msg+`", "type": "success"}}`)
+	oAdmin.renderUserRows(w, r)
+}
+
+type apiRenewalRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+type apiRenewalRunRequest struct {
+	DryRun bool `json:"dry_run"`
+}
+
+// apiUserRenewal handles POST /api/v1/users/{username}/renewal
+func (oAdmin *OvpnAdmin) apiUserRenewal(w http.ResponseWriter, r *http.Request, username string) {
+	if !oAdmin.apiAuthorize(w, r, permRotate) || !oAdmin.apiRequireUser(w, username) {
+		return
+	}
+	if oAdmin.renewal == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_enabled", "automatic renewal is not enabled")
+		return
+	}
+	var req apiRenewalRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	msg, err := oAdmin.setRenewalOptOut(username, !req.Enabled)
+	if err != nil {
+		msg = err.Error()
+	}
+	oAdmin.audit(r, auditEntry{Action: auditActionRenew, Target: username, Result: auditResult(err == nil), Message: msg})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "renewal_failed", msg)
+		return
+	}
+	oAdmin.apiGetUser(w, username)
+}
+
+// apiConfirmRenewal handles POST /api/v1/users/{username}/renewal/confirm
+func (oAdmin *OvpnAdmin) apiConfirmRenewal(w http.ResponseWriter, r *http.Request, username string) {
+	if !oAdmin.apiAuthorize(w, r, permRotate) || !oAdmin.apiRequireUser(w, username) {
+		return
+	}
+	if oAdmin.renewal == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_enabled", "automatic renewal is not enabled")
+		return
+	}
+
+	msg, err := oAdmin.confirmRenewal(username)
+	if err != nil {
+		msg = err.Error()
+	}
+	oAdmin.audit(r, auditEntry{Action: auditActionRenew, Target: username, Result: auditResult(err == nil), Message: msg})
+	switch {
+	case errors.Is(err, errRenewalNotPending):
+		writeAPIError(w, http.StatusConflict, "not_renewed", msg)
+		return
+	case err != nil:
+		writeAPIError(w, http.StatusInternalServerError, "renewal_failed", msg)
+		return
+	}
+	oAdmin.apiGetUser(w, username)
+}
+
+// apiRenewalHandler serves GET /api/v1/renewal, what the next run would renew, and POST /api/v1/renewal/run
+func (oAdmin *OvpnAdmin) apiRenewalHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	if oAdmin.renewal == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_enabled", "automatic renewal is not enabled")
+		return
+	}
+
+	switch {
+	case len(parts) == 0 || parts[0] == "":
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+			return
+		}
+		if !oAdmin.apiAuthorize(w, r, permView) {
+			return
+		}
+		writeJSON(w, http.StatusOK, oAdmin.renewExpiring(r, time.Now(), true))
+	case len(parts) == 1 && parts[0] == "run":
+		if r.Method != http.MethodPost {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+			return
+		}
+		if !oAdmin.apiAuthorize(w, r, permRotate) {
+			return
+		}
+		var req apiRenewalRunRequest
+		if r.ContentLength != 0 {
+			if err := decodeJSONBody(r, &req); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, oAdmin.renewExpiring(r, time.Now(), req.DryRun || *renewalDryRun))
+	default:
+		writeAPIError(w, http.StatusNotFound, "not_found", fmt.Sprintf("Unknown API endpoint %q", r.URL.Path))
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRenewalAdmin issues alice and bob certificates expiring in 5 days and carol the default 30 days one
+func newTestRenewalAdmin(t *testing.T) *OvpnAdmin {
+	t.Helper()
+	oldDaysBefore, oldDryRun := *renewalDaysBefore, *renewalDryRun
+	*renewalDaysBefore, *renewalDryRun = 14, false
+	t.Cleanup(func() { *renewalDaysBefore, *renewalDryRun = oldDaysBefore, oldDryRun })
+
+	p := newTestPKI(t)
+	soon := time.Now().AddDate(0, 0, 5)
+	for _, name := range []string{"alice", "bob"} {
+		if err := p.easyrsaBuildClient(name, soon); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.easyrsaBuildClient("carol", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	oAdmin := newTestOvpnAdmin()
+	oAdmin.storage = &filesystemStorage{pki: p, ccdDir: t.TempDir()}
+	oAdmin.modules = append(oAdmin.modules, "renewal")
+	oAdmin.renewal = newRenewalState(filepath.Join(t.TempDir(), "renewal.json"))
+	return oAdmin
+}
+
+func TestRenewExpiring(t *testing.T) {
+	oAdmin := newTestRenewalAdmin(t)
+	if err := oAdmin.renewal.setOptOut("bob", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := oAdmin.storage.WriteCcd("alice", []byte("push \"route 10.8.1.0 255.255.255.0\"\n")); err != nil {
+		t.Fatal(err)
+	}
+	aliceBefore := testClientCert(t, oAdmin, "alice")
+
+	report := oAdmin.renewExpiring(nil, time.Now(), true)
+	if len(report.Candidates) != 2 {
+		t.Fatalf("Expected alice and bob to expire within 14 days, got %+v", report.Candidates)
+	}
+	actions := map[string]string{}
+	for _, c := range report.Candidates {
+		actions[c.Username] = c.Action
+	}
+	if actions["alice"] != renewalActionRenew || actions["bob"] != renewalActionSkip {
+		t.Errorf("Expected alice to be renewed and bob skipped, got %v", actions)
+	}
+	if testClientCert(t, oAdmin, "alice").SerialNumber.Cmp(aliceBefore.SerialNumber) != 0 {
+		t.Fatal("Expected a dry run to change nothing")
+	}
+
+	report = oAdmin.renewExpiring(nil, time.Now(), false)
+	alice := testClientCert(t, oAdmin, "alice")
+	if alice.SerialNumber.Cmp(aliceBefore.SerialNumber) == 0 {
+		t.Fatal("Expected the certificate of alice to be renewed")
+	}
+	if days := time.Until(alice.NotAfter).Hours() / 24; days < 29 {
+		t.Errorf("Expected the renewed certificate to get the default lifetime, got %.1f days", days)
+	}
+	if !oAdmin.renewal.get("alice").ConfigReady || oAdmin.renewal.get("alice").RenewedAt == nil {
+		t.Error("Expected the renewal of alice to be recorded")
+	}
+	if oAdmin.renewal.get("bob").ConfigReady {
+		t.Error("Expected bob to be skipped")
+	}
+	if ccd, err := oAdmin.storage.ReadCcd("alice"); err != nil || !strings.Contains(ccd, "10.8.1.0") {
+		t.Errorf("Expected the CCD of alice to be kept, got %q (%v)", ccd, err)
+	}
+	if len(oAdmin.renewalCandidates(time.Now())) != 1 {
+		t.Error("Expected only bob to be left expiring")
+	}
+	// alice can connect with the old config until she downloads the new one
+	oldStatus := func() *certificateStatus {
+		t.Helper()
+		status, err := oAdmin.storage.CertificateStatus(aliceBefore.SerialNumber)
+		if err != nil || status == nil {
+			t.Fatalf("Expected the status of the old certificate, got %v", err)
+		}
+		return status
+	}
+	if !oldStatus().RevokedAt.IsZero() {
+		t.Error("Expected the old certificate to stay valid after the renewal")
+	}
+	pki := oAdmin.storage.(*filesystemStorage).pki
+	if _, err := os.Stat(pki.path("renewed", "certs_by_serial", indexTxtSerial(aliceBefore.SerialNumber)+".crt")); err != nil {
+		t.Errorf("Expected the old certificate in renewed/: %v", err)
+	}
+
+	reloaded := newRenewalState(oAdmin.renewal.path)
+	if !reloaded.get("alice").ConfigReady || !reloaded.get("bob").OptOut {
+		t.Errorf("Expected the state to be persisted, got %+v", reloaded.users)
+	}
+
+	w := httptest.NewRecorder()
+	oAdmin.userShowConfigHandler(w, httptest.NewRequest(http.MethodGet, "/users/alice/config", nil))
+	if !oAdmin.renewal.get("alice").ConfigReady || !oldStatus().RevokedAt.IsZero() {
+		t.Error("Expected the config download to leave the old certificate valid")
+	}
+
+	w = httptest.NewRecorder()
+	oAdmin.userConfirmRenewalHandler(w, httptest.NewRequest(http.MethodPost, "/users/alice/renewal/confirm", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if oAdmin.renewal.get("alice").ConfigReady {
+		t.Error("Expected the confirmation to clear the renewed badge")
+	}
+	if oldStatus().RevokedAt.IsZero() {
+		t.Error("Expected the confirmation to revoke the old certificate")
+	}
+	if testClientCert(t, oAdmin, "alice").SerialNumber.Cmp(alice.SerialNumber) != 0 {
+		t.Error("Expected the new certificate to stay valid")
+	}
+
+	w = httptest.NewRecorder()
+	oAdmin.userConfirmRenewalHandler(w, httptest.NewRequest(http.MethodGet, "/users/alice/renewal/confirm", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected a GET to be rejected, got %d", w.Code)
+	}
+}
+
+func TestRenewExpiring_SkipsExpired(t *testing.T) {
+	oAdmin := newTestRenewalAdmin(t)
+	if got := oAdmin.renewalCandidates(time.Now().AddDate(0, 0, 20)); len(got) != 1 || got[0].Username != "carol" {
+		t.Errorf("Expected expired certificates to be left alone, got %+v", got)
+	}
+}
+
+func TestUserRenewalHandler(t *testing.T) {
+	oAdmin := newTestRenewalAdmin(t)
+
+	post := func(enabled string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/users/alice/renewal", strings.NewReader(url.Values{"enabled": {enabled}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		oAdmin.userRenewalHandler(w, r)
+		return w
+	}
+
+	w := post("false")
+	if w.Code != http.StatusOK || !oAdmin.renewal.get("alice").OptOut {
+		t.Fatalf("Expected alice to be opted out, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "Auto-renew off") {
+		t.Error("Expected the rows to show that automatic renewal is off")
+	}
+	if w = post("true"); oAdmin.renewal.get("alice").OptOut {
+		t.Errorf("Expected alice to be opted in again, got %d", w.Code)
+	}
+}
+
+func TestUserCreate_ExplicitExpiryOptsOut(t *testing.T) {
+	oAdmin := newTestRenewalAdmin(t)
+	if ok, msg := oAdmin.userCreate("dave", "", time.Now().AddDate(0, 0, 3), nil); !ok {
+		t.Fatal(msg)
+	}
+	if ok, msg := oAdmin.userCreate("erin", "", time.Time{}, nil); !ok {
+		t.Fatal(msg)
+	}
+	if !oAdmin.renewal.get("dave").OptOut || oAdmin.renewal.get("erin").OptOut {
+		t.Error("Expected only users with a chosen expiration date to be opted out")
+	}
+}
+
+func TestAPIRenewal(t *testing.T) {
+	oAdmin := newTestRenewalAdmin(t)
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		oAdmin.apiV1Handler(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := call(http.MethodPost, "/api/v1/users/alice/renewal", `{"enabled":false}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	w := call(http.MethodGet, "/api/v1/renewal", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"dry_run":true`) {
+		t.Fatalf("Expected a dry run report, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := call(http.MethodPost, "/api/v1/renewal/run", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if oAdmin.renewal.get("alice").ConfigReady || !oAdmin.renewal.get("bob").ConfigReady {
+		t.Error("Expected only bob to be renewed")
+	}
+	if w := call(http.MethodPost, "/api/v1/users/alice/renewal/confirm", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a user without a renewal, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := call(http.MethodPost, "/api/v1/users/bob/renewal/confirm", ""); w.Code != http.StatusOK || oAdmin.renewal.get("bob").ConfigReady {
+		t.Errorf("Expected the renewal of bob to be confirmed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	oAdmin.renewal = nil
+	if w := call(http.MethodGet, "/api/v1/renewal", ""); w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 without --renewal, got %d", w.Code)
+	}
+}
@@ -28,7 +28,8 @@ else
     openvpn --genkey secret ./pki/ta.key
   fi
 fi
-easyrsa gen-crl
+# ovpn-admin re-signs crl.pem itself and may have encrypted ca.key, which easyrsa can't read
+[ -f "$EASY_RSA_LOC/pki/crl.pem" ] || easyrsa gen-crl
 
 # Enable IP forwarding (may fail if read-only, set via docker-compose sysctls instead)
 echo 1 > /proc/sys/net/ipv4/ip_forward 2>/dev/null || echo "Note: ip_forward is read-only, ensure sysctls is set in docker-compose"
@@ -45,6 +46,22 @@ fi
 
 cp -f /etc/openvpn/setup/openvpn.conf /etc/openvpn/openvpn.conf
 
+# Control channel protection, openvpn.conf uses tls-auth
+case "${OVPN_TLS_MODE:-tls-auth}" in
+  tls-crypt)
+    sed -i -e "s|^tls-auth .*|tls-crypt $EASY_RSA_LOC/pki/ta.key|" -e '/^key-direction/d' /etc/openvpn/openvpn.conf
+    ;;
+  tls-crypt-v2)
+    [ -e "$EASY_RSA_LOC/pki/tls-crypt-v2-server.key" ] || openvpn --genkey tls-crypt-v2-server "$EASY_RSA_LOC/pki/tls-crypt-v2-server.key"
+    mkdir -p /etc/openvpn/scripts/
+    cp -f /etc/openvpn/setup/tls-crypt-v2-verify.sh /etc/openvpn/scripts/tls-crypt-v2-verify.sh
+    chmod +x /etc/openvpn/scripts/tls-crypt-v2-verify.sh
+    sed -i -e "s|^tls-auth .*|tls-crypt-v2 $EASY_RSA_LOC/pki/tls-crypt-v2-server.key|" -e '/^key-direction/d' /etc/openvpn/openvpn.conf
+    echo "tls-crypt-v2-verify \"/etc/openvpn/scripts/tls-crypt-v2-verify.sh $EASY_RSA_LOC/pki/index.txt\"" >> /etc/openvpn/openvpn.conf
+    echo "script-security 2" >> /etc/openvpn/openvpn.conf
+    ;;
+esac
+
 # Add DNS servers if configured (comma-separated list, e.g., "1.1.1.1,8.8.8.8")
 if [[ -n "${OVPN_DNS:-}" ]]; then
   IFS=',' read -ra DNS_SERVERS <<< "$OVPN_DNS"
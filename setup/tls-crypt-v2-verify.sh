@@ -0,0 +1,13 @@
+#!/usr/bin/env sh
+
+# tls-crypt-v2-verify script rejecting the tls-crypt-v2 keys of revoked users before the TLS handshake.
+# ovpn-admin writes the serial of the certificate a key belongs to as its metadata, the key is accepted
+# while that serial is valid in index.txt.
+
+INDEX_TXT="${1:-/etc/openvpn/easyrsa/pki/index.txt}"
+
+# keys made by openvpn --genkey tls-crypt-v2-client carry a timestamp instead, the CRL still applies to them
+[ "$metadata_type" = "0" ] || exit 0
+
+serial=$(tr -dc '0-9A-Fa-f' < "$metadata_file")
+awk -F'\t' -v serial="$serial" '$1 == "V" && toupper($4) == toupper(serial) { found = 1 } END { exit !found }' "$INDEX_TXT"
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	storageFilesystem = "filesystem"
+	storageKubernetes = "kubernetes.secrets"
+)
+
+// Storage keeps the certificates, the certificate index and the CCD of the users.
+// The backend is selected once with --storage.backend, handlers only talk to this interface.
+type Storage interface {
+	// Name returns the --storage.backend value of the backend
+	Name() string
+	// Index returns the certificates in the order of the easyrsa index.txt
+	Index() ([]indexTxtLine, error)
+
+	// BuildClient issues a certificate for a new user expiring at notAfter, zero for --client-cert.expiration-days
+	BuildClient(commonName string, notAfter time.Time) error
+	// SignClient issues a certificate for the key of the CSR to the user named by its common name, the private key stays with the user
+	SignClient(csr *x509.CertificateRequest, notAfter time.Time) error
+	// Revoke revokes the current certificate of the user and the ones replaced by Renew
+	Revoke(commonName string) error
+	Unrevoke(commonName string) error
+	// Rotate revokes the current certificate of the user and the ones replaced by Renew, and issues a new one expiring
+	// at notAfter, for the same CSR if the user signed one
+	Rotate(commonName string, notAfter time.Time) error
+	// Renew issues a new certificate like Rotate, but the current one stays valid until it expires or RevokeRenewed
+	// is called, so the user can still connect until the new config is installed
+	Renew(commonName string, notAfter time.Time) error
+	// RevokeRenewed revokes the certificates of the user replaced by Renew that are still valid
+	RevokeRenewed(commonName string) error
+	// Delete revokes the certificates of the user and frees the name for a new one
+	Delete(commonName string) error
+	// ClientCert returns the PEM encoded certificate and decrypted private key of the user, the key is empty if the user signed a CSR
+	ClientCert(commonName string) (cert, key string, err error)
+	// TLSCryptV2Key returns the tls-crypt-v2 client key of the current certificate of the user, it is generated on first
+	// use. The key carries the certificate serial, so the tls-crypt-v2-verify script rejects it once the certificate is revoked.
+	TLSCryptV2Key(commonName string) (string, error)
+	// RewrapKeys encrypts the stored client and CA keys that are in plaintext or encrypted with an older master key
+	// with the active master key and returns how many it changed. The server key stays readable for OpenVPN.
+	RewrapKeys() (int, error)
+
+	// ReadCcd returns the client-config-dir content of the user, empty if there is none
+	ReadCcd(commonName string) (string, error)
+	WriteCcd(commonName string, ccd []byte) error
+	// StaticAddresses maps the users whose CCD assigns a static address to the address
+	StaticAddresses() (map[string]string, error)
+	// Groups returns the user groups, sorted by name
+	Groups() ([]userGroup, error)
+	// WriteGroups replaces the user groups, it doesn't change the CCD of their members
+	WriteGroups(groups []userGroup) error
+
+	// CertificateAuthorities returns the CAs certificates are trusted from and their keys
+	CertificateAuthorities() ([]*x509.Certificate, []crypto.Signer, error)
+	// CertificateStatus returns the status of the certificate with the serial, nil if it was not issued by the backend
+	CertificateStatus(serial *big.Int) (*certificateStatus, error)
+	// Certificates returns the current certificate of the user first, followed by the rotated and deleted ones, newest first
+	Certificates(commonName string) ([]issuedCertificate, error)
+
+	// CRL returns the PEM encoded crl.pem
+	CRL() ([]byte, error)
+	// GenCRL re-signs the CRL with the next CRL number
+	GenCRL() error
+}
+
+// certificateStatus is the revocation state of an issued certificate
+type certificateStatus struct {
+	CommonName string
+	NotAfter   time.Time
+	// RevokedAt is zero if the certificate is not revoked
+	RevokedAt time.Time
+}
+
+// issuedCertificate is a certificate of a user with its revocation state
+type issuedCertificate struct {
+	Cert *x509.Certificate
+	// Current is false for certificates replaced by a rotation or left behind by a delete
+	Current bool
+	// RevokedAt is zero if the certificate is not revoked
+	RevokedAt        time.Time
+	RevocationReason string
+}
+
+// sortIssuedCertificates puts the current certificate first and the others newest first
+func sortIssuedCertificates(certs []issuedCertificate) {
+	sort.SliceStable(certs, func(i, j int) bool {
+		if certs[i].Current != certs[j].Current {
+			return certs[i].Current
+		}
+		return certs[i].Cert.NotBefore.After(certs[j].Cert.NotBefore)
+	})
+}
+
+// retiredCommonName returns the user a REVOKED-<name>-<hash> identity was retired from, empty for other identities
+func retiredCommonName(identity string) string {
+	name, ok := strings.CutPrefix(identity, "REVOKED-")
+	if !ok {
+		return ""
+	}
+	i := strings.LastIndex(name, "-")
+	if i <= 0 || len(name)-i-1 != 32 {
+		return ""
+	}
+	return name[:i]
+}
+
+// ccdStaticAddress returns the address assigned by ifconfig-push in the CCD content
+func ccdStaticAddress(ccd string) string {
+	for _, line := range strings.Split(ccd, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == prefixStaticRoute {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// filesystemStorage keeps certificates in an easyrsa pki directory and the CCD in --ccd.path
+type filesystemStorage struct {
+	pki    *filesystemPKI
+	ccdDir string
+}
+
+func newFilesystemStorage(pkiDir, indexPath, ccdDir string) *filesystemStorage {
+	return &filesystemStorage{pki: newFilesystemPKI(pkiDir, indexPath), ccdDir: ccdDir}
+}
+
+func (s *filesystemStorage) Name() string {
+	return storageFilesystem
+}
+
+func (s *filesystemStorage) Index() ([]indexTxtLine, error) {
+	return s.pki.readIndex()
+}
+
+func (s *filesystemStorage) BuildClient(commonName string, notAfter time.Time) error {
+	return s.pki.easyrsaBuildClient(commonName, notAfter)
+}
+
+func (s *filesystemStorage) SignClient(csr *x509.CertificateRequest, notAfter time.Time) error {
+	return s.pki.easyrsaSignClient(csr, notAfter)
+}
+
+func (s *filesystemStorage) Revoke(commonName string) error {
+	return s.pki.easyrsaRevoke(commonName)
+}
+
+func (s *filesystemStorage) Unrevoke(commonName string) error {
+	return s.pki.easyrsaUnrevoke(commonName)
+}
+
+func (s *filesystemStorage) Rotate(commonName string, notAfter time.Time) error {
+	return s.pki.easyrsaRotate(commonName, notAfter)
+}
+
+func (s *filesystemStorage) Renew(commonName string, notAfter time.Time) error {
+	return s.pki.easyrsaRenew(commonName, notAfter)
+}
+
+func (s *filesystemStorage) RevokeRenewed(commonName string) error {
+	return s.pki.easyrsaRevokeRenewed(commonName)
+}
+
+func (s *filesystemStorage) Delete(commonName string) error {
+	return s.pki.easyrsaDelete(commonName)
+}
+
+func (s *filesystemStorage) ClientCert(commonName string) (string, string, error) {
+	cert, err := os.ReadFile(s.pki.path("issued", commonName+".crt"))
+	if err != nil {
+		return "", "", err
+	}
+	key, err := os.ReadFile(s.pki.path("private", commonName+".key"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", "", err
+	}
+	if key, err = s.pki.keys.open(key); err != nil {
+		return "", "", err
+	}
+	return string(cert), string(key), nil
+}
+
+func (s *filesystemStorage) TLSCryptV2Key(commonName string) (string, error) {
+	key, err := s.pki.tlsCryptV2Key(commonName)
+	return string(key), err
+}
+
+func (s *filesystemStorage) RewrapKeys() (int, error) {
+	return s.pki.rewrapKeys()
+}
+
+func (s *filesystemStorage) ReadCcd(commonName string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(s.ccdDir, commonName))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	return string(content), err
+}
+
+func (s *filesystemStorage) WriteCcd(commonName string, ccd []byte) error {
+	return os.WriteFile(filepath.Join(s.ccdDir, commonName), ccd, 0644)
+}
+
+func (s *filesystemStorage) StaticAddresses() (map[string]string, error) {
+	addresses := map[string]string{}
+	entries, err := os.ReadDir(s.ccdDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return addresses, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(s.ccdDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if address := ccdStaticAddress(string(content)); address != "" {
+			addresses[entry.Name()] = address
+		}
+	}
+	return addresses, nil
+}
+
+func (s *filesystemStorage) Groups() ([]userGroup, error) {
+	content, err := os.ReadFile(s.pki.path(groupsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseGroups(content)
+}
+
+func (s *filesystemStorage) WriteGroups(groups []userGroup) error {
+	content, err := marshalGroups(groups)
+	if err != nil {
+		return err
+	}
+	return fWriteAtomic(s.pki.path(groupsFile), content, 0644)
+}
+
+func (s *filesystemStorage) CertificateAuthorities() ([]*x509.Certificate, []crypto.Signer, error) {
+	return s.pki.loadCAs()
+}
+
+func (s *filesystemStorage) CertificateStatus(serial *big.Int) (*certificateStatus, error) {
+	lines, err := s.pki.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		lineSerial, ok := new(big.Int).SetString(line.SerialNumber, 16)
+		if !ok || lineSerial.Cmp(serial) != 0 {
+			continue
+		}
+		status := &certificateStatus{CommonName: line.Identity}
+		if status.NotAfter, err = time.Parse(indexTxtDateLayout, line.ExpirationDate); err != nil {
+			log.Warnf("pki: bad expiration date of %s: %v", line.Identity, err)
+		}
+		if line.Flag == "R" {
+			if status.RevokedAt, _, err = indexTxtRevocation(line.RevocationDate); err != nil {
+				log.Warnf("pki: bad revocation date of %s: %v", line.Identity, err)
+				status.RevokedAt = status.NotAfter
+			}
+		}
+		return status, nil
+	}
+	return nil, nil
+}
+
+func (s *filesystemStorage) Certificates(commonName string) ([]issuedCertificate, error) {
+	lines, err := s.pki.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	var certs []issuedCertificate
+	for _, line := range lines {
+		current := line.DistinguishedName == "/CN="+commonName
+		if !current && retiredCommonName(line.Identity) != commonName {
+			continue
+		}
+		cert, err := s.pki.readCert(commonName, line.SerialNumber, current)
+		if err != nil {
+			log.Warnf("pki: can't read certificate %s of %s: %v", line.SerialNumber, commonName, err)
+			continue
+		}
+		c := issuedCertificate{Cert: cert, Current: current}
+		if line.Flag == "R" {
+			if c.RevokedAt, c.RevocationReason, err = indexTxtRevocation(line.RevocationDate); err != nil {
+				log.Warnf("pki: bad revocation date of %s: %v", line.Identity, err)
+			}
+		}
+		certs = append(certs, c)
+	}
+	sortIssuedCertificates(certs)
+	return certs, nil
+}
+
+func (s *filesystemStorage) CRL() ([]byte, error) {
+	return os.ReadFile(s.pki.path("crl.pem"))
+}
+
+func (s *filesystemStorage) GenCRL() error {
+	return s.pki.easyrsaGenCRL()
+}
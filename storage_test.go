@@ -0,0 +1,454 @@
+package main
+
+import (
+	"crypto/x509"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testStorageConformance checks the behaviour every Storage backend has to provide
+func testStorageConformance(t *testing.T, newStorage func(t *testing.T) Storage) {
+	valid := func(t *testing.T, s Storage, commonName string) []indexTxtLine {
+		t.Helper()
+		lines, err := s.Index()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found []indexTxtLine
+		for _, line := range lines {
+			if line.Flag == "V" && strings.Contains(line.Identity, commonName) {
+				found = append(found, line)
+			}
+		}
+		return found
+	}
+	certOf := func(t *testing.T, s Storage, commonName string) string {
+		t.Helper()
+		certPEM, keyPEM, err := s.ClientCert(commonName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := decodeCert([]byte(certPEM))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decodePrivKey([]byte(keyPEM)); err != nil {
+			t.Errorf("Expected a private key for %s: %v", commonName, err)
+		}
+		if cert.Subject.CommonName != commonName {
+			t.Errorf("Expected a certificate for %s, got %s", commonName, cert.Subject.CommonName)
+		}
+		return indexTxtSerial(cert.SerialNumber)
+	}
+
+	t.Run("BuildClient", func(t *testing.T) {
+		s := newStorage(t)
+		if err := s.BuildClient("alice", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		if lines := valid(t, s, "alice"); len(lines) != 1 || lines[0].Identity != "alice" {
+			t.Fatalf("Expected one valid certificate for alice, got %+v", lines)
+		}
+		certOf(t, s, "alice")
+		if err := s.BuildClient("alice", time.Time{}); err == nil {
+			t.Error("Expected an error for an existing user")
+		}
+	})
+
+	t.Run("RevokeAndUnrevoke", func(t *testing.T) {
+		s := newStorage(t)
+		if err := s.BuildClient("alice", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Revoke("alice"); err != nil {
+			t.Fatal(err)
+		}
+		lines, _ := s.Index()
+		if i := indexTxtFind(lines, "alice"); i < 0 || lines[i].Flag != "R" {
+			t.Errorf("Expected alice to be revoked, got %+v", lines)
+		}
+		if err := s.Unrevoke("alice"); err != nil {
+			t.Fatal(err)
+		}
+		if lines := valid(t, s, "alice"); len(lines) != 1 {
+			t.Errorf("Expected alice to be valid again, got %+v", lines)
+		}
+		if err := s.Revoke("nobody"); err == nil {
+			t.Error("Expected an error revoking an unknown user")
+		}
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		s := newStorage(t)
+		if err := s.BuildClient("alice", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.WriteCcd("alice", []byte("ifconfig-push 10.8.0.10 255.255.255.0\n")); err != nil {
+			t.Fatal(err)
+		}
+		oldSerial := certOf(t, s, "alice")
+
+		if err := s.Rotate("alice", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		lines := valid(t, s, "alice")
+		if len(lines) != 1 || lines[0].Identity != "alice" {
+			t.Fatalf("Expected only the new certificate of alice to be valid, got %+v", lines)
+		}
+		if certOf(t, s, "alice") == oldSerial {
+			t.Error("Expected a new certificate")
+		}
+		if ccd, _ := s.ReadCcd("alice"); !strings.Contains(ccd, "10.8.0.10") {
+			t.Errorf("Expected the CCD to be kept, got %q", ccd)
+		}
+	})
+
+	t.Run("Renew", func(t *testing.T) {
+		s := newStorage(t)
+		for _, name := range []string{"alice", "bob"} {
+			if err := s.BuildClient(name, time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.WriteCcd("alice", []byte("ifconfig-push 10.8.0.10 255.255.255.0\n")); err != nil {
+			t.Fatal(err)
+		}
+		oldSerial := certOf(t, s, "alice")
+
+		if err := s.Renew("alice", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		if certOf(t, s, "alice") == oldSerial {
+			t.Error("Expected a new certificate")
+		}
+		// the old certificate stays valid under a retired name
+		lines := valid(t, s, "alice")
+		if len(lines) != 2 {
+			t.Fatalf("Expected the old and the new certificate of alice to be valid, got %+v", lines)
+		}
+		if ccd, _ := s.ReadCcd("alice"); !strings.Contains(ccd, "10.8.0.10") {
+			t.Errorf("Expected the CCD to be kept, got %q", ccd)
+		}
+		if addresses, err := s.StaticAddresses(); err != nil || len(addresses) != 1 {
+			t.Errorf("Expected one static address, got %v (%v)", addresses, err)
+		}
+
+		if err := s.RevokeRenewed("alice"); err != nil {
+			t.Fatal(err)
+		}
+		if lines := valid(t, s, "alice"); len(lines) != 1 || lines[0].Identity != "alice" {
+			t.Errorf("Expected only the new certificate of alice to be valid, got %+v", lines)
+		}
+		if err := s.RevokeRenewed("alice"); err != nil {
+			t.Errorf("Expected nothing to revoke, got %v", err)
+		}
+
+		// revoking or deleting the user revokes a renewed certificate too
+		if err := s.Renew("bob", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete("bob"); err != nil {
+			t.Fatal(err)
+		}
+		if lines := valid(t, s, "bob"); len(lines) != 0 {
+			t.Errorf("Expected every certificate of bob to be revoked, got %+v", lines)
+		}
+		if err := s.Renew("nobody", time.Time{}); err == nil {
+			t.Error("Expected an error renewing an unknown user")
+		}
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		s := newStorage(t)
+		notAfterOf := func(commonName string) time.Time {
+			t.Helper()
+			certPEM, _, err := s.ClientCert(commonName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, _ := decodeCert([]byte(certPEM))
+			return cert.NotAfter
+		}
+
+		notAfter := time.Now().Add(10 * 24 * time.Hour).Truncate(time.Second)
+		if err := s.BuildClient("alice", notAfter); err != nil {
+			t.Fatal(err)
+		}
+		if got := notAfterOf("alice"); !got.Equal(notAfter) {
+			t.Errorf("Expected the certificate to expire at %v, got %v", notAfter, got)
+		}
+		// rotation shortens the lifetime
+		notAfter = time.Now().Add(2 * 24 * time.Hour).Truncate(time.Second)
+		if err := s.Rotate("alice", notAfter); err != nil {
+			t.Fatal(err)
+		}
+		if got := notAfterOf("alice"); !got.Equal(notAfter) {
+			t.Errorf("Expected the rotated certificate to expire at %v, got %v", notAfter, got)
+		}
+		if err := s.BuildClient("bob", time.Now().Add(-time.Hour)); err == nil {
+			t.Error("Expected an error for an expiration in the past")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		s := newStorage(t)
+		if err := s.BuildClient("alice", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete("alice"); err != nil {
+			t.Fatal(err)
+		}
+		lines, _ := s.Index()
+		if indexTxtFind(lines, "alice") >= 0 || len(valid(t, s, "alice")) != 0 {
+			t.Errorf("Expected alice to be gone and her certificate revoked, got %+v", lines)
+		}
+		if err := s.BuildClient("alice", time.Time{}); err != nil {
+			t.Errorf("Expected the name to be free again: %v", err)
+		}
+	})
+
+	t.Run("CertificateStatus", func(t *testing.T) {
+		s := newStorage(t)
+		certs := map[string]*x509.Certificate{}
+		for _, name := range []string{"alice", "bob"} {
+			if err := s.BuildClient(name, time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+			certPEM, _, err := s.ClientCert(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			certs[name], _ = decodeCert([]byte(certPEM))
+		}
+		if err := s.Revoke("bob"); err != nil {
+			t.Fatal(err)
+		}
+		cas, caKeys, err := s.CertificateAuthorities()
+		if err != nil || len(cas) == 0 || len(cas) != len(caKeys) {
+			t.Fatalf("Expected the CA, got %d certificates, %v", len(cas), err)
+		}
+
+		for name, cert := range certs {
+			status, err := s.CertificateStatus(cert.SerialNumber)
+			if err != nil || status == nil {
+				t.Fatalf("Expected the status of %s, got %v", name, err)
+			}
+			if status.CommonName != name || !status.NotAfter.Equal(cert.NotAfter.Truncate(time.Second)) {
+				t.Errorf("Unexpected status of %s %+v", name, status)
+			}
+			if revoked := !status.RevokedAt.IsZero(); revoked != (name == "bob") {
+				t.Errorf("Unexpected revocation time of %s %v", name, status.RevokedAt)
+			}
+		}
+		if status, err := s.CertificateStatus(big.NewInt(1)); err != nil || status != nil {
+			t.Errorf("Expected no status for an unknown serial, got %+v, %v", status, err)
+		}
+	})
+
+	t.Run("SignClient", func(t *testing.T) {
+		s := newStorage(t)
+		csr := testCSR(t, "alice")
+		if err := s.SignClient(csr, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		if lines := valid(t, s, "alice"); len(lines) != 1 {
+			t.Fatalf("Expected one valid certificate for alice, got %+v", lines)
+		}
+		certPEM, keyPEM, err := s.ClientCert("alice")
+		if err != nil || keyPEM != "" {
+			t.Fatalf("Expected no private key for a signed CSR, got %q, %v", keyPEM, err)
+		}
+		cert, _ := decodeCert([]byte(certPEM))
+		if !publicKeyEqual(cert.PublicKey, csr.PublicKey) {
+			t.Error("Expected the certificate to be issued for the key of the CSR")
+		}
+		if err := s.SignClient(csr, time.Time{}); err == nil {
+			t.Error("Expected an error for an existing user")
+		}
+
+		for _, rotate := range []func() error{
+			func() error { return s.Rotate("alice", time.Time{}) },
+			func() error { return s.Revoke("alice") },
+			func() error { return s.Rotate("alice", time.Time{}) },
+		} {
+			if err := rotate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		certPEM, keyPEM, err = s.ClientCert("alice")
+		if err != nil || keyPEM != "" {
+			t.Fatalf("Expected the rotated certificate without a private key, got %q, %v", keyPEM, err)
+		}
+		rotated, _ := decodeCert([]byte(certPEM))
+		if rotated.SerialNumber.Cmp(cert.SerialNumber) == 0 || !publicKeyEqual(rotated.PublicKey, csr.PublicKey) {
+			t.Error("Expected rotation to issue a new certificate for the key of the CSR")
+		}
+	})
+
+	t.Run("Certificates", func(t *testing.T) {
+		s := newStorage(t)
+		for _, name := range []string{"alice", "alice-b"} {
+			if err := s.BuildClient(name, time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		first := certOf(t, s, "alice")
+		if err := s.Rotate("alice", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		second := certOf(t, s, "alice")
+		if err := s.Revoke("alice"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete("alice-b"); err != nil {
+			t.Fatal(err)
+		}
+
+		certs, err := s.Certificates("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(certs) != 2 {
+			t.Fatalf("Expected the current and the rotated certificate of alice, got %d", len(certs))
+		}
+		if !certs[0].Current || indexTxtSerial(certs[0].Cert.SerialNumber) != second || certs[0].RevokedAt.IsZero() {
+			t.Errorf("Expected the revoked current certificate %s first, got %+v", second, certs[0])
+		}
+		if certs[1].Current || indexTxtSerial(certs[1].Cert.SerialNumber) != first || certs[1].RevokedAt.IsZero() {
+			t.Errorf("Expected the rotated certificate %s to be revoked, got %+v", first, certs[1])
+		}
+		if certs, err := s.Certificates("alice-b"); err != nil || len(certs) != 1 || certs[0].Current {
+			t.Errorf("Expected only the deleted certificate of alice-b, got %+v, %v", certs, err)
+		}
+	})
+
+	t.Run("GenCRL", func(t *testing.T) {
+		s := newStorage(t)
+		numbers := []int64{}
+		for i := 0; i < 2; i++ {
+			if err := s.GenCRL(); err != nil {
+				t.Fatal(err)
+			}
+			crlPEM, err := s.CRL()
+			if err != nil {
+				t.Fatal(err)
+			}
+			crls, err := parseCRLs(crlPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			numbers = append(numbers, crls[0].Number.Int64())
+		}
+		if numbers[1] <= numbers[0] {
+			t.Errorf("Expected increasing CRL numbers, got %v", numbers)
+		}
+	})
+
+	t.Run("Ccd", func(t *testing.T) {
+		s := newStorage(t)
+		for _, name := range []string{"alice", "bob"} {
+			if err := s.BuildClient(name, time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if ccd, err := s.ReadCcd("alice"); err != nil || ccd != "" {
+			t.Errorf("Expected no CCD, got %q, %v", ccd, err)
+		}
+
+		content := "ifconfig-push 10.8.0.10 255.255.255.0\npush \"route 192.168.1.0 255.255.255.0\"\n"
+		if err := s.WriteCcd("alice", []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if ccd, err := s.ReadCcd("alice"); err != nil || ccd != content {
+			t.Errorf("Expected the written CCD back, got %q, %v", ccd, err)
+		}
+
+		// a pushed route doesn't count as an assigned address
+		if addresses, err := s.StaticAddresses(); err != nil || len(addresses) != 1 || addresses["alice"] != "10.8.0.10" {
+			t.Errorf("Expected only alice to have 10.8.0.10, got %v, %v", addresses, err)
+		}
+	})
+
+	t.Run("Groups", func(t *testing.T) {
+		s := newStorage(t)
+		if groups, err := s.Groups(); err != nil || len(groups) != 0 {
+			t.Fatalf("Expected no groups, got %v, %v", groups, err)
+		}
+		groups := []userGroup{
+			{Name: "sre", Members: []string{"alice"}, Routes: []ccdRoute{{Address: "10.0.0.0", Mask: "255.0.0.0"}}},
+			{Name: "dev", Members: []string{}, Routes: []ccdRoute{}, AddressPool: "10.8.0.64/26", PushOptions: []string{"dhcp-option DNS 10.0.0.53"}},
+		}
+		for i := 0; i < 2; i++ {
+			if err := s.WriteGroups(groups); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := s.Groups()
+		if err != nil || len(got) != 2 || got[0].Name != "dev" || got[1].Routes[0].Address != "10.0.0.0" || got[0].AddressPool != "10.8.0.64/26" {
+			t.Errorf("Expected the written groups back sorted by name, got %+v, %v", got, err)
+		}
+	})
+}
+
+func TestFilesystemStorage(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage {
+		return &filesystemStorage{pki: newTestPKI(t), ccdDir: t.TempDir()}
+	})
+}
+
+// an ECDSA PKI has to behave like the RSA one
+func TestFilesystemStorage_ECDSA(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage {
+		setTestKeyAlgo(t, keyAlgoECDSAP256)
+		return &filesystemStorage{pki: newTestPKIWithCA(t, keyAlgoECDSAP384), ccdDir: t.TempDir()}
+	})
+}
+
+// newTestKubernetesStorage returns a kubernetes backend on a fake clientset, keys may be nil
+func newTestKubernetesStorage(t *testing.T, keys *keyring) *OpenVPNPKI {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "pki"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldDir, oldCcdDir, oldDays := *easyrsaDirPath, *ccdDir, *clientCertExpirationDays
+	*easyrsaDirPath, *ccdDir, *clientCertExpirationDays = dir, filepath.Join(dir, "ccd"), "30"
+	t.Cleanup(func() { *easyrsaDirPath, *ccdDir, *clientCertExpirationDays = oldDir, oldCcdDir, oldDays })
+	setTestKeyAlgo(t, keyAlgoRSA2048)
+
+	pki := &OpenVPNPKI{KubeClient: fake.NewSimpleClientset(), Keyring: keys}
+	if err := pki.initPKI(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pki.indexTxtUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	return pki
+}
+
+func TestKubernetesStorage(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage {
+		return newTestKubernetesStorage(t, nil)
+	})
+}
+
+// encrypted keys have to be transparent to every operation
+func TestFilesystemStorage_EncryptedKeys(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage {
+		p := newTestPKI(t)
+		p.keys = testKeyring(t, "1")
+		return &filesystemStorage{pki: p, ccdDir: t.TempDir()}
+	})
+}
+
+func TestKubernetesStorage_EncryptedKeys(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage {
+		return newTestKubernetesStorage(t, testKeyring(t, "1"))
+	})
+}
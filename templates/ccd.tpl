@@ -1,6 +1,45 @@
+{{- if .Disable }}
+disable
+{{- end }}
+{{- if .PushReset }}
+push-reset
+{{- end }}
 {{- if (ne .ClientAddress "dynamic") }}
 ifconfig-push {{ .ClientAddress }} 255.255.255.0
 {{- end }}
+{{- if .ClientAddressIPv6 }}
+ifconfig-ipv6-push {{ .ClientAddressIPv6 }}
+{{- end }}
 {{- range $route := .CustomRoutes }}
 push "route {{ $route.Address }} {{ $route.Mask }}" # {{ $route.Description }}
 {{- end }}
+{{- range $route := .IRoutes }}
+iroute {{ $route.Address }} {{ $route.Mask }}{{ if $route.Description }} # {{ $route.Description }}{{ end }}
+{{- end }}
+{{- if .RedirectGateway }}
+push "redirect-gateway def1"
+{{- end }}
+{{- range .DNSServers }}
+push "dhcp-option DNS {{ . }}"
+{{- end }}
+{{- range .DNSDomains }}
+push "dhcp-option DOMAIN {{ . }}"
+{{- end }}
+{{- range .ConfigIncludes }}
+config {{ . }}
+{{- end }}
+{{- range .ExtraLines }}
+{{ . }}
+{{- end }}
+{{- if .Groups }}
+# groups:{{ range .Groups }} {{ . }}{{ end }}
+{{- if .GroupAddress }}
+ifconfig-push {{ .GroupAddress }} 255.255.255.0
+{{- end }}
+{{- range $route := .GroupRoutes }}
+push "route {{ $route.Address }} {{ $route.Mask }}" # {{ $route.Description }}
+{{- end }}
+{{- range $option := .GroupPushOptions }}
+push "{{ $option }}"
+{{- end }}
+{{- end }}
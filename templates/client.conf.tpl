@@ -12,7 +12,6 @@ data-ciphers AES-256-GCM:AES-128-GCM:CHACHA20-POLY1305:AES-256-CBC
 data-ciphers-fallback AES-256-CBC
 auth SHA256
 
-key-direction 1
 tls-client
 remote-cert-tls server
 # uncomment below lines for use with linux
@@ -27,16 +26,47 @@ remote-cert-tls server
 {{- if .PasswdAuth }}
 auth-user-pass
 {{- end }}
-
+{{ if .SplitFiles }}
+ca ca.crt
+cert client.crt
+{{- if .ExternalKey }}
+{{ .ExternalKey }}
+{{- else }}
+key client.key
+{{- end }}
+{{- if eq .TLSMode "tls-crypt-v2" }}
+tls-crypt-v2 tls-crypt-v2.key
+{{- else if eq .TLSMode "tls-crypt" }}
+tls-crypt ta.key
+{{- else }}
+tls-auth ta.key 1
+{{- end }}
+{{- else }}
 <cert>
 {{ .Cert -}}
 </cert>
+{{- if .ExternalKey }}
+{{ .ExternalKey }}
+{{- else }}
 <key>
 {{ .Key -}}
 </key>
+{{- end }}
 <ca>
 {{ .CA -}}
 </ca>
+{{- if eq .TLSMode "tls-crypt-v2" }}
+<tls-crypt-v2>
+{{ .TLS -}}
+</tls-crypt-v2>
+{{- else if eq .TLSMode "tls-crypt" }}
+<tls-crypt>
+{{ .TLS -}}
+</tls-crypt>
+{{- else }}
+key-direction 1
 <tls-auth>
 {{ .TLS -}}
 </tls-auth>
+{{- end }}
+{{- end }}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	tlsModeAuth       = "tls-auth"
+	tlsModeCrypt      = "tls-crypt"
+	tlsModeCryptV2    = "tls-crypt-v2"
+	staticKeyHeader   = "-----BEGIN OpenVPN Static key V1-----"
+	staticKeyFooter   = "-----END OpenVPN Static key V1-----"
+	staticKeySize     = 256
+	tlsCryptV2Server  = "OpenVPN tls-crypt-v2 server key"
+	tlsCryptV2Client  = "OpenVPN tls-crypt-v2 client key"
+	tlsCryptV2KeyFile = "tls-crypt-v2.key"
+	// tlsCryptV2ServerKeyFile is the server key in the pki directory, referenced by tls-crypt-v2 in openvpn.conf
+	tlsCryptV2ServerKeyFile = "tls-crypt-v2-server.key"
+	// the metadata starts with its type, the user defined one is 0x00
+	tlsCryptV2MetadataUser = 0x00
+	tlsCryptV2MaxMetadata  = 733
+)
+
+var tlsModes = []string{tlsModeAuth, tlsModeCrypt, tlsModeCryptV2}
+
+// genStaticKey returns a new 2048 bit OpenVPN static key for tls-auth and tls-crypt, like openvpn --genkey secret
+func genStaticKey() ([]byte, error) {
+	key := make([]byte, staticKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	b.WriteString("#\n# 2048 bit OpenVPN static key\n#\n" + staticKeyHeader + "\n")
+	for i := 0; i < len(key); i += 16 {
+		b.WriteString(hex.EncodeToString(key[i:i+16]) + "\n")
+	}
+	b.WriteString(staticKeyFooter + "\n")
+	return []byte(b.String()), nil
+}
+
+// genTLSCryptV2ServerKey returns a new tls-crypt-v2 server key, like openvpn --genkey tls-crypt-v2-server.
+// It holds a 512 bit cipher key followed by a 512 bit HMAC key, OpenVPN uses the first 256 bits of each.
+func genTLSCryptV2ServerKey() ([]byte, error) {
+	key := make([]byte, 128)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: tlsCryptV2Server, Bytes: key}), nil
+}
+
+// genTLSCryptV2ClientKey returns a new client key wrapped with the server key, like
+// openvpn --tls-crypt-v2 server.key --genkey tls-crypt-v2-client. The metadata is the certificate serial
+// in the index.txt format, the tls-crypt-v2-verify script rejects keys of revoked certificates with it.
+func genTLSCryptV2ClientKey(serverKeyPEM []byte, serial string) ([]byte, error) {
+	block, _ := pem.Decode(serverKeyPEM)
+	if block == nil || block.Type != tlsCryptV2Server || len(block.Bytes) != 128 {
+		return nil, errors.New("bad tls-crypt-v2 server key")
+	}
+	metadata := append([]byte{tlsCryptV2MetadataUser}, serial...)
+	if len(metadata) > tlsCryptV2MaxMetadata {
+		return nil, fmt.Errorf("tls-crypt-v2 metadata longer than %d bytes", tlsCryptV2MaxMetadata)
+	}
+
+	clientKey := make([]byte, staticKeySize)
+	if _, err := rand.Read(clientKey); err != nil {
+		return nil, err
+	}
+	plaintext := append(bytes.Clone(clientKey), metadata...)
+	// WKc = T || AES-256-CTR(Ke, IV, Kc || metadata) || len, T = HMAC-SHA256(Ka, len || Kc || metadata), IV = T[:16]
+	netLen := binary.BigEndian.AppendUint16(nil, uint16(sha256.Size+len(plaintext)+2))
+	mac := hmac.New(sha256.New, block.Bytes[64:96])
+	mac.Write(netLen)
+	mac.Write(plaintext)
+	tag := mac.Sum(nil)
+
+	aesBlock, err := aes.NewCipher(block.Bytes[:32])
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCTR(aesBlock, tag[:aes.BlockSize]).XORKeyStream(plaintext, plaintext)
+
+	wrapped := append(append(tag, plaintext...), netLen...)
+	return pem.EncodeToMemory(&pem.Block{Type: tlsCryptV2Client, Bytes: append(clientKey, wrapped...)}), nil
+}
+
+// tlsKeyFile returns the name the TLS key file has next to a config referencing it
+func tlsKeyFile(mode string) string {
+	if mode == tlsModeCryptV2 {
+		return tlsCryptV2KeyFile
+	}
+	return "ta.key"
+}
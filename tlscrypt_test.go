@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// setTestTLSMode sets --ovpn.tls-mode for the test
+func setTestTLSMode(t *testing.T, mode string) {
+	oldMode := *openvpnTLSMode
+	*openvpnTLSMode = mode
+	t.Cleanup(func() { *openvpnTLSMode = oldMode })
+}
+
+// unwrapTLSCryptV2ClientKey unwraps the client key the way the OpenVPN server does and returns its metadata
+func unwrapTLSCryptV2ClientKey(t *testing.T, serverKeyPEM, clientKeyPEM []byte) []byte {
+	t.Helper()
+	server, _ := pem.Decode(serverKeyPEM)
+	client, _ := pem.Decode(clientKeyPEM)
+	if server == nil || client == nil || client.Type != tlsCryptV2Client {
+		t.Fatalf("Expected PEM encoded tls-crypt-v2 keys, got %q", clientKeyPEM)
+	}
+	clientKey, wrapped := client.Bytes[:staticKeySize], client.Bytes[staticKeySize:]
+	if int(binary.BigEndian.Uint16(wrapped[len(wrapped)-2:])) != len(wrapped) {
+		t.Fatal("Expected the wrapped key to end with its length")
+	}
+	tag, ciphertext := wrapped[:sha256.Size], wrapped[sha256.Size:len(wrapped)-2]
+
+	block, err := aes.NewCipher(server.Bytes[:32])
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, tag[:aes.BlockSize]).XORKeyStream(plaintext, ciphertext)
+	mac := hmac.New(sha256.New, server.Bytes[64:96])
+	mac.Write(wrapped[len(wrapped)-2:])
+	mac.Write(plaintext)
+	if !hmac.Equal(mac.Sum(nil), tag) {
+		t.Fatal("Expected the tag to authenticate the wrapped key")
+	}
+	if !bytes.Equal(plaintext[:staticKeySize], clientKey) {
+		t.Fatal("Expected the wrapped key to be the client key")
+	}
+	return plaintext[staticKeySize:]
+}
+
+func TestGenStaticKey(t *testing.T) {
+	key, err := genStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := regexp.MustCompile(`(?s)` + staticKeyHeader + `\n((?:[0-9a-f]{32}\n){16})` + staticKeyFooter + `\n$`)
+	if !body.Match(key) {
+		t.Fatalf("Expected 16 lines of hex between the OpenVPN static key markers, got\n%s", key)
+	}
+	other, _ := genStaticKey()
+	if bytes.Equal(key, other) {
+		t.Error("Expected a new key on every call")
+	}
+}
+
+func TestGenTLSCryptV2ClientKey(t *testing.T) {
+	serverKey, err := genTLSCryptV2ServerKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := genTLSCryptV2ClientKey(serverKey, "0A1B2C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata := unwrapTLSCryptV2ClientKey(t, serverKey, clientKey); string(metadata) != "\x000A1B2C" {
+		t.Errorf("Expected the user metadata type followed by the serial, got %q", metadata)
+	}
+
+	if _, err := genTLSCryptV2ClientKey([]byte("garbage"), "01"); err == nil {
+		t.Error("Expected a bad server key to fail")
+	}
+	if _, err := genTLSCryptV2ClientKey(serverKey, strings.Repeat("A", tlsCryptV2MaxMetadata)); err == nil {
+		t.Error("Expected too long metadata to fail")
+	}
+}
+
+func TestClientConfig_TLSModes(t *testing.T) {
+	tests := []struct {
+		mode, inline, split string
+		keyDirection        bool
+	}{
+		{tlsModeAuth, "<tls-auth>", "\ntls-auth ta.key 1\n", true},
+		{tlsModeCrypt, "<tls-crypt>", "\ntls-crypt ta.key\n", false},
+		{tlsModeCryptV2, "<tls-crypt-v2>", "\ntls-crypt-v2 tls-crypt-v2.key\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			setTestTLSMode(t, tt.mode)
+			oAdmin := newTestExportAdmin(t)
+			conf, err := oAdmin.clientConfig("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			inline := oAdmin.executeClientConfig("alice", conf)
+			if !strings.Contains(inline, tt.inline) || strings.Contains(inline, "key-direction 1") != tt.keyDirection {
+				t.Errorf("Expected %s and key-direction %v, got\n%s", tt.inline, tt.keyDirection, inline)
+			}
+			conf.SplitFiles = true
+			if split := oAdmin.executeClientConfig("alice", conf); !strings.Contains(split+"\n", tt.split) {
+				t.Errorf("Expected %q, got\n%s", tt.split, split)
+			}
+		})
+	}
+}
+
+func TestFilesystemTLSCryptV2Key(t *testing.T) {
+	setTestTLSMode(t, tlsModeCryptV2)
+	oAdmin := newTestExportAdmin(t)
+	p := oAdmin.storage.(*filesystemStorage).pki
+	masterKeys := strings.Split(testMasterKeys(t, "k1", "k2"), ",")
+	p.keys, _ = parseKeyring(masterKeys[0])
+
+	key, err := oAdmin.storage.TLSCryptV2Key("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, err := os.ReadFile(p.path(tlsCryptV2ServerKeyFile))
+	if err != nil {
+		t.Fatalf("Expected the server key to be created: %v", err)
+	}
+	serial := indexTxtSerial(testClientCert(t, oAdmin, "alice").SerialNumber)
+	if metadata := unwrapTLSCryptV2ClientKey(t, serverKey, []byte(key)); string(metadata[1:]) != serial {
+		t.Errorf("Expected the serial %s as metadata, got %q", serial, metadata)
+	}
+	stored, err := os.ReadFile(p.path("tls-crypt-v2", serial+".key"))
+	if err != nil || !isEncryptedKey(stored) {
+		t.Fatalf("Expected the key to be stored encrypted by serial, got %q (%v)", stored, err)
+	}
+	if again, _ := oAdmin.storage.TLSCryptV2Key("alice"); again != key {
+		t.Error("Expected the stored key to be reused")
+	}
+
+	export, err := oAdmin.exportClientConfig("alice", exportFormatZip, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(export.Data, []byte(tlsCryptV2KeyFile)) {
+		t.Error("Expected the zip to contain tls-crypt-v2.key")
+	}
+
+	p.keys, _ = parseKeyring(masterKeys[1] + "," + masterKeys[0])
+	if _, err := oAdmin.storage.RewrapKeys(); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ = os.ReadFile(p.path("tls-crypt-v2", serial+".key"))
+	if masterKeyID(t, stored) != "k2" {
+		t.Error("Expected the tls-crypt-v2 key to be rewrapped with k2")
+	}
+
+	if err := oAdmin.storage.Rotate("alice", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if rotated, _ := oAdmin.storage.TLSCryptV2Key("alice"); rotated == key {
+		t.Error("Expected a new key for the rotated certificate")
+	}
+}
+
+func TestKubernetesTLSCryptV2Key(t *testing.T) {
+	masterKeys := strings.Split(testMasterKeys(t, "k1", "k2"), ",")
+	k1, _ := parseKeyring(masterKeys[0])
+	pki := newTestKubernetesStorage(t, k1)
+	// an installation older than tls-crypt-v2 support, the server key is added to the secret
+	if err := pki.secretCreate(metav1.ObjectMeta{Name: secretDHandTA}, map[string][]byte{"ta.key": []byte("ta")}, v1.SecretTypeOpaque); err != nil {
+		t.Fatal(err)
+	}
+	if err := pki.BuildClient("alice", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := pki.TLSCryptV2Key("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, err := pki.tlsCryptV2ServerKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	onDisk, err := os.ReadFile(filepath.Join(*easyrsaDirPath, "pki", tlsCryptV2ServerKeyFile))
+	if err != nil || !bytes.Equal(onDisk, serverKey) {
+		t.Errorf("Expected the server key to be written for OpenVPN (%v)", err)
+	}
+	secret, err := pki.secretGetByLabels("name=alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata := unwrapTLSCryptV2ClientKey(t, serverKey, []byte(key)); string(metadata[1:]) != secret.Annotations["serialNumber"] {
+		t.Errorf("Expected the serial %s as metadata, got %q", secret.Annotations["serialNumber"], metadata)
+	}
+	if !isEncryptedKey(secret.Data[tlsCryptV2KeyFile]) {
+		t.Error("Expected the key to be stored encrypted in the secret of the user")
+	}
+	if again, _ := pki.TLSCryptV2Key("alice"); again != key {
+		t.Error("Expected the stored key to be reused")
+	}
+
+	pki.Keyring, _ = parseKeyring(masterKeys[1] + "," + masterKeys[0])
+	if n, err := pki.RewrapKeys(); err != nil || n != 2 {
+		t.Fatalf("Expected the CA and alice's secret to be rewrapped, got %d (%v)", n, err)
+	}
+	secret, _ = pki.secretGetByLabels("name=alice")
+	if masterKeyID(t, secret.Data[tlsCryptV2KeyFile]) != "k2" {
+		t.Error("Expected the tls-crypt-v2 key to be rewrapped with k2")
+	}
+}